@@ -0,0 +1,179 @@
+// Command traceroute prints the route packets take to one or more network hosts.
+//
+// Usage:
+//
+//	traceroute [flags] host... [packetlen]
+//
+// With several hosts, the routes are traced concurrently and the output of each is printed
+// as a whole as soon as its trace ends. A trailing number is the length of the probes, IP
+// and UDP headers included, like the packetlen argument of traceroute.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"my-little-tracerouter/internal/network"
+	"my-little-tracerouter/internal/tracer"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// config is what the command line asks for.
+type config struct {
+	hosts []string
+	opts  tracer.Options
+	// report monitors the hosts for opts.Rounds rounds and prints their statistics instead
+	// of tracing them once.
+	report bool
+}
+
+// errUsage is returned by parseArgs when the command line is invalid, once the reason has
+// been written to stderr.
+var errUsage = errors.New("invalid usage")
+
+// parseArgs parses the command line, without the program name, writing any error and the
+// usage to stderr.
+func parseArgs(args []string, stderr io.Writer) (*config, error) {
+	fs := flag.NewFlagSet("traceroute", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: traceroute [flags] host... [packetlen]")
+		fs.PrintDefaults()
+	}
+
+	cfg := &config{}
+	fs.IntVar(&cfg.opts.MaxHops, "m", tracer.DefaultMaxHops, "maximum number of hops to probe")
+	fs.IntVar(&cfg.opts.ProbesPerHop, "q", tracer.DefaultProbesPerHop,
+		"number of probes per hop")
+	fs.DurationVar(&cfg.opts.Timeout, "w", tracer.DefaultTimeout, "time to wait for a reply")
+	fs.IntVar(&cfg.opts.Port, "port", tracer.DefaultPort, "destination port of the first probe")
+	fs.BoolVar(&cfg.report, "report", false,
+		"print the statistics of -count rounds like mtr --report")
+	fs.IntVar(&cfg.opts.Rounds, "count", tracer.DefaultReportRounds,
+		"number of rounds with -report")
+	dnsServer := fs.String("dns-server", "",
+		"address of the DNS server to resolve the hosts and hop names with")
+	numeric := fs.Bool("n", false, "print hop addresses numerically, without looking up names")
+	fixedPort := fs.Bool("fixed-port", false,
+		"send every probe to -port and vary the source port instead")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	cfg.opts.ResolveNames = !*numeric
+	if *dnsServer != "" {
+		resolver, err := network.NewDNSResolver(*dnsServer)
+		if err != nil {
+			fmt.Fprintf(stderr, "traceroute: %v\n", err)
+			return nil, errUsage
+		}
+		cfg.opts.DNSResolver = resolver
+	}
+	if *fixedPort {
+		cfg.opts.Vary = tracer.VarySrcPort
+	}
+	cfg.hosts = fs.Args()
+	if n := len(cfg.hosts); n > 1 {
+		if size, err := strconv.Atoi(cfg.hosts[n-1]); err == nil {
+			cfg.opts.PacketSize = size
+			cfg.hosts = cfg.hosts[:n-1]
+		}
+	}
+	if len(cfg.hosts) == 0 {
+		fmt.Fprintln(stderr, "traceroute: no host given")
+		fs.Usage()
+		return nil, errUsage
+	}
+	return cfg, nil
+}
+
+// run runs the command with the given arguments and returns its exit code: 2 for an
+// invalid command line and 1 if any trace failed.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	cfg, err := parseArgs(args, stderr)
+	if err != nil {
+		return 2
+	}
+
+	t := tracer.New(tracer.WithOptions(cfg.opts))
+	if cfg.report {
+		return runReport(ctx, t, cfg, stdout, stderr)
+	}
+	if len(cfg.hosts) == 1 {
+		result, err := t.TraceHost(ctx, cfg.hosts[0])
+		return writeResult(stdout, stderr, cfg.hosts[0], result, err, cfg.opts)
+	}
+
+	code := 0
+	for r := range t.TraceAll(ctx, cfg.hosts, cfg.opts) {
+		if writeResult(stdout, stderr, r.Host, r.Result, r.Err, cfg.opts) != 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+// runReport monitors the route to every host in turn and writes its statistics like
+// mtr --report, returning the exit code of run.
+func runReport(
+	ctx context.Context,
+	t *tracer.Tracer,
+	cfg *config,
+	stdout, stderr io.Writer,
+) int {
+	code := 0
+	for _, host := range cfg.hosts {
+		target, err := network.ResolveTargetWith(host, cfg.opts.Preference,
+			cfg.opts.DNSResolver)
+		if err != nil {
+			fmt.Fprintf(stderr, "traceroute: %s: %v\n", host, err)
+			code = 1
+			continue
+		}
+
+		snap, err := t.Report(ctx, target.IP, cfg.opts)
+		if err == nil || snap.Rounds > 0 {
+			fmt.Fprintln(stdout, tracer.Banner(target, cfg.opts))
+			fmt.Fprint(stdout, tracer.FormatReport(snap))
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "traceroute: %s: %v\n", host, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// writeResult writes the outcome of the trace to host and returns the exit code it calls for.
+// The hops of a trace that ended early are written before its error.
+func writeResult(
+	stdout, stderr io.Writer,
+	host string,
+	result *tracer.Result,
+	err error,
+	opts tracer.Options,
+) int {
+	if result != nil {
+		fmt.Fprintln(stdout, tracer.Banner(result.Target, opts))
+		if werr := tracer.FormatText(stdout, result.Hops); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "traceroute: %s: %v\n", host, err)
+		return 1
+	}
+	return 0
+}
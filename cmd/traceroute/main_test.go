@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"my-little-tracerouter/internal/tracer"
+)
+
+// runArgs runs the command with args and returns its exit code and output. It skips the
+// test if the command lacks the privileges to trace.
+func runArgs(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, &stdout, &stderr)
+	if strings.Contains(stderr.String(), "operation not permitted") {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	return code, stdout.String(), stderr.String()
+}
+
+func TestParseArgsDefaults(t *testing.T) {
+	cfg, err := parseArgs([]string{"example.com"}, &bytes.Buffer{})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, cfg.hosts)
+	assert.Equal(t, tracer.DefaultMaxHops, cfg.opts.MaxHops)
+	assert.Equal(t, tracer.DefaultProbesPerHop, cfg.opts.ProbesPerHop)
+	assert.Equal(t, tracer.DefaultTimeout, cfg.opts.Timeout)
+	assert.Equal(t, tracer.DefaultPort, cfg.opts.Port)
+	assert.Equal(t, tracer.VaryDstPort, cfg.opts.Vary)
+	assert.True(t, cfg.opts.ResolveNames)
+	assert.Nil(t, cfg.opts.DNSResolver)
+	assert.False(t, cfg.report)
+	assert.Equal(t, tracer.DefaultReportRounds, cfg.opts.Rounds)
+}
+
+func TestParseArgsTargets(t *testing.T) {
+	cfg, err := parseArgs([]string{"-m", "5", "-q", "1", "-w", "2s", "a.example", "192.0.2.1"},
+		&bytes.Buffer{})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example", "192.0.2.1"}, cfg.hosts)
+	assert.Equal(t, 5, cfg.opts.MaxHops)
+	assert.Equal(t, 1, cfg.opts.ProbesPerHop)
+	assert.Equal(t, 2*time.Second, cfg.opts.Timeout)
+}
+
+func TestParseArgsNumeric(t *testing.T) {
+	cfg, err := parseArgs([]string{"-n", "192.0.2.1"}, &bytes.Buffer{})
+
+	require.NoError(t, err)
+	assert.False(t, cfg.opts.ResolveNames)
+}
+
+func TestParseArgsDNSServer(t *testing.T) {
+	cfg, err := parseArgs([]string{"--dns-server", "10.0.0.53", "intranet.example"},
+		&bytes.Buffer{})
+	require.NoError(t, err)
+	assert.NotNil(t, cfg.opts.DNSResolver)
+
+	var stderr bytes.Buffer
+	_, err = parseArgs([]string{"--dns-server", "[x]]", "intranet.example"}, &stderr)
+	assert.ErrorIs(t, err, errUsage)
+	assert.Contains(t, stderr.String(), "invalid DNS server")
+}
+
+func TestParseArgsFixedPort(t *testing.T) {
+	cfg, err := parseArgs([]string{"--port", "53", "--fixed-port", "192.0.2.53"}, &bytes.Buffer{})
+
+	require.NoError(t, err)
+	assert.Equal(t, 53, cfg.opts.Port)
+	assert.Equal(t, tracer.VarySrcPort, cfg.opts.Vary)
+}
+
+func TestParseArgsReport(t *testing.T) {
+	cfg, err := parseArgs([]string{"--report", "--count", "5", "192.0.2.1"}, &bytes.Buffer{})
+
+	require.NoError(t, err)
+	assert.True(t, cfg.report)
+	assert.Equal(t, 5, cfg.opts.Rounds)
+}
+
+func TestParseArgsPacketLength(t *testing.T) {
+	cfg, err := parseArgs([]string{"example.com", "120"}, &bytes.Buffer{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, cfg.hosts)
+	assert.Equal(t, 120, cfg.opts.PacketSize)
+
+	cfg, err = parseArgs([]string{"a.example", "b.example", "60"}, &bytes.Buffer{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example", "b.example"}, cfg.hosts)
+	assert.Equal(t, 60, cfg.opts.PacketSize)
+
+	cfg, err = parseArgs([]string{"example.com"}, &bytes.Buffer{})
+	require.NoError(t, err)
+	assert.Zero(t, cfg.opts.PacketSize, "empty datagrams by default")
+}
+
+func TestParseArgsInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-m"},
+		{"-x", "example.com"},
+	} {
+		var stderr bytes.Buffer
+		_, err := parseArgs(args, &stderr)
+
+		assert.ErrorIs(t, err, errUsage, args)
+		assert.Contains(t, stderr.String(), "usage: traceroute", args)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	code, stdout, stderr := runArgs(t)
+
+	assert.Equal(t, 2, code)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "no host given")
+}
+
+func TestRunLoopback(t *testing.T) {
+	code, stdout, stderr := runArgs(t, "-n", "-m", "3", "-q", "1", "127.0.0.1")
+
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "traceroute to 127.0.0.1 (127.0.0.1), 3 hops max", firstLine(stdout))
+	assert.Contains(t, stdout, " 1  127.0.0.1  ")
+}
+
+func TestRunResolvesNames(t *testing.T) {
+	names, err := net.LookupAddr("127.0.0.1")
+	if err != nil || len(names) == 0 {
+		t.Skip("127.0.0.1 has no name on this host")
+	}
+
+	code, stdout, stderr := runArgs(t, "-m", "3", "-q", "1", "127.0.0.1")
+
+	assert.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, " 1  "+strings.TrimSuffix(names[0], ".")+" (127.0.0.1)  ")
+}
+
+func TestRunDNSServer(t *testing.T) {
+	server := serveDNS(t, "intranet.example.", net.IPv4(127, 0, 0, 1))
+
+	code, stdout, stderr := runArgs(t, "-n", "--dns-server", server, "-m", "3", "-q", "1",
+		"intranet.example")
+
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "traceroute to intranet.example (127.0.0.1), 3 hops max", firstLine(stdout))
+}
+
+// serveDNS answers the A queries for name with ip, and every other query with no record,
+// on a UDP port of the loopback interface, and returns its address.
+func serveDNS(t *testing.T, name string, ip net.IP) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+
+			q := query.Questions[0]
+			reply := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+				Questions: query.Questions,
+			}
+			if q.Type == dnsmessage.TypeA && q.Name.String() == name {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip.To4())
+				reply.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type,
+						Class: q.Class, TTL: 60},
+					Body: &a,
+				}}
+			}
+			if data, err := reply.Pack(); err == nil {
+				_, _ = conn.WriteTo(data, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestRunPacketLengthTooLarge(t *testing.T) {
+	code, stdout, stderr := runArgs(t, "-n", "-m", "3", "-q", "1", "127.0.0.1", "70000")
+
+	assert.Equal(t, 1, code)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "traceroute: 127.0.0.1: invalid UDP payload size")
+}
+
+func TestRunPacketLength(t *testing.T) {
+	code, stdout, stderr := runArgs(t, "-n", "-m", "3", "-q", "1", "127.0.0.1", "120")
+
+	assert.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, " 1  127.0.0.1  ")
+}
+
+func TestRunFixedPort(t *testing.T) {
+	code, stdout, stderr := runArgs(t, "-n", "-m", "3", "-q", "2", "--port", "53", "--fixed-port",
+		"127.0.0.1")
+
+	assert.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, " 1  127.0.0.1  ")
+}
+
+func TestRunReport(t *testing.T) {
+	code, stdout, stderr := runArgs(t, "-n", "--report", "--count", "1", "-m", "3", "-q", "2",
+		"127.0.0.1", "bad..host")
+
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "traceroute: bad..host: ")
+	lines := strings.Split(stdout, "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "traceroute to 127.0.0.1 (127.0.0.1), 3 hops max", lines[0])
+	assert.Contains(t, lines[1], "HOST")
+	assert.Regexp(t, `^ 1\. 127\.0\.0\.1 +0\.0% +2 `, lines[2])
+}
+
+func TestRunMultipleTargets(t *testing.T) {
+	code, stdout, stderr := runArgs(t, "-n", "-m", "3", "-q", "1", "127.0.0.1", "bad..host", "::1")
+
+	assert.Equal(t, 1, code, "a failing host fails the command")
+	assert.Contains(t, stderr, "traceroute: bad..host: ")
+	assert.Contains(t, stdout, "traceroute to 127.0.0.1 (127.0.0.1), 3 hops max\n"+
+		" 1  127.0.0.1  ", "the output of every host is grouped")
+	if !strings.Contains(stderr, "traceroute: ::1: ") {
+		assert.Contains(t, stdout, "traceroute to ::1 (::1), 3 hops max\n 1  ::1  ")
+	}
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
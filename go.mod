@@ -4,6 +4,8 @@ go 1.20
 
 require (
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/net v0.26.0
+	golang.org/x/sys v0.21.0
 )
 
 require (
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultASNTimeout bounds a single origin lookup when NewCymruResolver is given no timeout.
+const DefaultASNTimeout = 2 * time.Second
+
+// lookupTXT performs a TXT lookup; it is a variable so tests can avoid real DNS queries.
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+// Origin identifies the autonomous system announcing the BGP prefix an address belongs to.
+type Origin struct {
+	// ASN is the number of the origin AS.
+	ASN int
+	// Prefix is the most specific announced prefix covering the address.
+	Prefix *net.IPNet
+}
+
+// ASNResolver looks up the origin of hop addresses.
+//
+// Implementations must be safe for concurrent use. Since every responding hop is looked up,
+// they should cache their answers.
+type ASNResolver interface {
+	// ResolveOrigin returns the origin of ip, or nil if it is unknown.
+	ResolveOrigin(ip net.IP) *Origin
+}
+
+// CymruResolver resolves origins through the DNS interface of Team Cymru's IP to ASN
+// mapping service and caches the results.
+//
+// It is safe for concurrent use; concurrent lookups of the same address share a single
+// TXT query. Answers are cached per address rather than per prefix: a more specific prefix
+// announced by another AS may sit within the one found for a neighboring address.
+type CymruResolver struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*originEntry
+}
+
+type originEntry struct {
+	done   chan struct{}
+	origin *Origin
+}
+
+// NewCymruResolver creates a CymruResolver whose lookups give up after timeout.
+func NewCymruResolver(timeout time.Duration) *CymruResolver {
+	if timeout <= 0 {
+		timeout = DefaultASNTimeout
+	}
+
+	return &CymruResolver{
+		timeout: timeout,
+		cache:   make(map[string]*originEntry),
+	}
+}
+
+// ResolveOrigin returns the origin of ip, or nil if it is not announced, the lookup fails or
+// times out. Addresses that are never announced, such as private, shared, loopback,
+// link-local and multicast ones, are never looked up; see isReserved.
+func (r *CymruResolver) ResolveOrigin(ip net.IP) *Origin {
+	if isReserved(ip) {
+		return nil
+	}
+
+	key := ip.String()
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	if !ok {
+		entry = &originEntry{done: make(chan struct{})}
+		r.cache[key] = entry
+	}
+	r.mu.Unlock()
+
+	if ok {
+		<-entry.done
+		return entry.origin
+	}
+
+	entry.origin = r.lookup(ip)
+	close(entry.done)
+
+	return entry.origin
+}
+
+// reservedNets are the special-purpose blocks (RFC 6890) that are never announced and are
+// not covered by the methods of net.IP.
+var reservedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "this" network
+		"100.64.0.0/10", // shared address space of carrier-grade NATs
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved, and the limited broadcast address
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isReserved reports whether ip belongs to a block that is never announced on the
+// Internet, so that it has no origin.
+func isReserved(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CymruResolver) lookup(ip net.IP) *Origin {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	records, err := lookupTXT(ctx, cymruQuery(ip))
+	if err != nil {
+		return nil
+	}
+
+	var best *Origin
+	for _, record := range records {
+		origin, err := parseCymruRecord(record)
+		if err != nil {
+			continue
+		}
+		if best == nil || prefixLen(origin.Prefix) > prefixLen(best.Prefix) {
+			best = origin
+		}
+	}
+
+	return best
+}
+
+// cymruQuery returns the name holding the origin of ip, e.g.
+// "1.2.0.192.origin.asn.cymru.com" for 192.0.2.1. IPv6 addresses are spelled out in
+// reversed nibbles under origin6.asn.cymru.com.
+func cymruQuery(ip net.IP) string {
+	var b strings.Builder
+
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+		b.WriteString("origin.asn.cymru.com")
+		return b.String()
+	}
+
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip16[i]&0x0f, ip16[i]>>4)
+	}
+	b.WriteString("origin6.asn.cymru.com")
+	return b.String()
+}
+
+// parseCymruRecord parses a TXT record of the form
+// "64496 64497 | 192.0.2.0/24 | ZZ | arin | 2006-01-02". When several ASes announce the
+// prefix, the first one is used.
+func parseCymruRecord(record string) (*Origin, error) {
+	fields := strings.Split(record, "|")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid origin record: %q", record)
+	}
+
+	asns := strings.Fields(fields[0])
+	if len(asns) == 0 {
+		return nil, fmt.Errorf("invalid origin record: %q", record)
+	}
+	asn, err := strconv.Atoi(asns[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin AS number: %w", err)
+	}
+
+	_, prefix, err := net.ParseCIDR(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin prefix: %w", err)
+	}
+
+	return &Origin{ASN: asn, Prefix: prefix}, nil
+}
+
+func prefixLen(prefix *net.IPNet) int {
+	ones, _ := prefix.Mask.Size()
+	return ones
+}
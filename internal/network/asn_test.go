@@ -0,0 +1,155 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stubLookupTXT(t *testing.T, lookup func(ctx context.Context, name string) ([]string, error)) {
+	t.Helper()
+
+	original := lookupTXT
+	t.Cleanup(func() { lookupTXT = original })
+
+	lookupTXT = lookup
+}
+
+func TestCymruQuery(t *testing.T) {
+	assert.Equal(t, "1.100.51.198.origin.asn.cymru.com", cymruQuery(net.IPv4(198, 51, 100, 1)))
+	assert.Equal(t,
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com",
+		cymruQuery(net.ParseIP("2001:db8::1")))
+}
+
+func TestParseCymruRecord(t *testing.T) {
+	origin, err := parseCymruRecord("64496 64497 | 198.51.100.0/24 | ZZ | arin | 2006-01-02")
+	require.NoError(t, err)
+
+	assert.Equal(t, 64496, origin.ASN)
+	assert.Equal(t, "198.51.100.0/24", origin.Prefix.String())
+
+	for _, record := range []string{"", "64496", " | 198.51.100.0/24", "AS1 | 198.51.100.0/24",
+		"64496 | 198.51.100.0"} {
+		_, err := parseCymruRecord(record)
+		assert.Error(t, err, record)
+	}
+}
+
+func TestCymruResolverResolveOrigin(t *testing.T) {
+	stubLookupTXT(t, func(_ context.Context, name string) ([]string, error) {
+		assert.Equal(t, "1.100.51.198.origin.asn.cymru.com", name)
+		return []string{
+			"64496 | 198.51.0.0/16 | ZZ | arin | 2006-01-02",
+			"64497 | 198.51.100.0/24 | ZZ | arin | 2006-01-02",
+			"garbage",
+		}, nil
+	})
+
+	r := NewCymruResolver(time.Second)
+	origin := r.ResolveOrigin(net.IPv4(198, 51, 100, 1))
+
+	require.NotNil(t, origin)
+	assert.Equal(t, 64497, origin.ASN, "the most specific prefix wins")
+	assert.Equal(t, "198.51.100.0/24", origin.Prefix.String())
+}
+
+func TestCymruResolverUnknown(t *testing.T) {
+	stubLookupTXT(t, func(_ context.Context, name string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	})
+
+	r := NewCymruResolver(time.Second)
+
+	assert.Nil(t, r.ResolveOrigin(net.IPv4(198, 51, 100, 1)))
+}
+
+func TestCymruResolverSkipsPrivate(t *testing.T) {
+	stubLookupTXT(t, func(context.Context, string) ([]string, error) {
+		t.Error("private addresses must not be looked up")
+		return nil, errors.New("unexpected lookup")
+	})
+
+	r := NewCymruResolver(time.Second)
+
+	assert.Nil(t, r.ResolveOrigin(net.IPv4(10, 0, 0, 1)))
+	assert.Nil(t, r.ResolveOrigin(net.IPv6loopback))
+	assert.Nil(t, r.ResolveOrigin(net.IPv4(100, 64, 0, 1)))
+}
+
+func TestIsReserved(t *testing.T) {
+	for _, ip := range []string{"0.0.0.0", "0.1.2.3", "10.1.2.3", "100.127.255.254",
+		"127.0.0.1", "169.254.1.1", "172.16.0.1", "192.0.0.8", "192.168.1.1", "198.19.0.1",
+		"224.0.0.1", "250.0.0.1", "255.255.255.255", "::", "::1", "fc00::1", "fe80::1",
+		"ff02::1"} {
+		assert.True(t, isReserved(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"8.8.8.8", "100.63.255.255", "100.128.0.0", "198.51.100.1",
+		"2001:4860:4860::8888"} {
+		assert.False(t, isReserved(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestCymruResolverTimeout(t *testing.T) {
+	stubLookupTXT(t, func(ctx context.Context, _ string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	r := NewCymruResolver(10 * time.Millisecond)
+
+	start := time.Now()
+	assert.Nil(t, r.ResolveOrigin(net.IPv4(198, 51, 100, 1)))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestCymruResolverCaches(t *testing.T) {
+	var calls int32
+	stubLookupTXT(t, func(context.Context, string) ([]string, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return []string{"64496 | 198.51.100.0/24 | ZZ | arin | 2006-01-02"}, nil
+	})
+
+	r := NewCymruResolver(time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, 64496, r.ResolveOrigin(net.IPv4(198, 51, 100, 1)).ASN)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestCymruResolverMoreSpecificPrefix(t *testing.T) {
+	var queries []string
+	stubLookupTXT(t, func(_ context.Context, name string) ([]string, error) {
+		queries = append(queries, name)
+		records := []string{"64496 | 203.0.113.0/24 | ZZ | arin | 2006-01-02"}
+		if name == "129.113.0.203.origin.asn.cymru.com" {
+			records = append(records, "64511 | 203.0.113.128/25 | ZZ | arin | 2006-01-02")
+		}
+		return records, nil
+	})
+
+	r := NewCymruResolver(time.Second)
+
+	assert.Equal(t, 64496, r.ResolveOrigin(net.IPv4(203, 0, 113, 1)).ASN)
+	origin := r.ResolveOrigin(net.IPv4(203, 0, 113, 129))
+	require.NotNil(t, origin)
+	assert.Equal(t, 64511, origin.ASN, "a more specific prefix within a cached one is found")
+	assert.Equal(t, "203.0.113.128/25", origin.Prefix.String())
+	assert.Len(t, queries, 2)
+}
@@ -0,0 +1,65 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// internetChecksum computes the RFC 1071 one's complement checksum of data,
+// continuing from a partial sum.
+func internetChecksum(sum uint32, data []byte) uint16 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum returns the partial checksum of the IPv4 or IPv6 pseudo-header used by
+// TCP and UDP checksums.
+func pseudoHeaderSum(src, dst net.IP, protocol int, length int) uint32 {
+	var sum uint32
+
+	addSum := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+	}
+
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		addSum(src4)
+		addSum(dst4)
+	} else {
+		addSum(src.To16())
+		addSum(dst.To16())
+	}
+
+	sum += uint32(protocol)
+	sum += uint32(length)
+
+	return sum
+}
+
+// sourceIP returns the address packets to dst leave from, which transport checksums cover
+// through the pseudo-header. A specific local address a socket is bound to is used as is.
+func sourceIP(local, dst net.IP) (net.IP, error) {
+	if local != nil && !local.IsUnspecified() {
+		return local, nil
+	}
+
+	// Connecting a UDP socket sends nothing but makes the kernel pick the route.
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine source address: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,38 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInternetChecksum(t *testing.T) {
+	// Example from RFC 1071, section 3.
+	data := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+
+	assert.Equal(t, uint16(^uint16(0xddf2)), internetChecksum(0, data))
+}
+
+func TestInternetChecksumOddLength(t *testing.T) {
+	assert.Equal(t, ^uint16(0x0100), internetChecksum(0, []byte{0x01}))
+}
+
+func TestInternetChecksumVerifiesToZero(t *testing.T) {
+	// The checksum of data including its own checksum is zero.
+	data := []byte{0x45, 0x00, 0x00, 0x1c, 0x5f, 0x86, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00,
+		0x7f, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01}
+	sum := internetChecksum(0, data)
+	data[10], data[11] = byte(sum>>8), byte(sum)
+
+	assert.Equal(t, uint16(0), internetChecksum(0, data))
+	assert.Equal(t, uint16(0xdd48), sum)
+}
+
+func TestPseudoHeaderSum(t *testing.T) {
+	v4 := pseudoHeaderSum(net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 1), 6, 20)
+	v6 := pseudoHeaderSum(net.IPv6loopback, net.IPv6loopback, 6, 20)
+
+	assert.Equal(t, uint32(0x7f00+0x0001+0x7f00+0x0001+6+20), v4)
+	assert.Equal(t, uint32(2+6+20), v6)
+}
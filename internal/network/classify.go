@@ -0,0 +1,97 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/icmp"
+)
+
+// ErrMalformed is matched by the errors ParseICMP returns for messages that do not parse,
+// such as truncated ones.
+var ErrMalformed = errors.New("malformed ICMP message")
+
+// UnexpectedTypeError is returned when parsing an ICMP message of a type that does not
+// answer probes, such as Redirect, Source Quench or the Echo Requests of other hosts.
+type UnexpectedTypeError struct {
+	Family Family
+	Type   icmp.Type
+}
+
+func (e *UnexpectedTypeError) Error() string {
+	if e.Family == IPv6 {
+		return fmt.Sprintf("unexpected ICMPv6 message type: %v", e.Type)
+	}
+	return fmt.Sprintf("unexpected ICMP message type: %v", e.Type)
+}
+
+// malformedError marks the error of a message that does not parse, keeping its text.
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *malformedError) Unwrap() error {
+	return e.err
+}
+
+func (e *malformedError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// malformed marks err, returned by parsing a message, as ErrMalformed unless it reports an
+// unexpected type.
+func malformed(err error) error {
+	var typeErr *UnexpectedTypeError
+	if errors.As(err, &typeErr) {
+		return err
+	}
+	return &malformedError{err: err}
+}
+
+// Classification tells a loop reading ICMP messages what to do with the outcome of a read.
+type Classification int
+
+const (
+	// Relevant is a message that parsed and may answer a probe.
+	Relevant Classification = iota
+	// Ignore is unrelated ICMP traffic, such as a Redirect, or a malformed or corrupted
+	// message: the loop should keep reading.
+	Ignore
+	// Terminal is a failed read, such as a timeout or a closed socket: the loop should stop.
+	Terminal
+)
+
+// String returns a human-readable name of the classification.
+func (c Classification) String() string {
+	switch c {
+	case Relevant:
+		return "relevant"
+	case Ignore:
+		return "ignore"
+	case Terminal:
+		return "terminal"
+	default:
+		return fmt.Sprintf("Classification(%d)", int(c))
+	}
+}
+
+// Classify classifies err, returned by reading a message or by parsing it with ParseICMP,
+// so that unrelated or unparsable messages do not end a read loop: it is Relevant if err
+// is nil, Ignore if the message could not be parsed or was filtered out, and Terminal
+// otherwise.
+func Classify(err error) Classification {
+	var typeErr *UnexpectedTypeError
+	switch {
+	case err == nil:
+		return Relevant
+	case errors.As(err, &typeErr), errors.Is(err, ErrMalformed), errors.Is(err, ErrBadChecksum),
+		errors.Is(err, ErrForeignEcho):
+		return Ignore
+	default:
+		return Terminal
+	}
+}
@@ -0,0 +1,87 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestClassifyParsed(t *testing.T) {
+	_, err := ParseICMP(IPv4, buildTimeExceeded(t, net.IPv4(198, 51, 100, 7)))
+
+	assert.Equal(t, Relevant, Classify(err))
+}
+
+func TestClassifyUnexpectedType(t *testing.T) {
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeRedirect,
+		Body: &icmp.RawBody{Data: make([]byte, 4)},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	_, err = ParseICMP(IPv4, data)
+
+	var typeErr *UnexpectedTypeError
+	require.ErrorAs(t, err, &typeErr)
+	assert.Equal(t, ipv4.ICMPTypeRedirect, typeErr.Type)
+	assert.EqualError(t, err, "unexpected ICMP message type: redirect")
+	assert.NotErrorIs(t, err, ErrMalformed)
+	assert.Equal(t, Ignore, Classify(err))
+}
+
+func TestClassifyUnexpectedTypeV6(t *testing.T) {
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Body: &icmp.Echo{ID: 1, Seq: 1},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	_, err = ParseICMP(IPv6, data)
+
+	assert.EqualError(t, err, "unexpected ICMPv6 message type: echo request")
+	assert.Equal(t, Ignore, Classify(err))
+}
+
+func TestClassifyMalformed(t *testing.T) {
+	data := append([]byte(nil), portUnreachable[:20]...)
+
+	_, err := ParseICMP(IPv4, data)
+
+	assert.ErrorIs(t, err, ErrMalformed)
+	assert.Equal(t, Ignore, Classify(err))
+}
+
+func TestClassifyBadChecksum(t *testing.T) {
+	data := buildTimeExceeded(t, net.IPv4(198, 51, 100, 7))
+	data[len(data)-1] ^= 0xff
+
+	_, err := ParseICMPWithOptions(IPv4, data, ParseOptions{VerifyChecksum: true})
+
+	assert.Equal(t, Ignore, Classify(err))
+}
+
+func TestClassifyReadErrors(t *testing.T) {
+	for _, err := range []error{
+		ErrReadTimeout,
+		fmt.Errorf("failed to read ICMP message: %w", net.ErrClosed),
+		context.Canceled,
+	} {
+		assert.Equal(t, Terminal, Classify(err), err)
+	}
+}
+
+func TestClassificationString(t *testing.T) {
+	assert.Equal(t, "relevant", Relevant.String())
+	assert.Equal(t, "ignore", Ignore.String())
+	assert.Equal(t, "terminal", Terminal.String())
+	assert.Equal(t, "Classification(7)", Classification(7).String())
+}
@@ -0,0 +1,35 @@
+package network
+
+import (
+	"context"
+	"time"
+)
+
+// deadlineSetter is a connection whose reads can be given a deadline.
+type deadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// interruptOnDone makes a pending read on conn return as soon as ctx is done, by moving
+// its read deadline into the past.
+//
+// The returned function stops watching ctx. It waits until the deadline can no longer be
+// moved, so that a late cancellation cannot interrupt the next read on conn.
+func interruptOnDone(ctx context.Context, conn deadlineSetter) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
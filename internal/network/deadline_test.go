@@ -0,0 +1,56 @@
+package network
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingConn struct {
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (c *recordingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *recordingConn) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.deadlines)
+}
+
+func TestInterruptOnDone(t *testing.T) {
+	conn := &recordingConn{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stop := interruptOnDone(ctx, conn)
+	cancel()
+	assert.Eventually(t, func() bool { return conn.count() == 1 }, time.Second, time.Millisecond)
+	stop()
+
+	assert.True(t, conn.deadlines[0].Before(time.Now()))
+}
+
+func TestInterruptOnDoneStopped(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		conn := &recordingConn{}
+		ctx, cancel := context.WithCancel(context.Background())
+
+		stop := interruptOnDone(ctx, conn)
+		cancel()
+		stop()
+
+		// Whether or not the cancellation won, nothing may touch the deadline after stop.
+		n := conn.count()
+		time.Sleep(time.Millisecond)
+		assert.Equal(t, n, conn.count())
+	}
+}
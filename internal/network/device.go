@@ -0,0 +1,53 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"my-little-tracerouter/internal/sockopt"
+)
+
+// ErrBindToDeviceUnsupported is returned when binding a socket to a named interface is not
+// supported on the current platform.
+var ErrBindToDeviceUnsupported = errors.New("binding to an interface is not supported")
+
+// BindToDevice forces the packets of the connection out through the named interface,
+// e.g. "eth1", regardless of the routing table.
+//
+// It is supported on Linux (SO_BINDTODEVICE), where older kernels require CAP_NET_RAW, and
+// on macOS (IP_BOUND_IF and IPV6_BOUND_IF); other platforms return
+// ErrBindToDeviceUnsupported.
+func (c *UDPConn) BindToDevice(name string) error {
+	return bindToDevice(c.syscallConn, c.family, name)
+}
+
+// BindToDevice forces the SYN probes of the connection out through the named interface.
+//
+// See UDPConn.BindToDevice.
+func (c *TCPConn) BindToDevice(name string) error {
+	return bindToDevice(c.syscallConn, c.family, name)
+}
+
+// BindToDevice forces the Echo Requests sent through the listener out through the named
+// interface. On Linux the listener then also ignores the messages arriving through other
+// interfaces.
+//
+// See UDPConn.BindToDevice.
+func (c *ICMPConn) BindToDevice(name string) error {
+	rawConn, err := c.syscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to bind to interface %q: %w", name, err)
+	}
+	return bindToDevice(rawConn, c.family, name)
+}
+
+// bindToDevice binds the socket behind conn to the named interface.
+func bindToDevice(conn SyscallConn, family Family, name string) error {
+	err := sockopt.BindToDevice(conn, family == IPv6, name)
+	if errors.Is(err, sockopt.ErrUnsupported) {
+		return fmt.Errorf("failed to bind to interface %q on %s: %w", name, runtime.GOOS,
+			ErrBindToDeviceUnsupported)
+	}
+	return err
+}
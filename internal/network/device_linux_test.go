@@ -0,0 +1,91 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+func TestUDPConnBindToDevice(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.BindToDevice("lo")
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("SO_BINDTODEVICE requires elevated privileges")
+	}
+	require.NoError(t, err)
+
+	// Loopback still reaches loopback addresses.
+	assert.NoError(t, conn.SendEmptyPacket(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}))
+}
+
+func TestUDPConnBindToUnknownDevice(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.BindToDevice("nosuchif0")
+
+	assert.ErrorContains(t, err, `failed to bind to interface "nosuchif0"`)
+}
+
+func TestBindToDeviceControlFailure(t *testing.T) {
+	mockConn := new(MockSyscallConn)
+	mockConn.On("Control", mock.AnythingOfType("func(uintptr)")).Return(errors.New("closed"))
+
+	err := bindToDevice(mockConn, IPv4, "eth1")
+
+	assert.EqualError(t, err, `failed to bind to interface "eth1": closed`)
+}
+
+func TestBindToDevicePermissionDenied(t *testing.T) {
+	mockConn := new(MockSyscallConn)
+	mockConn.On("Control", mock.AnythingOfType("func(uintptr)")).Return(syscall.EPERM)
+
+	err := bindToDevice(mockConn, IPv4, "eth1")
+
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.ErrorContains(t, err, "requires CAP_NET_RAW or root")
+}
+
+func TestICMPConnBindToDeviceLoopback(t *testing.T) {
+	conn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.BindToDevice("lo"))
+
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	require.NoError(t, conn.SendEcho(dst, 64, 0x4244, 1, nil))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		_, data, _, err := conn.ReadWithTimeout(time.Until(deadline))
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(IPv4, data)
+		if err == nil && parsed.Type == ipv4.ICMPTypeEchoReply {
+			return
+		}
+	}
+	t.Fatal("no Echo Reply received through the loopback interface")
+}
+
+func TestICMPConnBindToDeviceUnsupportedConnection(t *testing.T) {
+	conn := &ICMPConn{conn: new(MockICMPPacketConn)}
+
+	assert.ErrorContains(t, conn.BindToDevice("lo"), "unsupported connection")
+}
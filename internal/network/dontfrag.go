@@ -0,0 +1,53 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"my-little-tracerouter/internal/sockopt"
+)
+
+// ErrDontFragmentUnsupported is returned when the Don't Fragment bit cannot be controlled
+// on the current platform.
+var ErrDontFragmentUnsupported = errors.New("setting the Don't Fragment bit is not supported")
+
+// PacketTooBigError is returned when a datagram is larger than the MTU of the path to its
+// destination, as far as the local host knows it, while the Don't Fragment bit is set.
+type PacketTooBigError struct {
+	// Size is the length of the UDP payload that did not fit.
+	Size int
+	// Err is the underlying error, usually EMSGSIZE.
+	Err error
+}
+
+func (e *PacketTooBigError) Error() string {
+	return fmt.Sprintf("failed to send UDP packet: %d-byte payload exceeds the path MTU: %v",
+		e.Size, e.Err)
+}
+
+func (e *PacketTooBigError) Unwrap() error {
+	return e.Err
+}
+
+// SetDontFragment sets or clears the IP Don't Fragment bit on outgoing datagrams, which
+// makes routers that cannot forward a probe without fragmenting it answer with
+// Fragmentation Needed (ICMPv6 Packet Too Big) and the MTU of their next hop instead.
+//
+// IPv6 routers never fragment, so on IPv6 connections it only keeps the local host from
+// fragmenting. Sending a datagram that does not fit the known path MTU then fails with
+// *PacketTooBigError. It is supported on Linux, macOS and FreeBSD; other platforms return
+// ErrDontFragmentUnsupported.
+func (c *UDPConn) SetDontFragment(on bool) error {
+	return setDontFragment(c.syscallConn, c.family, on)
+}
+
+// setDontFragment sets or clears the Don't Fragment bit of the socket behind conn.
+func setDontFragment(conn SyscallConn, family Family, on bool) error {
+	err := sockopt.SetDF(conn, family == IPv6, on)
+	if errors.Is(err, sockopt.ErrUnsupported) {
+		return fmt.Errorf("failed to set Don't Fragment on %s: %w", runtime.GOOS,
+			ErrDontFragmentUnsupported)
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPConnSetDontFragment(t *testing.T) {
+	tests := []struct {
+		family     Family
+		level, opt int
+		do, dont   int
+	}{
+		{IPv4, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER,
+			syscall.IP_PMTUDISC_DO, syscall.IP_PMTUDISC_DONT},
+		{IPv6, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER,
+			syscall.IPV6_PMTUDISC_DO, syscall.IPV6_PMTUDISC_DONT},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.family.String(), func(t *testing.T) {
+			conn, err := NewUDPConn(tt.family, ":0")
+			require.NoError(t, err)
+			defer conn.Close()
+
+			require.NoError(t, conn.SetDontFragment(true))
+			assert.Equal(t, tt.do, getsockoptInt(t, conn, tt.level, tt.opt))
+
+			require.NoError(t, conn.SetDontFragment(false))
+			assert.Equal(t, tt.dont, getsockoptInt(t, conn, tt.level, tt.opt))
+		})
+	}
+}
+
+func TestSetDontFragmentControlFailure(t *testing.T) {
+	mockConn := new(MockSyscallConn)
+	mockConn.On("Control", mock.AnythingOfType("func(uintptr)")).Return(errors.New("closed"))
+
+	err := setDontFragment(mockConn, IPv4, true)
+
+	assert.EqualError(t, err, "failed to set Don't Fragment: closed")
+}
+
+// defaultRouteEnv enables the tests sending through the default route of the host.
+const defaultRouteEnv = "TRACEROUTE_TEST_DEFAULT_ROUTE"
+
+// sendThroughDefaultRoute sends a 2000-byte datagram from conn through the default route of
+// the host, skipping the test unless defaultRouteEnv is set or if the host cannot route it.
+//
+// Loopback carries 64 KiB datagrams, so it cannot tell whether Don't Fragment is honored:
+// the datagram must leave through an interface whose MTU is smaller, usually 1500 bytes.
+// Whether one exists, and whether the host lets the datagram out, depends on the host, hence
+// the opt-in.
+func sendThroughDefaultRoute(t *testing.T, conn *UDPConn) error {
+	t.Helper()
+
+	if os.Getenv(defaultRouteEnv) == "" {
+		t.Skipf("sends through the default route of the host; set %s=1 to run",
+			defaultRouteEnv)
+	}
+
+	err := conn.send(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 33434},
+		make([]byte, 2000))
+	for _, errno := range []syscall.Errno{syscall.ENETUNREACH, syscall.EHOSTUNREACH,
+		syscall.EPERM} {
+		if errors.Is(err, errno) {
+			t.Skipf("the host does not route the datagram: %v", err)
+		}
+	}
+	return err
+}
+
+func TestUDPConnSendPacketTooBig(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDontFragment(true))
+
+	err = sendThroughDefaultRoute(t, conn)
+
+	var tooBig *PacketTooBigError
+	require.ErrorAs(t, err, &tooBig)
+	assert.Equal(t, 2000, tooBig.Size)
+	assert.ErrorIs(t, err, syscall.EMSGSIZE)
+}
+
+func TestUDPConnSendWithoutDontFragment(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDontFragment(false))
+
+	assert.NoError(t, sendThroughDefaultRoute(t, conn))
+}
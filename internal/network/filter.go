@@ -0,0 +1,118 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+
+	"my-little-tracerouter/internal/sockopt"
+)
+
+// ErrFilterUnsupported is returned when a filter cannot be attached to a socket on the
+// current platform.
+var ErrFilterUnsupported = errors.New("socket filters are not supported")
+
+// DefaultFilterTypes are the ICMP types passed by SetFilter when none is given: those of
+// the replies to UDP, TCP and ICMP probes.
+var DefaultFilterTypes = []ipv4.ICMPType{
+	ipv4.ICMPTypeTimeExceeded,
+	ipv4.ICMPTypeDestinationUnreachable,
+	ipv4.ICMPTypeEchoReply,
+}
+
+// icmpv6Types maps the ICMP types SetFilter accepts to their ICMPv6 counterparts. Packet
+// Too Big reports what Fragmentation Needed, a Destination Unreachable code, does in IPv4.
+var icmpv6Types = map[ipv4.ICMPType][]int{
+	ipv4.ICMPTypeEchoReply:              {129},
+	ipv4.ICMPTypeDestinationUnreachable: {1, 2},
+	ipv4.ICMPTypeEcho:                   {128},
+	ipv4.ICMPTypeTimeExceeded:           {3},
+	ipv4.ICMPTypeParameterProblem:       {4},
+}
+
+// SetFilter attaches a classic BPF program to the listener that only passes messages of
+// the given ICMP types, DefaultFilterTypes if none is given. The kernel then drops the
+// unrelated ICMP a busy host receives, such as pings to the host or errors meant for other
+// processes, instead of waking up reads that would discard them.
+//
+// On IPv6 listeners the types are mapped to their ICMPv6 counterparts, and only the types
+// with one are accepted; Destination Unreachable also passes Packet Too Big. A
+// DatagramICMP listener only receives the replies to its own probes, so no filter is
+// attached. It is only supported on Linux (SO_ATTACH_FILTER); other platforms return an
+// error matching ErrFilterUnsupported and sockopt.ErrUnsupported, and the listener keeps
+// receiving every message.
+func (c *ICMPConn) SetFilter(types ...ipv4.ICMPType) error {
+	if len(types) == 0 {
+		types = DefaultFilterTypes
+	}
+
+	var values []int
+	for _, typ := range types {
+		if c.family != IPv6 {
+			values = append(values, int(typ))
+			continue
+		}
+		v6, ok := icmpv6Types[typ]
+		if !ok {
+			return fmt.Errorf("failed to attach ICMP filter: %v has no ICMPv6 counterpart", typ)
+		}
+		values = append(values, v6...)
+	}
+
+	if c.mode == DatagramICMP {
+		return nil
+	}
+
+	// IPv4 raw sockets receive the IP header along with the message.
+	filter, err := icmpFilter(c.family == IPv4, values)
+	if err != nil {
+		return fmt.Errorf("failed to attach ICMP filter: %w", err)
+	}
+
+	rawConn, err := c.syscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to attach ICMP filter: %w", err)
+	}
+	err = sockopt.AttachFilter(rawConn, filter)
+	if errors.Is(err, sockopt.ErrUnsupported) {
+		return fmt.Errorf("failed to attach ICMP filter: %w: %w", ErrFilterUnsupported, err)
+	}
+	return err
+}
+
+// icmpFilter assembles a program passing the ICMP messages of the given types. The
+// messages follow an IPv4 header if ipHeader is set.
+func icmpFilter(ipHeader bool, types []int) ([]bpf.RawInstruction, error) {
+	if len(types) > math.MaxUint8 {
+		return nil, fmt.Errorf("too many ICMP types: %d", len(types))
+	}
+
+	var prog []bpf.Instruction
+	if ipHeader {
+		// X = IHL * 4, then load the type at X.
+		prog = append(prog,
+			bpf.LoadMemShift{Off: 0},
+			bpf.LoadIndirect{Off: 0, Size: 1},
+		)
+	} else {
+		prog = append(prog, bpf.LoadAbsolute{Off: 0, Size: 1})
+	}
+
+	// Every match jumps over the remaining comparisons and the rejection to the acceptance.
+	for i, typ := range types {
+		prog = append(prog, bpf.JumpIf{
+			Cond:     bpf.JumpEqual,
+			Val:      uint32(typ),
+			SkipTrue: uint8(len(types) - i),
+		})
+	}
+	prog = append(prog,
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: math.MaxUint32},
+	)
+
+	return bpf.Assemble(prog)
+}
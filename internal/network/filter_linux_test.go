@@ -0,0 +1,63 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestICMPConnSetFilterLoopback(t *testing.T) {
+	conn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+	if conn.Mode() != RawICMP {
+		t.Skip("socket filters are only attached to raw sockets")
+	}
+
+	require.NoError(t, conn.SetFilter(ipv4.ICMPTypeEchoReply))
+
+	// Without the filter, the raw socket would read its own Echo Request first.
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	require.NoError(t, conn.SendEcho(dst, 64, 0x4246, 1, nil))
+
+	_, data, _, err := conn.ReadWithTimeout(time.Second)
+	require.NoError(t, err)
+
+	parsed, err := ParseICMP(IPv4, data)
+	require.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeEchoReply, parsed.Type)
+}
+
+func TestICMPConnSetFilterLoopbackIPv6(t *testing.T) {
+	conn, err := NewICMPConn(IPv6)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+	if conn.Mode() != RawICMP {
+		t.Skip("socket filters are only attached to raw sockets")
+	}
+
+	require.NoError(t, conn.SetFilter(ipv4.ICMPTypeEchoReply))
+
+	dst := &net.IPAddr{IP: net.IPv6loopback}
+	require.NoError(t, conn.SendEcho(dst, 64, 0x4246, 1, nil))
+
+	_, data, _, err := conn.ReadWithTimeout(time.Second)
+	require.NoError(t, err)
+
+	parsed, err := ParseICMP(IPv6, data)
+	require.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypeEchoReply, parsed.Type)
+}
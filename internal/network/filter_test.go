@@ -0,0 +1,87 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+)
+
+// runFilter returns whether the program passes the packet.
+func runFilter(t *testing.T, filter []bpf.RawInstruction, packet []byte) bool {
+	t.Helper()
+
+	prog, ok := bpf.Disassemble(filter)
+	require.True(t, ok)
+	vm, err := bpf.NewVM(prog)
+	require.NoError(t, err)
+
+	n, err := vm.Run(packet)
+	require.NoError(t, err)
+	return n > 0
+}
+
+func TestICMPFilterIPv4(t *testing.T) {
+	filter, err := icmpFilter(true, []int{11, 3, 0})
+	require.NoError(t, err)
+
+	header := func(ihl int, typ byte) []byte {
+		packet := make([]byte, ihl*4+8)
+		packet[0] = 0x40 | byte(ihl)
+		packet[ihl*4] = typ
+		return packet
+	}
+
+	assert.True(t, runFilter(t, filter, header(5, 11)))
+	assert.True(t, runFilter(t, filter, header(5, 3)))
+	assert.True(t, runFilter(t, filter, header(5, 0)))
+	assert.True(t, runFilter(t, filter, header(6, 0)), "options shift the ICMP header")
+	assert.False(t, runFilter(t, filter, header(5, 8)))
+	assert.False(t, runFilter(t, filter, header(5, 5)))
+}
+
+func TestICMPFilterIPv6(t *testing.T) {
+	filter, err := icmpFilter(false, []int{3, 129})
+	require.NoError(t, err)
+
+	assert.True(t, runFilter(t, filter, []byte{3, 0, 0, 0}))
+	assert.True(t, runFilter(t, filter, []byte{129, 0, 0, 0}))
+	assert.False(t, runFilter(t, filter, []byte{128, 0, 0, 0}))
+	assert.False(t, runFilter(t, filter, []byte{135, 0, 0, 0}))
+}
+
+func TestICMPFilterTooManyTypes(t *testing.T) {
+	_, err := icmpFilter(false, make([]int, 256))
+
+	assert.ErrorContains(t, err, "too many ICMP types")
+}
+
+func TestICMPConnSetFilterNoICMPv6Counterpart(t *testing.T) {
+	conn := &ICMPConn{conn: new(MockICMPPacketConn), family: IPv6}
+
+	err := conn.SetFilter(ipv4.ICMPTypeRedirect)
+
+	assert.ErrorContains(t, err, "has no ICMPv6 counterpart")
+}
+
+func TestICMPConnSetFilterDatagram(t *testing.T) {
+	conn := &ICMPConn{conn: new(MockICMPPacketConn), mode: DatagramICMP}
+
+	assert.NoError(t, conn.SetFilter())
+}
+
+func TestICMPConnSetFilterUnsupportedConnection(t *testing.T) {
+	conn := &ICMPConn{conn: new(MockICMPPacketConn)}
+
+	assert.ErrorContains(t, conn.SetFilter(), "unsupported connection")
+}
+
+func TestICMPFilterPacketTooBig(t *testing.T) {
+	filter, err := icmpFilter(false, icmpv6Types[ipv4.ICMPTypeDestinationUnreachable])
+	require.NoError(t, err)
+
+	assert.True(t, runFilter(t, filter, []byte{1, 4, 0, 0}))
+	assert.True(t, runFilter(t, filter, []byte{2, 0, 0, 0}), "Packet Too Big")
+}
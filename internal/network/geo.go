@@ -0,0 +1,24 @@
+package network
+
+import "net"
+
+// GeoInfo is the approximate location of an address.
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, e.g. "NL".
+	Country string
+	// City is the name of the city, if known.
+	City string
+	// Lat and Lon are the latitude and longitude in degrees.
+	Lat float64
+	Lon float64
+}
+
+// GeoResolver locates hop addresses, e.g. from a MaxMind GeoLite2 database or through an
+// HTTP API.
+//
+// Implementations must be safe for concurrent use. Since every responding hop is looked up,
+// they should cache their answers.
+type GeoResolver interface {
+	// Locate returns the location of ip, or an error if it cannot be located.
+	Locate(ip net.IP) (GeoInfo, error)
+}
@@ -0,0 +1,694 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"my-little-tracerouter/internal/sockopt"
+)
+
+const (
+	// MaxPacketSize is the size of the buffer used to read ICMP messages unless
+	// ICMPConn.SetReadSize changes it, and the largest UDP probe sent.
+	MaxPacketSize = 1500
+
+	// MaxReadSize is the largest size ICMPConn.SetReadSize accepts, that of the largest
+	// IP packet.
+	MaxReadSize = 65535
+
+	// oobSize is the size of the buffer the control messages of a read are received in.
+	oobSize = 512
+
+	// AllInterfaces is the IPv4 address used to listen on every interface.
+	AllInterfaces = "0.0.0.0"
+
+	// AllInterfacesV6 is the IPv6 address used to listen on every interface.
+	AllInterfacesV6 = "::"
+)
+
+// listenPacket opens the raw ICMP sockets; it is a variable so tests can deny them.
+var listenPacket = net.ListenPacket
+
+// ErrReadTimeout is returned when no message arrived before the read deadline.
+var ErrReadTimeout = errors.New("read timeout")
+
+// Family identifies the IP address family a connection operates on.
+type Family int
+
+const (
+	// IPv4 selects IPv4 sockets and ICMP.
+	IPv4 Family = iota
+	// IPv6 selects IPv6 sockets and ICMPv6.
+	IPv6
+)
+
+// String returns a human-readable name of the family.
+func (f Family) String() string {
+	switch f {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	default:
+		return fmt.Sprintf("Family(%d)", int(f))
+	}
+}
+
+// ICMPMode is the kind of socket an ICMPConn listens on.
+type ICMPMode int
+
+const (
+	// RawICMP is a raw socket, which receives every ICMP message and requires elevated
+	// privileges.
+	RawICMP ICMPMode = iota
+	// DatagramICMP is an unprivileged datagram socket, as used by ping, which only
+	// receives the replies to the Echo Requests sent through it.
+	DatagramICMP
+)
+
+// String returns a human-readable name of the mode.
+func (m ICMPMode) String() string {
+	switch m {
+	case RawICMP:
+		return "raw"
+	case DatagramICMP:
+		return "datagram"
+	default:
+		return fmt.Sprintf("ICMPMode(%d)", int(m))
+	}
+}
+
+// ICMPPacketConn represents a packet connection capable of receiving and sending
+// ICMP messages.
+type ICMPPacketConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, dst net.Addr) (int, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// ICMPConn wraps an ICMP packet connection used to receive traceroute replies and to send
+// ICMP Echo probes.
+type ICMPConn struct {
+	conn   ICMPPacketConn
+	family Family
+	setTTL func(ttl int) error
+
+	// ipConn is the raw socket behind a listener opened by NewICMPConn. Reading from it
+	// directly yields the control messages enabled by recvTTL and recvTimestamp.
+	ipConn        *net.IPConn
+	recvTTL       bool
+	recvTimestamp bool
+
+	// sendMu keeps concurrent Echo Requests from sending with each other's TTL.
+	sendMu sync.Mutex
+
+	// readSize is the size of the buffers messages are read into, MaxPacketSize if zero.
+	// The buffers are reused across reads through buffers.
+	readSize int
+	buffers  sync.Pool
+
+	// mode is DatagramICMP if NewICMPConn fell back to dgramConn, the datagram socket
+	// behind the listener, for lack of privileges.
+	mode      ICMPMode
+	dgramConn *net.UDPConn
+}
+
+// Message is an ICMP message read from an ICMPConn.
+type Message struct {
+	// Peer is the address of the sender.
+	Peer net.IP
+	// Data holds the raw ICMP message.
+	Data []byte
+	// TTL is the TTL (IPv4) or hop limit (IPv6) the message arrived with, or -1 unless
+	// EnableReceiveTTL succeeded.
+	TTL int
+	// ReceivedAt is when the kernel received the message if EnableTimestamps succeeded,
+	// and when it was read otherwise.
+	ReceivedAt time.Time
+}
+
+// Reply is an ICMP message read by ICMPConn.Receive, along with its parse.
+type Reply struct {
+	Message
+	// ICMP is the parsed message.
+	ICMP *ParsedICMP
+}
+
+// NewICMPConn creates a new ICMP listener for the given address family.
+//
+// IPv4 listens on "ip4:icmp" and IPv6 listens on "ip6:ipv6-icmp", both on all interfaces.
+// Opening a raw ICMP socket usually requires elevated privileges. Without them the
+// listener falls back to an unprivileged datagram socket where the platform allows it;
+// see DatagramICMP. Windows has no such sockets, so there it must run from an
+// administrator console; the error returned otherwise matches os.ErrPermission.
+func NewICMPConn(family Family) (*ICMPConn, error) {
+	return NewICMPConnBound(family, nil)
+}
+
+// NewICMPConnBound creates a new ICMP listener like NewICMPConn, bound to the given local
+// address unless it is nil. It only receives the messages sent to that address, and Echo
+// Requests sent through it leave from it. It returns a *SourceAddrError if local is not
+// assigned to a local interface.
+func NewICMPConnBound(family Family, local net.IP) (*ICMPConn, error) {
+	var network string
+
+	switch family {
+	case IPv4:
+		network = "ip4:icmp"
+	case IPv6:
+		network = "ip6:ipv6-icmp"
+	default:
+		return nil, fmt.Errorf("unsupported address family: %v", family)
+	}
+
+	address, err := bindAddr(family, local)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := listenPacket(network, address)
+	if err != nil {
+		rawErr := fmt.Errorf("failed to create ICMP connection: %w", permissionError(err))
+		if !errors.Is(rawErr, os.ErrPermission) {
+			return nil, rawErr
+		}
+		// Report the lack of privileges if the unprivileged socket is not allowed either.
+		dgram, err := newDatagramICMPConn(family, address)
+		if err != nil {
+			return nil, rawErr
+		}
+		return dgram, nil
+	}
+	ipConn := conn.(*net.IPConn)
+
+	var setTTL func(int) error
+	if family == IPv6 {
+		setTTL = ipv6.NewPacketConn(ipConn).SetHopLimit
+	} else {
+		setTTL = ipv4.NewPacketConn(ipConn).SetTTL
+	}
+
+	return &ICMPConn{
+		conn:   ipConn,
+		family: family,
+		setTTL: setTTL,
+		ipConn: ipConn,
+	}, nil
+}
+
+// NewICMPConnFrom returns a listener for the given address family reading from conn, an
+// ICMP socket opened by the caller, e.g. a raw socket a privileged process handed down to
+// a daemon that dropped its privileges, or a fake in tests. The listener owns conn and
+// closes it with Close.
+//
+// A *net.IPConn, such as one made by net.FilePacketConn from a raw socket, is used like the
+// raw socket NewICMPConn opens. The TTL of an *icmp.PacketConn listening on a raw socket
+// can be set as well, but reading control messages, as EnableReceiveTTL and
+// EnableTimestamps do, and SetTOS require a *net.IPConn. Unprivileged datagram sockets are
+// not accepted: they need no privileges to open, so NewICMPConn opens them itself.
+func NewICMPConnFrom(family Family, conn ICMPPacketConn) (*ICMPConn, error) {
+	if family != IPv4 && family != IPv6 {
+		return nil, fmt.Errorf("unsupported address family: %v", family)
+	}
+
+	c := &ICMPConn{conn: conn, family: family}
+	switch conn := conn.(type) {
+	case *net.IPConn:
+		c.ipConn = conn
+		if family == IPv6 {
+			c.setTTL = ipv6.NewPacketConn(conn).SetHopLimit
+		} else {
+			c.setTTL = ipv4.NewPacketConn(conn).SetTTL
+		}
+	case *net.UDPConn:
+		return nil, fmt.Errorf("datagram ICMP sockets are not supported")
+	case *icmp.PacketConn:
+		if _, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			return nil, fmt.Errorf("datagram ICMP sockets are not supported")
+		}
+		switch {
+		case family == IPv6 && conn.IPv6PacketConn() != nil:
+			c.setTTL = conn.IPv6PacketConn().SetHopLimit
+		case family == IPv4 && conn.IPv4PacketConn() != nil:
+			c.setTTL = conn.IPv4PacketConn().SetTTL
+		default:
+			return nil, fmt.Errorf("connection does not listen for %v", family)
+		}
+	default:
+		c.setTTL = func(int) error {
+			return fmt.Errorf("unsupported connection %T", conn)
+		}
+	}
+	return c, nil
+}
+
+// NewUnprivilegedICMPConn creates an ICMP listener for the given address family on an
+// unprivileged datagram socket, the way ping does, without trying a raw socket first. It
+// works without elevated privileges, e.g. in a container without CAP_NET_RAW, but only
+// serves ICMP probes; see DatagramICMP.
+//
+// Linux only allows such sockets for the groups in net.ipv4.ping_group_range, which covers
+// ICMPv6 as well; for any other group the error says so and matches os.ErrPermission.
+// Windows has no such sockets.
+func NewUnprivilegedICMPConn(family Family) (*ICMPConn, error) {
+	return NewUnprivilegedICMPConnBound(family, nil)
+}
+
+// NewUnprivilegedICMPConnBound creates an unprivileged ICMP listener like
+// NewUnprivilegedICMPConn, bound to the given local address unless it is nil, like
+// NewICMPConnBound.
+func NewUnprivilegedICMPConnBound(family Family, local net.IP) (*ICMPConn, error) {
+	if family != IPv4 && family != IPv6 {
+		return nil, fmt.Errorf("unsupported address family: %v", family)
+	}
+
+	address, err := bindAddr(family, local)
+	if err != nil {
+		return nil, err
+	}
+	return newDatagramICMPConn(family, address)
+}
+
+// newDatagramICMPConn creates an ICMP listener on an unprivileged datagram socket bound to
+// address.
+func newDatagramICMPConn(family Family, address string) (*ICMPConn, error) {
+	udpConn, err := listenDatagramICMP(family, net.ParseIP(address))
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			err = fmt.Errorf("%w%s", err, datagramPermissionHint)
+		}
+		return nil, fmt.Errorf("failed to create datagram ICMP connection: %w", err)
+	}
+
+	var setTTL func(int) error
+	if family == IPv6 {
+		setTTL = ipv6.NewPacketConn(udpConn).SetHopLimit
+	} else {
+		setTTL = ipv4.NewPacketConn(udpConn).SetTTL
+	}
+
+	return &ICMPConn{
+		conn:      udpConn,
+		family:    family,
+		setTTL:    setTTL,
+		mode:      DatagramICMP,
+		dgramConn: udpConn,
+	}, nil
+}
+
+// NewICMPv6Conn creates a new ICMPv6 listener on all interfaces.
+//
+// It is equivalent to NewICMPConn(IPv6).
+func NewICMPv6Conn() (*ICMPConn, error) {
+	return NewICMPConn(IPv6)
+}
+
+// Family returns the address family the connection listens on.
+func (c *ICMPConn) Family() Family {
+	return c.family
+}
+
+// Mode returns the kind of socket the listener uses.
+//
+// A DatagramICMP listener only receives Echo Replies and the errors caused by the Echo
+// Requests sent through it, so it cannot serve other kinds of probes. Its messages are
+// read like those of a raw socket, but since Linux reports errors without the IP header
+// the router quoted, the header is rebuilt from what the kernel reports: the quoted TTL is
+// 1 and the quoted TOS and Identification are 0.
+func (c *ICMPConn) Mode() ICMPMode {
+	return c.mode
+}
+
+// EchoID returns the identifier of the Echo Requests sent through the listener with the
+// given one: Linux replaces it with the port of a datagram socket, so that the socket
+// receives the replies.
+func (c *ICMPConn) EchoID(id int) int {
+	if c.mode != DatagramICMP || !datagramRewritesEchoID {
+		return id
+	}
+	return c.dgramConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// syscallConn returns the socket behind a listener opened by NewICMPConn.
+func (c *ICMPConn) syscallConn() (syscall.RawConn, error) {
+	var (
+		rawConn syscall.RawConn
+		err     error
+	)
+	switch {
+	case c.ipConn != nil:
+		rawConn, err = c.ipConn.SyscallConn()
+	case c.dgramConn != nil:
+		rawConn, err = c.dgramConn.SyscallConn()
+	default:
+		return nil, fmt.Errorf("unsupported connection")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get syscall conn: %w", err)
+	}
+	return rawConn, nil
+}
+
+// EnableReceiveTTL makes the reads report the TTL (IPv4) or hop limit (IPv6) with which
+// messages arrive, as opposed to the TTL of the datagram they quote. It lets callers
+// estimate the length of the return path.
+//
+// If the platform does not support it an error is returned and reads keep reporting -1.
+func (c *ICMPConn) EnableReceiveTTL() error {
+	rawConn, err := c.syscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to enable receiving TTL: %w", err)
+	}
+	if err := sockopt.EnableRecvTTL(rawConn, c.family == IPv6); err != nil {
+		return err
+	}
+
+	c.recvTTL = true
+	return nil
+}
+
+// EnableTimestamps makes the reads report when the kernel received each message, which
+// keeps scheduling delays out of RTTs computed from Message.ReceivedAt.
+//
+// It is only supported on Linux (SO_TIMESTAMPING, or SO_TIMESTAMPNS on kernels without
+// it). Elsewhere an error is returned and ReceivedAt keeps being taken from the wall clock
+// when a read returns.
+func (c *ICMPConn) EnableTimestamps() error {
+	rawConn, err := c.syscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to enable timestamps: %w", err)
+	}
+	if err := sockopt.EnableTimestamps(rawConn); err != nil {
+		return err
+	}
+
+	c.recvTimestamp = true
+	return nil
+}
+
+// ReadWithTimeout reads a single ICMP message, waiting at most timeout.
+//
+// It returns the IP address of the sender, the raw ICMP message bytes and the TTL the
+// message arrived with, which is -1 unless EnableReceiveTTL succeeded. If nothing arrives
+// in time, ErrReadTimeout is returned. It is ReadMessage with a context that expires after
+// timeout.
+func (c *ICMPConn) ReadWithTimeout(timeout time.Duration) (net.IP, []byte, int, error) {
+	msg, err := c.readTimeout(timeout)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	return msg.Peer, msg.Data, msg.TTL, nil
+}
+
+// Receive reads and parses a single ICMP message, waiting at most timeout. If nothing
+// arrives in time, ErrReadTimeout is returned; a message that does not parse is returned
+// with the error of ParseICMP.
+func (c *ICMPConn) Receive(timeout time.Duration) (Reply, error) {
+	msg, err := c.readTimeout(timeout)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	parsed, err := ParseICMP(c.family, msg.Data)
+	if err != nil {
+		return Reply{Message: *msg}, err
+	}
+	return Reply{Message: *msg, ICMP: parsed}, nil
+}
+
+// readTimeout is ReadMessage with a context that expires after timeout, returning
+// ErrReadTimeout once it does.
+func (c *ICMPConn) readTimeout(timeout time.Duration) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	msg, err := c.ReadMessage(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrReadTimeout
+	}
+	return msg, err
+}
+
+// ReadMessage reads a single ICMP message, waiting until it arrives or ctx is done.
+//
+// The deadline of ctx, if any, bounds the read. Cancelling ctx unblocks a pending read,
+// in which case ctx.Err() is returned, so that callers can tell a cancelled trace from a
+// lost reply.
+func (c *ICMPConn) ReadMessage(ctx context.Context) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.conn.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+
+	stop := interruptOnDone(ctx, c.conn)
+	msg, err := c.read()
+	stop()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (c *ICMPConn) read() (*Message, error) {
+	if c.dgramConn != nil {
+		return c.readDatagram()
+	}
+	if c.recvTTL || c.recvTimestamp {
+		return c.readMsg()
+	}
+
+	buf := c.getBuffer()
+	defer c.putBuffer(buf)
+
+	n, peer, err := c.conn.ReadFrom(buf.data)
+	receivedAt := time.Now()
+	if err != nil {
+		return nil, readError(err)
+	}
+
+	var ip net.IP
+	switch addr := peer.(type) {
+	case *net.IPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		// Datagram sockets report their peers as UDP addresses.
+		ip = addr.IP
+	default:
+		return nil, fmt.Errorf("unexpected peer address type: %T", peer)
+	}
+
+	return &Message{Peer: ip, Data: bytes.Clone(buf.data[:n]), TTL: -1, ReceivedAt: receivedAt},
+		nil
+}
+
+// readMsg reads a message along with the control messages enabled on the socket.
+func (c *ICMPConn) readMsg() (*Message, error) {
+	buf := c.getBuffer()
+	defer c.putBuffer(buf)
+
+	n, oobn, _, peer, err := c.ipConn.ReadMsgIP(buf.data, buf.oob)
+	msg := &Message{TTL: -1, ReceivedAt: time.Now()}
+	if err != nil {
+		return nil, readError(err)
+	}
+	oob := buf.oob[:oobn]
+	msg.Peer = peer.IP
+
+	// Unlike ReadFrom, ReadMsgIP leaves the IPv4 header in front of the message.
+	data := buf.data[:n]
+	if c.family == IPv4 {
+		if len(data) < ipv4.HeaderLen {
+			return nil, fmt.Errorf("failed to read ICMP message: short IPv4 packet")
+		}
+		headerLen := int(data[0]&0x0f) << 2
+		if headerLen < ipv4.HeaderLen || headerLen > len(data) {
+			return nil, fmt.Errorf("failed to read ICMP message: invalid IPv4 header length")
+		}
+		data = data[headerLen:]
+	}
+	msg.Data = bytes.Clone(data)
+
+	if c.recvTTL {
+		msg.TTL = c.parseTTL(oob)
+	}
+	if c.recvTimestamp {
+		if ts, ok := parseTimestamp(oob); ok {
+			msg.ReceivedAt = ts
+		}
+	}
+
+	return msg, nil
+}
+
+// parseTTL extracts the TTL or hop limit from the control messages of a read.
+func (c *ICMPConn) parseTTL(oob []byte) int {
+	if c.family == IPv6 {
+		var cm ipv6.ControlMessage
+		if err := cm.Parse(oob); err != nil {
+			return -1
+		}
+		return cm.HopLimit
+	}
+
+	var cm ipv4.ControlMessage
+	if err := cm.Parse(oob); err != nil {
+		return -1
+	}
+	return cm.TTL
+}
+
+// SetReadSize sets the size of the buffer messages are read into, MaxPacketSize by
+// default. Longer messages are truncated, which loses the end of the datagram they quote,
+// so links with jumbo frames may need a larger size. It must be between the size of an ICMP
+// header following an IPv4 one and MaxReadSize, and must not be changed while a read is
+// in progress.
+//
+// The buffers are reused across reads, and only the bytes of each message are copied out
+// of them into Message.Data.
+func (c *ICMPConn) SetReadSize(size int) error {
+	if minSize := ipv4.HeaderLen + icmpHeaderLen; size < minSize || size > MaxReadSize {
+		return fmt.Errorf("invalid read size %d: must be between %d and %d", size, minSize,
+			MaxReadSize)
+	}
+	c.readSize = size
+	return nil
+}
+
+// ReadSize returns the size of the buffer messages are read into.
+func (c *ICMPConn) ReadSize() int {
+	if c.readSize == 0 {
+		return MaxPacketSize
+	}
+	return c.readSize
+}
+
+// readBuffer holds the buffers of a read: one for the message and one for its control
+// messages.
+type readBuffer struct {
+	data []byte
+	oob  []byte
+}
+
+// getBuffer returns a buffer to read a message into, reusing one returned by putBuffer if
+// it still has the size set by SetReadSize.
+func (c *ICMPConn) getBuffer() *readBuffer {
+	size := c.ReadSize()
+	if buf, ok := c.buffers.Get().(*readBuffer); ok && len(buf.data) == size {
+		return buf
+	}
+	return &readBuffer{data: make([]byte, size), oob: make([]byte, oobSize)}
+}
+
+// putBuffer makes buf available to the next read once no slice of it is in use.
+func (c *ICMPConn) putBuffer(buf *readBuffer) {
+	c.buffers.Put(buf)
+}
+
+func readError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrReadTimeout
+	}
+	return fmt.Errorf("failed to read ICMP message: %w", err)
+}
+
+// SetTTL sets the Time to Live (TTL) for outgoing ICMP messages.
+//
+// On IPv6 connections the unicast hop limit is set instead.
+func (c *ICMPConn) SetTTL(ttl int) error {
+	if err := c.setTTL(ttl); err != nil {
+		return fmt.Errorf("failed to set TTL: %w", err)
+	}
+	return nil
+}
+
+// SetTOS sets the Type of Service byte (IPv6 traffic class) of outgoing ICMP messages.
+//
+// See UDPConn.SetTOS.
+func (c *ICMPConn) SetTOS(tos int) error {
+	rawConn, err := c.syscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to set TOS: %w", err)
+	}
+	return setTOS(rawConn, c.family, tos)
+}
+
+// MarshalEcho returns an ICMP Echo Request of the given family with the given identifier,
+// sequence number and payload, ready to be sent with ICMPConn.WriteTo.
+func MarshalEcho(family Family, id, seq int, payload []byte) ([]byte, error) {
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if family == IPv6 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: payload},
+	}
+	// The kernel computes the ICMPv6 checksum, so no pseudo-header is needed.
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ICMP Echo: %w", err)
+	}
+	return b, nil
+}
+
+// WriteTo sends msg, a marshalled ICMP message without IP header, to addr with the Time to
+// Live last set by SetTTL. Datagram listeners accept a *net.IPAddr as well.
+func (c *ICMPConn) WriteTo(msg []byte, addr net.Addr) error {
+	if ipAddr, ok := addr.(*net.IPAddr); ok && c.mode == DatagramICMP {
+		addr = &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+	}
+	if _, err := c.conn.WriteTo(msg, addr); err != nil {
+		return fmt.Errorf("failed to send ICMP message: %w", err)
+	}
+	return nil
+}
+
+// SendEcho sends an ICMP Echo Request with the given identifier, sequence number and
+// payload to addr, using ttl as its Time to Live.
+//
+// Routers answer with Time Exceeded quoting the request, so the identifier and sequence
+// number identify the probe a reply belongs to. It is safe to call concurrently.
+func (c *ICMPConn) SendEcho(addr *net.IPAddr, ttl, id, seq int, payload []byte) error {
+	b, err := MarshalEcho(c.family, id, seq, payload)
+	if err != nil {
+		return err
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if err := c.SetTTL(ttl); err != nil {
+		return err
+	}
+
+	return c.WriteTo(b, addr)
+}
+
+// Close closes the ICMP connection.
+func (c *ICMPConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,54 @@
+//go:build unix && !linux
+
+package network
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// datagramRewritesEchoID reports whether the kernel replaces the identifier of the Echo
+// Requests sent through a datagram socket with the port of the socket.
+const datagramRewritesEchoID = false
+
+// datagramPermissionHint follows the error of a datagram socket the process may not open.
+const datagramPermissionHint = ""
+
+// ipStripHeader is IP_STRIPHDR, which the syscall package does not define on macOS.
+const ipStripHeader = 0x17
+
+// prepareDatagramICMP makes macOS strip the IPv4 header of the messages read from the
+// datagram socket fd, like Linux and raw sockets do.
+func prepareDatagramICMP(fd int, family Family) error {
+	if runtime.GOOS != "darwin" || family != IPv4 {
+		return nil
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, ipStripHeader, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// readDatagram reads a message from the datagram socket, which receives the ICMP messages
+// the kernel passes to it along with their peers, as a raw socket would.
+func (c *ICMPConn) readDatagram() (*Message, error) {
+	buf := c.getBuffer()
+	defer c.putBuffer(buf)
+
+	n, oobn, _, peer, err := c.dgramConn.ReadMsgUDP(buf.data, buf.oob)
+	msg := &Message{TTL: -1, ReceivedAt: time.Now()}
+	if err != nil {
+		return nil, readError(err)
+	}
+	msg.Peer = peer.IP
+	msg.Data = bytes.Clone(buf.data[:n])
+
+	if c.recvTTL {
+		msg.TTL = c.parseTTL(buf.oob[:oobn])
+	}
+
+	return msg, nil
+}
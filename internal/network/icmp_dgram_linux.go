@@ -0,0 +1,243 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// datagramRewritesEchoID reports whether the kernel replaces the identifier of the Echo
+// Requests sent through a datagram socket with the port of the socket.
+const datagramRewritesEchoID = true
+
+// datagramPermissionHint follows the error of a datagram socket the process may not open.
+const datagramPermissionHint = " (the group of the process is not in net.ipv4.ping_group_range)"
+
+// soEEOriginICMP and soEEOriginICMP6 are the origins of errors reported by an ICMP or
+// ICMPv6 message (SO_EE_ORIGIN_ICMP and SO_EE_ORIGIN_ICMP6).
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// sockExtendedErr is struct sock_extended_err, which describes an error queued on a socket
+// with IP_RECVERR. The address of the router that sent the ICMP error follows it.
+type sockExtendedErr struct {
+	Errno  uint32
+	Origin uint8
+	Type   uint8
+	Code   uint8
+	Pad    uint8
+	Info   uint32
+	Data   uint32
+}
+
+// prepareDatagramICMP sets IP_RECVERR (IPV6_RECVERR) on the datagram socket fd. Linux does
+// not pass the ICMP errors caused by Echo Requests to datagram sockets otherwise.
+func prepareDatagramICMP(fd int, family Family) error {
+	level, opt := syscall.SOL_IP, syscall.IP_RECVERR
+	if family == IPv6 {
+		level, opt = syscall.SOL_IPV6, syscall.IPV6_RECVERR
+	}
+	if err := syscall.SetsockoptInt(fd, level, opt, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// readDatagram reads a message from the datagram socket: an Echo Reply, or an ICMP error
+// from its error queue, which is rebuilt as the router sent it. Errors not reported by
+// routers, such as local ones, are skipped.
+func (c *ICMPConn) readDatagram() (*Message, error) {
+	rawConn, err := c.dgramConn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get syscall conn: %w", err)
+	}
+
+	rbuf := c.getBuffer()
+	defer c.putBuffer(rbuf)
+	buf, oob := rbuf.data, rbuf.oob
+
+	for {
+		var (
+			n, oobn  int
+			from     syscall.Sockaddr
+			queued   bool
+			errQueue error
+		)
+		err := rawConn.Read(func(fd uintptr) bool {
+			n, oobn, from, queued, errQueue = recvDatagram(int(fd), buf, oob)
+			return !errors.Is(errQueue, syscall.EAGAIN)
+		})
+		receivedAt := time.Now()
+		if err == nil {
+			err = errQueue
+		}
+		if err != nil {
+			return nil, readError(err)
+		}
+
+		msg := &Message{TTL: -1, ReceivedAt: receivedAt}
+		if c.recvTimestamp {
+			if ts, ok := parseTimestamp(oob[:oobn]); ok {
+				msg.ReceivedAt = ts
+			}
+		}
+
+		if !queued {
+			msg.Peer = sockaddrIP(from)
+			msg.Data = bytes.Clone(buf[:n])
+			if c.recvTTL {
+				msg.TTL = c.parseTTL(oob[:oobn])
+			}
+			return msg, nil
+		}
+
+		peer, data, ok := parseErrQueue(c.family, buf[:n], oob[:oobn], sockaddrIP(from))
+		if !ok {
+			continue
+		}
+		msg.Peer, msg.Data = peer, data
+		return msg, nil
+	}
+}
+
+// recvDatagram reads the next message from the error queue of the socket fd, or the next
+// datagram if the error queue is empty. queued reports which one was read.
+func recvDatagram(fd int, buf, oob []byte) (n, oobn int, from syscall.Sockaddr, queued bool,
+	err error) {
+	const flags = syscall.MSG_DONTWAIT
+	// A pending error is also reported once by a regular read, so drain the error queue
+	// first and try it again if that happened.
+	for i := 0; i < 2; i++ {
+		n, oobn, _, from, err = syscall.Recvmsg(fd, buf, oob, flags|syscall.MSG_ERRQUEUE)
+		if err == nil {
+			return n, oobn, from, true, nil
+		}
+		n, oobn, _, from, err = syscall.Recvmsg(fd, buf, oob, flags)
+		if err == nil || errors.Is(err, syscall.EAGAIN) {
+			return n, oobn, from, false, err
+		}
+	}
+	return 0, 0, nil, false, err
+}
+
+// sockaddrIP returns the address of sa, or nil if it is not an IP address.
+func sockaddrIP(sa syscall.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(append([]byte(nil), sa.Addr[:]...))
+	case *syscall.SockaddrInet6:
+		return net.IP(append([]byte(nil), sa.Addr[:]...))
+	default:
+		return nil
+	}
+}
+
+// parseErrQueue rebuilds the ICMP error message a router sent in response to an Echo
+// Request to dst, from the quoted Echo Request in data and the control messages in oob of
+// a read from the error queue. It returns the address of the router and the message, or
+// false if the error was not reported by an ICMP message.
+func parseErrQueue(family Family, data, oob []byte, dst net.IP) (net.IP, []byte, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	for _, m := range msgs {
+		isV4 := m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVERR
+		isV6 := m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == syscall.IPV6_RECVERR
+		if !isV4 && !isV6 {
+			continue
+		}
+
+		var ee sockExtendedErr
+		eeLen := int(unsafe.Sizeof(ee))
+		if len(m.Data) < eeLen {
+			return nil, nil, false
+		}
+		ee = *(*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+
+		offender := m.Data[eeLen:]
+		switch {
+		case family == IPv4 && ee.Origin == soEEOriginICMP:
+			var sa syscall.RawSockaddrInet4
+			if len(offender) < int(unsafe.Sizeof(sa)) {
+				return nil, nil, false
+			}
+			sa = *(*syscall.RawSockaddrInet4)(unsafe.Pointer(&offender[0]))
+			peer := net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3])
+			return peer, rebuildICMPv4Error(ee, dst, data), true
+		case family == IPv6 && ee.Origin == soEEOriginICMP6:
+			var sa syscall.RawSockaddrInet6
+			if len(offender) < int(unsafe.Sizeof(sa)) {
+				return nil, nil, false
+			}
+			sa = *(*syscall.RawSockaddrInet6)(unsafe.Pointer(&offender[0]))
+			peer := net.IP(append([]byte(nil), sa.Addr[:]...))
+			return peer, rebuildICMPv6Error(ee, dst, data), true
+		default:
+			return nil, nil, false
+		}
+	}
+
+	return nil, nil, false
+}
+
+// rebuildICMPv4Error returns the ICMP error described by ee quoting an IPv4 header to dst
+// and data, the Echo Request as the router quoted it.
+func rebuildICMPv4Error(ee sockExtendedErr, dst net.IP, data []byte) []byte {
+	msg := make([]byte, 8+ipv4.HeaderLen+len(data))
+	msg[0], msg[1] = ee.Type, ee.Code
+
+	switch {
+	case int(ee.Type) == int(ipv4.ICMPTypeDestinationUnreachable) &&
+		unreachableV4(int(ee.Code)) == UnreachableFragmentation:
+		binary.BigEndian.PutUint16(msg[6:8], uint16(ee.Info))
+	case int(ee.Type) == int(ipv4.ICMPTypeParameterProblem):
+		msg[4] = byte(ee.Info)
+	}
+
+	quoted := msg[8:]
+	quoted[0] = ipv4.Version<<4 | ipv4.HeaderLen>>2
+	binary.BigEndian.PutUint16(quoted[2:4], uint16(ipv4.HeaderLen+len(data)))
+	quoted[8] = 1
+	quoted[9] = protocolICMP
+	copy(quoted[16:20], dst.To4())
+	binary.BigEndian.PutUint16(quoted[10:12], internetChecksum(0, quoted[:ipv4.HeaderLen]))
+	copy(quoted[ipv4.HeaderLen:], data)
+
+	binary.BigEndian.PutUint16(msg[2:4], internetChecksum(0, msg))
+	return msg
+}
+
+// rebuildICMPv6Error returns the ICMPv6 error described by ee quoting an IPv6 header to dst
+// and data. Its checksum is left out since it covers the local address.
+func rebuildICMPv6Error(ee sockExtendedErr, dst net.IP, data []byte) []byte {
+	msg := make([]byte, 8+ipv6.HeaderLen+len(data))
+	msg[0], msg[1] = ee.Type, ee.Code
+
+	switch int(ee.Type) {
+	case int(ipv6.ICMPTypePacketTooBig), int(ipv6.ICMPTypeParameterProblem):
+		binary.BigEndian.PutUint32(msg[4:8], ee.Info)
+	}
+
+	quoted := msg[8:]
+	quoted[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(quoted[4:6], uint16(len(data)))
+	quoted[6] = protocolICMPv6
+	quoted[7] = 1
+	copy(quoted[24:40], dst.To16())
+	copy(quoted[ipv6.HeaderLen:], data)
+
+	return msg
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func newTestDatagramICMPConn(t *testing.T) *ICMPConn {
+	t.Helper()
+
+	conn, err := newDatagramICMPConn(IPv4, AllInterfaces)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("datagram ICMP sockets are not allowed by net.ipv4.ping_group_range")
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestDatagramICMPConnEchoLoopback(t *testing.T) {
+	conn := newTestDatagramICMPConn(t)
+	assert.Equal(t, DatagramICMP, conn.Mode())
+
+	id := conn.EchoID(0x4245)
+	assert.Equal(t, conn.dgramConn.LocalAddr().(*net.UDPAddr).Port, id)
+
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	require.NoError(t, conn.SendEcho(dst, 64, 0x4245, 1, []byte("ping")))
+
+	ip, data, _, err := conn.ReadWithTimeout(time.Second)
+	require.NoError(t, err)
+
+	assert.True(t, ip.Equal(dst.IP))
+	parsed, err := ParseICMPWithOptions(IPv4, data, ParseOptions{VerifyChecksum: true})
+	require.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeEchoReply, parsed.Type)
+	assert.True(t, parsed.MatchesEcho(id, 1))
+}
+
+func TestNewICMPConnFallsBackToDatagram(t *testing.T) {
+	original := listenPacket
+	t.Cleanup(func() { listenPacket = original })
+	listenPacket = func(string, string) (net.PacketConn, error) {
+		return nil, &net.OpError{Op: "listen", Err: os.NewSyscallError("socket", syscall.EPERM)}
+	}
+
+	conn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("datagram ICMP sockets are not allowed by net.ipv4.ping_group_range")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, DatagramICMP, conn.Mode())
+}
+
+func TestNewUnprivilegedICMPConn(t *testing.T) {
+	conn, err := NewUnprivilegedICMPConn(IPv4)
+	if err != nil {
+		assert.ErrorIs(t, err, os.ErrPermission)
+		assert.ErrorContains(t, err, "net.ipv4.ping_group_range")
+		t.Skip("datagram ICMP sockets are not allowed by net.ipv4.ping_group_range")
+	}
+	defer conn.Close()
+
+	assert.Equal(t, DatagramICMP, conn.Mode())
+	assert.Equal(t, IPv4, conn.Family())
+}
+
+// errQueueControl returns the control message of a read from the error queue describing
+// ee, reported by the router at the raw socket address offender.
+func errQueueControl(level, typ int, ee sockExtendedErr, offender []byte) []byte {
+	data := append(unsafe.Slice((*byte)(unsafe.Pointer(&ee)), unsafe.Sizeof(ee)), offender...)
+
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = int32(level), int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestParseErrQueueTimeExceeded(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	quoted, err := MarshalEcho(IPv4, 0x4245, 3, nil)
+	require.NoError(t, err)
+
+	sa := syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: [4]byte{192, 0, 2, 1}}
+	oob := errQueueControl(syscall.SOL_IP, syscall.IP_RECVERR, sockExtendedErr{
+		Errno:  uint32(syscall.EHOSTUNREACH),
+		Origin: soEEOriginICMP,
+		Type:   uint8(ipv4.ICMPTypeTimeExceeded),
+	}, (*[unsafe.Sizeof(sa)]byte)(unsafe.Pointer(&sa))[:])
+
+	peer, data, ok := parseErrQueue(IPv4, quoted, oob, dst)
+	require.True(t, ok)
+
+	assert.True(t, peer.Equal(net.IPv4(192, 0, 2, 1)))
+	parsed, err := ParseICMPWithOptions(IPv4, data, ParseOptions{VerifyChecksum: true})
+	require.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeTimeExceeded, parsed.Type)
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+	assert.Equal(t, 1, parsed.QuotedTTL())
+	assert.Equal(t, 0x4245, parsed.Key.EchoID)
+	assert.Equal(t, 3, parsed.Key.EchoSeq)
+}
+
+func TestParseErrQueueFragmentationNeeded(t *testing.T) {
+	quoted, err := MarshalEcho(IPv4, 1, 1, nil)
+	require.NoError(t, err)
+
+	sa := syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: [4]byte{192, 0, 2, 1}}
+	oob := errQueueControl(syscall.SOL_IP, syscall.IP_RECVERR, sockExtendedErr{
+		Errno:  uint32(syscall.EMSGSIZE),
+		Origin: soEEOriginICMP,
+		Type:   uint8(ipv4.ICMPTypeDestinationUnreachable),
+		Code:   4,
+		Info:   1400,
+	}, (*[unsafe.Sizeof(sa)]byte)(unsafe.Pointer(&sa))[:])
+
+	_, data, ok := parseErrQueue(IPv4, quoted, oob, net.IPv4(198, 51, 100, 7))
+	require.True(t, ok)
+
+	parsed, err := ParseICMP(IPv4, data)
+	require.NoError(t, err)
+	assert.Equal(t, 1400, parsed.MTU)
+}
+
+func TestParseErrQueueIPv6(t *testing.T) {
+	dst := net.ParseIP("2001:db8::7")
+	quoted, err := MarshalEcho(IPv6, 0x4245, 3, nil)
+	require.NoError(t, err)
+
+	sa := syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	copy(sa.Addr[:], net.ParseIP("2001:db8::1"))
+	oob := errQueueControl(syscall.SOL_IPV6, syscall.IPV6_RECVERR, sockExtendedErr{
+		Errno:  uint32(syscall.EHOSTUNREACH),
+		Origin: soEEOriginICMP6,
+		Type:   uint8(ipv6.ICMPTypeTimeExceeded),
+	}, (*[unsafe.Sizeof(sa)]byte)(unsafe.Pointer(&sa))[:])
+
+	peer, data, ok := parseErrQueue(IPv6, quoted, oob, dst)
+	require.True(t, ok)
+
+	assert.True(t, peer.Equal(net.ParseIP("2001:db8::1")))
+	parsed, err := ParseICMP(IPv6, data)
+	require.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypeTimeExceeded, parsed.Type)
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+	assert.Equal(t, 0x4245, parsed.Key.EchoID)
+}
+
+func TestParseErrQueueLocalError(t *testing.T) {
+	oob := errQueueControl(syscall.SOL_IP, syscall.IP_RECVERR, sockExtendedErr{
+		Errno:  uint32(syscall.EMSGSIZE),
+		Origin: 1,
+	}, make([]byte, syscall.SizeofSockaddrInet4))
+
+	_, _, ok := parseErrQueue(IPv4, nil, oob, net.IPv4(198, 51, 100, 7))
+
+	assert.False(t, ok)
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package network
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenDatagramICMP opens an unprivileged ICMP datagram socket bound to local, the way
+// ping does. Linux only allows it for the groups in net.ipv4.ping_group_range.
+func listenDatagramICMP(family Family, local net.IP) (*net.UDPConn, error) {
+	domain, proto := syscall.AF_INET, protocolICMP
+	var sa syscall.Sockaddr
+	if family == IPv6 {
+		domain, proto = syscall.AF_INET6, protocolICMPv6
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], local.To16())
+		sa = sa6
+	} else {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], local.To4())
+		sa = sa4
+	}
+
+	fd, err := syscall.Socket(domain, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	if err := prepareDatagramICMP(fd, family); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	// FilePacketConn duplicates the descriptor, so the file is closed either way.
+	f := os.NewFile(uintptr(fd), "icmp")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,21 @@
+package network
+
+import (
+	"errors"
+	"net"
+)
+
+// datagramRewritesEchoID reports whether the kernel replaces the identifier of the Echo
+// Requests sent through a datagram socket with the port of the socket.
+const datagramRewritesEchoID = false
+
+// datagramPermissionHint follows the error of a datagram socket the process may not open.
+const datagramPermissionHint = ""
+
+func listenDatagramICMP(_ Family, _ net.IP) (*net.UDPConn, error) {
+	return nil, errors.New("datagram ICMP sockets are not supported on windows")
+}
+
+func (c *ICMPConn) readDatagram() (*Message, error) {
+	return nil, errors.New("failed to read ICMP message: datagram sockets are not supported")
+}
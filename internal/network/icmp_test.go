@@ -0,0 +1,548 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type MockICMPPacketConn struct {
+	mock.Mock
+}
+
+func (m *MockICMPPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	args := m.Called(b)
+	if data, ok := args.Get(0).([]byte); ok {
+		copy(b, data)
+		return len(data), addrArg(args.Get(1)), args.Error(2)
+	}
+	return 0, addrArg(args.Get(1)), args.Error(2)
+}
+
+func (m *MockICMPPacketConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	args := m.Called(b, dst)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockICMPPacketConn) SetReadDeadline(t time.Time) error {
+	args := m.Called(t)
+	return args.Error(0)
+}
+
+func (m *MockICMPPacketConn) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func addrArg(v interface{}) net.Addr {
+	if v == nil {
+		return nil
+	}
+	return v.(net.Addr)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestNewICMPConn(t *testing.T) {
+	for _, family := range []Family{IPv4, IPv6} {
+		conn, err := NewICMPConn(family)
+		if err != nil && errors.Is(err, os.ErrPermission) {
+			t.Skip("raw ICMP sockets require elevated privileges")
+		}
+
+		assert.NoError(t, err)
+		assert.NotNil(t, conn)
+		assert.Equal(t, family, conn.Family())
+		assert.NoError(t, conn.Close())
+	}
+}
+
+func TestNewICMPv6Conn(t *testing.T) {
+	conn, err := NewICMPv6Conn()
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, IPv6, conn.Family())
+	assert.NoError(t, conn.Close())
+}
+
+func TestNewICMPConnUnsupportedFamily(t *testing.T) {
+	conn, err := NewICMPConn(Family(42))
+
+	assert.Error(t, err)
+	assert.Nil(t, conn)
+}
+
+func TestNewUnprivilegedICMPConnUnsupportedFamily(t *testing.T) {
+	conn, err := NewUnprivilegedICMPConn(Family(42))
+
+	assert.ErrorContains(t, err, "unsupported address family")
+	assert.Nil(t, conn)
+}
+
+func TestNewICMPConnFrom(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	peer := &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	mockConn.On("ReadFrom", mock.Anything).Return([]byte{11, 0, 0, 0}, peer, nil)
+	mockConn.On("Close").Return(nil)
+
+	conn, err := NewICMPConnFrom(IPv4, mockConn)
+	require.NoError(t, err)
+	assert.Equal(t, IPv4, conn.Family())
+	assert.Equal(t, RawICMP, conn.Mode())
+
+	msg, err := conn.ReadMessage(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []byte{11, 0, 0, 0}, msg.Data)
+	assert.Error(t, conn.SetTTL(1), "the TTL of an unknown connection cannot be set")
+
+	assert.NoError(t, conn.Close())
+	mockConn.AssertExpectations(t)
+}
+
+func TestNewICMPConnFromUnsupported(t *testing.T) {
+	_, err := NewICMPConnFrom(Family(42), new(MockICMPPacketConn))
+	assert.Error(t, err)
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer udpConn.Close()
+
+	_, err = NewICMPConnFrom(IPv4, udpConn)
+	assert.ErrorContains(t, err, "datagram ICMP sockets are not supported")
+}
+
+func TestNewICMPConnFromLoopback(t *testing.T) {
+	ipConn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil && errors.Is(permissionError(err), os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+
+	conn, err := NewICMPConnFrom(IPv4, ipConn.(*net.IPConn))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.EnableReceiveTTL(), "a raw socket supports control messages")
+	require.NoError(t, conn.SendEcho(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 64, 0x4244, 1,
+		nil))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		_, data, ttl, err := conn.ReadWithTimeout(time.Until(deadline))
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(IPv4, data)
+		if err == nil && parsed.MatchesEcho(0x4244, 1) {
+			assert.Greater(t, ttl, 0)
+			return
+		}
+	}
+	t.Fatal("no Echo Reply received")
+}
+
+func TestNewICMPConnFromPacketConn(t *testing.T) {
+	packetConn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil && errors.Is(permissionError(err), os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer packetConn.Close()
+
+	_, err = NewICMPConnFrom(IPv6, packetConn)
+	assert.ErrorContains(t, err, "does not listen for IPv6")
+
+	conn, err := NewICMPConnFrom(IPv4, packetConn)
+	require.NoError(t, err)
+	assert.NoError(t, conn.SetTTL(5))
+	assert.Error(t, conn.EnableReceiveTTL(), "control messages require a *net.IPConn")
+}
+
+func TestICMPConnReadWithTimeout(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	payload := []byte{11, 0, 0, 0}
+	peer := &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}
+
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	mockConn.On("ReadFrom", mock.Anything).Return(payload, peer, nil)
+
+	conn := &ICMPConn{conn: mockConn}
+	ip, data, ttl, err := conn.ReadWithTimeout(time.Second)
+
+	assert.NoError(t, err)
+	assert.True(t, ip.Equal(peer.IP))
+	assert.Equal(t, payload, data)
+	assert.Equal(t, -1, ttl, "the TTL is unknown unless receiving it is enabled")
+	mockConn.AssertExpectations(t)
+}
+
+func TestICMPConnReadCopiesMessages(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	peer := &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}
+
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	mockConn.On("ReadFrom", mock.Anything).Return([]byte{11, 0, 1, 1}, peer, nil).Once()
+	mockConn.On("ReadFrom", mock.Anything).Return([]byte{3, 3, 2, 2}, peer, nil).Once()
+
+	conn := &ICMPConn{conn: mockConn}
+	first, err := conn.ReadMessage(context.Background())
+	require.NoError(t, err)
+	second, err := conn.ReadMessage(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{11, 0, 1, 1}, first.Data, "reusing buffers must not clobber messages")
+	assert.Equal(t, []byte{3, 3, 2, 2}, second.Data)
+	assert.Less(t, cap(first.Data), MaxPacketSize, "only the message is kept")
+}
+
+func TestICMPConnSetReadSize(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	peer := &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}
+
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	mockConn.On("ReadFrom", mock.MatchedBy(func(b []byte) bool { return len(b) == 9000 })).
+		Return([]byte{11, 0, 0, 0}, peer, nil)
+
+	conn := &ICMPConn{conn: mockConn}
+	assert.Equal(t, MaxPacketSize, conn.ReadSize())
+
+	assert.Error(t, conn.SetReadSize(27))
+	assert.Error(t, conn.SetReadSize(MaxReadSize+1))
+	assert.Equal(t, MaxPacketSize, conn.ReadSize())
+
+	require.NoError(t, conn.SetReadSize(9000))
+	assert.Equal(t, 9000, conn.ReadSize())
+
+	_, err := conn.ReadMessage(context.Background())
+	require.NoError(t, err)
+	mockConn.AssertExpectations(t)
+}
+
+func TestICMPConnReadWithTimeoutDatagramPeer(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}
+
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	mockConn.On("ReadFrom", mock.Anything).Return([]byte{0, 0, 0, 0}, peer, nil)
+
+	conn := &ICMPConn{conn: mockConn}
+	ip, _, _, err := conn.ReadWithTimeout(time.Second)
+
+	assert.NoError(t, err)
+	assert.True(t, ip.Equal(peer.IP))
+}
+
+func TestICMPConnReadWithTimeoutExpired(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	mockConn.On("ReadFrom", mock.Anything).Return(nil, nil, timeoutError{})
+
+	conn := &ICMPConn{conn: mockConn}
+	_, _, _, err := conn.ReadWithTimeout(time.Millisecond)
+
+	assert.ErrorIs(t, err, ErrReadTimeout)
+}
+
+func newIdleConn(t *testing.T) *ICMPConn {
+	t.Helper()
+
+	// A UDP socket nobody writes to behaves like an ICMP listener that never receives.
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &ICMPConn{conn: conn}
+}
+
+func TestICMPConnReadMessage(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	payload := []byte{11, 0, 0, 0}
+	peer := &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}
+
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	mockConn.On("ReadFrom", mock.Anything).Return(payload, peer, nil)
+
+	conn := &ICMPConn{conn: mockConn}
+	before := time.Now()
+	msg, err := conn.ReadMessage(context.Background())
+
+	require.NoError(t, err)
+	assert.True(t, msg.Peer.Equal(peer.IP))
+	assert.Equal(t, payload, msg.Data)
+	assert.Equal(t, -1, msg.TTL)
+	assert.False(t, msg.ReceivedAt.Before(before))
+}
+
+func TestICMPConnReceive(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	dst := net.IPv4(198, 51, 100, 7)
+	peer := &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}
+
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	mockConn.On("ReadFrom", mock.Anything).Return(buildTimeExceeded(t, dst), peer, nil).Once()
+	mockConn.On("ReadFrom", mock.Anything).Return([]byte{11}, peer, nil).Once()
+
+	conn := &ICMPConn{conn: mockConn, family: IPv4}
+	reply, err := conn.Receive(time.Second)
+
+	require.NoError(t, err)
+	assert.True(t, reply.Peer.Equal(peer.IP))
+	require.NotNil(t, reply.ICMP)
+	assert.Equal(t, ipv4.ICMPTypeTimeExceeded, reply.ICMP.Type)
+	assert.True(t, reply.ICMP.Header.Dst.Equal(dst))
+
+	reply, err = conn.Receive(time.Second)
+	assert.Error(t, err, "the message does not parse")
+	assert.Equal(t, []byte{11}, reply.Data)
+	assert.Nil(t, reply.ICMP)
+}
+
+func TestICMPConnReceiveTimeout(t *testing.T) {
+	conn := newIdleConn(t)
+
+	_, err := conn.Receive(20 * time.Millisecond)
+
+	assert.ErrorIs(t, err, ErrReadTimeout)
+}
+
+func TestICMPConnReadMessageCancel(t *testing.T) {
+	conn := newIdleConn(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := conn.ReadMessage(ctx)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotErrorIs(t, err, ErrReadTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestICMPConnReadMessageDeadline(t *testing.T) {
+	conn := newIdleConn(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := conn.ReadMessage(ctx)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestICMPConnReadMessageAlreadyDone(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	conn := &ICMPConn{conn: mockConn}
+	_, err := conn.ReadMessage(ctx)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	mockConn.AssertNotCalled(t, "ReadFrom", mock.Anything)
+}
+
+func TestICMPConnReadWithTimeoutIdle(t *testing.T) {
+	conn := newIdleConn(t)
+
+	_, _, _, err := conn.ReadWithTimeout(20 * time.Millisecond)
+
+	assert.ErrorIs(t, err, ErrReadTimeout)
+	assert.NotErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestICMPConnSendEcho(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	dst := &net.IPAddr{IP: net.IPv4(198, 51, 100, 7)}
+
+	var sent []byte
+	mockConn.On("WriteTo", mock.Anything, dst).Run(func(args mock.Arguments) {
+		sent = args.Get(0).([]byte)
+	}).Return(16, nil)
+
+	var ttl int
+	conn := &ICMPConn{
+		conn:   mockConn,
+		family: IPv4,
+		setTTL: func(v int) error { ttl = v; return nil },
+	}
+
+	err := conn.SendEcho(dst, 5, 0x1234, 7, []byte("probe"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, ttl)
+
+	msg, err := icmp.ParseMessage(protocolICMP, sent)
+	require.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeEcho, msg.Type)
+	assert.Equal(t, &icmp.Echo{ID: 0x1234, Seq: 7, Data: []byte("probe")}, msg.Body)
+}
+
+func TestICMPConnSendEchoTTLFailure(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	conn := &ICMPConn{
+		conn:   mockConn,
+		family: IPv6,
+		setTTL: func(int) error { return errors.New("boom") },
+	}
+
+	err := conn.SendEcho(&net.IPAddr{IP: net.IPv6loopback}, 1, 1, 1, nil)
+
+	assert.Error(t, err)
+	mockConn.AssertNotCalled(t, "WriteTo", mock.Anything, mock.Anything)
+}
+
+func TestICMPConnSendEchoLoopback(t *testing.T) {
+	conn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	require.NoError(t, conn.SendEcho(dst, 64, 0x4242, 1, []byte("ping")))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		_, data, _, err := conn.ReadWithTimeout(time.Until(deadline))
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(IPv4, data)
+		if err == nil && parsed.Type == ipv4.ICMPTypeEchoReply {
+			return
+		}
+	}
+	t.Fatal("no Echo Reply received")
+}
+
+func TestMarshalEcho(t *testing.T) {
+	b, err := MarshalEcho(IPv6, 0x1234, 7, []byte("probe"))
+	require.NoError(t, err)
+
+	msg, err := icmp.ParseMessage(protocolICMPv6, b)
+	require.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypeEchoRequest, msg.Type)
+	assert.Equal(t, &icmp.Echo{ID: 0x1234, Seq: 7, Data: []byte("probe")}, msg.Body)
+}
+
+func TestICMPConnWriteToFailure(t *testing.T) {
+	mockConn := new(MockICMPPacketConn)
+	dst := &net.IPAddr{IP: net.IPv4(198, 51, 100, 7)}
+	mockConn.On("WriteTo", []byte{1, 2}, dst).Return(0, errors.New("boom"))
+
+	conn := &ICMPConn{conn: mockConn, family: IPv4}
+
+	err := conn.WriteTo([]byte{1, 2}, dst)
+
+	assert.ErrorContains(t, err, "failed to send ICMP message")
+}
+
+func TestICMPConnEnableReceiveTTLUnsupported(t *testing.T) {
+	conn := &ICMPConn{conn: new(MockICMPPacketConn)}
+
+	assert.Error(t, conn.EnableReceiveTTL())
+}
+
+func TestICMPConnEnableTimestampsUnsupported(t *testing.T) {
+	conn := &ICMPConn{conn: new(MockICMPPacketConn)}
+
+	assert.Error(t, conn.EnableTimestamps())
+}
+
+func TestICMPConnReadSizeLoopback(t *testing.T) {
+	conn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Loopback carries packets larger than MaxPacketSize, like links with jumbo frames.
+	payload := bytes.Repeat([]byte{0x42}, 4000)
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	readEcho := func(seq int) []byte {
+		require.NoError(t, conn.SendEcho(dst, 64, 0x4244, seq, payload))
+
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			_, data, _, err := conn.ReadWithTimeout(time.Until(deadline))
+			require.NoError(t, err)
+
+			msg, err := icmp.ParseMessage(protocolICMP, data)
+			if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+				continue
+			}
+			if echo, ok := msg.Body.(*icmp.Echo); ok && echo.ID == 0x4244 && echo.Seq == seq {
+				return data
+			}
+		}
+		t.Fatal("no Echo Reply received")
+		return nil
+	}
+
+	assert.Less(t, len(readEcho(1)), len(payload), "replies are truncated by default")
+
+	require.NoError(t, conn.SetReadSize(9000))
+	assert.Len(t, readEcho(2), icmpHeaderLen+len(payload))
+}
+
+func TestICMPConnReceiveTTLLoopback(t *testing.T) {
+	for _, family := range []Family{IPv4, IPv6} {
+		t.Run(family.String(), func(t *testing.T) {
+			testICMPConnReceiveTTLLoopback(t, family)
+		})
+	}
+}
+
+func testICMPConnReceiveTTLLoopback(t *testing.T, family Family) {
+	conn, err := NewICMPConn(family)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.EnableReceiveTTL())
+
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if family == IPv6 {
+		dst = &net.IPAddr{IP: net.IPv6loopback}
+	}
+	require.NoError(t, conn.SendEcho(dst, 64, 0x4243, 1, nil))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		_, data, ttl, err := conn.ReadWithTimeout(time.Until(deadline))
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(family, data)
+		if err == nil && parsed.MatchesEcho(0x4243, 1) {
+			// The kernel answers loopback pings with its default TTL, unchanged on the way.
+			assert.Greater(t, ttl, 0)
+			return
+		}
+	}
+	t.Fatal("no Echo Reply received")
+}
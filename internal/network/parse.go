@@ -0,0 +1,710 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP   = 1
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+
+	udpHeaderLen  = 8
+	icmpHeaderLen = 8
+)
+
+// ErrBadChecksum is returned when the checksum of a received ICMP message does not match
+// its contents.
+var ErrBadChecksum = errors.New("bad ICMP checksum")
+
+// ErrForeignEcho is returned when an Echo Reply, or an error quoting an Echo Request, has
+// another identifier than the one ParseOptions.EchoID filters on.
+var ErrForeignEcho = errors.New("ICMP Echo with a foreign identifier")
+
+// ParseOptions configures ParseICMPWithOptions.
+type ParseOptions struct {
+	// VerifyChecksum recomputes the ICMP checksum and rejects messages whose checksum does
+	// not match with ErrBadChecksum.
+	VerifyChecksum bool
+	// Src and Dst are the source and destination addresses of an ICMPv6 message, which its
+	// checksum covers through the pseudo-header. ICMPv6 checksums are only verified when
+	// both are set; the kernel already verifies them on raw ICMPv6 sockets.
+	Src net.IP
+	Dst net.IP
+	// FilterEchoID rejects Echo Replies whose identifier is not EchoID, and errors quoting
+	// such Echo Requests, with ErrForeignEcho, so that a raw listener, which receives the
+	// ICMP traffic of every process on the host, discards the replies to other pings and
+	// traceroutes. Errors quoting an Echo Request without its identifier are kept.
+	FilterEchoID bool
+	EchoID       int
+}
+
+// ProbeKey identifies the probe quoted in an ICMP error message.
+//
+// Protocol is the transport protocol of the quoted probe. The ports are taken from its UDP
+// or TCP header, the checksum from its UDP header and the Echo identifier and sequence
+// number from its ICMP Echo header; they are zero when the router did not quote the
+// transport header. ID is the IPv4 identification field and is always zero for IPv6 probes.
+type ProbeKey struct {
+	Protocol int
+	SrcPort  int
+	DstPort  int
+	Checksum int
+	EchoID   int
+	EchoSeq  int
+	ID       int
+}
+
+// UDPHeader is the UDP header of a probe quoted in an ICMP error message.
+type UDPHeader struct {
+	SrcPort int
+	DstPort int
+	// Length is the length of the UDP header and payload the probe was sent with.
+	Length int
+}
+
+// MPLSLabel is an MPLS label stack entry reported by a router in an ICMP extension
+// (RFC 4950).
+type MPLSLabel struct {
+	// Label is the 20-bit label value.
+	Label int
+	// TC is the traffic class, formerly the experimental (EXP) field.
+	TC int
+	// S is set on the entry at the bottom of the label stack.
+	S bool
+	// TTL is the time to live of the label stack entry.
+	TTL int
+}
+
+// String formats the entry the way traceroute prints it, e.g. "L=24015, E=0, S=1, T=1".
+func (l MPLSLabel) String() string {
+	s := 0
+	if l.S {
+		s = 1
+	}
+	return fmt.Sprintf("L=%d, E=%d, S=%d, T=%d", l.Label, l.TC, s, l.TTL)
+}
+
+// InterfaceRole identifies which interface of a router an InterfaceInfo describes
+// (RFC 5837).
+type InterfaceRole int
+
+const (
+	// IncomingInterface is the interface the probe arrived on.
+	IncomingInterface InterfaceRole = iota
+	// SubIPComponent is the sub-IP component of the interface the probe arrived on.
+	SubIPComponent
+	// OutgoingInterface is the interface the probe would have been forwarded on.
+	OutgoingInterface
+	// NextHop is the IP next hop the probe would have been forwarded to.
+	NextHop
+)
+
+// InterfaceInfo identifies a router interface reported in an ICMP extension (RFC 5837).
+//
+// Every field is optional; routers decide which of them they reveal.
+type InterfaceInfo struct {
+	Role  InterfaceRole
+	Index int
+	Name  string
+	MTU   int
+	IP    net.IP
+}
+
+// ParsedICMP is an ICMP message received in response to a probe.
+type ParsedICMP struct {
+	// Type is the ICMP or ICMPv6 message type.
+	Type icmp.Type
+	// Code is the message code, e.g. 3 (port unreachable) for Destination Unreachable.
+	Code int
+	// Pointer is the offset of the offending octet in the quoted datagram of a Parameter
+	// Problem message. It is zero for any other message.
+	Pointer int
+	// MTU is the MTU of the next hop reported by a Fragmentation Needed (ICMPv6 Packet Too
+	// Big) message. It is zero for any other message and when the router did not report it,
+	// as routers predating RFC 1191 do.
+	MTU int
+	// Header is the embedded IPv4 header of the quoted probe, if the message quotes one.
+	Header *ipv4.Header
+	// HeaderV6 is the embedded IPv6 header of the quoted probe, if the message quotes one.
+	HeaderV6 *ipv6.Header
+	// Key identifies the quoted probe, if the message quotes one.
+	Key *ProbeKey
+	// Echo is the body of an Echo Reply, holding the identifier and sequence number of the
+	// Echo Request it answers.
+	Echo *icmp.Echo
+	// UDP is the UDP header of the quoted probe. It is nil unless the probe was a UDP
+	// datagram and the router quoted its full header.
+	UDP *UDPHeader
+	// MPLS holds the label stack the probe was traveling in, if the router appended an
+	// MPLS extension object to the message.
+	MPLS []MPLSLabel
+	// Interface identifies the router interface that received the probe, if the router
+	// appended an interface information object to the message.
+	Interface *InterfaceInfo
+}
+
+// QuotedDst returns the destination address of the quoted probe, or nil if the message
+// does not quote one.
+func (p *ParsedICMP) QuotedDst() net.IP {
+	switch {
+	case p.Header != nil:
+		return p.Header.Dst
+	case p.HeaderV6 != nil:
+		return p.HeaderV6.Dst
+	default:
+		return nil
+	}
+}
+
+// QuotedTOS returns the TOS byte (IPv6 traffic class) of the quoted probe as the router
+// received it, or -1 if the message does not quote one. Comparing its ECN bits with those
+// the probe was sent with reveals routers that clear them.
+func (p *ParsedICMP) QuotedTOS() int {
+	switch {
+	case p.Header != nil:
+		return p.Header.TOS
+	case p.HeaderV6 != nil:
+		return p.HeaderV6.TrafficClass
+	default:
+		return -1
+	}
+}
+
+// QuotedID returns the IPv4 Identification of the quoted probe as the router received it,
+// or -1 if the message quotes no IPv4 header. A value other than the one the probe was sent
+// with means a NAT before the router rewrote the probe.
+func (p *ParsedICMP) QuotedID() int {
+	if p.Header == nil {
+		return -1
+	}
+	return p.Header.ID
+}
+
+// QuotedTTL returns the TTL (IPv6 hop limit) of the quoted probe as the router received
+// it, or -1 if the message does not quote one.
+//
+// A router answering with Time Exceeded received the probe with a TTL of 1, or 0 if it
+// quotes the probe after decrementing the TTL. A probe quoted by its destination arrived
+// with the TTL it was sent with less the number of routers it passed.
+func (p *ParsedICMP) QuotedTTL() int {
+	switch {
+	case p.Header != nil:
+		return p.Header.TTL
+	case p.HeaderV6 != nil:
+		return p.HeaderV6.HopLimit
+	default:
+		return -1
+	}
+}
+
+// Unreachable classifies the reason given by a Destination Unreachable message.
+type Unreachable int
+
+const (
+	// NotUnreachable is reported for messages other than Destination Unreachable.
+	NotUnreachable Unreachable = iota
+	// UnreachableNet means no route to the destination network exists.
+	UnreachableNet
+	// UnreachableHost means the destination host cannot be reached.
+	UnreachableHost
+	// UnreachableProtocol means the destination does not support the probe's protocol.
+	UnreachableProtocol
+	// UnreachablePort means the destination has no listener on the probe's port, which is
+	// how a UDP probe that reached its destination is answered.
+	UnreachablePort
+	// UnreachableFragmentation means the probe needed fragmentation but had DF set.
+	UnreachableFragmentation
+	// UnreachableProhibited means a filter administratively prohibited the probe.
+	UnreachableProhibited
+	// UnreachableOther covers every other code.
+	UnreachableOther
+)
+
+// Unreachable returns the reason of a Destination Unreachable message, or NotUnreachable
+// for any other message. An ICMPv6 Packet Too Big message is reported as
+// UnreachableFragmentation, its ICMPv4 counterpart.
+func (p *ParsedICMP) Unreachable() Unreachable {
+	switch p.Type {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		return unreachableV4(p.Code)
+	case ipv6.ICMPTypeDestinationUnreachable:
+		return unreachableV6(p.Code)
+	case ipv6.ICMPTypePacketTooBig:
+		return UnreachableFragmentation
+	default:
+		return NotUnreachable
+	}
+}
+
+// Annotation returns the marker traceroute prints after a hop answering with this message,
+// e.g. "!H" for host unreachable or "!X" for administratively prohibited. A Parameter
+// Problem is marked with the offset of the offending octet, e.g. "!PP@20". It is empty for
+// Port Unreachable, which simply means the destination was reached, and for messages other
+// than Destination Unreachable and Parameter Problem.
+func (p *ParsedICMP) Annotation() string {
+	if p.Type == ipv4.ICMPTypeParameterProblem || p.Type == ipv6.ICMPTypeParameterProblem {
+		return fmt.Sprintf("!PP@%d", p.Pointer)
+	}
+	return unreachableAnnotation(p.Unreachable(), p.Code)
+}
+
+// CodeAnnotation returns the marker traceroute prints for an ICMPv4 Destination Unreachable
+// message with the given code: "!N" (network), "!H" (host), "!P" (protocol), "!F"
+// (fragmentation needed), "!X" (administratively prohibited) or "!<code>" for any other
+// code. It is empty for Port Unreachable.
+func CodeAnnotation(code int) string {
+	return unreachableAnnotation(unreachableV4(code), code)
+}
+
+func unreachableV4(code int) Unreachable {
+	switch code {
+	case 0, 6, 11:
+		return UnreachableNet
+	case 1, 7, 12:
+		return UnreachableHost
+	case 2:
+		return UnreachableProtocol
+	case 3:
+		return UnreachablePort
+	case 4:
+		return UnreachableFragmentation
+	case 9, 10, 13:
+		return UnreachableProhibited
+	default:
+		return UnreachableOther
+	}
+}
+
+func unreachableV6(code int) Unreachable {
+	switch code {
+	case 0:
+		return UnreachableNet
+	case 1, 5, 6:
+		return UnreachableProhibited
+	case 3:
+		return UnreachableHost
+	case 4:
+		return UnreachablePort
+	default:
+		return UnreachableOther
+	}
+}
+
+func unreachableAnnotation(reason Unreachable, code int) string {
+	switch reason {
+	case UnreachableNet:
+		return "!N"
+	case UnreachableHost:
+		return "!H"
+	case UnreachableProtocol:
+		return "!P"
+	case UnreachableFragmentation:
+		return "!F"
+	case UnreachableProhibited:
+		return "!X"
+	case UnreachableOther:
+		return fmt.Sprintf("!<%d>", code)
+	default:
+		return ""
+	}
+}
+
+// MatchesEcho reports whether the message is an Echo Reply to the Echo Request with the
+// given identifier and sequence number.
+func (p *ParsedICMP) MatchesEcho(id, seq int) bool {
+	return p.MatchesEchoSeq(seq) && p.Echo.ID == id&0xffff
+}
+
+// MatchesEchoSeq reports whether the message is an Echo Reply to an Echo Request with the
+// given sequence number, whatever its identifier.
+//
+// Use it with unprivileged ICMP sockets on Linux, where the kernel replaces the identifier
+// of outgoing requests with the socket's local port.
+func (p *ParsedICMP) MatchesEchoSeq(seq int) bool {
+	return p.Echo != nil && p.Echo.Seq == seq&0xffff
+}
+
+// ParseICMP parses an ICMP message of the given family received in response to a probe.
+//
+// Time Exceeded, Destination Unreachable, Parameter Problem and Echo Reply messages, as well
+// as ICMPv6 Packet Too Big messages, are accepted; any other type is reported with
+// *UnexpectedTypeError, and messages that do not parse with an error matching ErrMalformed.
+// See Classify.
+func ParseICMP(family Family, data []byte) (*ParsedICMP, error) {
+	return ParseICMPWithOptions(family, data, ParseOptions{})
+}
+
+// ParseICMPWithOptions is like ParseICMP but lets the caller opt into checksum
+// verification, so corrupted messages can be told apart from malformed ones.
+func ParseICMPWithOptions(family Family, data []byte, opts ParseOptions) (*ParsedICMP, error) {
+	if opts.VerifyChecksum {
+		if err := verifyChecksum(family, data, opts.Src, opts.Dst); err != nil {
+			return nil, err
+		}
+	}
+
+	var parsed *ParsedICMP
+	var err error
+	if family == IPv6 {
+		parsed, err = parseICMPv6(data)
+	} else {
+		parsed, err = parseICMPv4(data)
+	}
+	if err != nil {
+		return nil, malformed(err)
+	}
+	if opts.FilterEchoID && !parsed.hasEchoID(opts.EchoID) {
+		return nil, ErrForeignEcho
+	}
+	return parsed, nil
+}
+
+// hasEchoID reports whether the message is not an Echo Reply, or an error quoting an Echo
+// Request, with another identifier than id.
+func (p *ParsedICMP) hasEchoID(id int) bool {
+	id &= 0xffff
+	switch {
+	case p.Echo != nil:
+		return p.Echo.ID == id
+	case p.Key == nil:
+		return true
+	case p.Key.Protocol != protocolICMP && p.Key.Protocol != protocolICMPv6:
+		return true
+	case p.Key.EchoID == 0 && p.Key.EchoSeq == 0:
+		return true
+	default:
+		return p.Key.EchoID == id
+	}
+}
+
+// ParseICMPMessage parses an ICMPv4 message received in response to a probe.
+//
+// For Time Exceeded and Destination Unreachable messages the IPv4 header of the original
+// probe is returned along with the key identifying that probe. Echo Reply messages carry
+// no embedded datagram, so the returned header and key are nil.
+// Use ParseICMP to also obtain the message code and the identifier and sequence number of
+// Echo Replies.
+func ParseICMPMessage(data []byte) (icmp.Type, *ipv4.Header, *ProbeKey, error) {
+	parsed, err := parseICMPv4(data)
+	if err != nil {
+		return nil, nil, nil, malformed(err)
+	}
+	return parsed.Type, parsed.Header, parsed.Key, nil
+}
+
+// ParseICMPv6Message parses an ICMPv6 message received in response to a probe.
+//
+// It mirrors ParseICMPMessage but returns the embedded IPv6 header instead.
+func ParseICMPv6Message(data []byte) (icmp.Type, *ipv6.Header, *ProbeKey, error) {
+	parsed, err := parseICMPv6(data)
+	if err != nil {
+		return nil, nil, nil, malformed(err)
+	}
+	return parsed.Type, parsed.HeaderV6, parsed.Key, nil
+}
+
+// verifyChecksum checks the checksum of the ICMP message in data. ICMPv6 messages are
+// skipped unless both addresses of the pseudo-header are known.
+func verifyChecksum(family Family, data []byte, src, dst net.IP) error {
+	var sum uint32
+
+	if family == IPv6 {
+		if src == nil || dst == nil {
+			return nil
+		}
+		sum = pseudoHeaderSum(src, dst, protocolICMPv6, len(data))
+	}
+
+	if len(data) < 4 || internetChecksum(sum, data) != 0 {
+		return ErrBadChecksum
+	}
+	return nil
+}
+
+func parseICMPv4(data []byte) (*ParsedICMP, error) {
+	msg, err := icmp.ParseMessage(protocolICMP, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ICMP message: %w", err)
+	}
+
+	parsed := &ParsedICMP{Type: msg.Type, Code: msg.Code}
+
+	switch msg.Type {
+	case ipv4.ICMPTypeTimeExceeded:
+		parsed.Header, parsed.Key, err = parseTimeExceededMessage(msg.Body)
+	case ipv4.ICMPTypeDestinationUnreachable:
+		parsed.Header, parsed.Key, err = parseDestinationUnreachableMessage(msg.Body)
+		if unreachableV4(msg.Code) == UnreachableFragmentation {
+			// The Next-Hop MTU field (RFC 1191) takes the low half of the unused word,
+			// which icmp.DstUnreach does not expose.
+			parsed.MTU = int(binary.BigEndian.Uint16(data[6:8]))
+		}
+	case ipv4.ICMPTypeParameterProblem:
+		parsed.Pointer, parsed.Header, parsed.Key, err = parseParameterProblemMessage(msg.Body)
+	case ipv4.ICMPTypeEchoReply:
+		parsed.Echo, _ = msg.Body.(*icmp.Echo)
+	default:
+		return nil, &UnexpectedTypeError{Family: IPv4, Type: msg.Type}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Header != nil {
+		parsed.UDP = parseQuotedUDP(parsed.Header.Protocol, quotedData(msg.Body),
+			parsed.Header.Len)
+	}
+	parseExtensions(parsed, msg.Body)
+	return parsed, nil
+}
+
+func parseICMPv6(data []byte) (*ParsedICMP, error) {
+	msg, err := icmp.ParseMessage(protocolICMPv6, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ICMPv6 message: %w", err)
+	}
+
+	parsed := &ParsedICMP{Type: msg.Type, Code: msg.Code}
+
+	switch msg.Type {
+	case ipv6.ICMPTypeTimeExceeded:
+		parsed.HeaderV6, parsed.Key, err = parseTimeExceededV6Message(msg.Body)
+	case ipv6.ICMPTypeDestinationUnreachable:
+		parsed.HeaderV6, parsed.Key, err = parseDestinationUnreachableV6Message(msg.Body)
+	case ipv6.ICMPTypePacketTooBig:
+		parsed.MTU, parsed.HeaderV6, parsed.Key, err = parsePacketTooBigMessage(msg.Body)
+	case ipv6.ICMPTypeParameterProblem:
+		parsed.Pointer, parsed.HeaderV6, parsed.Key, err =
+			parseParameterProblemV6Message(msg.Body)
+	case ipv6.ICMPTypeEchoReply:
+		parsed.Echo, _ = msg.Body.(*icmp.Echo)
+	default:
+		return nil, &UnexpectedTypeError{Family: IPv6, Type: msg.Type}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.HeaderV6 != nil {
+		parsed.UDP = parseQuotedUDP(parsed.HeaderV6.NextHeader, quotedData(msg.Body),
+			ipv6.HeaderLen)
+	}
+	parseExtensions(parsed, msg.Body)
+	return parsed, nil
+}
+
+func parseTimeExceededMessage(body icmp.MessageBody) (*ipv4.Header, *ProbeKey, error) {
+	te, ok := body.(*icmp.TimeExceeded)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid Time Exceeded message body")
+	}
+
+	return parseQuotedIPv4(te.Data)
+}
+
+func parseDestinationUnreachableMessage(body icmp.MessageBody) (*ipv4.Header, *ProbeKey, error) {
+	du, ok := body.(*icmp.DstUnreach)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid Destination Unreachable message body")
+	}
+
+	return parseQuotedIPv4(du.Data)
+}
+
+func parseParameterProblemMessage(
+	body icmp.MessageBody,
+) (int, *ipv4.Header, *ProbeKey, error) {
+	pp, ok := body.(*icmp.ParamProb)
+	if !ok {
+		return 0, nil, nil, fmt.Errorf("invalid Parameter Problem message body")
+	}
+
+	header, key, err := parseQuotedIPv4(pp.Data)
+	return int(pp.Pointer), header, key, err
+}
+
+func parseTimeExceededV6Message(body icmp.MessageBody) (*ipv6.Header, *ProbeKey, error) {
+	te, ok := body.(*icmp.TimeExceeded)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid Time Exceeded message body")
+	}
+
+	return parseQuotedIPv6(te.Data)
+}
+
+func parseDestinationUnreachableV6Message(body icmp.MessageBody) (*ipv6.Header, *ProbeKey, error) {
+	du, ok := body.(*icmp.DstUnreach)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid Destination Unreachable message body")
+	}
+
+	return parseQuotedIPv6(du.Data)
+}
+
+func parsePacketTooBigMessage(body icmp.MessageBody) (int, *ipv6.Header, *ProbeKey, error) {
+	ptb, ok := body.(*icmp.PacketTooBig)
+	if !ok {
+		return 0, nil, nil, fmt.Errorf("invalid Packet Too Big message body")
+	}
+
+	header, key, err := parseQuotedIPv6(ptb.Data)
+	return ptb.MTU, header, key, err
+}
+
+// quotedData returns the original datagram quoted in an ICMP error message body.
+func quotedData(body icmp.MessageBody) []byte {
+	switch b := body.(type) {
+	case *icmp.TimeExceeded:
+		return b.Data
+	case *icmp.DstUnreach:
+		return b.Data
+	case *icmp.ParamProb:
+		return b.Data
+	case *icmp.PacketTooBig:
+		return b.Data
+	default:
+		return nil
+	}
+}
+
+// parseQuotedUDP decodes the UDP header following the quoted IP header of headerLen bytes.
+//
+// It returns nil if the probe was not a UDP datagram or the router did not quote the whole
+// UDP header.
+func parseQuotedUDP(protocol int, data []byte, headerLen int) *UDPHeader {
+	if protocol != protocolUDP || len(data) < headerLen+udpHeaderLen {
+		return nil
+	}
+
+	udp := data[headerLen:]
+	return &UDPHeader{
+		SrcPort: int(binary.BigEndian.Uint16(udp[0:2])),
+		DstPort: int(binary.BigEndian.Uint16(udp[2:4])),
+		Length:  int(binary.BigEndian.Uint16(udp[4:6])),
+	}
+}
+
+// parseExtensions fills in the MPLS label stack and interface information carried in the
+// ICMP extension structure of an error message (RFC 4884, RFC 4950, RFC 5837).
+//
+// The extension header, including its checksum, and the bounds of every object are
+// validated while the message is parsed; a malformed or absent extension structure simply
+// yields nothing, and objects of unknown classes are skipped.
+func parseExtensions(parsed *ParsedICMP, body icmp.MessageBody) {
+	var extensions []icmp.Extension
+
+	switch b := body.(type) {
+	case *icmp.TimeExceeded:
+		extensions = b.Extensions
+	case *icmp.DstUnreach:
+		extensions = b.Extensions
+	case *icmp.ParamProb:
+		extensions = b.Extensions
+	}
+
+	for _, ext := range extensions {
+		switch ext := ext.(type) {
+		case *icmp.MPLSLabelStack:
+			for _, l := range ext.Labels {
+				parsed.MPLS = append(parsed.MPLS, MPLSLabel{
+					Label: l.Label,
+					TC:    l.TC,
+					S:     l.S,
+					TTL:   l.TTL,
+				})
+			}
+		case *icmp.InterfaceInfo:
+			info := parseInterfaceInfo(ext)
+			// Prefer the incoming interface when the router reports several.
+			if parsed.Interface == nil || parsed.Interface.Role != IncomingInterface &&
+				info.Role == IncomingInterface {
+				parsed.Interface = info
+			}
+		}
+	}
+}
+
+func parseInterfaceInfo(ext *icmp.InterfaceInfo) *InterfaceInfo {
+	// The two most significant bits of the C-Type hold the interface role.
+	info := &InterfaceInfo{Role: InterfaceRole(ext.Type >> 6 & 0x3)}
+
+	if ext.Interface != nil {
+		info.Index = ext.Interface.Index
+		info.Name = ext.Interface.Name
+		info.MTU = ext.Interface.MTU
+	}
+	if ext.Addr != nil {
+		info.IP = ext.Addr.IP
+	}
+
+	return info
+}
+
+func parseParameterProblemV6Message(
+	body icmp.MessageBody,
+) (int, *ipv6.Header, *ProbeKey, error) {
+	pp, ok := body.(*icmp.ParamProb)
+	if !ok {
+		return 0, nil, nil, fmt.Errorf("invalid Parameter Problem message body")
+	}
+
+	header, key, err := parseQuotedIPv6(pp.Data)
+	return int(pp.Pointer), header, key, err
+}
+
+// parseQuotedIPv4 parses the original datagram quoted in an ICMPv4 error message.
+func parseQuotedIPv4(data []byte) (*ipv4.Header, *ProbeKey, error) {
+	header, err := ipv4.ParseHeader(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse embedded IPv4 header: %w", err)
+	}
+
+	key := parseProbeKey(header.Protocol, data[header.Len:])
+	key.ID = header.ID
+
+	return header, key, nil
+}
+
+// parseQuotedIPv6 parses the original datagram quoted in an ICMPv6 error message.
+func parseQuotedIPv6(data []byte) (*ipv6.Header, *ProbeKey, error) {
+	header, err := ipv6.ParseHeader(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse embedded IPv6 header: %w", err)
+	}
+
+	return header, parseProbeKey(header.NextHeader, data[ipv6.HeaderLen:]), nil
+}
+
+// parseProbeKey extracts the identifying fields of the quoted transport header, if it is
+// present.
+func parseProbeKey(protocol int, transport []byte) *ProbeKey {
+	key := &ProbeKey{Protocol: protocol}
+
+	switch protocol {
+	case protocolICMP, protocolICMPv6:
+		if len(transport) >= 8 {
+			key.EchoID = int(binary.BigEndian.Uint16(transport[4:6]))
+			key.EchoSeq = int(binary.BigEndian.Uint16(transport[6:8]))
+		}
+	default:
+		if len(transport) >= 4 {
+			key.SrcPort = int(binary.BigEndian.Uint16(transport[0:2]))
+			key.DstPort = int(binary.BigEndian.Uint16(transport[2:4]))
+		}
+		if protocol == protocolUDP && len(transport) >= udpHeaderLen {
+			key.Checksum = int(binary.BigEndian.Uint16(transport[6:8]))
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,842 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func buildTimeExceeded(t *testing.T, dst net.IP) []byte {
+	t.Helper()
+
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + 8,
+		ID:       4242,
+		TTL:      1,
+		Protocol: 17,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      dst,
+	}
+	quoted, err := header.Marshal()
+	require.NoError(t, err)
+	quoted = append(quoted, 0xc3, 0x50, 0x82, 0x9a, 0x00, 0x08, 0x00, 0x00)
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	return data
+}
+
+func buildTimeExceededV6(t *testing.T, dst net.IP) []byte {
+	t.Helper()
+
+	quoted := make([]byte, ipv6.HeaderLen+8)
+	quoted[0] = 6 << 4
+	quoted[5] = 8
+	quoted[6] = 17
+	quoted[7] = 1
+	copy(quoted[8:24], net.ParseIP("fd00::2"))
+	copy(quoted[24:40], dst.To16())
+	copy(quoted[40:], []byte{0xc3, 0x50, 0x82, 0x9a, 0x00, 0x08, 0x00, 0x00})
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestParseICMPMessageTimeExceeded(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+
+	typ, header, key, err := ParseICMPMessage(buildTimeExceeded(t, dst))
+
+	assert.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeTimeExceeded, typ)
+	require.NotNil(t, header)
+	assert.True(t, header.Dst.Equal(dst))
+	assert.Equal(t, 1, header.TTL)
+	assert.Equal(t, &ProbeKey{Protocol: 17, SrcPort: 50000, DstPort: 33434, ID: 4242}, key)
+}
+
+func TestParseICMPMessageTimeExceededWithoutTransport(t *testing.T) {
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen,
+		ID:       7,
+		TTL:      1,
+		Protocol: 17,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      net.IPv4(198, 51, 100, 7),
+	}
+	quoted, err := header.Marshal()
+	require.NoError(t, err)
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	_, _, key, err := ParseICMPMessage(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &ProbeKey{Protocol: 17, ID: 7}, key)
+}
+
+// portUnreachable is a Port Unreachable captured on loopback in reply to an empty UDP probe
+// sent from port 37483 to 127.0.0.1:33434.
+var portUnreachable = []byte{
+	0x03, 0x03, 0xe9, 0xd2, 0x00, 0x00, 0x00, 0x00,
+	0x45, 0x00, 0x00, 0x1c, 0x5f, 0x86, 0x40, 0x00, 0x40, 0x11, 0xdd, 0x48,
+	0x7f, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01,
+	0x92, 0x6b, 0x82, 0x9a, 0x00, 0x08, 0xfe, 0x1b,
+}
+
+func TestParseICMPMessageDestinationUnreachable(t *testing.T) {
+	typ, header, key, err := ParseICMPMessage(portUnreachable)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeDestinationUnreachable, typ)
+	require.NotNil(t, header)
+	assert.True(t, header.Dst.Equal(net.IPv4(127, 0, 0, 1)))
+	assert.Equal(t, 64, header.TTL)
+	assert.Equal(t, &ProbeKey{
+		Protocol: 17, SrcPort: 37483, DstPort: 33434, Checksum: 0xfe1b, ID: 0x5f86,
+	}, key)
+}
+
+func TestParseICMPMessageDestinationUnreachableHeaderOnly(t *testing.T) {
+	// Some routers quote only the IP header of the original datagram.
+	data := append([]byte(nil), portUnreachable[:28]...)
+
+	typ, header, key, err := ParseICMPMessage(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeDestinationUnreachable, typ)
+	require.NotNil(t, header)
+	assert.Equal(t, &ProbeKey{Protocol: 17, ID: 0x5f86}, key)
+}
+
+func TestParseICMPMessageDestinationUnreachableTruncated(t *testing.T) {
+	data := append([]byte(nil), portUnreachable[:20]...)
+
+	_, header, key, err := ParseICMPMessage(data)
+
+	assert.Error(t, err)
+	assert.Nil(t, header)
+	assert.Nil(t, key)
+}
+
+func TestParseICMPv6MessageDestinationUnreachable(t *testing.T) {
+	dst := net.ParseIP("2001:db8::1")
+	quoted := make([]byte, ipv6.HeaderLen+8)
+	quoted[0] = 6 << 4
+	quoted[6] = 17
+	quoted[7] = 64
+	copy(quoted[24:40], dst.To16())
+	copy(quoted[40:], []byte{0xc3, 0x50, 0x82, 0x9a, 0x00, 0x08, 0x00, 0x00})
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeDestinationUnreachable,
+		Code: 4,
+		Body: &icmp.DstUnreach{Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	typ, header, key, err := ParseICMPv6Message(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypeDestinationUnreachable, typ)
+	require.NotNil(t, header)
+	assert.True(t, header.Dst.Equal(dst))
+	assert.Equal(t, &ProbeKey{Protocol: 17, SrcPort: 50000, DstPort: 33434}, key)
+}
+
+func TestParseICMPMessageEchoReply(t *testing.T) {
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 1, Seq: 1},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	typ, header, key, err := ParseICMPMessage(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeEchoReply, typ)
+	assert.Nil(t, header)
+	assert.Nil(t, key)
+}
+
+func TestParseICMPMessageUnexpectedType(t *testing.T) {
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 1, Seq: 1},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	_, _, _, err = ParseICMPMessage(data)
+
+	assert.Error(t, err)
+}
+
+func TestParseICMPv6MessageTimeExceeded(t *testing.T) {
+	dst := net.ParseIP("2001:db8::1")
+
+	typ, header, key, err := ParseICMPv6Message(buildTimeExceededV6(t, dst))
+
+	assert.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypeTimeExceeded, typ)
+	require.NotNil(t, header)
+	assert.True(t, header.Dst.Equal(dst))
+	assert.Equal(t, 1, header.HopLimit)
+	assert.Equal(t, &ProbeKey{Protocol: 17, SrcPort: 50000, DstPort: 33434}, key)
+}
+
+func TestParseICMPv6MessageEchoReply(t *testing.T) {
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 1, Seq: 1},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	typ, header, key, err := ParseICMPv6Message(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypeEchoReply, typ)
+	assert.Nil(t, header)
+	assert.Nil(t, key)
+}
+
+func buildDestinationUnreachable(t *testing.T, code int, dst net.IP) []byte {
+	t.Helper()
+
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + 8,
+		TTL:      3,
+		Protocol: 17,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      dst,
+	}
+	quoted, err := header.Marshal()
+	require.NoError(t, err)
+	quoted = append(quoted, 0xc3, 0x50, 0x82, 0x9a, 0x00, 0x08, 0x00, 0x00)
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: code,
+		Body: &icmp.DstUnreach{Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestParseICMPDestinationUnreachableCodes(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+
+	// Network, host, port unreachable, host administratively prohibited and
+	// communication administratively prohibited.
+	for _, code := range []int{0, 1, 3, 10, 13} {
+		parsed, err := ParseICMP(IPv4, buildDestinationUnreachable(t, code, dst))
+
+		require.NoError(t, err, "code %d", code)
+		assert.Equal(t, ipv4.ICMPTypeDestinationUnreachable, parsed.Type)
+		assert.Equal(t, code, parsed.Code)
+		require.NotNil(t, parsed.Header)
+		assert.True(t, parsed.QuotedDst().Equal(dst))
+		assert.Equal(t, &ProbeKey{Protocol: 17, SrcPort: 50000, DstPort: 33434}, parsed.Key)
+	}
+}
+
+func TestParseICMPFragmentationNeeded(t *testing.T) {
+	data := buildDestinationUnreachable(t, 4, net.IPv4(198, 51, 100, 7))
+	// Next-Hop MTU 1400 (RFC 1191); ParseICMP does not check the now stale checksum.
+	data[6], data[7] = 0x05, 0x78
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.Equal(t, UnreachableFragmentation, parsed.Unreachable())
+	assert.Equal(t, "!F", parsed.Annotation())
+	assert.Equal(t, 1400, parsed.MTU)
+}
+
+func TestParseICMPDestinationUnreachableIgnoresMTU(t *testing.T) {
+	data := buildDestinationUnreachable(t, 1, net.IPv4(198, 51, 100, 7))
+	data[6], data[7] = 0x05, 0x78
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.Zero(t, parsed.MTU)
+}
+
+func TestParseICMPv6PacketTooBig(t *testing.T) {
+	dst := net.ParseIP("2001:db8::1")
+	quoted := make([]byte, ipv6.HeaderLen+8)
+	quoted[0] = 6 << 4
+	quoted[6] = 17
+	quoted[7] = 64
+	copy(quoted[24:40], dst.To16())
+	copy(quoted[40:], []byte{0xc3, 0x50, 0x82, 0x9a, 0x00, 0x08, 0x00, 0x00})
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypePacketTooBig,
+		Body: &icmp.PacketTooBig{MTU: 1280, Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	parsed, err := ParseICMP(IPv6, data)
+
+	require.NoError(t, err)
+	assert.Equal(t, 1280, parsed.MTU)
+	assert.Equal(t, UnreachableFragmentation, parsed.Unreachable())
+	assert.Equal(t, "!F", parsed.Annotation())
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+	assert.Equal(t, &ProbeKey{Protocol: 17, SrcPort: 50000, DstPort: 33434}, parsed.Key)
+	require.NotNil(t, parsed.UDP)
+	assert.Equal(t, 8, parsed.UDP.Length)
+}
+
+func TestParsedICMPUnreachable(t *testing.T) {
+	tests := []struct {
+		typ        icmp.Type
+		code       int
+		reason     Unreachable
+		annotation string
+	}{
+		{ipv4.ICMPTypeDestinationUnreachable, 0, UnreachableNet, "!N"},
+		{ipv4.ICMPTypeDestinationUnreachable, 1, UnreachableHost, "!H"},
+		{ipv4.ICMPTypeDestinationUnreachable, 2, UnreachableProtocol, "!P"},
+		{ipv4.ICMPTypeDestinationUnreachable, 3, UnreachablePort, ""},
+		{ipv4.ICMPTypeDestinationUnreachable, 4, UnreachableFragmentation, "!F"},
+		{ipv4.ICMPTypeDestinationUnreachable, 13, UnreachableProhibited, "!X"},
+		{ipv4.ICMPTypeDestinationUnreachable, 5, UnreachableOther, "!<5>"},
+		{ipv6.ICMPTypeDestinationUnreachable, 0, UnreachableNet, "!N"},
+		{ipv6.ICMPTypeDestinationUnreachable, 1, UnreachableProhibited, "!X"},
+		{ipv6.ICMPTypeDestinationUnreachable, 3, UnreachableHost, "!H"},
+		{ipv6.ICMPTypeDestinationUnreachable, 4, UnreachablePort, ""},
+		{ipv4.ICMPTypeTimeExceeded, 0, NotUnreachable, ""},
+		{ipv6.ICMPTypeEchoReply, 0, NotUnreachable, ""},
+	}
+
+	for _, tt := range tests {
+		parsed := &ParsedICMP{Type: tt.typ, Code: tt.code}
+
+		assert.Equal(t, tt.reason, parsed.Unreachable(), "%v code %d", tt.typ, tt.code)
+		assert.Equal(t, tt.annotation, parsed.Annotation(), "%v code %d", tt.typ, tt.code)
+	}
+}
+
+func TestCodeAnnotation(t *testing.T) {
+	assert.Equal(t, "!N", CodeAnnotation(0))
+	assert.Equal(t, "!H", CodeAnnotation(1))
+	assert.Equal(t, "!P", CodeAnnotation(2))
+	assert.Equal(t, "", CodeAnnotation(3))
+	assert.Equal(t, "!F", CodeAnnotation(4))
+	assert.Equal(t, "!X", CodeAnnotation(13))
+	assert.Equal(t, "!<14>", CodeAnnotation(14))
+}
+
+func TestParseICMPTimeExceeded(t *testing.T) {
+	dst := net.ParseIP("2001:db8::1")
+
+	parsed, err := ParseICMP(IPv6, buildTimeExceededV6(t, dst))
+
+	require.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypeTimeExceeded, parsed.Type)
+	assert.Equal(t, 0, parsed.Code)
+	assert.Nil(t, parsed.Header)
+	require.NotNil(t, parsed.HeaderV6)
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+}
+
+func TestParsedICMPQuotedTOS(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	tests := []struct {
+		name string
+		tos  byte
+		want ECN
+	}{
+		{"ECN preserved", 0xba, ECT0},
+		{"ECN bleached", 0xb8, NotECT},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildTimeExceeded(t, dst)
+			// The quoted IPv4 header follows the 8-byte ICMP header; TOS is its second byte.
+			data[9] = tt.tos
+
+			parsed, err := ParseICMP(IPv4, data)
+
+			require.NoError(t, err)
+			assert.Equal(t, int(tt.tos), parsed.QuotedTOS())
+			assert.Equal(t, tt.want, ECNOf(parsed.QuotedTOS()))
+		})
+	}
+}
+
+func TestParsedICMPQuotedTOSWithoutQuote(t *testing.T) {
+	parsed := &ParsedICMP{Type: ipv4.ICMPTypeEchoReply}
+
+	assert.Equal(t, -1, parsed.QuotedTOS())
+	assert.Equal(t, -1, parsed.QuotedTTL())
+	assert.Equal(t, -1, parsed.QuotedID())
+}
+
+func TestParsedICMPQuotedID(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	data := buildTimeExceeded(t, dst)
+	// The quoted IPv4 header follows the 8-byte ICMP header; ID is its third 16-bit word.
+	binary.BigEndian.PutUint16(data[12:14], 0x4242)
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.Equal(t, 0x4242, parsed.QuotedID())
+
+	parsed, err = ParseICMP(IPv6, buildTimeExceededV6(t, net.ParseIP("2001:db8::7")))
+
+	require.NoError(t, err)
+	assert.Equal(t, -1, parsed.QuotedID(), "IPv6 headers have no Identification")
+}
+
+func TestParsedICMPQuotedTTL(t *testing.T) {
+	parsed, err := ParseICMP(IPv4, buildTimeExceeded(t, net.IPv4(198, 51, 100, 7)))
+	require.NoError(t, err)
+	assert.Equal(t, 1, parsed.QuotedTTL())
+
+	parsed, err = ParseICMP(IPv6, buildTimeExceededV6(t, net.ParseIP("2001:db8::1")))
+	require.NoError(t, err)
+	assert.Equal(t, 1, parsed.QuotedTTL())
+}
+
+func TestParseICMPEchoReply(t *testing.T) {
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 1, Seq: 2},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeEchoReply, parsed.Type)
+	assert.Nil(t, parsed.QuotedDst())
+	assert.Nil(t, parsed.Key)
+	require.NotNil(t, parsed.Echo)
+	assert.Equal(t, 1, parsed.Echo.ID)
+	assert.Equal(t, 2, parsed.Echo.Seq)
+}
+
+func buildTimeExceededQuotingEcho(t *testing.T, id, seq int) []byte {
+	t.Helper()
+
+	echo := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq},
+	}
+	echoBytes, err := echo.Marshal(nil)
+	require.NoError(t, err)
+
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(echoBytes),
+		TTL:      1,
+		Protocol: 1,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      net.IPv4(198, 51, 100, 7),
+	}
+	quoted, err := header.Marshal()
+	require.NoError(t, err)
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: append(quoted, echoBytes...)},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+	return data
+}
+
+func TestParseICMPTimeExceededQuotingEcho(t *testing.T) {
+	data := buildTimeExceededQuotingEcho(t, 0x1234, 9)
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.Equal(t, &ProbeKey{Protocol: 1, EchoID: 0x1234, EchoSeq: 9}, parsed.Key)
+}
+
+func buildTimeExceededWithExtensions(
+	t *testing.T,
+	dst net.IP,
+	extensions ...icmp.Extension,
+) []byte {
+	t.Helper()
+
+	msg, err := icmp.ParseMessage(protocolICMP, buildTimeExceeded(t, dst))
+	require.NoError(t, err)
+
+	msg.Body.(*icmp.TimeExceeded).Extensions = extensions
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	return data
+}
+
+func buildTimeExceededWithMPLS(t *testing.T, dst net.IP) []byte {
+	t.Helper()
+
+	return buildTimeExceededWithExtensions(t, dst, &icmp.MPLSLabelStack{
+		Class: 1,
+		Type:  1,
+		Labels: []icmp.MPLSLabel{
+			{Label: 24015, TC: 0, S: false, TTL: 1},
+			{Label: 16, TC: 5, S: true, TTL: 254},
+		},
+	})
+}
+
+func TestParseICMPTimeExceededMPLS(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+
+	parsed, err := ParseICMP(IPv4, buildTimeExceededWithMPLS(t, dst))
+
+	require.NoError(t, err)
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+	assert.Equal(t, []MPLSLabel{
+		{Label: 24015, TC: 0, S: false, TTL: 1},
+		{Label: 16, TC: 5, S: true, TTL: 254},
+	}, parsed.MPLS)
+	assert.Equal(t, "L=24015, E=0, S=0, T=1", parsed.MPLS[0].String())
+	assert.Equal(t, "L=16, E=5, S=1, T=254", parsed.MPLS[1].String())
+}
+
+func TestParseICMPTimeExceededMPLSBadChecksum(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	data := buildTimeExceededWithMPLS(t, dst)
+
+	// The extension header follows the ICMP header and the 128-byte original datagram.
+	data[8+128+2] ^= 0xff
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+	assert.Empty(t, parsed.MPLS)
+}
+
+func TestParseICMPTimeExceededWithoutMPLS(t *testing.T) {
+	parsed, err := ParseICMP(IPv4, buildTimeExceeded(t, net.IPv4(198, 51, 100, 7)))
+
+	require.NoError(t, err)
+	assert.Empty(t, parsed.MPLS)
+}
+
+func TestParseICMPWithOptionsVerifyChecksum(t *testing.T) {
+	data := buildTimeExceeded(t, net.IPv4(198, 51, 100, 7))
+	opts := ParseOptions{VerifyChecksum: true}
+
+	_, err := ParseICMPWithOptions(IPv4, data, opts)
+	require.NoError(t, err)
+
+	data[len(data)-1] ^= 0xff
+
+	parsed, err := ParseICMPWithOptions(IPv4, data, opts)
+	assert.Nil(t, parsed)
+	assert.ErrorIs(t, err, ErrBadChecksum)
+
+	_, err = ParseICMP(IPv4, data)
+	assert.NoError(t, err, "checksums are not verified by default")
+}
+
+func TestParseICMPWithOptionsFilterEchoID(t *testing.T) {
+	reply := icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 0x1234, Seq: 1}}
+	replyBytes, err := reply.Marshal(nil)
+	require.NoError(t, err)
+	opts := ParseOptions{FilterEchoID: true, EchoID: 0x1234}
+
+	for name, data := range map[string][]byte{
+		"echo reply":    replyBytes,
+		"quoting echo":  buildTimeExceededQuotingEcho(t, 0x1234, 9),
+		"quoting UDP":   buildTimeExceeded(t, net.IPv4(198, 51, 100, 7)),
+		"quoting no ID": buildTimeExceededQuotingEcho(t, 0, 0),
+	} {
+		_, err := ParseICMPWithOptions(IPv4, data, opts)
+		assert.NoError(t, err, name)
+	}
+
+	opts.EchoID = 0x4321
+	for name, data := range map[string][]byte{
+		"echo reply":   replyBytes,
+		"quoting echo": buildTimeExceededQuotingEcho(t, 0x1234, 9),
+	} {
+		parsed, err := ParseICMPWithOptions(IPv4, data, opts)
+		assert.Nil(t, parsed, name)
+		assert.ErrorIs(t, err, ErrForeignEcho, name)
+		assert.Equal(t, Ignore, Classify(err), name)
+	}
+}
+
+func TestParseICMPWithOptionsVerifyChecksumV6(t *testing.T) {
+	src, dst := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 1, Seq: 2},
+	}
+	data, err := msg.Marshal(icmp.IPv6PseudoHeader(src, dst))
+	require.NoError(t, err)
+
+	opts := ParseOptions{VerifyChecksum: true, Src: src, Dst: dst}
+
+	_, err = ParseICMPWithOptions(IPv6, data, opts)
+	require.NoError(t, err)
+
+	data[len(data)-1] ^= 0xff
+
+	_, err = ParseICMPWithOptions(IPv6, data, opts)
+	assert.ErrorIs(t, err, ErrBadChecksum)
+
+	_, err = ParseICMPWithOptions(IPv6, data, ParseOptions{VerifyChecksum: true})
+	assert.NoError(t, err, "ICMPv6 checksums need the pseudo-header addresses")
+}
+
+// interfaceInfoType builds the C-Type of an RFC 5837 object revealing the ifIndex, address,
+// name and MTU of an interface with the given role.
+func interfaceInfoType(role InterfaceRole) int {
+	return int(role)<<6 | 0x0f
+}
+
+func TestParseICMPTimeExceededInterfaceInfo(t *testing.T) {
+	data := buildTimeExceededWithExtensions(t, net.IPv4(198, 51, 100, 7),
+		&icmp.InterfaceInfo{
+			Class:     2,
+			Type:      interfaceInfoType(IncomingInterface),
+			Interface: &net.Interface{Index: 17, Name: "ge-0/0/1", MTU: 9000},
+			Addr:      &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+		},
+	)
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	require.NotNil(t, parsed.Interface)
+	assert.Equal(t, IncomingInterface, parsed.Interface.Role)
+	assert.Equal(t, 17, parsed.Interface.Index)
+	assert.Equal(t, "ge-0/0/1", parsed.Interface.Name)
+	assert.Equal(t, 9000, parsed.Interface.MTU)
+	assert.True(t, parsed.Interface.IP.Equal(net.IPv4(192, 0, 2, 1)))
+}
+
+func TestParseICMPTimeExceededInterfaceInfoPrefersIncoming(t *testing.T) {
+	data := buildTimeExceededWithExtensions(t, net.IPv4(198, 51, 100, 7),
+		&icmp.RawExtension{Data: []byte{0x00, 0x08, 0x7f, 0x01, 0xde, 0xad, 0xbe, 0xef}},
+		&icmp.InterfaceInfo{
+			Class:     2,
+			Type:      interfaceInfoType(OutgoingInterface),
+			Interface: &net.Interface{Index: 2, Name: "out0", MTU: 1500},
+			Addr:      &net.IPAddr{IP: net.IPv4(192, 0, 2, 2)},
+		},
+		&icmp.InterfaceInfo{
+			Class:     2,
+			Type:      interfaceInfoType(IncomingInterface),
+			Interface: &net.Interface{Index: 1, Name: "in0", MTU: 1500},
+			Addr:      &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+		},
+	)
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	require.NotNil(t, parsed.Interface)
+	assert.Equal(t, IncomingInterface, parsed.Interface.Role)
+	assert.Equal(t, "in0", parsed.Interface.Name)
+}
+
+func TestParseICMPTimeExceededInterfaceInfoOutOfBounds(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	data := buildTimeExceededWithExtensions(t, dst, &icmp.InterfaceInfo{
+		Class:     2,
+		Type:      interfaceInfoType(IncomingInterface),
+		Interface: &net.Interface{Index: 1, Name: "in0", MTU: 1500},
+		Addr:      &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+	})
+
+	// Truncate the message so that the object's length overruns it.
+	data = data[:len(data)-8]
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+	assert.Nil(t, parsed.Interface)
+}
+
+func TestParseICMPQuotedUDPHeader(t *testing.T) {
+	parsed, err := ParseICMP(IPv4, buildTimeExceeded(t, net.IPv4(198, 51, 100, 7)))
+
+	require.NoError(t, err)
+	assert.Equal(t, &UDPHeader{SrcPort: 50000, DstPort: 33434, Length: 8}, parsed.UDP)
+
+	parsed, err = ParseICMP(IPv6, buildTimeExceededV6(t, net.ParseIP("2001:db8::7")))
+
+	require.NoError(t, err)
+	assert.Equal(t, &UDPHeader{SrcPort: 50000, DstPort: 33434, Length: 8}, parsed.UDP)
+}
+
+func TestParseICMPQuotedUDPHeaderMissing(t *testing.T) {
+	// Only the IP header of the original datagram is quoted.
+	parsed, err := ParseICMP(IPv4, append([]byte(nil), portUnreachable[:28]...))
+
+	require.NoError(t, err)
+	require.NotNil(t, parsed.Header)
+	assert.Nil(t, parsed.UDP)
+
+	// The quoted probe is a TCP segment.
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + 8,
+		TTL:      1,
+		Protocol: 6,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      net.IPv4(198, 51, 100, 7),
+	}
+	quoted, err := header.Marshal()
+	require.NoError(t, err)
+	quoted = append(quoted, 0xc3, 0x50, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01)
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	parsed, err = ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.Equal(t, 6, parsed.Key.Protocol)
+	assert.Nil(t, parsed.UDP)
+}
+
+func TestParsedICMPMatchesEcho(t *testing.T) {
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 0x1234, Seq: 9},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	parsed, err := ParseICMP(IPv4, data)
+	require.NoError(t, err)
+
+	assert.True(t, parsed.MatchesEcho(0x1234, 9))
+	assert.False(t, parsed.MatchesEcho(0x1234, 10))
+	assert.False(t, parsed.MatchesEcho(0x4321, 9))
+
+	// With a kernel-assigned identifier only the sequence number is compared.
+	assert.True(t, parsed.MatchesEchoSeq(9))
+	assert.False(t, parsed.MatchesEchoSeq(10))
+}
+
+func TestParsedICMPMatchesEchoNotEchoReply(t *testing.T) {
+	parsed, err := ParseICMP(IPv4, buildTimeExceeded(t, net.IPv4(198, 51, 100, 7)))
+	require.NoError(t, err)
+
+	assert.False(t, parsed.MatchesEcho(0, 0))
+	assert.False(t, parsed.MatchesEchoSeq(0))
+}
+
+func TestParseICMPParameterProblem(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+
+	// The probe carries a malformed Record Route option, whose length octet claims more
+	// bytes than the option area holds; the router points at the start of the option.
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen + 4,
+		TotalLen: ipv4.HeaderLen + 4 + 8,
+		ID:       4242,
+		TTL:      1,
+		Protocol: 17,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      dst,
+		Options:  []byte{0x07, 0x27, 0x04, 0x00},
+	}
+	quoted, err := header.Marshal()
+	require.NoError(t, err)
+	quoted = append(quoted, 0xc3, 0x50, 0x82, 0x9a, 0x00, 0x08, 0x00, 0x00)
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeParameterProblem,
+		Body: &icmp.ParamProb{Pointer: ipv4.HeaderLen, Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	parsed, err := ParseICMP(IPv4, data)
+
+	require.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeParameterProblem, parsed.Type)
+	assert.Equal(t, 20, parsed.Pointer)
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+	assert.Equal(t, &ProbeKey{Protocol: 17, SrcPort: 50000, DstPort: 33434, ID: 4242}, parsed.Key)
+	assert.Equal(t, &UDPHeader{SrcPort: 50000, DstPort: 33434, Length: 8}, parsed.UDP)
+	assert.Equal(t, "!PP@20", parsed.Annotation())
+	assert.Equal(t, NotUnreachable, parsed.Unreachable())
+}
+
+func TestParseICMPv6ParameterProblem(t *testing.T) {
+	dst := net.ParseIP("2001:db8::7")
+
+	msg, err := icmp.ParseMessage(protocolICMPv6, buildTimeExceededV6(t, dst))
+	require.NoError(t, err)
+
+	// Point at the Next Header field of the quoted IPv6 header.
+	pp := icmp.Message{
+		Type: ipv6.ICMPTypeParameterProblem,
+		Code: 1,
+		Body: &icmp.ParamProb{Pointer: 6, Data: msg.Body.(*icmp.TimeExceeded).Data},
+	}
+	data, err := pp.Marshal(nil)
+	require.NoError(t, err)
+
+	parsed, err := ParseICMP(IPv6, data)
+
+	require.NoError(t, err)
+	assert.Equal(t, 6, parsed.Pointer)
+	assert.True(t, parsed.QuotedDst().Equal(dst))
+	assert.Equal(t, "!PP@6", parsed.Annotation())
+}
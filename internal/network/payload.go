@@ -0,0 +1,43 @@
+package network
+
+// PayloadFunc generates the size-byte payload of the attempt-th probe sent with the given
+// TTL. Generating it per probe lets every probe carry distinct content.
+type PayloadFunc func(ttl, attempt, size int) []byte
+
+// IncrementingPayload fills payloads with the pattern of Unix traceroute, the bytes 0x40 to
+// 0x7f repeated, so every probe of a given size is identical.
+func IncrementingPayload(ttl, attempt, size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = 0x40 + byte(i&0x3f)
+	}
+	return payload
+}
+
+// FillPayload returns a PayloadFunc filling payloads with b.
+func FillPayload(b byte) PayloadFunc {
+	return func(ttl, attempt, size int) []byte {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = b
+		}
+		return payload
+	}
+}
+
+// BytesPayload returns a PayloadFunc sending data, repeated or truncated to the payload
+// size. An empty data yields all-zero payloads.
+func BytesPayload(data []byte) PayloadFunc {
+	data = append([]byte(nil), data...)
+
+	return func(ttl, attempt, size int) []byte {
+		payload := make([]byte, size)
+		if len(data) == 0 {
+			return payload
+		}
+		for i := range payload {
+			payload[i] = data[i%len(data)]
+		}
+		return payload
+	}
+}
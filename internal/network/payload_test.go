@@ -0,0 +1,31 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncrementingPayload(t *testing.T) {
+	payload := IncrementingPayload(1, 0, 66)
+
+	assert.Len(t, payload, 66)
+	assert.Equal(t, byte('@'), payload[0])
+	assert.Equal(t, byte(0x7f), payload[63])
+	assert.Equal(t, []byte("@A"), payload[64:])
+	assert.Empty(t, IncrementingPayload(1, 0, 0))
+}
+
+func TestFillPayload(t *testing.T) {
+	assert.Equal(t, []byte{0xff, 0xff, 0xff}, FillPayload(0xff)(1, 0, 3))
+}
+
+func TestBytesPayload(t *testing.T) {
+	data := []byte("abc")
+	payload := BytesPayload(data)
+	data[0] = 'x'
+
+	assert.Equal(t, []byte("abcab"), payload(1, 0, 5))
+	assert.Equal(t, []byte("ab"), payload(1, 0, 2))
+	assert.Equal(t, []byte{0, 0}, BytesPayload(nil)(1, 0, 2))
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// pingTTL is the Time to Live of the Echo Requests sent by Ping, the default of most
+// hosts.
+const pingTTL = 64
+
+// pingIDs tells apart the identifiers of concurrent pings, offset from those of the
+// traces of the process.
+var pingIDs uint32
+
+// PingStats summarizes the replies to the Echo Requests sent by Ping.
+type PingStats struct {
+	// Sent is the number of Echo Requests sent and Received the number of replies
+	// received in time.
+	Sent     int
+	Received int
+	// RTTs holds the round-trip time of every reply received, in the order the requests
+	// were sent.
+	RTTs []time.Duration
+	// Min, Avg, Max and StdDev summarize RTTs; StdDev is their population standard
+	// deviation. They are zero when no reply was received.
+	Min    time.Duration
+	Avg    time.Duration
+	Max    time.Duration
+	StdDev time.Duration
+	// Loss is the percentage of requests that received no reply.
+	Loss float64
+}
+
+// Ping sends count ICMP Echo Requests to dest one after the other, each as soon as the
+// previous one was answered or timeout passed without a reply, and summarizes the replies
+// like ping.
+//
+// It opens a listener of its own with NewICMPConn, so it falls back to an unprivileged
+// datagram socket where raw sockets are not allowed.
+func Ping(dest net.IP, count int, timeout time.Duration) (PingStats, error) {
+	if count <= 0 {
+		return PingStats{}, fmt.Errorf("invalid ping count %d: must be positive", count)
+	}
+	if timeout <= 0 {
+		return PingStats{}, fmt.Errorf("invalid ping timeout %v: must be positive", timeout)
+	}
+
+	family := IPv4
+	switch {
+	case dest.To4() != nil:
+	case dest.To16() != nil:
+		family = IPv6
+	default:
+		return PingStats{}, fmt.Errorf("invalid destination address %v", dest)
+	}
+
+	conn, err := NewICMPConn(family)
+	if err != nil {
+		return PingStats{}, err
+	}
+	defer conn.Close()
+
+	id := (os.Getpid() + 0x8000 + int(atomic.AddUint32(&pingIDs, 1))) & 0xffff
+	return conn.ping(context.Background(), dest, conn.EchoID(id), count, timeout)
+}
+
+// ping sends count Echo Requests with the given identifier to dest through the listener
+// and summarizes their replies.
+func (c *ICMPConn) ping(
+	ctx context.Context,
+	dest net.IP,
+	id, count int,
+	timeout time.Duration,
+) (PingStats, error) {
+	var stats PingStats
+
+	for seq := 1; seq <= count; seq++ {
+		sentAt := time.Now()
+		if err := c.SendEcho(&net.IPAddr{IP: dest}, pingTTL, id, seq, nil); err != nil {
+			return stats, err
+		}
+		stats.Sent++
+
+		rtt, err := c.readEchoReply(ctx, dest, id, seq, sentAt, timeout)
+		if err != nil {
+			return stats, err
+		}
+		if rtt >= 0 {
+			stats.RTTs = append(stats.RTTs, rtt)
+		}
+	}
+
+	stats.summarize()
+	return stats, nil
+}
+
+// readEchoReply waits up to timeout after sentAt for the reply to the Echo Request with
+// the given identifier and sequence number, and returns its RTT, or -1 if none arrived in
+// time. Other messages are discarded.
+func (c *ICMPConn) readEchoReply(
+	ctx context.Context,
+	dest net.IP,
+	id, seq int,
+	sentAt time.Time,
+	timeout time.Duration,
+) (time.Duration, error) {
+	ctx, cancel := context.WithDeadline(ctx, sentAt.Add(timeout))
+	defer cancel()
+
+	for {
+		msg, err := c.ReadMessage(ctx)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrReadTimeout) {
+			return -1, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+
+		parsed, err := ParseICMP(c.family, msg.Data)
+		if err != nil || !msg.Peer.Equal(dest) {
+			continue
+		}
+		if parsed.MatchesEcho(id, seq) {
+			return msg.ReceivedAt.Sub(sentAt), nil
+		}
+	}
+}
+
+// summarize computes the statistics of the RTTs.
+func (s *PingStats) summarize() {
+	s.Received = len(s.RTTs)
+	if s.Sent > 0 {
+		s.Loss = float64(s.Sent-s.Received) / float64(s.Sent) * 100
+	}
+	if s.Received == 0 {
+		return
+	}
+
+	var sum time.Duration
+	s.Min, s.Max = s.RTTs[0], s.RTTs[0]
+	for _, rtt := range s.RTTs {
+		sum += rtt
+		if rtt < s.Min {
+			s.Min = rtt
+		}
+		if rtt > s.Max {
+			s.Max = rtt
+		}
+	}
+	s.Avg = sum / time.Duration(s.Received)
+
+	var variance float64
+	for _, rtt := range s.RTTs {
+		d := float64(rtt - s.Avg)
+		variance += d * d
+	}
+	s.StdDev = time.Duration(math.Sqrt(variance / float64(s.Received)))
+}
@@ -0,0 +1,122 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func echoReply(t *testing.T, id, seq int) []byte {
+	t.Helper()
+
+	msg := icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: id, Seq: seq}}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+	return data
+}
+
+func TestICMPConnPing(t *testing.T) {
+	dest := &net.IPAddr{IP: net.IPv4(198, 51, 100, 7)}
+	other := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	mockConn := new(MockICMPPacketConn)
+	mockConn.On("WriteTo", mock.Anything, dest).Return(8, nil)
+	mockConn.On("SetReadDeadline", mock.AnythingOfType("time.Time")).Return(nil)
+	// The first request is answered after a reply from another host and one to another
+	// request; the second one is not.
+	mockConn.On("ReadFrom", mock.Anything).Return(echoReply(t, 7, 1), other, nil).Once()
+	mockConn.On("ReadFrom", mock.Anything).Return(echoReply(t, 7, 2), dest, nil).Once()
+	mockConn.On("ReadFrom", mock.Anything).Return(echoReply(t, 7, 1), dest, nil).Once()
+	mockConn.On("ReadFrom", mock.Anything).Return(nil, nil, timeoutError{}).Once()
+
+	var ttls []int
+	conn := &ICMPConn{conn: mockConn, family: IPv4, setTTL: func(ttl int) error {
+		ttls = append(ttls, ttl)
+		return nil
+	}}
+
+	stats, err := conn.ping(context.Background(), dest.IP, 7, 2, time.Second)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Sent)
+	assert.Equal(t, 1, stats.Received)
+	require.Len(t, stats.RTTs, 1)
+	assert.Equal(t, stats.RTTs[0], stats.Min)
+	assert.Equal(t, stats.RTTs[0], stats.Max)
+	assert.Equal(t, time.Duration(0), stats.StdDev)
+	assert.Equal(t, 50.0, stats.Loss)
+	assert.Equal(t, []int{pingTTL, pingTTL}, ttls)
+	mockConn.AssertExpectations(t)
+}
+
+func TestICMPConnPingSendFailure(t *testing.T) {
+	dest := &net.IPAddr{IP: net.IPv4(198, 51, 100, 7)}
+	mockConn := new(MockICMPPacketConn)
+	mockConn.On("WriteTo", mock.Anything, dest).Return(0, errors.New("boom"))
+
+	conn := &ICMPConn{conn: mockConn, family: IPv4, setTTL: func(int) error { return nil }}
+
+	stats, err := conn.ping(context.Background(), dest.IP, 7, 3, time.Second)
+
+	assert.ErrorContains(t, err, "failed to send ICMP message")
+	assert.Equal(t, 0, stats.Sent)
+}
+
+func TestPingStatsSummarize(t *testing.T) {
+	stats := PingStats{
+		Sent: 4,
+		RTTs: []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond},
+	}
+
+	stats.summarize()
+
+	assert.Equal(t, 3, stats.Received)
+	assert.Equal(t, 10*time.Millisecond, stats.Min)
+	assert.Equal(t, 20*time.Millisecond, stats.Avg)
+	assert.Equal(t, 30*time.Millisecond, stats.Max)
+	assert.Equal(t, 8164965*time.Nanosecond, stats.StdDev)
+	assert.Equal(t, 25.0, stats.Loss)
+}
+
+func TestPingStatsSummarizeNoReply(t *testing.T) {
+	stats := PingStats{Sent: 2}
+
+	stats.summarize()
+
+	assert.Equal(t, PingStats{Sent: 2, Loss: 100}, stats)
+}
+
+func TestPingInvalidArguments(t *testing.T) {
+	_, err := Ping(net.IPv4(127, 0, 0, 1), 0, time.Second)
+	assert.EqualError(t, err, "invalid ping count 0: must be positive")
+
+	_, err = Ping(net.IPv4(127, 0, 0, 1), 1, 0)
+	assert.EqualError(t, err, "invalid ping timeout 0s: must be positive")
+
+	_, err = Ping(net.IP{1, 2}, 1, time.Second)
+	assert.EqualError(t, err, "invalid destination address ?0102")
+}
+
+func TestPingLoopback(t *testing.T) {
+	stats, err := Ping(net.IPv4(127, 0, 0, 1), 3, time.Second)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Sent)
+	assert.Equal(t, 3, stats.Received)
+	assert.Equal(t, 0.0, stats.Loss)
+	assert.Positive(t, stats.Min)
+	assert.LessOrEqual(t, stats.Min, stats.Avg)
+	assert.LessOrEqual(t, stats.Avg, stats.Max)
+}
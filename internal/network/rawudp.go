@@ -0,0 +1,116 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// RawUDPConn sends IPv4 UDP datagrams whose IP header it builds itself, so that fields the
+// kernel otherwise fills in, such as the Identification, can be chosen.
+type RawUDPConn struct {
+	*ipv4.RawConn
+	// dst and src cache the source address of the last destination sent to.
+	dst, src net.IP
+}
+
+// RawUDPDatagram describes a datagram sent by RawUDPConn.
+type RawUDPDatagram struct {
+	// Src is the source address and port. An unspecified address is replaced by the one
+	// the datagram leaves from.
+	Src *net.UDPAddr
+	Dst *net.UDPAddr
+	// TTL, TOS and ID are the Time to Live, Type of Service and Identification of the IPv4
+	// header. The kernel picks an ID if it is zero.
+	TTL int
+	TOS int
+	ID  int
+	// DontFragment sets the Don't Fragment bit.
+	DontFragment bool
+	Payload      []byte
+}
+
+// NewRawUDPConn opens a raw IPv4 socket for sending UDP datagrams with RawUDPConn.Send.
+// Opening a raw socket usually requires elevated privileges.
+func NewRawUDPConn() (*RawUDPConn, error) {
+	conn, err := net.ListenIP("ip4:udp", &net.IPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raw UDP connection: %w", err)
+	}
+
+	rawConn, err := ipv4.NewRawConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create raw UDP connection: %w", err)
+	}
+
+	return &RawUDPConn{RawConn: rawConn}, nil
+}
+
+// Send sends d with an IPv4 header of its own. The UDP checksum is computed over the
+// source address the datagram leaves from.
+func (c *RawUDPConn) Send(d RawUDPDatagram) error {
+	if d.ID < 0 || d.ID > 0xffff {
+		return fmt.Errorf("invalid IP identification: %d", d.ID)
+	}
+	if d.Dst.IP.To4() == nil {
+		return fmt.Errorf("unsupported destination address: %v", d.Dst.IP)
+	}
+
+	src, err := c.sourceIP(d.Src.IP, d.Dst.IP)
+	if err != nil {
+		return err
+	}
+
+	datagram := make([]byte, udpHeaderLen+len(d.Payload))
+	binary.BigEndian.PutUint16(datagram[0:2], uint16(d.Src.Port))
+	binary.BigEndian.PutUint16(datagram[2:4], uint16(d.Dst.Port))
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(len(datagram)))
+	copy(datagram[udpHeaderLen:], d.Payload)
+
+	checksum := internetChecksum(pseudoHeaderSum(src, d.Dst.IP, protocolUDP, len(datagram)),
+		datagram)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(datagram[6:8], checksum)
+
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TOS:      d.TOS,
+		TotalLen: ipv4.HeaderLen + len(datagram),
+		ID:       d.ID,
+		TTL:      d.TTL,
+		Protocol: protocolUDP,
+		Src:      src.To4(),
+		Dst:      d.Dst.IP.To4(),
+	}
+	if d.DontFragment {
+		header.Flags = ipv4.DontFragment
+	}
+
+	if err := c.WriteTo(header, datagram, nil); err != nil {
+		return fmt.Errorf("failed to send raw UDP datagram: %w", err)
+	}
+	return nil
+}
+
+// sourceIP returns the address datagrams to dst leave from, unless local is specified.
+func (c *RawUDPConn) sourceIP(local, dst net.IP) (net.IP, error) {
+	if local != nil && !local.IsUnspecified() {
+		return local, nil
+	}
+	if c.src != nil && c.dst.Equal(dst) {
+		return c.src, nil
+	}
+
+	src, err := sourceIP(nil, dst)
+	if err != nil {
+		return nil, err
+	}
+	c.dst, c.src = dst, src
+	return src, nil
+}
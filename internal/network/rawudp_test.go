@@ -0,0 +1,78 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawUDPConnSendLoopback(t *testing.T) {
+	icmpConn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer icmpConn.Close()
+
+	conn, err := NewRawUDPConn()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The port the datagram claims to come from, reserved so that nothing else uses it.
+	reserved, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer reserved.Close()
+	src := reserved.LocalAddr().(*net.UDPAddr)
+
+	require.NoError(t, conn.Send(RawUDPDatagram{
+		Src: src,
+		Dst: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33434},
+		TTL: 64,
+		TOS: 0xb8,
+		ID:  0x4242,
+	}))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		_, data, _, err := icmpConn.ReadWithTimeout(time.Until(deadline))
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(IPv4, data)
+		if err != nil || parsed.Key == nil || parsed.Key.SrcPort != src.Port {
+			continue
+		}
+
+		assert.Equal(t, UnreachablePort, parsed.Unreachable())
+		assert.Equal(t, 33434, parsed.Key.DstPort)
+		assert.Equal(t, 0x4242, parsed.QuotedID())
+		assert.Equal(t, 0xb8, parsed.QuotedTOS())
+		return
+	}
+	t.Fatal("no Port Unreachable quoting the datagram")
+}
+
+func TestRawUDPConnSendInvalid(t *testing.T) {
+	conn, err := NewRawUDPConn()
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	src := &net.UDPAddr{Port: 50000}
+
+	assert.Error(t, conn.Send(RawUDPDatagram{
+		Src: src,
+		Dst: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33434},
+		ID:  0x10000,
+	}))
+	assert.Error(t, conn.Send(RawUDPDatagram{
+		Src: src,
+		Dst: &net.UDPAddr{IP: net.IPv6loopback, Port: 33434},
+	}))
+}
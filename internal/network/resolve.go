@@ -0,0 +1,175 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Preference selects which address family ResolveTarget picks for a host.
+type Preference int
+
+const (
+	// PreferIPv6 picks an IPv6 address when one exists and falls back to IPv4.
+	PreferIPv6 Preference = iota
+	// ForceIPv4 only accepts IPv4 addresses.
+	ForceIPv4
+	// ForceIPv6 only accepts IPv6 addresses.
+	ForceIPv6
+)
+
+// Target is a traceroute destination resolved to a concrete address.
+type Target struct {
+	// Host is the name or literal address the target was resolved from.
+	Host string
+	// IP is the address chosen according to the requested preference.
+	IP net.IP
+	// Candidates holds every address the host resolved to.
+	Candidates []net.IP
+}
+
+// Family returns the address family of the chosen address.
+func (t *Target) Family() Family {
+	if t.IP.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+// String formats the target the way traceroute prints it, e.g. "example.com (192.0.2.1)".
+func (t *Target) String() string {
+	return fmt.Sprintf("%s (%s)", t.Host, t.IP)
+}
+
+// NoAddressError is returned by ResolveTarget when a host has no address of the requested family.
+type NoAddressError struct {
+	Host   string
+	Family Family
+}
+
+func (e *NoAddressError) Error() string {
+	return fmt.Sprintf("no %v address for host %q", e.Family, e.Host)
+}
+
+// DNSResolver looks up the addresses of host names and the names of addresses. It is
+// implemented by *net.Resolver, e.g. one created by NewDNSResolver.
+type DNSResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// NewDNSResolver creates a resolver sending its queries to server, an address whose port
+// defaults to 53, instead of the servers of the system configuration, e.g. to reach the
+// internal view of a split-horizon DNS.
+func NewDNSResolver(server string) (*net.Resolver, error) {
+	address, err := dnsServerAddr(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}, nil
+}
+
+// dnsServerAddr returns the address of server with port 53 unless it has one.
+func dnsServerAddr(server string) (string, error) {
+	if server == "" {
+		return "", errors.New("invalid DNS server: empty address")
+	}
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server, nil
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+	if strings.ContainsAny(host, "[]") {
+		return "", fmt.Errorf("invalid DNS server %q", server)
+	}
+	return net.JoinHostPort(host, "53"), nil
+}
+
+// lookupIPAddr resolves a host name; it is a variable so tests can avoid real DNS queries.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// ResolveTarget resolves host to its A and AAAA records and picks one according to pref.
+//
+// Literal IP addresses are used as is without querying DNS.
+// A *NoAddressError is returned when none of the addresses match a forced family.
+func ResolveTarget(host string, pref Preference) (*Target, error) {
+	return ResolveTargetWith(host, pref, nil)
+}
+
+// ResolveTargetWith resolves host like ResolveTarget, querying resolver instead of the
+// servers of the system configuration unless it is nil.
+func ResolveTargetWith(host string, pref Preference, resolver DNSResolver) (*Target, error) {
+	var candidates []net.IP
+
+	if ip := net.ParseIP(host); ip != nil {
+		candidates = []net.IP{ip}
+	} else {
+		lookup := lookupIPAddr
+		if resolver != nil {
+			lookup = resolver.LookupIPAddr
+		}
+		addrs, err := lookup(context.Background(), host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
+		}
+		for _, addr := range addrs {
+			candidates = append(candidates, addr.IP)
+		}
+	}
+
+	ip, err := pickAddress(candidates, pref)
+	if err != nil {
+		err.Host = host
+		return nil, err
+	}
+
+	return &Target{
+		Host:       host,
+		IP:         ip,
+		Candidates: candidates,
+	}, nil
+}
+
+func pickAddress(candidates []net.IP, pref Preference) (net.IP, *NoAddressError) {
+	var v4, v6 net.IP
+
+	for _, ip := range candidates {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+
+	switch pref {
+	case ForceIPv4:
+		if v4 == nil {
+			return nil, &NoAddressError{Family: IPv4}
+		}
+		return v4, nil
+	case ForceIPv6:
+		if v6 == nil {
+			return nil, &NoAddressError{Family: IPv6}
+		}
+		return v6, nil
+	default:
+		if v6 != nil {
+			return v6, nil
+		}
+		if v4 != nil {
+			return v4, nil
+		}
+		return nil, &NoAddressError{Family: IPv4}
+	}
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stubLookup(t *testing.T, addrs ...string) {
+	t.Helper()
+
+	original := lookupIPAddr
+	t.Cleanup(func() { lookupIPAddr = original })
+
+	lookupIPAddr = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		result := make([]net.IPAddr, 0, len(addrs))
+		for _, addr := range addrs {
+			result = append(result, net.IPAddr{IP: net.ParseIP(addr)})
+		}
+		return result, nil
+	}
+}
+
+func TestResolveTargetLiteralSkipsDNS(t *testing.T) {
+	stubLookup(t)
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		t.Fatal("DNS must not be queried for literal addresses")
+		return nil, nil
+	}
+
+	target, err := ResolveTarget("192.0.2.1", PreferIPv6)
+
+	require.NoError(t, err)
+	assert.True(t, target.IP.Equal(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, IPv4, target.Family())
+	assert.Equal(t, "192.0.2.1 (192.0.2.1)", target.String())
+}
+
+func TestResolveTargetPreference(t *testing.T) {
+	stubLookup(t, "192.0.2.1", "2001:db8::1", "192.0.2.2")
+
+	target, err := ResolveTarget("example.com", PreferIPv6)
+	require.NoError(t, err)
+	assert.True(t, target.IP.Equal(net.ParseIP("2001:db8::1")))
+	assert.Len(t, target.Candidates, 3)
+
+	target, err = ResolveTarget("example.com", ForceIPv4)
+	require.NoError(t, err)
+	assert.True(t, target.IP.Equal(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, "example.com (192.0.2.1)", target.String())
+
+	target, err = ResolveTarget("example.com", ForceIPv6)
+	require.NoError(t, err)
+	assert.Equal(t, IPv6, target.Family())
+}
+
+func TestResolveTargetPreferIPv6FallsBack(t *testing.T) {
+	stubLookup(t, "192.0.2.1")
+
+	target, err := ResolveTarget("example.com", PreferIPv6)
+
+	require.NoError(t, err)
+	assert.True(t, target.IP.Equal(net.ParseIP("192.0.2.1")))
+}
+
+func TestResolveTargetNoAddressOfFamily(t *testing.T) {
+	stubLookup(t, "2001:db8::1")
+
+	target, err := ResolveTarget("v6only.example.com", ForceIPv4)
+
+	assert.Nil(t, target)
+	var noAddr *NoAddressError
+	require.True(t, errors.As(err, &noAddr))
+	assert.Equal(t, "v6only.example.com", noAddr.Host)
+	assert.Equal(t, IPv4, noAddr.Family)
+}
+
+func TestResolveTargetLookupFailure(t *testing.T) {
+	stubLookup(t)
+
+	target, err := ResolveTarget("missing.example.com", PreferIPv6)
+
+	assert.Nil(t, target)
+	assert.Error(t, err)
+}
+
+// stubDNSResolver answers lookups from its records.
+type stubDNSResolver struct {
+	addrs map[string][]string
+	names map[string][]string
+}
+
+var _ DNSResolver = (*net.Resolver)(nil)
+
+func (r *stubDNSResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	result := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return result, nil
+}
+
+func (r *stubDNSResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func TestResolveTargetWith(t *testing.T) {
+	stubLookup(t)
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		t.Fatal("the system resolver must not be queried")
+		return nil, nil
+	}
+	resolver := &stubDNSResolver{addrs: map[string][]string{
+		"intranet.example.com": {"10.0.0.7"},
+	}}
+
+	target, err := ResolveTargetWith("intranet.example.com", PreferIPv6, resolver)
+	require.NoError(t, err)
+	assert.True(t, target.IP.Equal(net.ParseIP("10.0.0.7")))
+
+	_, err = ResolveTargetWith("missing.example.com", PreferIPv6, resolver)
+	assert.ErrorContains(t, err, "no such host")
+}
+
+func TestDNSServerAddr(t *testing.T) {
+	for server, want := range map[string]string{
+		"10.0.0.53":         "10.0.0.53:53",
+		"10.0.0.53:5353":    "10.0.0.53:5353",
+		"2001:db8::53":      "[2001:db8::53]:53",
+		"[2001:db8::53]":    "[2001:db8::53]:53",
+		"[2001:db8::53]:54": "[2001:db8::53]:54",
+		"dns.example.com":   "dns.example.com:53",
+	} {
+		addr, err := dnsServerAddr(server)
+		require.NoError(t, err, server)
+		assert.Equal(t, want, addr, server)
+	}
+
+	for _, server := range []string{"", "[[::1]]"} {
+		_, err := dnsServerAddr(server)
+		assert.Error(t, err, server)
+	}
+}
+
+func TestNewDNSResolverQueriesServer(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	resolver, err := NewDNSResolver(server.LocalAddr().String())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go func() { _, _ = resolver.LookupIPAddr(ctx, "intranet.example.com") }()
+
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(2*time.Second)))
+	buf := make([]byte, 512)
+	n, _, err := server.ReadFrom(buf)
+	require.NoError(t, err, "the query must be sent to the server")
+	assert.Contains(t, string(buf[:n]), "intranet")
+}
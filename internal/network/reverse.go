@@ -0,0 +1,124 @@
+package network
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReverseTimeout bounds a single PTR lookup when NewReverseResolver is given no timeout.
+const DefaultReverseTimeout = time.Second
+
+// DefaultReverseConcurrency is the number of PTR lookups a resolver created by
+// NewReverseResolver runs at once.
+const DefaultReverseConcurrency = 8
+
+// lookupAddr performs a PTR lookup; it is a variable so tests can avoid real DNS queries.
+var lookupAddr = net.DefaultResolver.LookupAddr
+
+// ReverseResolver resolves hop addresses to host names and caches the results.
+//
+// It is safe for concurrent use; concurrent lookups of the same address share a single
+// PTR query, and lookups of other addresses beyond its limit wait for a running one to
+// complete.
+type ReverseResolver struct {
+	// dns queries the PTR records, or the servers of the system configuration if nil.
+	dns     DNSResolver
+	timeout time.Duration
+	// slots holds a token per running PTR query.
+	slots chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]*reverseEntry
+}
+
+type reverseEntry struct {
+	done chan struct{}
+	name string
+}
+
+// NewReverseResolver creates a ReverseResolver whose lookups give up after timeout, and
+// that runs up to DefaultReverseConcurrency of them at once.
+func NewReverseResolver(timeout time.Duration) *ReverseResolver {
+	return NewLimitedReverseResolver(timeout, DefaultReverseConcurrency)
+}
+
+// NewLimitedReverseResolver creates a ReverseResolver whose lookups give up after timeout,
+// and that runs up to limit of them at once, DefaultReverseConcurrency if not positive.
+// The timeout only counts once a lookup runs, so that lookups waiting their turn are not
+// cached as failures.
+func NewLimitedReverseResolver(timeout time.Duration, limit int) *ReverseResolver {
+	return NewReverseResolverWith(nil, timeout, limit)
+}
+
+// NewReverseResolverWith creates a ReverseResolver like NewLimitedReverseResolver, whose
+// lookups query dns instead of the servers of the system configuration unless it is nil.
+func NewReverseResolverWith(dns DNSResolver, timeout time.Duration, limit int) *ReverseResolver {
+	if timeout <= 0 {
+		timeout = DefaultReverseTimeout
+	}
+	if limit <= 0 {
+		limit = DefaultReverseConcurrency
+	}
+
+	return &ReverseResolver{
+		dns:     dns,
+		timeout: timeout,
+		slots:   make(chan struct{}, limit),
+		cache:   make(map[string]*reverseEntry),
+	}
+}
+
+// ResolveHop returns the host name of ip, or the address itself formatted as a string if
+// it has no PTR record or the lookup fails or times out.
+func (r *ReverseResolver) ResolveHop(ip net.IP) string {
+	key := ip.String()
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	if !ok {
+		entry = &reverseEntry{done: make(chan struct{})}
+		r.cache[key] = entry
+	}
+	r.mu.Unlock()
+
+	if ok {
+		<-entry.done
+		return entry.name
+	}
+
+	entry.name = r.lookup(ip)
+	close(entry.done)
+
+	return entry.name
+}
+
+func (r *ReverseResolver) lookup(ip net.IP) string {
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	lookup := lookupAddr
+	if r.dns != nil {
+		lookup = r.dns.LookupAddr
+	}
+	names, err := lookup(ctx, ip.String())
+	if err != nil || len(names) == 0 {
+		return ip.String()
+	}
+
+	return strings.TrimSuffix(names[0], ".")
+}
+
+var defaultReverseResolver = NewReverseResolver(DefaultReverseTimeout)
+
+// ResolveHop resolves ip to a host name using a process-wide cache.
+//
+// See ReverseResolver.ResolveHop.
+func ResolveHop(ip net.IP) string {
+	return defaultReverseResolver.ResolveHop(ip)
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func stubLookupAddr(t *testing.T, lookup func(ctx context.Context, addr string) ([]string, error)) {
+	t.Helper()
+
+	original := lookupAddr
+	t.Cleanup(func() { lookupAddr = original })
+
+	lookupAddr = lookup
+}
+
+func TestReverseResolverResolveHop(t *testing.T) {
+	stubLookupAddr(t, func(_ context.Context, addr string) ([]string, error) {
+		assert.Equal(t, "192.0.2.1", addr)
+		return []string{"router.example.net."}, nil
+	})
+
+	r := NewReverseResolver(time.Second)
+
+	assert.Equal(t, "router.example.net", r.ResolveHop(net.IPv4(192, 0, 2, 1)))
+}
+
+func TestReverseResolverFallsBackToIP(t *testing.T) {
+	stubLookupAddr(t, func(_ context.Context, addr string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	})
+
+	r := NewReverseResolver(time.Second)
+
+	assert.Equal(t, "2001:db8::1", r.ResolveHop(net.ParseIP("2001:db8::1")))
+}
+
+func TestReverseResolverTimeout(t *testing.T) {
+	stubLookupAddr(t, func(ctx context.Context, _ string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	r := NewReverseResolver(10 * time.Millisecond)
+
+	start := time.Now()
+	assert.Equal(t, "192.0.2.1", r.ResolveHop(net.IPv4(192, 0, 2, 1)))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestReverseResolverLimitsConcurrency(t *testing.T) {
+	var running, peak int32
+	stubLookupAddr(t, func(context.Context, string) ([]string, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return []string{"router.example.net."}, nil
+	})
+
+	// Lookups waiting their turn longer than the timeout still complete.
+	r := NewLimitedReverseResolver(30*time.Millisecond, 2)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 6; i++ {
+		wg.Add(1)
+		go func(ip net.IP) {
+			defer wg.Done()
+			assert.Equal(t, "router.example.net", r.ResolveHop(ip))
+		}(net.IPv4(192, 0, 2, byte(i)))
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak))
+}
+
+func TestNewLimitedReverseResolverDefaults(t *testing.T) {
+	r := NewLimitedReverseResolver(0, 0)
+
+	assert.Equal(t, DefaultReverseTimeout, r.timeout)
+	assert.Equal(t, DefaultReverseConcurrency, cap(r.slots))
+}
+
+func TestReverseResolverCaches(t *testing.T) {
+	var calls int32
+	stubLookupAddr(t, func(context.Context, string) ([]string, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return []string{"router.example.net."}, nil
+	})
+
+	r := NewReverseResolver(time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "router.example.net", r.ResolveHop(net.IPv4(192, 0, 2, 1)))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestReverseResolverWith(t *testing.T) {
+	stubLookupAddr(t, func(context.Context, string) ([]string, error) {
+		t.Fatal("the system resolver must not be queried")
+		return nil, nil
+	})
+	dns := &stubDNSResolver{names: map[string][]string{"10.0.0.1": {"gw.corp.example."}}}
+
+	r := NewReverseResolverWith(dns, time.Second, 1)
+
+	assert.Equal(t, "gw.corp.example", r.ResolveHop(net.IPv4(10, 0, 0, 1)))
+	assert.Equal(t, "10.0.0.2", r.ResolveHop(net.IPv4(10, 0, 0, 2)))
+}
@@ -0,0 +1,74 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// interfaceAddrs lists the addresses of the local interfaces; it is a variable so tests can
+// control them.
+var interfaceAddrs = net.InterfaceAddrs
+
+// SourceAddrError is returned when probes should leave from an address that is not
+// assigned to any local interface.
+type SourceAddrError struct {
+	// IP is the requested source address.
+	IP net.IP
+	// Valid lists the addresses of the local interfaces of the same family.
+	Valid []net.IP
+}
+
+func (e *SourceAddrError) Error() string {
+	valid := make([]string, len(e.Valid))
+	for i, ip := range e.Valid {
+		valid[i] = ip.String()
+	}
+	return fmt.Sprintf("source address %v is not assigned to a local interface; valid choices: %s",
+		e.IP, strings.Join(valid, ", "))
+}
+
+// CheckSourceIP returns a *SourceAddrError unless ip is assigned to a local interface.
+func CheckSourceIP(ip net.IP) error {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list local addresses: %w", err)
+	}
+
+	v4 := ip.To4() != nil
+	var valid []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.Equal(ip) {
+			return nil
+		}
+		if (ipNet.IP.To4() != nil) == v4 {
+			valid = append(valid, ipNet.IP)
+		}
+	}
+
+	return &SourceAddrError{IP: ip, Valid: valid}
+}
+
+// bindAddr returns the address to bind a socket to for sending from local, which must be
+// assigned to a local interface unless it is nil or unspecified. A nil address binds every
+// interface of the family.
+func bindAddr(family Family, local net.IP) (string, error) {
+	if local == nil || local.IsUnspecified() {
+		if family == IPv6 {
+			return AllInterfacesV6, nil
+		}
+		return AllInterfaces, nil
+	}
+
+	if (local.To4() != nil) != (family == IPv4) {
+		return "", fmt.Errorf("source address %v is not an %v address", local, family)
+	}
+	if err := CheckSourceIP(local); err != nil {
+		return "", err
+	}
+	return local.String(), nil
+}
@@ -0,0 +1,128 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stubInterfaceAddrs(t *testing.T, cidrs ...string) {
+	t.Helper()
+
+	original := interfaceAddrs
+	t.Cleanup(func() { interfaceAddrs = original })
+
+	var addrs []net.Addr
+	for _, cidr := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+	}
+	interfaceAddrs = func() ([]net.Addr, error) { return addrs, nil }
+}
+
+func TestCheckSourceIP(t *testing.T) {
+	stubInterfaceAddrs(t, "127.0.0.1/8", "::1/128", "192.0.2.10/24", "2001:db8::10/64")
+
+	assert.NoError(t, CheckSourceIP(net.IPv4(192, 0, 2, 10)))
+	assert.NoError(t, CheckSourceIP(net.ParseIP("2001:db8::10")))
+
+	err := CheckSourceIP(net.IPv4(192, 0, 2, 99))
+
+	var sourceErr *SourceAddrError
+	require.ErrorAs(t, err, &sourceErr)
+	assert.EqualError(t, err, "source address 192.0.2.99 is not assigned to a local interface; "+
+		"valid choices: 127.0.0.1, 192.0.2.10")
+}
+
+func TestCheckSourceIPListFailure(t *testing.T) {
+	original := interfaceAddrs
+	t.Cleanup(func() { interfaceAddrs = original })
+	interfaceAddrs = func() ([]net.Addr, error) { return nil, errors.New("no netlink") }
+
+	err := CheckSourceIP(net.IPv4(192, 0, 2, 10))
+	assert.ErrorContains(t, err, "failed to list local addresses")
+}
+
+func TestBindAddr(t *testing.T) {
+	stubInterfaceAddrs(t, "192.0.2.10/24")
+
+	addr, err := bindAddr(IPv4, nil)
+	require.NoError(t, err)
+	assert.Equal(t, AllInterfaces, addr)
+
+	addr, err = bindAddr(IPv6, net.IPv6unspecified)
+	require.NoError(t, err)
+	assert.Equal(t, AllInterfacesV6, addr)
+
+	addr, err = bindAddr(IPv4, net.IPv4(192, 0, 2, 10))
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.10", addr)
+
+	_, err = bindAddr(IPv6, net.IPv4(192, 0, 2, 10))
+	assert.EqualError(t, err, "source address 192.0.2.10 is not an IPv6 address")
+}
+
+func TestNewUDPConnFromSourceIP(t *testing.T) {
+	conn, err := NewUDPConnFrom(IPv4, net.IPv4(127, 0, 0, 1), 0)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.True(t, conn.LocalAddr().(*net.UDPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)))
+
+	stubInterfaceAddrs(t, "127.0.0.1/8")
+	conn, err = NewUDPConnFrom(IPv4, net.IPv4(192, 0, 2, 99), 0)
+
+	var sourceErr *SourceAddrError
+	assert.ErrorAs(t, err, &sourceErr)
+	assert.Nil(t, conn)
+}
+
+func TestNewICMPConnBoundSourceIP(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux routes the whole of 127.0.0.0/8 to the loopback interface")
+	}
+	stubInterfaceAddrs(t, "127.0.0.1/8", "127.0.0.2/8")
+	source := net.IPv4(127, 0, 0, 2)
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	bound, err := NewICMPConnBound(IPv4, source)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer bound.Close()
+	if bound.Mode() != RawICMP {
+		t.Skip("datagram sockets only receive the replies to their own Echo Requests")
+	}
+
+	other, err := NewICMPConn(IPv4)
+	require.NoError(t, err)
+	defer other.Close()
+
+	// The reply to the first Echo Request goes to 127.0.0.1, that to the second one, sent
+	// from the bound listener, to 127.0.0.2.
+	require.NoError(t, other.SendEcho(dst, 64, 0x4245, 1, nil))
+	require.NoError(t, bound.SendEcho(dst, 64, 0x4245, 2, nil))
+
+	var seqs []int
+	for {
+		_, data, _, err := bound.ReadWithTimeout(200 * time.Millisecond)
+		if errors.Is(err, ErrReadTimeout) {
+			break
+		}
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(IPv4, data)
+		if err == nil && parsed.Echo != nil && parsed.Echo.ID == 0x4245 {
+			seqs = append(seqs, parsed.Echo.Seq)
+		}
+	}
+	assert.Equal(t, []int{2}, seqs, "only the replies sent to the source address are read")
+}
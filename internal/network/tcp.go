@@ -0,0 +1,244 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	protocolTCP = 6
+
+	tcpHeaderLen = 20
+
+	// ephemeralPortMin and ephemeralPortMax bound the randomly chosen SYN source port.
+	ephemeralPortMin = 32768
+	ephemeralPortMax = 60999
+)
+
+// TCP header flags.
+const (
+	TCPFlagFIN = 0x01
+	TCPFlagSYN = 0x02
+	TCPFlagRST = 0x04
+	TCPFlagACK = 0x10
+)
+
+// TCPSegment is the decoded header of a TCP segment.
+type TCPSegment struct {
+	SrcPort int
+	DstPort int
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+}
+
+// IsSYNACK reports whether the segment acknowledges a SYN, i.e. the port is open.
+func (s *TCPSegment) IsSYNACK() bool {
+	return s.Flags&(TCPFlagSYN|TCPFlagACK) == TCPFlagSYN|TCPFlagACK
+}
+
+// IsRST reports whether the segment resets the connection, i.e. the port is closed.
+func (s *TCPSegment) IsRST() bool {
+	return s.Flags&TCPFlagRST != 0
+}
+
+// ParseTCPSegment decodes the TCP header at the start of b.
+func ParseTCPSegment(b []byte) (*TCPSegment, error) {
+	if len(b) < tcpHeaderLen {
+		return nil, fmt.Errorf("TCP segment too short: %d bytes", len(b))
+	}
+
+	return &TCPSegment{
+		SrcPort: int(binary.BigEndian.Uint16(b[0:2])),
+		DstPort: int(binary.BigEndian.Uint16(b[2:4])),
+		Seq:     binary.BigEndian.Uint32(b[4:8]),
+		Ack:     binary.BigEndian.Uint32(b[8:12]),
+		Flags:   b[13],
+	}, nil
+}
+
+// TCPConn wraps a raw *net.IPConn used to send TCP SYN probes for traceroute operations.
+type TCPConn struct {
+	*net.IPConn
+	syscallConn SyscallConn
+	family      Family
+	localIP     net.IP
+	srcPort     int
+}
+
+// NewTCPConn creates a new raw TCP connection of the given family bound to the local address.
+//
+// The local address should be in the format "ip:port". The port is used as the source port
+// of the SYN probes; use ":0" to bind any address and pick a random ephemeral port.
+// Opening a raw socket usually requires elevated privileges.
+func NewTCPConn(family Family, localAddr string) (*TCPConn, error) {
+	var network, tcpNetwork string
+
+	switch family {
+	case IPv4:
+		network, tcpNetwork = "ip4:tcp", "tcp4"
+	case IPv6:
+		network, tcpNetwork = "ip6:tcp", "tcp6"
+	default:
+		return nil, fmt.Errorf("unsupported address family: %v", family)
+	}
+
+	addr, err := net.ResolveTCPAddr(tcpNetwork, localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve local address: %w", err)
+	}
+
+	conn, err := net.ListenIP(network, &net.IPAddr{IP: addr.IP, Zone: addr.Zone})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TCP connection: %w", err)
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to get syscall conn: %w", err)
+	}
+
+	srcPort := addr.Port
+	if srcPort == 0 {
+		srcPort = ephemeralPortMin + rand.Intn(ephemeralPortMax-ephemeralPortMin+1)
+	}
+
+	return &TCPConn{
+		IPConn:      conn,
+		syscallConn: rawConn,
+		family:      family,
+		localIP:     addr.IP,
+		srcPort:     srcPort,
+	}, nil
+}
+
+// Family returns the address family of the connection.
+func (c *TCPConn) Family() Family {
+	return c.family
+}
+
+// SrcPort returns the source port used by the SYN probes.
+func (c *TCPConn) SrcPort() int {
+	return c.srcPort
+}
+
+// SetTTL sets the Time to Live (TTL) for outgoing packets.
+//
+// On IPv6 connections the unicast hop limit is set instead.
+// Returns an error if setting TTL fails.
+func (c *TCPConn) SetTTL(ttl int) error {
+	return setTTL(c.syscallConn, c.family, ttl)
+}
+
+// SendSYN sends a TCP SYN segment to the specified address.
+//
+// The destination answers with SYN-ACK if the port is open or RST if it is closed, while
+// routers along the way answer with ICMP Time Exceeded once the TTL expires.
+// It returns an error if sending the segment fails.
+func (c *TCPConn) SendSYN(addr *net.TCPAddr) error {
+	src, err := sourceIP(c.localIP, addr.IP)
+	if err != nil {
+		return err
+	}
+
+	segment := buildSYN(src, addr.IP, c.srcPort, addr.Port, rand.Uint32())
+
+	if _, err := c.WriteToIP(segment, &net.IPAddr{IP: addr.IP, Zone: addr.Zone}); err != nil {
+		return fmt.Errorf("failed to send TCP SYN: %w", err)
+	}
+
+	return nil
+}
+
+// ReadResponse waits at most timeout for the destination's answer to a SYN sent to addr.
+//
+// Segments that are not addressed from addr to the probe's source port are skipped. If
+// no answer arrives in time, ErrReadTimeout is returned.
+func (c *TCPConn) ReadResponse(addr *net.TCPAddr, timeout time.Duration) (*TCPSegment, error) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+
+	return c.readResponse(addr)
+}
+
+// ReadResponseWithContext is like ReadResponse but waits until ctx is done instead of a
+// fixed timeout, in which case ctx.Err() is returned.
+func (c *TCPConn) ReadResponseWithContext(
+	ctx context.Context,
+	addr *net.TCPAddr,
+) (*TCPSegment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+
+	stop := interruptOnDone(ctx, c)
+	segment, err := c.readResponse(addr)
+	stop()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+
+	return segment, nil
+}
+
+func (c *TCPConn) readResponse(addr *net.TCPAddr) (*TCPSegment, error) {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, peer, err := c.ReadFromIP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, ErrReadTimeout
+			}
+			return nil, fmt.Errorf("failed to read TCP segment: %w", err)
+		}
+
+		segment, err := ParseTCPSegment(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if peer.IP.Equal(addr.IP) && segment.SrcPort == addr.Port &&
+			segment.DstPort == c.srcPort {
+			return segment, nil
+		}
+	}
+}
+
+// Close closes the TCP connection and releases associated resources.
+func (c *TCPConn) Close() error {
+	return c.IPConn.Close()
+}
+
+// buildSYN builds a TCP SYN segment with a valid checksum.
+func buildSYN(src, dst net.IP, srcPort, dstPort int, seq uint32) []byte {
+	b := make([]byte, tcpHeaderLen)
+
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	b[12] = (tcpHeaderLen / 4) << 4
+	b[13] = TCPFlagSYN
+	binary.BigEndian.PutUint16(b[14:16], 65535)
+
+	sum := internetChecksum(pseudoHeaderSum(src, dst, protocolTCP, len(b)), b)
+	binary.BigEndian.PutUint16(b[16:18], sum)
+
+	return b
+}
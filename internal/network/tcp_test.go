@@ -0,0 +1,155 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTCPConn(t *testing.T, family Family, localAddr string) *TCPConn {
+	t.Helper()
+
+	conn, err := NewTCPConn(family, localAddr)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw TCP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestNewTCPConn(t *testing.T) {
+	conn := newTestTCPConn(t, IPv4, ":0")
+
+	assert.Equal(t, IPv4, conn.Family())
+	assert.GreaterOrEqual(t, conn.SrcPort(), ephemeralPortMin)
+	assert.LessOrEqual(t, conn.SrcPort(), ephemeralPortMax)
+
+	conn = newTestTCPConn(t, IPv4, "127.0.0.1:40123")
+	assert.Equal(t, 40123, conn.SrcPort())
+}
+
+func TestNewTCPConnUnsupportedFamily(t *testing.T) {
+	conn, err := NewTCPConn(Family(42), ":0")
+
+	assert.Error(t, err)
+	assert.Nil(t, conn)
+}
+
+func TestTCPConnSetTTL(t *testing.T) {
+	mockSyscallConn := new(MockSyscallConn)
+	mockSyscallConn.On("Control", mock.AnythingOfType("func(uintptr)")).Return(nil)
+
+	conn := &TCPConn{
+		syscallConn: mockSyscallConn,
+	}
+
+	err := conn.SetTTL(64)
+	assert.NoError(t, err)
+	mockSyscallConn.AssertCalled(t, "Control", mock.AnythingOfType("func(uintptr)"))
+}
+
+func TestTCPConnSetTTLSetsockoptFailure(t *testing.T) {
+	mockSyscallConn := new(MockSyscallConn)
+	mockSyscallConn.On("Control", mock.AnythingOfType("func(uintptr)")).
+		Run(func(args mock.Arguments) {
+			// An invalid descriptor makes setsockopt fail.
+			args.Get(0).(func(uintptr))(^uintptr(0))
+		}).
+		Return(nil)
+
+	conn := &TCPConn{
+		syscallConn: mockSyscallConn,
+		family:      IPv6,
+	}
+
+	err := conn.SetTTL(64)
+	assert.ErrorContains(t, err, "failed to set TTL")
+}
+
+func TestBuildSYN(t *testing.T) {
+	src, dst := net.IPv4(192, 0, 2, 2), net.IPv4(198, 51, 100, 7)
+
+	b := buildSYN(src, dst, 50000, 443, 0x01020304)
+	segment, err := ParseTCPSegment(b)
+
+	require.NoError(t, err)
+	assert.Equal(t, 50000, segment.SrcPort)
+	assert.Equal(t, 443, segment.DstPort)
+	assert.Equal(t, uint32(0x01020304), segment.Seq)
+	assert.Equal(t, uint8(TCPFlagSYN), segment.Flags)
+	assert.Equal(t, uint16(0), internetChecksum(pseudoHeaderSum(src, dst, protocolTCP, len(b)), b))
+}
+
+func TestParseTCPSegmentTooShort(t *testing.T) {
+	segment, err := ParseTCPSegment(make([]byte, 12))
+
+	assert.Error(t, err)
+	assert.Nil(t, segment)
+}
+
+func TestTCPSegmentFlags(t *testing.T) {
+	assert.True(t, (&TCPSegment{Flags: TCPFlagSYN | TCPFlagACK}).IsSYNACK())
+	assert.False(t, (&TCPSegment{Flags: TCPFlagSYN}).IsSYNACK())
+	assert.True(t, (&TCPSegment{Flags: TCPFlagRST | TCPFlagACK}).IsRST())
+	assert.False(t, (&TCPSegment{Flags: TCPFlagACK}).IsRST())
+}
+
+func TestTCPConnSendSYNOpenPort(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	conn := newTestTCPConn(t, IPv4, "127.0.0.1:0")
+	require.NoError(t, conn.SetTTL(64))
+
+	addr := listener.Addr().(*net.TCPAddr)
+	require.NoError(t, conn.SendSYN(addr))
+
+	segment, err := conn.ReadResponse(addr, time.Second)
+	require.NoError(t, err)
+	assert.True(t, segment.IsSYNACK())
+}
+
+func TestTCPConnSendSYNClosedPort(t *testing.T) {
+	conn := newTestTCPConn(t, IPv4, ":0")
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 61337}
+	require.NoError(t, conn.SendSYN(addr))
+
+	segment, err := conn.ReadResponse(addr, time.Second)
+	require.NoError(t, err)
+	assert.True(t, segment.IsRST())
+}
+
+func TestTCPConnReadResponseTimeout(t *testing.T) {
+	conn := newTestTCPConn(t, IPv4, "127.0.0.1:0")
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 61337}
+	_, err := conn.ReadResponse(addr, 50*time.Millisecond)
+
+	assert.ErrorIs(t, err, ErrReadTimeout)
+}
+
+func TestTCPConnReadResponseWithContextCancel(t *testing.T) {
+	conn := newTestTCPConn(t, IPv4, "127.0.0.1:0")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 61337}
+	_, err := conn.ReadResponseWithContext(ctx, addr)
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// parseTimestamp extracts the kernel receive timestamp from the control messages of a
+// read: the software timestamp of SCM_TIMESTAMPING, or SCM_TIMESTAMPNS.
+func parseTimestamp(oob []byte) (time.Time, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET {
+			continue
+		}
+		switch m.Header.Type {
+		case unix.SCM_TIMESTAMPING:
+			var ts unix.ScmTimestamping
+			if len(m.Data) < int(unsafe.Sizeof(ts)) {
+				continue
+			}
+			ts = *(*unix.ScmTimestamping)(unsafe.Pointer(&m.Data[0]))
+			// The software timestamp comes first; it is zero if only hardware ones were
+			// taken.
+			if ts.Ts[0].Sec != 0 || ts.Ts[0].Nsec != 0 {
+				return time.Unix(ts.Ts[0].Unix()), true
+			}
+		case syscall.SCM_TIMESTAMPNS:
+			var ts syscall.Timespec
+			if len(m.Data) < int(unsafe.Sizeof(ts)) {
+				continue
+			}
+			ts = *(*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+			return time.Unix(ts.Unix()), true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,149 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// controlMessage builds a control message buffer holding a single message.
+func controlMessage(level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func timespecBytes(ts syscall.Timespec) []byte {
+	b := make([]byte, unsafe.Sizeof(ts))
+	*(*syscall.Timespec)(unsafe.Pointer(&b[0])) = ts
+	return b
+}
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Unix(1700000000, 123456789)
+	oob := controlMessage(
+		syscall.SOL_SOCKET,
+		syscall.SCM_TIMESTAMPNS,
+		timespecBytes(syscall.NsecToTimespec(want.UnixNano())),
+	)
+
+	got, ok := parseTimestamp(oob)
+	require.True(t, ok)
+	assert.True(t, want.Equal(got), "got %v, want %v", got, want)
+}
+
+func scmTimestampingBytes(ts unix.ScmTimestamping) []byte {
+	b := make([]byte, unsafe.Sizeof(ts))
+	*(*unix.ScmTimestamping)(unsafe.Pointer(&b[0])) = ts
+	return b
+}
+
+func TestParseTimestampTimestamping(t *testing.T) {
+	want := time.Unix(1700000000, 987654321)
+	var ts unix.ScmTimestamping
+	ts.Ts[0] = unix.NsecToTimespec(want.UnixNano())
+	ts.Ts[2] = unix.NsecToTimespec(time.Unix(42, 0).UnixNano())
+	oob := controlMessage(syscall.SOL_SOCKET, unix.SCM_TIMESTAMPING, scmTimestampingBytes(ts))
+
+	got, ok := parseTimestamp(oob)
+	require.True(t, ok)
+	assert.True(t, want.Equal(got), "got %v, want %v", got, want)
+}
+
+func TestParseTimestampTimestampingHardwareOnly(t *testing.T) {
+	var ts unix.ScmTimestamping
+	ts.Ts[2] = unix.NsecToTimespec(time.Unix(42, 0).UnixNano())
+	oob := controlMessage(syscall.SOL_SOCKET, unix.SCM_TIMESTAMPING, scmTimestampingBytes(ts))
+
+	_, ok := parseTimestamp(oob)
+	assert.False(t, ok, "hardware timestamps are on another clock")
+}
+
+func TestParseTimestampAfterOtherMessages(t *testing.T) {
+	want := time.Unix(1700000000, 5)
+	oob := append(
+		controlMessage(syscall.IPPROTO_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}),
+		controlMessage(
+			syscall.SOL_SOCKET,
+			syscall.SCM_TIMESTAMPNS,
+			timespecBytes(syscall.NsecToTimespec(want.UnixNano())),
+		)...,
+	)
+
+	got, ok := parseTimestamp(oob)
+	require.True(t, ok)
+	assert.True(t, want.Equal(got), "got %v, want %v", got, want)
+}
+
+func TestParseTimestampMissing(t *testing.T) {
+	tests := []struct {
+		name string
+		oob  []byte
+	}{
+		{name: "empty", oob: nil},
+		{
+			name: "other message",
+			oob:  controlMessage(syscall.IPPROTO_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}),
+		},
+		{
+			name: "truncated",
+			oob:  controlMessage(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMPNS, []byte{1, 2}),
+		},
+		{
+			name: "truncated timestamping",
+			oob:  controlMessage(syscall.SOL_SOCKET, unix.SCM_TIMESTAMPING, make([]byte, 16)),
+		},
+		{name: "malformed", oob: []byte{1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := parseTimestamp(tt.oob)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestICMPConnTimestampsLoopback(t *testing.T) {
+	conn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.EnableTimestamps())
+
+	sentAt := time.Now()
+	require.NoError(t, conn.SendEcho(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 64, 0x4244, 1, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for {
+		msg, err := conn.ReadMessage(ctx)
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(IPv4, msg.Data)
+		if err == nil && parsed.MatchesEcho(0x4244, 1) {
+			readAt := time.Now()
+			assert.False(t, msg.ReceivedAt.Before(sentAt.Add(-time.Millisecond)))
+			assert.False(t, msg.ReceivedAt.After(readAt))
+			assert.Equal(t, -1, msg.TTL)
+			return
+		}
+	}
+}
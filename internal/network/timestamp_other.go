@@ -0,0 +1,9 @@
+//go:build !linux
+
+package network
+
+import "time"
+
+func parseTimestamp(_ []byte) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"my-little-tracerouter/internal/sockopt"
+)
+
+// dscpCodePoints maps the names of the standard DSCP classes to their code points
+// (RFC 2474, RFC 2597, RFC 3246, RFC 5865 and RFC 8622).
+var dscpCodePoints = map[string]int{
+	"CS0":  0,
+	"LE":   1,
+	"CS1":  8,
+	"AF11": 10,
+	"AF12": 12,
+	"AF13": 14,
+	"CS2":  16,
+	"AF21": 18,
+	"AF22": 20,
+	"AF23": 22,
+	"CS3":  24,
+	"AF31": 26,
+	"AF32": 28,
+	"AF33": 30,
+	"CS4":  32,
+	"AF41": 34,
+	"AF42": 36,
+	"AF43": 38,
+	"CS5":  40,
+	"VA":   44,
+	"EF":   46,
+	"CS6":  48,
+	"CS7":  56,
+}
+
+// ECN is an Explicit Congestion Notification codepoint, held in the two low-order bits of
+// the TOS byte or IPv6 traffic class (RFC 3168).
+type ECN int
+
+const (
+	// NotECT marks a packet whose transport does not support ECN.
+	NotECT ECN = iota
+	// ECT1 marks an ECN-capable transport with ECT(1).
+	ECT1
+	// ECT0 marks an ECN-capable transport with ECT(0).
+	ECT0
+	// CE marks a packet a router experienced congestion with.
+	CE
+)
+
+// String returns the name RFC 3168 gives the codepoint, e.g. "ECT(0)".
+func (e ECN) String() string {
+	switch e {
+	case NotECT:
+		return "Not-ECT"
+	case ECT1:
+		return "ECT(1)"
+	case ECT0:
+		return "ECT(0)"
+	case CE:
+		return "CE"
+	default:
+		return fmt.Sprintf("ECN(%d)", int(e))
+	}
+}
+
+// ECNOf returns the ECN codepoint of a TOS byte or traffic class.
+func ECNOf(tos int) ECN {
+	return ECN(tos & 0x3)
+}
+
+// ParseTOS parses a Type of Service byte given either as a number, e.g. "184" or "0xb8",
+// or as the name of a DSCP class, e.g. "EF" or "cs6". A DSCP class takes the upper six
+// bits of the byte, leaving the ECN bits clear.
+func ParseTOS(s string) (int, error) {
+	if dscp, ok := dscpCodePoints[strings.ToUpper(s)]; ok {
+		return dscp << 2, nil
+	}
+
+	tos, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TOS %q: not a byte or DSCP class name", s)
+	}
+
+	return int(tos), nil
+}
+
+// SetTOS sets the Type of Service byte of outgoing datagrams, whose upper six bits hold the
+// DSCP class. On IPv6 connections the traffic class is set instead.
+func (c *UDPConn) SetTOS(tos int) error {
+	return setTOS(c.syscallConn, c.family, tos)
+}
+
+// SetTOS sets the Type of Service byte of the SYN probes.
+//
+// See UDPConn.SetTOS.
+func (c *TCPConn) SetTOS(tos int) error {
+	return setTOS(c.syscallConn, c.family, tos)
+}
+
+// setTOS sets the IPv4 TOS or IPv6 traffic class of the socket behind conn.
+func setTOS(conn SyscallConn, family Family, tos int) error {
+	return sockopt.SetTOS(conn, family == IPv6, tos)
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTOS(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"EF", 0xb8},
+		{"ef", 0xb8},
+		{"CS6", 0xc0},
+		{"AF41", 0x88},
+		{"CS0", 0},
+		{"184", 184},
+		{"0x10", 0x10},
+		{"0", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			tos, err := ParseTOS(tt.in)
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tos)
+		})
+	}
+}
+
+func TestParseTOSInvalid(t *testing.T) {
+	for _, in := range []string{"", "256", "-1", "XX"} {
+		_, err := ParseTOS(in)
+
+		assert.Error(t, err, "input %q", in)
+	}
+}
+
+func TestECN(t *testing.T) {
+	assert.Equal(t, ECT0, ECNOf(0xba))
+	assert.Equal(t, NotECT, ECNOf(0xb8))
+	assert.Equal(t, CE, ECNOf(0x03))
+	assert.Equal(t, "Not-ECT", NotECT.String())
+	assert.Equal(t, "ECT(1)", ECT1.String())
+	assert.Equal(t, "ECT(0)", ECT0.String())
+	assert.Equal(t, "CE", CE.String())
+	assert.Equal(t, "ECN(7)", ECN(7).String())
+}
+
+func TestUDPConnSetTOSOutOfRange(t *testing.T) {
+	mockConn := new(MockSyscallConn)
+	conn := &UDPConn{syscallConn: mockConn}
+
+	assert.EqualError(t, conn.SetTOS(256), "invalid TOS: 256")
+	mockConn.AssertNotCalled(t, "Control", mock.Anything)
+}
+
+func TestSetTOSControlFailure(t *testing.T) {
+	mockConn := new(MockSyscallConn)
+	mockConn.On("Control", mock.AnythingOfType("func(uintptr)")).Return(errors.New("closed"))
+
+	assert.EqualError(t, setTOS(mockConn, IPv6, 0xb8), "failed to set TOS: closed")
+}
@@ -0,0 +1,15 @@
+package network
+
+import "errors"
+
+// IsTransient reports whether err, returned by sending a probe, is a transient failure
+// after which sending again may succeed, such as a full socket buffer under load. Other
+// errors, e.g. an unreachable network or a denied permission, are permanent.
+func IsTransient(err error) bool {
+	for _, transient := range transientErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, transient := range transientErrors {
+		err := fmt.Errorf("failed to send UDP packet: %w", &net.OpError{
+			Op:  "write",
+			Net: "udp",
+			Err: os.NewSyscallError("sendto", transient),
+		})
+		assert.True(t, IsTransient(err), transient.Error())
+	}
+
+	assert.False(t, IsTransient(nil))
+	assert.False(t, IsTransient(errors.New("boom")))
+	assert.False(t, IsTransient(os.ErrPermission))
+	assert.False(t, IsTransient(&PacketTooBigError{Size: 1472, Err: errMessageTooLong}))
+}
@@ -1,12 +1,58 @@
 package network
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
-	"os"
+	"strconv"
 	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"my-little-tracerouter/internal/sockopt"
 )
 
+// PayloadSizeError is returned when a UDP payload would not fit in a packet of at most
+// MaxPacketSize bytes.
+type PayloadSizeError struct {
+	// Size is the requested payload length.
+	Size int
+	// Max is the longest payload that fits.
+	Max int
+}
+
+func (e *PayloadSizeError) Error() string {
+	return fmt.Sprintf("invalid UDP payload size %d: must be between 0 and %d", e.Size, e.Max)
+}
+
+// PortInUseError is returned when the local port a connection should be bound to is already
+// in use. Binding another port may succeed.
+type PortInUseError struct {
+	// Port is the local port that is in use.
+	Port int
+	// Err is the underlying error, usually EADDRINUSE.
+	Err error
+}
+
+func (e *PortInUseError) Error() string {
+	return fmt.Sprintf("failed to bind local port %d: %v", e.Port, e.Err)
+}
+
+func (e *PortInUseError) Unwrap() error {
+	return e.Err
+}
+
+// MaxPayloadSize returns the longest UDP payload that fits in a packet of MaxPacketSize
+// bytes along with the IP and UDP headers of the given family.
+func MaxPayloadSize(family Family) int {
+	if family == IPv6 {
+		return MaxPacketSize - ipv6.HeaderLen - udpHeaderLen
+	}
+	return MaxPacketSize - ipv4.HeaderLen - udpHeaderLen
+}
+
 // SyscallConn represents a low-level network connection.
 type SyscallConn interface {
 	Control(func(fd uintptr)) error
@@ -16,19 +62,44 @@ type SyscallConn interface {
 type UDPConn struct {
 	*net.UDPConn
 	syscallConn SyscallConn
+	family      Family
+	payload     PayloadFunc
+	// dst and src cache the source address of the last destination a checksum was
+	// computed for.
+	dst, src net.IP
+	// dest is where SendProbe sends probes, nil until SetDestination is called.
+	dest *net.UDPAddr
 }
 
-// NewUDPConn creates a new UDP connection bound UDP to the specified local address.
+// NewUDPConn creates a new UDP connection of the given family bound to the specified local address.
 //
-// The local address should be in the formay "ip:port". Use ":0" for any available port.
-// Returns a pointer to UDPConn and an error if the connection can't be established.
-func NewUDPConn(localAddr string) (*UDPConn, error) {
-	addr, err := net.ResolveUDPAddr("udp4", localAddr)
+// The local address should be in the format "ip:port". Use ":0" for any available port on
+// every address, or a concrete address such as "192.0.2.10:0" to send from it on a host
+// with several, e.g. for policy routing; replies then come back to that address. Unlike
+// NewUDPConnFrom, the address is not checked against the local interfaces first.
+// Returns a pointer to UDPConn and an error if the connection can't be established, which is
+// a *PortInUseError if the port is taken.
+func NewUDPConn(family Family, localAddr string) (*UDPConn, error) {
+	var network string
+
+	switch family {
+	case IPv4:
+		network = "udp4"
+	case IPv6:
+		network = "udp6"
+	default:
+		return nil, fmt.Errorf("unsupported address family: %v", family)
+	}
+
+	addr, err := net.ResolveUDPAddr(network, localAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve local address: %w", err)
 	}
 
-	conn, err := net.ListenUDP("udp4", addr)
+	conn, err := net.ListenUDP(network, addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, &PortInUseError{Port: addr.Port, Err: err}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create UDP connection: %w", err)
 	}
@@ -42,37 +113,213 @@ func NewUDPConn(localAddr string) (*UDPConn, error) {
 	return &UDPConn{
 		UDPConn:     conn,
 		syscallConn: rawConn,
+		family:      family,
 	}, nil
 }
 
+// NewUDPConnFrom creates a new UDP connection of the given family bound to the given local
+// address and port. A nil local address binds every address, and a zero port any available
+// one. It returns a *SourceAddrError if local is not assigned to a local interface and a
+// *PortInUseError if the port is taken.
+func NewUDPConnFrom(family Family, local net.IP, port int) (*UDPConn, error) {
+	if port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("invalid local port %d: must be between 0 and 65535", port)
+	}
+	host, err := bindAddr(family, local)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPConn(family, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Family returns the address family of the connection.
+func (c *UDPConn) Family() Family {
+	return c.family
+}
+
 // SetTTL sets the Time to Live (TTL) for outgoing packets.
 //
 // TTL value determines how many network hops a packet can traverse before being discarded.
+// On IPv6 connections the unicast hop limit is set instead.
 // Returns an error if setting TTL fails.
 func (c *UDPConn) SetTTL(ttl int) error {
-	return c.syscallConn.Control(func(fd uintptr) {
-		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	return setTTL(c.syscallConn, c.family, ttl)
+}
 
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to set TTL: %v\n", err)
-		}
-	})
+// setTTL sets the IPv4 TTL or IPv6 unicast hop limit of the socket behind conn.
+func setTTL(conn SyscallConn, family Family, ttl int) error {
+	return sockopt.SetTTL(conn, family == IPv6, ttl)
 }
 
 // SendEmptyPacket sends an empty UDP packet to the specified address.
 //
 // This function is used to send probe packets in the traceroute process.
-// It returns an error if sending the packet fails.
+// It returns an error if sending the packet fails. It is SendPacket with a size of zero.
 func (c *UDPConn) SendEmptyPacket(addr *net.UDPAddr) error {
-	_, err := c.WriteToUDP([]byte{}, addr)
+	return c.SendPacket(addr, 0)
+}
 
-	if err != nil {
+// SendPacket sends a UDP datagram whose payload is size bytes long to addr.
+//
+// It is SendProbeTo for TTL 0 and attempt 0, so unless SetPayloadFunc was called the payload
+// is filled with the same pattern as the probes of Unix traceroute and packets of a given
+// size are always identical.
+func (c *UDPConn) SendPacket(addr *net.UDPAddr, size int) error {
+	return c.SendProbeTo(addr, 0, 0, size)
+}
+
+// SetPayloadFunc sets the function generating the payloads sent by SendProbeTo. Passing nil
+// restores the default, IncrementingPayload.
+func (c *UDPConn) SetPayloadFunc(payload PayloadFunc) {
+	c.payload = payload
+}
+
+// SetDestination sets where SendProbe sends probes: the seq-th one goes to addr.IP on port
+// addr.Port + seq, as in classic traceroute.
+func (c *UDPConn) SetDestination(addr *net.UDPAddr) {
+	c.dest = addr
+}
+
+// SendProbe sends the seq-th empty probe for ttl to the destination set with
+// SetDestination, setting the TTL of the connection first.
+func (c *UDPConn) SendProbe(ttl, seq int) error {
+	if c.dest == nil {
+		return errors.New("failed to send probe: no destination set")
+	}
+	port := c.dest.Port + seq
+	if seq < 0 || port > 0xffff {
+		return fmt.Errorf("failed to send probe: invalid port %d", port)
+	}
+	if err := c.SetTTL(ttl); err != nil {
+		return err
+	}
+
+	addr := &net.UDPAddr{IP: c.dest.IP, Port: port, Zone: c.dest.Zone}
+	return c.SendProbeTo(addr, ttl, seq, 0)
+}
+
+// SendProbeTo sends the attempt-th probe for ttl to addr: a UDP datagram whose size-byte
+// payload is generated by the PayloadFunc of the connection.
+//
+// A size that does not fit a packet of MaxPacketSize bytes is rejected with
+// *PayloadSizeError; see MaxPayloadSize. The TTL of the datagram is not changed; see
+// SetTTL.
+func (c *UDPConn) SendProbeTo(addr *net.UDPAddr, ttl, attempt, size int) error {
+	if limit := MaxPayloadSize(c.family); size < 0 || size > limit {
+		return &PayloadSizeError{Size: size, Max: limit}
+	}
+
+	generate := c.payload
+	if generate == nil {
+		generate = IncrementingPayload
+	}
+	payload := generate(ttl, attempt, size)
+	if len(payload) != size {
+		return fmt.Errorf("failed to generate UDP payload: got %d bytes, want %d",
+			len(payload), size)
+	}
+
+	return c.send(addr, payload)
+}
+
+// SendPayload sends a UDP datagram carrying payload to addr.
+//
+// With the Don't Fragment bit set, a payload that does not fit the path MTU known to the
+// local host fails with *PacketTooBigError. See SetDontFragment.
+func (c *UDPConn) SendPayload(addr *net.UDPAddr, payload []byte) error {
+	return c.send(addr, payload)
+}
+
+// send sends payload to addr, reporting a payload that does not fit the path MTU with
+// *PacketTooBigError.
+func (c *UDPConn) send(addr *net.UDPAddr, payload []byte) error {
+	if _, err := c.WriteToUDP(payload, addr); err != nil {
+		if errors.Is(err, errMessageTooLong) {
+			return &PacketTooBigError{Size: len(payload), Err: err}
+		}
 		return fmt.Errorf("failed to send UDP packet: %w", err)
 	}
 
 	return nil
 }
 
+// SendWithChecksum sends a UDP datagram to addr whose UDP checksum equals checksum.
+//
+// A two-byte payload is chosen to produce the requested checksum, so probes sharing the
+// same ports can still be told apart by the checksum quoted in ICMP errors. This is how
+// Paris traceroute keeps every probe on the same load-balanced path. The checksum must not
+// be 0 or 0xffff, which the kernel cannot send as is.
+// It returns an error if sending the packet fails.
+func (c *UDPConn) SendWithChecksum(addr *net.UDPAddr, checksum uint16) error {
+	if checksum == 0 || checksum == 0xffff {
+		return fmt.Errorf("invalid UDP checksum: %#04x", checksum)
+	}
+
+	src, err := c.sourceIP(addr.IP)
+	if err != nil {
+		return err
+	}
+
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	return c.send(addr, udpChecksumPayload(src, addr.IP, port, addr.Port, checksum))
+}
+
+// OffloadedChecksum returns the checksum field of a datagram sent to addr by
+// SendWithChecksum as quoted by ICMP errors generated before checksum offloading filled it
+// in, which happens on loopback and virtual interfaces. The field then holds the folded
+// pseudo-header sum, which is the same for every such datagram.
+func (c *UDPConn) OffloadedChecksum(addr *net.UDPAddr) (int, error) {
+	src, err := c.sourceIP(addr.IP)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := pseudoHeaderSum(src, addr.IP, protocolUDP, udpHeaderLen+2)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return int(sum), nil
+}
+
+// sourceIP returns the address datagrams to dst leave from, looking it up once per
+// destination unless the connection is bound to a specific address.
+func (c *UDPConn) sourceIP(dst net.IP) (net.IP, error) {
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	if local != nil && !local.IsUnspecified() {
+		return local, nil
+	}
+	if c.src != nil && c.dst.Equal(dst) {
+		return c.src, nil
+	}
+
+	src, err := sourceIP(nil, dst)
+	if err != nil {
+		return nil, err
+	}
+	c.dst, c.src = dst, src
+	return src, nil
+}
+
+// udpChecksumPayload returns the two-byte payload that makes the checksum of a UDP datagram
+// between the given endpoints equal to checksum.
+func udpChecksumPayload(src, dst net.IP, srcPort, dstPort int, checksum uint16) []byte {
+	datagram := make([]byte, udpHeaderLen+2)
+	binary.BigEndian.PutUint16(datagram[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(datagram[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(len(datagram)))
+
+	// With a zero payload the checksum is the complement of the sum of everything else,
+	// so adding ^checksum to that sum in one's complement arithmetic yields the payload.
+	rest := uint32(internetChecksum(pseudoHeaderSum(src, dst, protocolUDP, len(datagram)),
+		datagram))
+	sum := rest + uint32(^checksum)
+	sum = (sum >> 16) + (sum & 0xffff)
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(sum))
+	return payload
+}
+
 // Close closes the UDP connection and releases associated resources.
 //
 // It should be called when the connection is no longer needed to prevent resource leaks.
@@ -1,9 +1,14 @@
 package network
 
 import (
+	"bytes"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"net"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -18,7 +23,7 @@ func (m *MockSyscallConn) Control(f func(fd uintptr)) error {
 }
 
 func TestNewUDPConn(t *testing.T) {
-	conn, err := NewUDPConn(":0")
+	conn, err := NewUDPConn(IPv4, ":0")
 	defer conn.Close()
 
 	assert.NoError(t, err)
@@ -27,6 +32,61 @@ func TestNewUDPConn(t *testing.T) {
 	assert.NotNil(t, conn.syscallConn)
 }
 
+func TestNewUDPConnSourceIP(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	assert.True(t, local.IP.Equal(net.IPv4(127, 0, 0, 1)))
+	assert.NotZero(t, local.Port)
+
+	conn, err = NewUDPConn(IPv4, "192.0.2.99:0")
+	assert.ErrorContains(t, err, "failed to create UDP connection")
+	assert.Nil(t, conn)
+}
+
+func TestNewUDPConnIPv6(t *testing.T) {
+	conn, err := NewUDPConn(IPv6, "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, IPv6, conn.Family())
+}
+
+func TestNewUDPConnUnsupportedFamily(t *testing.T) {
+	conn, err := NewUDPConn(Family(42), ":0")
+
+	assert.Error(t, err)
+	assert.Nil(t, conn)
+}
+
+func TestNewUDPConnFrom(t *testing.T) {
+	conn, err := NewUDPConnFrom(IPv4, nil, 0)
+	require.NoError(t, err)
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	second, err := NewUDPConnFrom(IPv4, nil, port)
+
+	var inUse *PortInUseError
+	require.ErrorAs(t, err, &inUse)
+	assert.Equal(t, port, inUse.Port)
+	assert.ErrorIs(t, err, syscall.EADDRINUSE)
+	assert.Nil(t, second)
+}
+
+func TestNewUDPConnFromInvalidPort(t *testing.T) {
+	for _, port := range []int{-1, 65536} {
+		conn, err := NewUDPConnFrom(IPv4, nil, port)
+
+		assert.Error(t, err, port)
+		assert.Nil(t, conn)
+	}
+}
+
 func TestUDPConnSetTTL(t *testing.T) {
 	mockSyscallConn := new(MockSyscallConn)
 	mockSyscallConn.On("Control", mock.AnythingOfType("func(uintptr)")).Return(nil)
@@ -40,6 +100,18 @@ func TestUDPConnSetTTL(t *testing.T) {
 	mockSyscallConn.AssertCalled(t, "Control", mock.AnythingOfType("func(uintptr)"))
 }
 
+func TestUDPConnSetTTLControlFailure(t *testing.T) {
+	mockSyscallConn := new(MockSyscallConn)
+	mockSyscallConn.On("Control", mock.AnythingOfType("func(uintptr)")).
+		Return(errors.New("closed"))
+
+	conn := &UDPConn{
+		syscallConn: mockSyscallConn,
+	}
+
+	assert.EqualError(t, conn.SetTTL(64), "failed to set TTL: closed")
+}
+
 func TestUDPConnSendEmptyPacket(t *testing.T) {
 	serverAddr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
 	assert.NoError(t, err)
@@ -60,7 +132,7 @@ func TestUDPConnSendEmptyPacket(t *testing.T) {
 		close(received)
 	}()
 
-	clientConn, err := NewUDPConn(":0")
+	clientConn, err := NewUDPConn(IPv4, ":0")
 	assert.NoError(t, err)
 	defer clientConn.Close()
 
@@ -74,8 +146,136 @@ func TestUDPConnSendEmptyPacket(t *testing.T) {
 	}
 }
 
+func TestUDPConnSendPayload(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	clientConn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	payload := make([]byte, 1472)
+	require.NoError(t, clientConn.SendPayload(serverConn.LocalAddr().(*net.UDPAddr), payload))
+
+	buf := make([]byte, 2048)
+	serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := serverConn.ReadFromUDP(buf)
+	require.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+}
+
+func TestUDPConnSendPacket(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	clientConn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	require.NoError(t, clientConn.SendPacket(serverConn.LocalAddr().(*net.UDPAddr), 68))
+
+	buf := make([]byte, 2048)
+	serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := serverConn.ReadFromUDP(buf)
+	require.NoError(t, err)
+	require.Equal(t, 68, n)
+	pattern := "@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~\x7f"
+	assert.Equal(t, []byte(pattern+"@ABC"), buf[:n])
+}
+
+func TestUDPConnSendProbe(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.ErrorContains(t, conn.SendProbe(1, 0), "no destination set")
+
+	server := serverConn.LocalAddr().(*net.UDPAddr)
+	conn.SetDestination(&net.UDPAddr{IP: server.IP, Port: server.Port - 2})
+	require.NoError(t, conn.SendProbe(5, 2), "the third probe goes to the server port")
+
+	buf := make([]byte, 64)
+	serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := serverConn.ReadFromUDP(buf)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	assert.Error(t, conn.SendProbe(1, 0xffff))
+}
+
+func TestUDPConnSendProbeToPayloads(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	clientConn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	perProbe := func(ttl, attempt, size int) []byte {
+		return bytes.Repeat([]byte{byte(ttl<<4 | attempt)}, size)
+	}
+
+	for _, tc := range []struct {
+		payload PayloadFunc
+		want    []byte
+	}{
+		{nil, []byte("@ABCD")},
+		{FillPayload(0xa5), []byte{0xa5, 0xa5, 0xa5, 0xa5, 0xa5}},
+		{BytesPayload([]byte("xy")), []byte("xyxyx")},
+		{perProbe, []byte{0x32, 0x32, 0x32, 0x32, 0x32}},
+	} {
+		clientConn.SetPayloadFunc(tc.payload)
+		require.NoError(t, clientConn.SendProbeTo(serverConn.LocalAddr().(*net.UDPAddr), 3, 2, 5))
+
+		buf := make([]byte, 64)
+		serverConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := serverConn.ReadFromUDP(buf)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, buf[:n])
+	}
+}
+
+func TestUDPConnSendProbeToInvalidPayload(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetPayloadFunc(func(ttl, attempt, size int) []byte { return []byte{1} })
+
+	err = conn.SendProbeTo(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33434}, 1, 0, 4)
+	assert.Error(t, err)
+}
+
+func TestUDPConnSendPacketTooLarge(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33434}
+	for _, size := range []int{-1, MaxPayloadSize(IPv4) + 1} {
+		err := conn.SendPacket(addr, size)
+
+		var sizeErr *PayloadSizeError
+		require.ErrorAs(t, err, &sizeErr)
+		assert.Equal(t, size, sizeErr.Size)
+		assert.Equal(t, 1472, sizeErr.Max)
+	}
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+	assert.Equal(t, 1472, MaxPayloadSize(IPv4))
+	assert.Equal(t, 1452, MaxPayloadSize(IPv6))
+}
+
 func TestUDPConnIntegration(t *testing.T) {
-	conn, err := NewUDPConn(":0")
+	conn, err := NewUDPConn(IPv4, ":0")
 	assert.NoError(t, err)
 	defer conn.Close()
 
@@ -88,3 +288,104 @@ func TestUDPConnIntegration(t *testing.T) {
 	err = conn.SendEmptyPacket(nonExistentAddr)
 	assert.NoError(t, err)
 }
+
+func TestUDPChecksumPayload(t *testing.T) {
+	for _, tt := range []struct{ src, dst string }{
+		{"192.0.2.1", "198.51.100.7"},
+		{"2001:db8::1", "2001:db8::7"},
+	} {
+		src, dst := net.ParseIP(tt.src), net.ParseIP(tt.dst)
+
+		for _, checksum := range []uint16{1, 2, 0x1234, 0xfffe} {
+			payload := udpChecksumPayload(src, dst, 50000, 33434, checksum)
+
+			datagram := []byte{0xc3, 0x50, 0x82, 0x9a, 0x00, 0x0a, 0x00, 0x00}
+			datagram = append(datagram, payload...)
+			sum := internetChecksum(pseudoHeaderSum(src, dst, protocolUDP, len(datagram)),
+				datagram)
+
+			assert.Equal(t, checksum, sum, "%v -> %v", src, dst)
+		}
+	}
+}
+
+func TestUDPConnOffloadedChecksum(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	checksum, err := conn.OffloadedChecksum(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+
+	require.NoError(t, err)
+	// 0x7f00 + 0x0001 twice for the addresses, 17 for UDP and 10 for the length.
+	assert.Equal(t, 0xfe1d, checksum)
+}
+
+func TestUDPConnSourceIPCached(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dest := net.IPv4(127, 0, 0, 1)
+	src, err := conn.sourceIP(dest)
+	require.NoError(t, err)
+	assert.True(t, src.Equal(dest))
+
+	// A cached address is reused without looking the route up again.
+	cached := net.IPv4(127, 0, 0, 2)
+	conn.src = cached
+	src, err = conn.sourceIP(dest)
+	require.NoError(t, err)
+	assert.Equal(t, cached, src)
+
+	src, err = conn.sourceIP(net.IPv4(127, 0, 0, 3))
+	require.NoError(t, err)
+	assert.True(t, src.Equal(net.IPv4(127, 0, 0, 1)), "another destination is looked up")
+}
+
+func TestUDPConnSendWithChecksumInvalid(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33434}
+
+	assert.Error(t, conn.SendWithChecksum(addr, 0))
+	assert.Error(t, conn.SendWithChecksum(addr, 0xffff))
+}
+
+func TestUDPConnSendWithChecksumLoopback(t *testing.T) {
+	icmpConn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer icmpConn.Close()
+
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dest := net.IPv4(127, 0, 0, 1)
+	require.NoError(t, conn.SendWithChecksum(&net.UDPAddr{IP: dest, Port: 33434}, 0x1234))
+
+	srcPort := conn.LocalAddr().(*net.UDPAddr).Port
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		_, data, _, err := icmpConn.ReadWithTimeout(time.Until(deadline))
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(IPv4, data)
+		if err != nil || parsed.Key == nil || parsed.Key.SrcPort != srcPort {
+			continue
+		}
+
+		// Loopback leaves the checksum to be computed by an offloading device that does
+		// not exist, so the quote holds the partial checksum instead.
+		offloaded, err := conn.OffloadedChecksum(&net.UDPAddr{IP: dest, Port: 33434})
+		require.NoError(t, err)
+		assert.Contains(t, []int{0x1234, offloaded}, parsed.Key.Checksum)
+		return
+	}
+	t.Fatal("no Port Unreachable quoting the probe")
+}
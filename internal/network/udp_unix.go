@@ -0,0 +1,18 @@
+//go:build unix
+
+package network
+
+import "syscall"
+
+// errMessageTooLong is the error sending a datagram larger than the path MTU fails with.
+var errMessageTooLong error = syscall.EMSGSIZE
+
+// transientErrors are the errors sending a datagram fails with when the socket buffers are
+// full or the call was interrupted.
+var transientErrors = []error{syscall.ENOBUFS, syscall.EAGAIN, syscall.ENOMEM, syscall.EINTR}
+
+// permissionError returns err, which already matches os.ErrPermission if it is EPERM or
+// EACCES.
+func permissionError(err error) error {
+	return err
+}
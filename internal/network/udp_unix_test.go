@@ -0,0 +1,133 @@
+//go:build unix
+
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func getsockoptInt(t *testing.T, conn *UDPConn, level, opt int) int {
+	t.Helper()
+
+	var value int
+	var sockErr error
+	require.NoError(t, conn.syscallConn.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, sockErr)
+
+	return value
+}
+
+func TestUDPConnSetTTLSetsockoptFailure(t *testing.T) {
+	mockSyscallConn := new(MockSyscallConn)
+	mockSyscallConn.On("Control", mock.AnythingOfType("func(uintptr)")).
+		Run(func(args mock.Arguments) {
+			// An invalid descriptor makes setsockopt fail with EBADF.
+			args.Get(0).(func(uintptr))(^uintptr(0))
+		}).
+		Return(nil)
+
+	conn := &UDPConn{
+		syscallConn: mockSyscallConn,
+	}
+
+	err := conn.SetTTL(64)
+	assert.ErrorIs(t, err, syscall.EBADF)
+	assert.ErrorContains(t, err, "failed to set TTL")
+}
+
+func TestUDPConnSetTOS(t *testing.T) {
+	tests := []struct {
+		family     Family
+		level, opt int
+	}{
+		{IPv4, syscall.IPPROTO_IP, syscall.IP_TOS},
+		{IPv6, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.family.String(), func(t *testing.T) {
+			conn, err := NewUDPConn(tt.family, ":0")
+			require.NoError(t, err)
+			defer conn.Close()
+
+			require.NoError(t, conn.SetTOS(0xb8))
+
+			assert.Equal(t, 0xb8, getsockoptInt(t, conn, tt.level, tt.opt))
+		})
+	}
+}
+
+func TestUDPConnSetTOSLoopback(t *testing.T) {
+	icmpConn, err := NewICMPConn(IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer icmpConn.Close()
+
+	conn, err := NewUDPConn(IPv4, ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// EF, the class of voice traffic, with ECT(0).
+	require.NoError(t, conn.SetTOS(0xba))
+	require.NoError(t, conn.SendEmptyPacket(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33434}))
+
+	srcPort := conn.LocalAddr().(*net.UDPAddr).Port
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		_, data, _, err := icmpConn.ReadWithTimeout(time.Until(deadline))
+		require.NoError(t, err)
+
+		parsed, err := ParseICMP(IPv4, data)
+		if err != nil || parsed.Key == nil || parsed.Key.SrcPort != srcPort {
+			continue
+		}
+
+		// The Port Unreachable quotes the probe as it was sent.
+		assert.Equal(t, 0xba, parsed.QuotedTOS())
+		assert.Equal(t, ECT0, ECNOf(parsed.QuotedTOS()))
+		return
+	}
+	t.Fatal("no Port Unreachable quoting the probe")
+}
+
+func TestUDPConnSetHopLimitIPv6(t *testing.T) {
+	conn, err := NewUDPConn(IPv6, "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.SetTTL(7)
+	assert.NoError(t, err)
+
+	var hops int
+	var sockErr error
+	err = conn.syscallConn.Control(func(fd uintptr) {
+		hops, sockErr = syscall.GetsockoptInt(
+			int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS)
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, sockErr)
+	assert.Equal(t, 7, hops)
+}
+
+func TestIsTransientPermanentErrors(t *testing.T) {
+	for _, err := range []error{syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.EACCES,
+		syscall.EMSGSIZE} {
+		assert.False(t, IsTransient(err), err.Error())
+	}
+	assert.True(t, IsTransient(syscall.EWOULDBLOCK))
+}
@@ -0,0 +1,28 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// errMessageTooLong is WSAEMSGSIZE, the error sending a datagram larger than the path MTU
+// fails with.
+var errMessageTooLong error = syscall.Errno(10040)
+
+// transientErrors are WSAENOBUFS, WSAEWOULDBLOCK and WSAEINTR, the errors sending a
+// datagram fails with when the socket buffers are full or the call was interrupted.
+var transientErrors = []error{syscall.Errno(10055), syscall.Errno(10035), syscall.Errno(10004)}
+
+// wsaeacces is WSAEACCES, the error opening a raw socket fails with outside an
+// administrator console. Unlike ERROR_ACCESS_DENIED it does not match os.ErrPermission.
+const wsaeacces = syscall.Errno(10013)
+
+// permissionError makes err match os.ErrPermission if it is WSAEACCES.
+func permissionError(err error) error {
+	if errors.Is(err, wsaeacces) && !errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%w (run as administrator): %w", os.ErrPermission, err)
+	}
+	return err
+}
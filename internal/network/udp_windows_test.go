@@ -0,0 +1,52 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionError(t *testing.T) {
+	err := permissionError(&net.OpError{Op: "listen", Err: os.NewSyscallError("socket", wsaeacces)})
+
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.ErrorIs(t, err, wsaeacces)
+	assert.ErrorContains(t, err, "run as administrator")
+
+	other := errors.New("boom")
+	assert.Same(t, other, permissionError(other))
+}
+
+func TestUDPConnSetTTLWindows(t *testing.T) {
+	conn, err := NewUDPConn(IPv4, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetTTL(7))
+
+	var ttl int
+	var sockErr error
+	require.NoError(t, conn.syscallConn.Control(func(fd uintptr) {
+		ttl, sockErr = syscall.GetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP,
+			syscall.IP_TTL)
+	}))
+	require.NoError(t, sockErr)
+	assert.Equal(t, 7, ttl)
+}
+
+func TestNewICMPConnWindows(t *testing.T) {
+	conn, err := NewICMPConn(IPv4)
+	if err != nil {
+		// Raw sockets require an administrator console.
+		assert.ErrorIs(t, err, os.ErrPermission)
+		return
+	}
+	defer conn.Close()
+
+	assert.Equal(t, RawICMP, conn.Mode())
+}
@@ -0,0 +1,80 @@
+// Package sockopt sets the socket options of probe sockets, hiding how their names and
+// semantics differ across platforms.
+//
+// Every function takes the socket through its Control method, as exposed by
+// syscall.RawConn, and a flag selecting the IPv6 variant of the option. Options the
+// platform does not support fail with an *UnsupportedError, which matches ErrUnsupported,
+// so that callers can degrade.
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Conn is a socket whose options can be set, such as a syscall.RawConn.
+type Conn interface {
+	Control(f func(fd uintptr)) error
+}
+
+// ErrUnsupported is matched by the errors returned for options the current platform does
+// not support.
+var ErrUnsupported = errors.New("socket option not supported")
+
+// UnsupportedError is returned when an option is not supported on the current platform.
+type UnsupportedError struct {
+	// Option names the option, e.g. "SO_BINDTODEVICE".
+	Option string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s is not supported on %s", e.Option, runtime.GOOS)
+}
+
+// Is makes every *UnsupportedError match ErrUnsupported.
+func (e *UnsupportedError) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
+// SetTTL sets the IPv4 TTL, or the IPv6 unicast hop limit if v6 is set.
+func SetTTL(conn Conn, v6 bool, ttl int) error {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TTL
+	if v6 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+
+	return setInt(conn, level, opt, ttl, "failed to set TTL")
+}
+
+// SetTOS sets the IPv4 Type of Service byte, or the IPv6 traffic class if v6 is set.
+func SetTOS(conn Conn, v6 bool, tos int) error {
+	if tos < 0 || tos > 0xff {
+		return fmt.Errorf("invalid TOS: %d", tos)
+	}
+
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if v6 {
+		level, opt = syscall.IPPROTO_IPV6, ipv6TrafficClass
+	}
+
+	return setInt(conn, level, opt, tos, "failed to set TOS")
+}
+
+// unsupported returns the error of an option the current platform does not support,
+// prefixed with desc.
+func unsupported(desc, option string) error {
+	return fmt.Errorf("%s: %w", desc, &UnsupportedError{Option: option})
+}
+
+// bindError wraps err, the failure to bind a socket to the named interface, explaining the
+// privileges needed if it was denied.
+func bindError(name string, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("failed to bind to interface %q: requires CAP_NET_RAW or root: %w",
+			name, err)
+	}
+	return fmt.Errorf("failed to bind to interface %q: %w", name, err)
+}
@@ -0,0 +1,48 @@
+//go:build darwin || freebsd
+
+package sockopt
+
+import (
+	"syscall"
+
+	"golang.org/x/net/bpf"
+)
+
+// SetDF sets IP_DONTFRAG (IPV6_DONTFRAG), which sets the Don't Fragment bit on every
+// datagram.
+func SetDF(conn Conn, v6 bool, on bool) error {
+	level, opt := syscall.IPPROTO_IP, ipDontFrag
+	if v6 {
+		level, opt = syscall.IPPROTO_IPV6, ipv6DontFrag
+	}
+
+	value := 0
+	if on {
+		value = 1
+	}
+
+	return setInt(conn, level, opt, value, "failed to set Don't Fragment")
+}
+
+// EnableRecvTTL sets IP_RECVTTL (IPV6_RECVHOPLIMIT), which makes reads report the TTL
+// (hop limit) datagrams arrive with in a control message.
+func EnableRecvTTL(conn Conn, v6 bool) error {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_RECVTTL
+	if v6 {
+		level, opt = syscall.IPPROTO_IPV6, ipv6RecvHopLimit
+	}
+
+	return setInt(conn, level, opt, 1, "failed to enable receiving TTL")
+}
+
+// EnableTimestamps makes reads report when the kernel received each datagram. It is not
+// supported on the BSDs, whose SO_TIMESTAMP only has microsecond resolution.
+func EnableTimestamps(_ Conn) error {
+	return unsupported("failed to enable timestamps", "SO_TIMESTAMPNS")
+}
+
+// AttachFilter attaches a classic BPF program to the socket. Socket filters are not
+// supported on this platform.
+func AttachFilter(_ Conn, _ []bpf.RawInstruction) error {
+	return unsupported("failed to attach filter", "SO_ATTACH_FILTER")
+}
@@ -0,0 +1,67 @@
+//go:build darwin || freebsd
+
+package sockopt
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUDPSocket(t *testing.T) syscall.RawConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	rawConn, err := conn.(*net.UDPConn).SyscallConn()
+	require.NoError(t, err)
+	return rawConn
+}
+
+func getInt(t *testing.T, conn syscall.RawConn, level, opt int) int {
+	t.Helper()
+
+	var value int
+	var sockErr error
+	require.NoError(t, conn.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, sockErr)
+
+	return value
+}
+
+func TestSetTTL(t *testing.T) {
+	conn := newUDPSocket(t)
+	require.NoError(t, SetTTL(conn, false, 7))
+	assert.Equal(t, 7, getInt(t, conn, syscall.IPPROTO_IP, syscall.IP_TTL))
+}
+
+func TestSetDF(t *testing.T) {
+	conn := newUDPSocket(t)
+
+	require.NoError(t, SetDF(conn, false, true))
+	assert.Equal(t, 1, getInt(t, conn, syscall.IPPROTO_IP, ipDontFrag))
+
+	require.NoError(t, SetDF(conn, false, false))
+	assert.Equal(t, 0, getInt(t, conn, syscall.IPPROTO_IP, ipDontFrag))
+}
+
+func TestEnableRecvTTL(t *testing.T) {
+	conn := newUDPSocket(t)
+	require.NoError(t, EnableRecvTTL(conn, false))
+	assert.Equal(t, 1, getInt(t, conn, syscall.IPPROTO_IP, syscall.IP_RECVTTL))
+}
+
+func TestEnableTimestampsUnsupported(t *testing.T) {
+	assert.ErrorIs(t, EnableTimestamps(newUDPSocket(t)), ErrUnsupported)
+}
+
+func TestAttachFilterUnsupported(t *testing.T) {
+	assert.ErrorIs(t, AttachFilter(newUDPSocket(t), nil), ErrUnsupported)
+}
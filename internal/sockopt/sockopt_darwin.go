@@ -0,0 +1,43 @@
+package sockopt
+
+import (
+	"net"
+	"syscall"
+)
+
+// The syscall package does not define the Don't Fragment, interface binding and hop limit
+// options of macOS.
+const (
+	ipDontFrag       = 0x1c
+	ipv6DontFrag     = 0x3e
+	ipBoundIf        = 0x19
+	ipv6BoundIf      = 0x7d
+	ipv6RecvHopLimit = 0x25
+)
+
+// BindToDevice sets IP_BOUND_IF (IPV6_BOUND_IF) to the index of the named interface, which
+// forces the packets of the socket out through it.
+func BindToDevice(conn Conn, v6 bool, name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return bindError(name, err)
+	}
+
+	level, opt := syscall.IPPROTO_IP, ipBoundIf
+	if v6 {
+		level, opt = syscall.IPPROTO_IPV6, ipv6BoundIf
+	}
+
+	var sockErr error
+	err = conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, iface.Index)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return bindError(name, err)
+	}
+
+	return nil
+}
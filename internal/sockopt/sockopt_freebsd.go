@@ -0,0 +1,18 @@
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	ipDontFrag       = syscall.IP_DONTFRAG
+	ipv6DontFrag     = syscall.IPV6_DONTFRAG
+	ipv6RecvHopLimit = syscall.IPV6_RECVHOPLIMIT
+)
+
+// BindToDevice forces the packets of the socket out through the named interface. It is
+// not supported on FreeBSD.
+func BindToDevice(_ Conn, _ bool, name string) error {
+	return unsupported(fmt.Sprintf("failed to bind to interface %q", name), "SO_BINDTODEVICE")
+}
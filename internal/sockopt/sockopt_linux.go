@@ -0,0 +1,101 @@
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// SetDF sets the path MTU discovery mode of the socket. IP_PMTUDISC_DO sets the Don't
+// Fragment bit on every datagram, while IP_PMTUDISC_DONT never does.
+func SetDF(conn Conn, v6 bool, on bool) error {
+	level, opt, value := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT
+	if on {
+		value = syscall.IP_PMTUDISC_DO
+	}
+	if v6 {
+		level, opt, value = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER,
+			syscall.IPV6_PMTUDISC_DONT
+		if on {
+			value = syscall.IPV6_PMTUDISC_DO
+		}
+	}
+
+	return setInt(conn, level, opt, value, "failed to set Don't Fragment")
+}
+
+// BindToDevice sets SO_BINDTODEVICE, which forces the packets of the socket out through
+// the named interface and makes it ignore those arriving through others. Older kernels
+// require CAP_NET_RAW.
+func BindToDevice(conn Conn, _ bool, name string) error {
+	var sockErr error
+
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_BINDTODEVICE, name)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return bindError(name, err)
+	}
+
+	return nil
+}
+
+// EnableRecvTTL sets IP_RECVTTL (IPV6_RECVHOPLIMIT), which makes reads report the TTL
+// (hop limit) datagrams arrive with in a control message.
+func EnableRecvTTL(conn Conn, v6 bool) error {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_RECVTTL
+	if v6 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT
+	}
+
+	return setInt(conn, level, opt, 1, "failed to enable receiving TTL")
+}
+
+// EnableTimestamps makes reads report when the kernel received each datagram in a control
+// message. It sets SO_TIMESTAMPING with software receive timestamps, and SO_TIMESTAMPNS on
+// kernels that refuse it. Hardware timestamps are not requested: they are taken on the
+// clock of the network card, which send times cannot be compared with.
+func EnableTimestamps(conn Conn) error {
+	flags := unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE
+	if err := setInt(conn, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags,
+		"failed to enable timestamps"); err == nil {
+		return nil
+	}
+
+	return setInt(conn, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1,
+		"failed to enable timestamps")
+}
+
+// AttachFilter attaches the classic BPF program filter with SO_ATTACH_FILTER, so that the
+// kernel drops the datagrams it rejects before they are queued on the socket.
+func AttachFilter(conn Conn, filter []bpf.RawInstruction) error {
+	if len(filter) == 0 || len(filter) > 0xffff {
+		return fmt.Errorf("invalid filter length: %d", len(filter))
+	}
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&filter[0])),
+	}
+
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER,
+			&prog)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to attach filter: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package sockopt
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// newUDPSocket opens a UDP socket on the loopback address of the given family.
+func newUDPSocket(t *testing.T, v6 bool) syscall.RawConn {
+	t.Helper()
+
+	network, address := "udp4", "127.0.0.1:0"
+	if v6 {
+		network, address = "udp6", "[::1]:0"
+	}
+	conn, err := net.ListenPacket(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	rawConn, err := conn.(*net.UDPConn).SyscallConn()
+	require.NoError(t, err)
+	return rawConn
+}
+
+func getInt(t *testing.T, conn syscall.RawConn, level, opt int) int {
+	t.Helper()
+
+	var value int
+	var sockErr error
+	require.NoError(t, conn.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, sockErr)
+
+	return value
+}
+
+func TestSetTTL(t *testing.T) {
+	conn := newUDPSocket(t, false)
+	require.NoError(t, SetTTL(conn, false, 7))
+	assert.Equal(t, 7, getInt(t, conn, syscall.IPPROTO_IP, syscall.IP_TTL))
+
+	conn6 := newUDPSocket(t, true)
+	require.NoError(t, SetTTL(conn6, true, 9))
+	assert.Equal(t, 9, getInt(t, conn6, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS))
+}
+
+func TestSetTOS(t *testing.T) {
+	conn := newUDPSocket(t, false)
+	require.NoError(t, SetTOS(conn, false, 0xb8))
+	assert.Equal(t, 0xb8, getInt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS))
+}
+
+func TestSetDF(t *testing.T) {
+	conn := newUDPSocket(t, false)
+
+	require.NoError(t, SetDF(conn, false, true))
+	assert.Equal(t, syscall.IP_PMTUDISC_DO,
+		getInt(t, conn, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER))
+
+	require.NoError(t, SetDF(conn, false, false))
+	assert.Equal(t, syscall.IP_PMTUDISC_DONT,
+		getInt(t, conn, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER))
+}
+
+func TestEnableRecvTTL(t *testing.T) {
+	conn := newUDPSocket(t, false)
+	require.NoError(t, EnableRecvTTL(conn, false))
+	assert.Equal(t, 1, getInt(t, conn, syscall.IPPROTO_IP, syscall.IP_RECVTTL))
+
+	conn6 := newUDPSocket(t, true)
+	require.NoError(t, EnableRecvTTL(conn6, true))
+	assert.Equal(t, 1, getInt(t, conn6, syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT))
+}
+
+func TestEnableTimestamps(t *testing.T) {
+	conn := newUDPSocket(t, false)
+	require.NoError(t, EnableTimestamps(conn))
+	assert.Equal(t, unix.SOF_TIMESTAMPING_RX_SOFTWARE|unix.SOF_TIMESTAMPING_SOFTWARE,
+		getInt(t, conn, unix.SOL_SOCKET, unix.SO_TIMESTAMPING))
+}
+
+func TestBindToDevice(t *testing.T) {
+	conn := newUDPSocket(t, false)
+
+	err := BindToDevice(conn, false, "lo")
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("SO_BINDTODEVICE requires elevated privileges")
+	}
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, BindToDevice(conn, false, "nosuchif0"),
+		`failed to bind to interface "nosuchif0"`)
+}
+
+func TestBindToDevicePermissionDenied(t *testing.T) {
+	err := BindToDevice(failingConn{err: syscall.EPERM}, false, "eth1")
+
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.ErrorContains(t, err, "requires CAP_NET_RAW or root")
+}
+
+func TestAttachFilter(t *testing.T) {
+	conn := newUDPSocket(t, false)
+
+	filter, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0xffff}})
+	require.NoError(t, err)
+
+	require.NoError(t, AttachFilter(conn, filter))
+	assert.ErrorContains(t, AttachFilter(conn, nil), "invalid filter length: 0")
+}
@@ -0,0 +1,39 @@
+//go:build unix && !linux && !darwin && !freebsd
+
+package sockopt
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+)
+
+// SetDF sets or clears the Don't Fragment bit of outgoing datagrams. It is not supported
+// on this platform.
+func SetDF(_ Conn, _ bool, _ bool) error {
+	return unsupported("failed to set Don't Fragment", "IP_DONTFRAG")
+}
+
+// BindToDevice forces the packets of the socket out through the named interface. It is
+// not supported on this platform.
+func BindToDevice(_ Conn, _ bool, name string) error {
+	return unsupported(fmt.Sprintf("failed to bind to interface %q", name), "SO_BINDTODEVICE")
+}
+
+// EnableRecvTTL makes reads report the TTL or hop limit datagrams arrive with. It is not
+// supported on this platform.
+func EnableRecvTTL(_ Conn, _ bool) error {
+	return unsupported("failed to enable receiving TTL", "IP_RECVTTL")
+}
+
+// EnableTimestamps makes reads report when the kernel received each datagram. It is not
+// supported on this platform.
+func EnableTimestamps(_ Conn) error {
+	return unsupported("failed to enable timestamps", "SO_TIMESTAMPNS")
+}
+
+// AttachFilter attaches a classic BPF program to the socket. Socket filters are not
+// supported on this platform.
+func AttachFilter(_ Conn, _ []bpf.RawInstruction) error {
+	return unsupported("failed to attach filter", "SO_ATTACH_FILTER")
+}
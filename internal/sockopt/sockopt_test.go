@@ -0,0 +1,40 @@
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingConn is a socket whose Control always fails.
+type failingConn struct {
+	err error
+}
+
+func (c failingConn) Control(func(fd uintptr)) error {
+	return c.err
+}
+
+func TestUnsupportedError(t *testing.T) {
+	err := fmt.Errorf("failed to set Don't Fragment: %w", &UnsupportedError{Option: "IP_DONTFRAG"})
+
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.ErrorContains(t, err, "IP_DONTFRAG is not supported on")
+	assert.NotErrorIs(t, errors.New("boom"), ErrUnsupported)
+}
+
+func TestSetTTLControlFailure(t *testing.T) {
+	conn := failingConn{err: errors.New("closed")}
+
+	assert.EqualError(t, SetTTL(conn, false, 64), "failed to set TTL: closed")
+	assert.EqualError(t, SetTTL(conn, true, 64), "failed to set TTL: closed")
+}
+
+func TestSetTOSInvalid(t *testing.T) {
+	conn := failingConn{err: errors.New("unexpected Control")}
+
+	assert.EqualError(t, SetTOS(conn, false, -1), "invalid TOS: -1")
+	assert.EqualError(t, SetTOS(conn, true, 0x100), "invalid TOS: 256")
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const ipv6TrafficClass = syscall.IPV6_TCLASS
+
+// setInt sets an integer socket option on the socket behind conn, prefixing errors with
+// desc.
+func setInt(conn Conn, level, opt, value int, desc string) error {
+	var sockErr error
+
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", desc, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+)
+
+// ipv6TrafficClass is IPV6_TCLASS, which the syscall package does not define on Windows.
+const ipv6TrafficClass = 39
+
+// setInt sets an integer socket option on the socket behind conn, prefixing errors with
+// desc.
+func setInt(conn Conn, level, opt, value int, desc string) error {
+	var sockErr error
+
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(syscall.Handle(fd), level, opt, value)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", desc, err)
+	}
+
+	return nil
+}
+
+// SetDF sets or clears the Don't Fragment bit of outgoing datagrams. It is not supported
+// on Windows.
+func SetDF(_ Conn, _ bool, _ bool) error {
+	return unsupported("failed to set Don't Fragment", "IP_DONTFRAGMENT")
+}
+
+// BindToDevice forces the packets of the socket out through the named interface. It is
+// not supported on Windows.
+func BindToDevice(_ Conn, _ bool, name string) error {
+	return unsupported(fmt.Sprintf("failed to bind to interface %q", name), "IP_UNICAST_IF")
+}
+
+// EnableRecvTTL makes reads report the TTL or hop limit datagrams arrive with. It is not
+// supported on Windows.
+func EnableRecvTTL(_ Conn, _ bool) error {
+	return unsupported("failed to enable receiving TTL", "IP_HOPLIMIT")
+}
+
+// EnableTimestamps makes reads report when the kernel received each datagram. It is not
+// supported on Windows.
+func EnableTimestamps(_ Conn) error {
+	return unsupported("failed to enable timestamps", "SO_TIMESTAMP")
+}
+
+// AttachFilter attaches a classic BPF program to the socket. Socket filters are not
+// supported on this platform.
+func AttachFilter(_ Conn, _ []bpf.RawInstruction) error {
+	return unsupported("failed to attach filter", "SO_ATTACH_FILTER")
+}
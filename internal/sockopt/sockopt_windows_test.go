@@ -0,0 +1,46 @@
+package sockopt
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUDPSocket(t *testing.T) syscall.RawConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	rawConn, err := conn.(*net.UDPConn).SyscallConn()
+	require.NoError(t, err)
+	return rawConn
+}
+
+func TestSetTTL(t *testing.T) {
+	conn := newUDPSocket(t)
+	require.NoError(t, SetTTL(conn, false, 7))
+
+	var ttl int
+	var sockErr error
+	require.NoError(t, conn.Control(func(fd uintptr) {
+		ttl, sockErr = syscall.GetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP,
+			syscall.IP_TTL)
+	}))
+	require.NoError(t, sockErr)
+	assert.Equal(t, 7, ttl)
+}
+
+func TestUnsupportedOptions(t *testing.T) {
+	conn := newUDPSocket(t)
+
+	assert.ErrorIs(t, SetDF(conn, false, true), ErrUnsupported)
+	assert.ErrorIs(t, BindToDevice(conn, false, "eth0"), ErrUnsupported)
+	assert.ErrorIs(t, EnableRecvTTL(conn, false), ErrUnsupported)
+	assert.ErrorIs(t, EnableTimestamps(conn), ErrUnsupported)
+	assert.ErrorIs(t, AttachFilter(conn, nil), ErrUnsupported)
+}
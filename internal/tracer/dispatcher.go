@@ -0,0 +1,351 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// routeBuffer is the number of messages queued for a trace that has not read them yet.
+// Further ones are dropped like lost replies.
+const routeBuffer = 64
+
+// ErrDispatcherClosed is returned when reading the replies of a trace whose Dispatcher was
+// closed.
+var ErrDispatcherClosed = errors.New("dispatcher closed")
+
+// Dispatcher shares a single ICMP listener between the traces of a process, so that they
+// do not each open a raw socket and parse a copy of every message.
+//
+// A single goroutine reads the listener, parses every message once and hands it to the
+// trace whose probe it quotes, or that the Echo Reply answers: traces are told apart by
+// their destination and the source port of their UDP or TCP probes, or the identifier of
+// their Echo Requests. A message quoting a probe without its ports is handed to every
+// trace to the quoted destination. Other messages are only counted; see Unmatched.
+//
+// Traces use a Dispatcher through Options.Dispatcher. The listener cannot be bound to an
+// interface for them, and their ICMP probes cannot have a TOS of their own, nor can they
+// vary their source port. A Dispatcher is safe for concurrent use.
+type Dispatcher struct {
+	conn messageReader
+	// listener is the socket behind conn, through which Echo Requests are sent, and nil in
+	// tests.
+	listener *network.ICMPConn
+	mode     network.ICMPMode
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	// failed is closed once the read loop stopped, and err tells why.
+	failed chan struct{}
+
+	mu     sync.Mutex
+	routes map[routeKey]*route
+	err    error
+
+	unmatched atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// routeKey identifies the probes of a trace.
+type routeKey struct {
+	// dst is the destination address in its 16-byte form.
+	dst      string
+	protocol int
+	// id is the source port of UDP and TCP probes, and the identifier of Echo Requests.
+	id int
+}
+
+// NewDispatcher opens an ICMP listener for the given address family and starts reading
+// it. Like NewICMPConn, it falls back to an unprivileged datagram listener, which only
+// serves ICMP probes. Close stops it.
+func NewDispatcher(family network.Family) (*Dispatcher, error) {
+	conn, err := network.NewICMPConn(family)
+	if err != nil {
+		return nil, err
+	}
+
+	// See openListener.
+	_ = conn.EnableReceiveTTL()
+	_ = conn.EnableTimestamps()
+	if err := attachFilter(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	d := newDispatcher(conn)
+	d.listener = conn
+	d.mode = conn.Mode()
+	return d, nil
+}
+
+// newDispatcher starts dispatching the messages read from conn.
+func newDispatcher(conn messageReader) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &Dispatcher{
+		conn:   conn,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		failed: make(chan struct{}),
+		routes: make(map[routeKey]*route),
+	}
+	go d.run(ctx)
+	return d
+}
+
+// Family returns the address family of the destinations the dispatcher serves.
+func (d *Dispatcher) Family() network.Family {
+	return d.conn.Family()
+}
+
+// Unmatched returns the number of messages read that did not parse or belonged to no
+// registered trace.
+func (d *Dispatcher) Unmatched() uint64 {
+	return d.unmatched.Load()
+}
+
+// Dropped returns the number of messages dropped because their trace did not read them in
+// time.
+func (d *Dispatcher) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+// Close stops reading the listener and closes it. The traces still using the dispatcher
+// fail with ErrDispatcherClosed.
+func (d *Dispatcher) Close() error {
+	d.cancel()
+	<-d.done
+	return d.conn.Close()
+}
+
+// run reads the listener until ctx is done or a read fails.
+func (d *Dispatcher) run(ctx context.Context) {
+	defer close(d.done)
+
+	for {
+		msg, err := d.conn.ReadMessage(ctx)
+		if err != nil {
+			if errors.Is(err, network.ErrReadTimeout) && ctx.Err() == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				err = ErrDispatcherClosed
+			}
+			d.fail(err)
+			return
+		}
+
+		parsed, err := parseReply(d.conn.Family(), msg)
+		if network.Classify(err) != network.Relevant || !d.dispatch(msg, parsed) {
+			d.unmatched.Add(1)
+		}
+	}
+}
+
+// fail records why the read loop stopped and wakes up the traces waiting for replies.
+func (d *Dispatcher) fail(err error) {
+	d.mu.Lock()
+	d.err = err
+	d.mu.Unlock()
+
+	close(d.failed)
+}
+
+func (d *Dispatcher) readErr() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// dispatch hands the message to the traces it belongs to and reports whether there was
+// any.
+func (d *Dispatcher) dispatch(msg *network.Message, parsed *network.ParsedICMP) bool {
+	key, exact := messageRouteKey(msg, parsed)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if exact {
+		r, ok := d.routes[key]
+		if ok {
+			d.deliver(r, msg, parsed)
+		}
+		return ok
+	}
+
+	delivered := false
+	for k, r := range d.routes {
+		if k.dst == key.dst && (key.protocol == 0 || k.protocol == key.protocol) {
+			d.deliver(r, msg, parsed)
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+// deliver queues the message for the trace, or drops it if the queue is full.
+func (d *Dispatcher) deliver(r *route, msg *network.Message, parsed *network.ParsedICMP) {
+	select {
+	case r.messages <- routedMessage{msg: msg, parsed: parsed}:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// messageRouteKey returns the key of the trace a message belongs to, and whether it
+// identifies a single trace. Otherwise, only the destination and possibly the protocol of
+// the key are set.
+func messageRouteKey(msg *network.Message, parsed *network.ParsedICMP) (routeKey, bool) {
+	if parsed.Echo != nil {
+		protocol := protocolICMP
+		if msg.Peer.To4() == nil {
+			protocol = protocolICMPv6
+		}
+		return routeKey{dst: ipKey(msg.Peer), protocol: protocol, id: parsed.Echo.ID}, true
+	}
+
+	key := routeKey{dst: ipKey(parsed.QuotedDst())}
+	if parsed.Key == nil {
+		return key, false
+	}
+	key.protocol = parsed.Key.Protocol
+
+	switch key.protocol {
+	case protocolICMP, protocolICMPv6:
+		if parsed.Key.EchoID == 0 && parsed.Key.EchoSeq == 0 {
+			return key, false
+		}
+		key.id = parsed.Key.EchoID
+	default:
+		if parsed.Key.SrcPort == 0 {
+			return key, false
+		}
+		key.id = parsed.Key.SrcPort
+	}
+	return key, true
+}
+
+// routeKeyOf returns the key of the probes sent by p to dest.
+func routeKeyOf(p prober, dest net.IP) routeKey {
+	key := routeKey{dst: ipKey(dest)}
+
+	switch p := p.(type) {
+	case *udpProber:
+		key.protocol = protocolUDP
+		key.id = p.conn.LocalAddr().(*net.UDPAddr).Port
+	case *tcpProber:
+		key.protocol = protocolTCP
+		key.id = p.conn.SrcPort()
+	case *echoProber:
+		key.protocol = protocolICMP
+		if p.conn.Family() == network.IPv6 {
+			key.protocol = protocolICMPv6
+		}
+		key.id = p.id
+	}
+	return key
+}
+
+func ipKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+// check returns an error unless a trace to an address of the given family can share the
+// listener with the options given.
+func (d *Dispatcher) check(family network.Family, opts Options) error {
+	switch {
+	case family != d.Family():
+		return fmt.Errorf("dispatcher serves %v destinations, not %v", d.Family(), family)
+	case d.mode == network.DatagramICMP && opts.Method != ICMP:
+		return errNeedsRawSocket(opts.Method)
+	case opts.Interface != "" && (opts.InterfaceOnly || opts.Method == ICMP):
+		return fmt.Errorf("binding the listener to an interface is not supported with a " +
+			"dispatcher")
+	case opts.Method == ICMP && opts.trafficClass() != 0:
+		return fmt.Errorf("the TOS of ICMP probes is not supported with a dispatcher")
+	case opts.Method == UDP && opts.Vary == VarySrcPort:
+		return fmt.Errorf("varying the source port is not supported with a dispatcher")
+	default:
+		return nil
+	}
+}
+
+// register starts routing the messages with the given key to a new route.
+func (d *Dispatcher) register(key routeKey) (*route, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return nil, fmt.Errorf("failed to register trace: %w", d.err)
+	}
+	if _, ok := d.routes[key]; ok {
+		return nil, fmt.Errorf("failed to register trace: another trace to %v sends the "+
+			"same probes", net.IP(key.dst))
+	}
+
+	r := &route{d: d, key: key, messages: make(chan routedMessage, routeBuffer)}
+	d.routes[key] = r
+	return r, nil
+}
+
+// unregister stops routing messages to r.
+func (d *Dispatcher) unregister(r *route) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.routes[r.key] == r {
+		delete(d.routes, r.key)
+	}
+}
+
+// routedMessage is a message handed to a trace along with its parsed form.
+type routedMessage struct {
+	msg    *network.Message
+	parsed *network.ParsedICMP
+}
+
+// route reads the messages of a trace registered with a Dispatcher.
+type route struct {
+	d        *Dispatcher
+	key      routeKey
+	messages chan routedMessage
+}
+
+func (r *route) Family() network.Family {
+	return r.d.Family()
+}
+
+func (r *route) ReadMessage(ctx context.Context) (*network.Message, error) {
+	msg, _, err := r.readParsed(ctx)
+	return msg, err
+}
+
+// readParsed returns the next message handed to the trace along with its parsed form,
+// waiting until it arrives or ctx is done.
+func (r *route) readParsed(
+	ctx context.Context,
+) (*network.Message, *network.ParsedICMP, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	select {
+	case m := <-r.messages:
+		return m.msg, m.parsed, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-r.d.failed:
+		return nil, nil, r.d.readErr()
+	}
+}
+
+// Close unregisters the trace; the listener stays open.
+func (r *route) Close() error {
+	r.d.unregister(r)
+	return nil
+}
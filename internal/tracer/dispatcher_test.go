@@ -0,0 +1,293 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// newFedDispatcher returns a Dispatcher reading the messages sent to the returned channel.
+func newFedDispatcher(t *testing.T) (*Dispatcher, chan<- *network.Message) {
+	t.Helper()
+
+	feed := make(chan *network.Message)
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			select {
+			case msg := <-feed:
+				return msg, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+	receiver.On("Close").Return(nil)
+
+	d := newDispatcher(receiver)
+	t.Cleanup(func() { d.Close() })
+	return d, feed
+}
+
+func echoReply(t *testing.T, from net.IP, id, seq int) *network.Message {
+	t.Helper()
+
+	data, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: id, Seq: seq},
+	}).Marshal(nil)
+	require.NoError(t, err)
+	return &network.Message{Peer: from, Data: data, TTL: -1, ReceivedAt: time.Now()}
+}
+
+func readRoute(t *testing.T, r *route) (*network.Message, *network.ParsedICMP) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	msg, parsed, err := r.readParsed(ctx)
+	require.NoError(t, err)
+	return msg, parsed
+}
+
+func TestDispatcherRoutesMessages(t *testing.T) {
+	d, feed := newFedDispatcher(t)
+	router := net.IPv4(192, 0, 2, 1)
+	destA, destB := net.IPv4(198, 51, 100, 7), net.IPv4(198, 51, 100, 8)
+
+	// quotingMessage quotes UDP probes from port 50000.
+	a, err := d.register(routeKey{dst: ipKey(destA), protocol: protocolUDP, id: 50000})
+	require.NoError(t, err)
+	b, err := d.register(routeKey{dst: ipKey(destB), protocol: protocolUDP, id: 50000})
+	require.NoError(t, err)
+	echo, err := d.register(routeKey{dst: ipKey(destA), protocol: protocolICMP, id: 0x4242})
+	require.NoError(t, err)
+
+	feed <- &network.Message{
+		Peer: router,
+		Data: quotingMessage(t, destB, ipv4.ICMPTypeTimeExceeded, 0, 1),
+	}
+	feed <- &network.Message{
+		Peer: router,
+		Data: quotingMessage(t, destA, ipv4.ICMPTypeTimeExceeded, 0, 2),
+	}
+	feed <- echoReply(t, destA, 0x4242, 7)
+
+	_, parsed := readRoute(t, b)
+	assert.True(t, parsed.QuotedDst().Equal(destB))
+	assert.Equal(t, DefaultPort, parsed.Key.DstPort)
+
+	msg, parsed := readRoute(t, a)
+	assert.True(t, msg.Peer.Equal(router))
+	assert.Equal(t, DefaultPort+1, parsed.Key.DstPort)
+
+	_, parsed = readRoute(t, echo)
+	assert.True(t, parsed.MatchesEcho(0x4242, 7))
+
+	assert.Zero(t, d.Unmatched())
+}
+
+func TestDispatcherCountsUnmatched(t *testing.T) {
+	d, feed := newFedDispatcher(t)
+	dest := net.IPv4(198, 51, 100, 7)
+
+	r, err := d.register(routeKey{dst: ipKey(dest), protocol: protocolUDP, id: 50000})
+	require.NoError(t, err)
+
+	// A probe of another trace, an Echo Reply to another process and garbage.
+	feed <- &network.Message{
+		Peer: dest,
+		Data: quotingMessage(t, net.IPv4(198, 51, 100, 9), ipv4.ICMPTypeTimeExceeded, 0, 1),
+	}
+	feed <- echoReply(t, dest, 0x4242, 7)
+	feed <- &network.Message{Peer: dest, Data: []byte{11, 0}}
+	feed <- &network.Message{
+		Peer: dest,
+		Data: quotingMessage(t, dest, ipv4.ICMPTypeDestinationUnreachable, 3, 1),
+	}
+
+	readRoute(t, r)
+	assert.Equal(t, uint64(3), d.Unmatched())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = r.ReadMessage(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "unmatched messages are not delivered")
+}
+
+func TestDispatcherRegisterDuplicate(t *testing.T) {
+	d, _ := newFedDispatcher(t)
+	key := routeKey{dst: ipKey(net.IPv4(198, 51, 100, 7)), protocol: protocolUDP, id: 50000}
+
+	_, err := d.register(key)
+	require.NoError(t, err)
+	_, err = d.register(key)
+
+	assert.ErrorContains(t, err, "another trace to 198.51.100.7 sends the same probes")
+}
+
+func TestDispatcherUnregister(t *testing.T) {
+	d, feed := newFedDispatcher(t)
+	dest := net.IPv4(198, 51, 100, 7)
+	key := routeKey{dst: ipKey(dest), protocol: protocolUDP, id: 50000}
+
+	r, err := d.register(key)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	feed <- &network.Message{
+		Peer: dest,
+		Data: quotingMessage(t, dest, ipv4.ICMPTypeDestinationUnreachable, 3, 1),
+	}
+	// The next message is only read once the previous one was dispatched.
+	feed <- &network.Message{Peer: dest, Data: []byte{11, 0}}
+
+	assert.Eventually(t, func() bool { return d.Unmatched() == 2 }, time.Second,
+		time.Millisecond)
+
+	_, err = d.register(key)
+	assert.NoError(t, err, "the key can be registered again")
+}
+
+func TestDispatcherRegisterRace(t *testing.T) {
+	d, feed := newFedDispatcher(t)
+	dest := net.IPv4(198, 51, 100, 7)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				r, err := d.register(routeKey{dst: ipKey(dest), protocol: protocolUDP, id: port})
+				if assert.NoError(t, err) {
+					r.Close()
+				}
+			}
+		}(50000 + i)
+	}
+
+	msg := &network.Message{
+		Peer: dest,
+		Data: quotingMessage(t, dest, ipv4.ICMPTypeDestinationUnreachable, 3, 1),
+	}
+	for i := 0; i < 100; i++ {
+		feed <- msg
+	}
+	wg.Wait()
+}
+
+func TestDispatcherDropsWhenFull(t *testing.T) {
+	d, feed := newFedDispatcher(t)
+	dest := net.IPv4(198, 51, 100, 7)
+
+	_, err := d.register(routeKey{dst: ipKey(dest), protocol: protocolUDP, id: 50000})
+	require.NoError(t, err)
+
+	msg := &network.Message{
+		Peer: dest,
+		Data: quotingMessage(t, dest, ipv4.ICMPTypeDestinationUnreachable, 3, 1),
+	}
+	for i := 0; i < routeBuffer+2; i++ {
+		feed <- msg
+	}
+
+	assert.Eventually(t, func() bool { return d.Dropped() >= 1 }, time.Second, time.Millisecond)
+	assert.Zero(t, d.Unmatched())
+}
+
+func TestDispatcherClose(t *testing.T) {
+	d, _ := newFedDispatcher(t)
+
+	r, err := d.register(routeKey{dst: ipKey(net.IPv4(198, 51, 100, 7))})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	_, err = r.ReadMessage(context.Background())
+	assert.ErrorIs(t, err, ErrDispatcherClosed)
+
+	_, err = d.register(routeKey{})
+	assert.ErrorIs(t, err, ErrDispatcherClosed)
+}
+
+func TestDispatcherReadError(t *testing.T) {
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(nil, errors.New("socket closed"))
+	receiver.On("Close").Return(nil)
+	d := newDispatcher(receiver)
+	defer d.Close()
+
+	r, err := d.register(routeKey{})
+	if err == nil {
+		_, err = r.ReadMessage(context.Background())
+	}
+
+	assert.ErrorContains(t, err, "socket closed")
+}
+
+func TestDispatcherCheck(t *testing.T) {
+	d, _ := newFedDispatcher(t)
+
+	assert.NoError(t, d.check(network.IPv4, Options{Method: UDP}))
+	assert.ErrorContains(t, d.check(network.IPv6, Options{}), "serves IPv4 destinations")
+	assert.ErrorContains(t, d.check(network.IPv4, Options{Method: ICMP, Interface: "eth1"}),
+		"binding the listener")
+	assert.ErrorContains(t, d.check(network.IPv4, Options{Method: ICMP, TOS: 0xb8}),
+		"TOS of ICMP probes")
+	assert.ErrorContains(t, d.check(network.IPv4, Options{Vary: VarySrcPort}),
+		"varying the source port")
+
+	d.mode = network.DatagramICMP
+	assert.ErrorIs(t, d.check(network.IPv4, Options{Method: UDP}), os.ErrPermission)
+}
+
+func TestTracerRunDispatcherLoopback(t *testing.T) {
+	d, err := NewDispatcher(network.IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer d.Close()
+
+	methods := []ProbeMethod{UDP, UDP, ICMP, ICMP}
+	if d.mode == network.DatagramICMP {
+		methods = []ProbeMethod{ICMP, ICMP}
+	}
+	dest := net.IPv4(127, 0, 0, 1)
+
+	var wg sync.WaitGroup
+	for _, method := range methods {
+		wg.Add(1)
+		go func(method ProbeMethod) {
+			defer wg.Done()
+
+			hops, err := New(WithOptions(Options{
+				MaxHops:    3,
+				Timeout:    time.Second,
+				Method:     method,
+				Dispatcher: d,
+			})).Run(context.Background(), dest)
+			if assert.NoError(t, err, method.String()) && assert.Len(t, hops, 1) {
+				assert.True(t, hops[0].IP.Equal(dest))
+				assert.Equal(t, 0.0, hops[0].Loss, method.String())
+			}
+		}(method)
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	assert.Empty(t, d.routes, "finished traces unregister")
+}
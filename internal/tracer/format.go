@@ -0,0 +1,485 @@
+package tracer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// jsonHop is the JSON schema of a single hop emitted by FormatJSON.
+//
+// Fields that carry no value for a hop are encoded as null rather than omitted, so every
+// hop has the same shape regardless of whether it responded.
+type jsonHop struct {
+	Hop       int        `json:"hop"`
+	Addresses []string   `json:"addresses"`
+	Hostname  *string    `json:"hostname"`
+	RTTs      []*float64 `json:"rtts_ms"`
+	Min       *float64   `json:"min_ms"`
+	Avg       *float64   `json:"avg_ms"`
+	Max       *float64   `json:"max_ms"`
+	StdDev    *float64   `json:"stddev_ms"`
+	Loss      float64    `json:"loss_pct"`
+	// Responders breaks the replies down by the address they came from.
+	Responders []jsonResponder `json:"responders"`
+	// ASN and Prefix are the origin AS and BGP prefix of the first responder, if known.
+	ASN    *int    `json:"asn"`
+	Prefix *string `json:"prefix"`
+	// Country, City, Lat and Lon locate the first responder, if known.
+	Country *string  `json:"country"`
+	City    *string  `json:"city"`
+	Lat     *float64 `json:"lat"`
+	Lon     *float64 `json:"lon"`
+	// ReplyTTL and ReturnHops describe the return path of the first reply, if known.
+	ReplyTTL   *int `json:"reply_ttl"`
+	ReturnHops *int `json:"return_hops"`
+	// QuotedTTL is the TTL the probe arrived with at the first responder, if quoted.
+	QuotedTTL *int `json:"quoted_ttl"`
+	// Annotations mark unreachable or filtered hops, e.g. "!H" or "!X".
+	Annotations []string `json:"annotations"`
+	// MTU is the next-hop MTU reported with Fragmentation Needed.
+	MTU *int `json:"mtu"`
+	// MPLS is the label stack reported by the first responder, if any.
+	MPLS []jsonMPLSLabel `json:"mpls"`
+	// ECNSent and ECNQuoted are the ECN codepoints the probes were sent with and arrived
+	// at the first responder with, when probing with ECN.
+	ECNSent   *string `json:"ecn_sent"`
+	ECNQuoted *string `json:"ecn_quoted"`
+	// Duplicates and Reordered count the duplicated and out-of-order replies of the hop.
+	Duplicates int `json:"duplicates"`
+	Reordered  int `json:"reordered"`
+	// NATDetected is set when the first responder quoted a rewritten IPv4 Identification.
+	NATDetected bool `json:"nat_detected"`
+	// Loop is set on the hops of a routing loop.
+	Loop bool `json:"loop"`
+}
+
+// jsonResponder is the JSON schema of a Responder.
+type jsonResponder struct {
+	Address string    `json:"address"`
+	Count   int       `json:"count"`
+	RTTs    []float64 `json:"rtts_ms"`
+}
+
+// jsonMPLSLabel is the JSON schema of an MPLS label stack entry.
+type jsonMPLSLabel struct {
+	Label int  `json:"label"`
+	TC    int  `json:"tc"`
+	S     bool `json:"s"`
+	TTL   int  `json:"ttl"`
+}
+
+type jsonTrace struct {
+	Hops []jsonHop `json:"hops"`
+}
+
+// FormatJSON encodes hops as a JSON document of the form {"hops": [...]}.
+//
+// RTTs are given in milliseconds. Timed-out probes, hops that did not respond at all and
+// unresolved host names are encoded as explicit nulls, so indices stay consistent for
+// downstream parsers.
+func FormatJSON(hops []Hop) ([]byte, error) {
+	trace := jsonTrace{Hops: make([]jsonHop, 0, len(hops))}
+
+	for _, hop := range hops {
+		h := jsonHop{
+			Hop:    hop.TTL,
+			RTTs:   make([]*float64, 0, len(hop.RTTs)),
+			Min:    milliseconds(hop.Min),
+			Avg:    milliseconds(hop.Avg),
+			Max:    milliseconds(hop.Max),
+			StdDev: milliseconds(hop.StdDev),
+			Loss:   hop.Loss,
+
+			Duplicates: hop.Duplicates,
+			Reordered:  hop.Reordered,
+
+			NATDetected: hop.NATDetected,
+			Loop:        hop.Loop,
+		}
+
+		for _, addr := range hop.Addrs() {
+			h.Addresses = append(h.Addresses, addr.String())
+		}
+		for _, r := range hop.Responders {
+			responder := jsonResponder{Address: r.IP.String(), Count: r.Count}
+			for _, rtt := range r.RTTs {
+				responder.RTTs = append(responder.RTTs, *milliseconds(rtt))
+			}
+			h.Responders = append(h.Responders, responder)
+		}
+		if hop.Host != "" {
+			name := hop.Host
+			h.Hostname = &name
+		}
+		if hop.ASN > 0 {
+			asn := hop.ASN
+			h.ASN = &asn
+		}
+		if hop.Prefix != nil {
+			prefix := hop.Prefix.String()
+			h.Prefix = &prefix
+		}
+		if hop.Country != "" {
+			country := hop.Country
+			h.Country = &country
+		}
+		if hop.City != "" {
+			city := hop.City
+			h.City = &city
+		}
+		if hop.Lat != 0 || hop.Lon != 0 {
+			lat, lon := hop.Lat, hop.Lon
+			h.Lat, h.Lon = &lat, &lon
+		}
+		if hop.ReplyTTL > 0 {
+			replyTTL, returnHops := hop.ReplyTTL, hop.ReturnHops()
+			h.ReplyTTL, h.ReturnHops = &replyTTL, &returnHops
+		}
+		if hop.Responded() && hop.QuotedTTL >= 0 {
+			quotedTTL := hop.QuotedTTL
+			h.QuotedTTL = &quotedTTL
+		}
+		h.Annotations = hop.Annotations
+		if hop.MTU > 0 {
+			mtu := hop.MTU
+			h.MTU = &mtu
+		}
+		for _, l := range hop.MPLS {
+			h.MPLS = append(h.MPLS, jsonMPLSLabel{Label: l.Label, TC: l.TC, S: l.S, TTL: l.TTL})
+		}
+		if hop.SentECN != network.NotECT {
+			sent := hop.SentECN.String()
+			h.ECNSent = &sent
+			if hop.Responded() && hop.QuotedECN != UnknownECN {
+				quoted := hop.QuotedECN.String()
+				h.ECNQuoted = &quoted
+			}
+		}
+		for _, rtt := range hop.RTTs {
+			h.RTTs = append(h.RTTs, milliseconds(rtt))
+		}
+
+		trace.Hops = append(trace.Hops, h)
+	}
+
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode trace as JSON: %w", err)
+	}
+
+	return data, nil
+}
+
+// milliseconds converts d to fractional milliseconds, or nil for NoRTT.
+func milliseconds(d time.Duration) *float64 {
+	if d == NoRTT {
+		return nil
+	}
+
+	ms := float64(d) / float64(time.Millisecond)
+	return &ms
+}
+
+// FormatHop renders a hop the way traceroute prints it, e.g.
+// " 3  gw.example.net (192.0.2.1)  1.234 ms  *  2.345 ms !X". Once the origin AS of the
+// router was looked up, it precedes its name like with mtr -z, e.g.
+// " 3  [AS64496] gw.example.net (192.0.2.1)", or "[AS???]" if it is unknown. The MPLS label
+// stack the router reported follows its address like with traceroute -e, e.g.
+// "(192.0.2.1) <MPLS:L=24015, E=0, S=1, T=1>", the entries separated by slashes.
+//
+// The RTTs are printed in the order the probes were sent. When a probe of a hop answered
+// from several addresses, as behind a load balancer, was answered by another router than
+// the previous one, its address precedes its RTT, e.g.
+// " 3  192.0.2.1  1.234 ms  192.0.2.2  2.345 ms  *  192.0.2.1  3.456 ms".
+//
+// Timed-out probes are shown as "*" and the annotations of an unreachable or filtered hop
+// follow its last RTT, along with the next-hop MTU reported with Fragmentation Needed,
+// e.g. "!F pmtu 1400". Duplicated and reordered replies are counted last, e.g. "dup 1 reord 2".
+func FormatHop(hop Hop) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%2d", hop.TTL)
+	if hop.IP != nil {
+		sep := "  "
+		switch {
+		case hop.ASN > 0:
+			fmt.Fprintf(&b, "  [AS%d]", hop.ASN)
+			sep = " "
+		case hop.OriginLookedUp:
+			b.WriteString("  [AS???]")
+			sep = " "
+		}
+		if hop.Host != "" && hop.Host != hop.IP.String() {
+			fmt.Fprintf(&b, "%s%s (%s)", sep, hop.Host, hop.IP)
+		} else {
+			fmt.Fprintf(&b, "%s%s", sep, hop.IP)
+		}
+		if len(hop.MPLS) > 0 {
+			labels := make([]string, len(hop.MPLS))
+			for i, l := range hop.MPLS {
+				labels[i] = l.String()
+			}
+			fmt.Fprintf(&b, " <MPLS:%s>", strings.Join(labels, "/"))
+		}
+	}
+
+	// Like traceroute, print the address of a probe answered by another router than the
+	// previous one before its RTT.
+	last := hop.IP
+	for i, rtt := range hop.RTTs {
+		if rtt == NoRTT {
+			b.WriteString("  *")
+			continue
+		}
+		if i < len(hop.Probes) {
+			if ip := hop.Probes[i].Responder; ip != nil && !ip.Equal(last) {
+				fmt.Fprintf(&b, "  %s", ip)
+				last = ip
+			}
+		}
+		fmt.Fprintf(&b, "  %.3f ms", *milliseconds(rtt))
+	}
+
+	for _, annotation := range hop.Annotations {
+		fmt.Fprintf(&b, " %s", annotation)
+	}
+	if hop.MTU > 0 {
+		fmt.Fprintf(&b, " pmtu %d", hop.MTU)
+	}
+	if hop.Duplicates > 0 {
+		fmt.Fprintf(&b, " dup %d", hop.Duplicates)
+	}
+	if hop.Reordered > 0 {
+		fmt.Fprintf(&b, " reord %d", hop.Reordered)
+	}
+
+	return b.String()
+}
+
+// FormatText writes hops to w one per line with FormatHop, the way traceroute prints them,
+// so that its output can stand in for that of traceroute in scripts.
+//
+// The first hop whose router received the probes with an ECN codepoint other than the one
+// they were sent with is flagged, e.g. "ecn ECT(0)->Not-ECT", since the middlebox clearing
+// the codepoint sits right before it. So is the first hop whose router received them with a
+// rewritten IPv4 Identification, with "nat". Every hop of a routing loop is flagged with
+// "loop".
+func FormatText(w io.Writer, hops []Hop) error {
+	bleached, natted := false, false
+
+	for _, hop := range hops {
+		var b strings.Builder
+		b.WriteString(FormatHop(hop))
+		if !bleached && hop.ECNBleached() {
+			fmt.Fprintf(&b, " ecn %v->%v", hop.SentECN, hop.QuotedECN)
+			bleached = true
+		}
+		if !natted && hop.NATDetected {
+			b.WriteString(" nat")
+			natted = true
+		}
+		if hop.Loop {
+			b.WriteString(" loop")
+		}
+		b.WriteByte('\n')
+
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return fmt.Errorf("failed to write hop %d: %w", hop.TTL, err)
+		}
+	}
+
+	return nil
+}
+
+// FormatCSV writes hops to w as CSV, one row per hop after a header row of the form
+// "ttl,address,hostname,rtt1_ms,rtt2_ms,rtt3_ms".
+//
+// There is one RTT column per probe of the hop with the most probes, and at least
+// DefaultProbesPerHop, so traces run with the same options share the header. RTTs are
+// given in milliseconds. Timed-out probes, missing probes, hops that did not respond and
+// unresolved host names are left as empty cells.
+func FormatCSV(w io.Writer, hops []Hop) error {
+	probes := DefaultProbesPerHop
+	for _, hop := range hops {
+		if len(hop.RTTs) > probes {
+			probes = len(hop.RTTs)
+		}
+	}
+
+	cw := csv.NewWriter(w)
+
+	header := []string{"ttl", "address", "hostname"}
+	for i := 1; i <= probes; i++ {
+		header = append(header, fmt.Sprintf("rtt%d_ms", i))
+	}
+	if err := cw.Write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	for _, hop := range hops {
+		row := make([]string, len(header))
+		row[0] = strconv.Itoa(hop.TTL)
+		if hop.IP != nil {
+			row[1] = hop.IP.String()
+		}
+		row[2] = hop.Host
+		for i, rtt := range hop.RTTs {
+			if ms := milliseconds(rtt); ms != nil {
+				row[3+i] = strconv.FormatFloat(*ms, 'f', 3, 64)
+			}
+		}
+		if err := cw.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %w", err)
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return nil
+}
+
+// jsonMultipathNode is the JSON schema of a node emitted by FormatMultipathJSON.
+type jsonMultipathNode struct {
+	Address string  `json:"address"`
+	RTT     float64 `json:"rtt_ms"`
+	// Next lists the addresses of the nodes of the following hop it leads to.
+	Next []string `json:"next"`
+}
+
+type jsonMultipathHop struct {
+	Hop    int                 `json:"hop"`
+	Nodes  []jsonMultipathNode `json:"nodes"`
+	Probes int                 `json:"probes"`
+	Lost   int                 `json:"lost"`
+}
+
+type jsonMultipath struct {
+	Hops []jsonMultipathHop `json:"hops"`
+}
+
+// FormatMultipathJSON encodes the graph found by RunMultipath as a JSON document of the
+// form {"hops": [{"hop": 1, "nodes": [{"address": ..., "next": [...]}], ...}]}, where every
+// node lists the addresses of the nodes of the following hop it leads to.
+func FormatMultipathJSON(mp *Multipath) ([]byte, error) {
+	out := jsonMultipath{Hops: make([]jsonMultipathHop, 0, len(mp.Hops))}
+
+	for i, hop := range mp.Hops {
+		h := jsonMultipathHop{
+			Hop:    hop.TTL,
+			Nodes:  make([]jsonMultipathNode, 0, len(hop.Nodes)),
+			Probes: hop.Probes,
+			Lost:   hop.Lost,
+		}
+		for _, node := range hop.Nodes {
+			n := jsonMultipathNode{
+				Address: node.IP.String(),
+				RTT:     *milliseconds(node.RTT),
+				Next:    make([]string, 0, len(node.Next)),
+			}
+			for _, next := range node.Next {
+				n.Next = append(n.Next, mp.Hops[i+1].Nodes[next].IP.String())
+			}
+			h.Nodes = append(h.Nodes, n)
+		}
+		out.Hops = append(out.Hops, h)
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode multipath trace as JSON: %w", err)
+	}
+
+	return data, nil
+}
+
+// FormatMultipath renders the graph found by RunMultipath one node per line, each followed
+// by the nodes of the following hop it leads to, e.g.
+//
+//	2  192.0.2.1  1.234 ms -> 198.51.100.1, 198.51.100.2
+//	   192.0.2.2  1.345 ms -> 198.51.100.2
+//	3  198.51.100.1  2.345 ms
+//
+// A hop where every probe was lost is shown as "*".
+func FormatMultipath(mp *Multipath) string {
+	var b strings.Builder
+
+	for i, hop := range mp.Hops {
+		if len(hop.Nodes) == 0 {
+			fmt.Fprintf(&b, "%2d  *\n", hop.TTL)
+			continue
+		}
+
+		for n, node := range hop.Nodes {
+			if n == 0 {
+				fmt.Fprintf(&b, "%2d", hop.TTL)
+			} else {
+				b.WriteString("  ")
+			}
+			fmt.Fprintf(&b, "  %s  %.3f ms", node.IP, *milliseconds(node.RTT))
+
+			for j, next := range node.Next {
+				sep := ", "
+				if j == 0 {
+					sep = " -> "
+				}
+				fmt.Fprintf(&b, "%s%s", sep, mp.Hops[i+1].Nodes[next].IP)
+			}
+			b.WriteByte('\n')
+		}
+	}
+
+	return b.String()
+}
+
+// FormatReport renders the statistics of a Monitor as a table like mtr --report, e.g.
+//
+//	   HOST          Loss%   Snt   Last    Avg   Best   Wrst  StDev
+//	1. 192.0.2.1      0.0%    10    1.2    1.4    1.1    2.0    0.3
+//	2. ???          100.0%    10
+//	3. 198.51.100.7  10.0%    10    9.8   10.3    9.5   12.1    0.8
+//
+// RTTs are given in milliseconds. Hops where no probe received a reply are shown as "???",
+// without RTTs.
+func FormatReport(snap MonitorSnapshot) string {
+	hosts := make([]string, len(snap.Hops))
+	width := len("HOST")
+	for i, hop := range snap.Hops {
+		switch {
+		case hop.IP == nil:
+			hosts[i] = "???"
+		case hop.Name != "" && hop.Name != hop.IP.String():
+			hosts[i] = fmt.Sprintf("%s (%s)", hop.Name, hop.IP)
+		default:
+			hosts[i] = hop.IP.String()
+		}
+		if len(hosts[i]) > width {
+			width = len(hosts[i])
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "    %-*s %6s %5s %6s %6s %6s %6s %6s\n", width, "HOST", "Loss%", "Snt",
+		"Last", "Avg", "Best", "Wrst", "StDev")
+
+	for i, hop := range snap.Hops {
+		fmt.Fprintf(&b, "%2d. %-*s %5.1f%% %5d", hop.TTL, width, hosts[i], hop.Loss, hop.Sent)
+		if hop.Received > 0 {
+			for _, rtt := range []time.Duration{hop.Last, hop.Avg, hop.Best, hop.Worst,
+				hop.StdDev} {
+				fmt.Fprintf(&b, " %6.1f", *milliseconds(rtt))
+			}
+		}
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
@@ -0,0 +1,467 @@
+package tracer
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func TestFormatJSON(t *testing.T) {
+	first := Hop{TTL: 1}
+	first.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: 1500 * time.Microsecond, QuotedTTL: 1})
+	first.add(Probe{RTT: NoRTT})
+	first.add(Probe{Responder: net.IPv4(10, 0, 0, 2), RTT: 2500 * time.Microsecond})
+	first.summarize()
+	first.Host = "gw.example.net"
+	first.ASN = 64496
+	first.Country, first.City, first.Lat, first.Lon = "NL", "Amsterdam", 52.37, 4.89
+	_, first.Prefix, _ = net.ParseCIDR("10.0.0.0/8")
+	first.Duplicates, first.Reordered = 1, 2
+
+	second := Hop{TTL: 2}
+	second.add(Probe{RTT: NoRTT})
+	second.summarize()
+
+	third := Hop{TTL: 3, SentECN: network.ECT0}
+	third.add(Probe{
+		Responder:  net.IPv4(10, 0, 1, 1),
+		RTT:        3 * time.Millisecond,
+		ReplyTTL:   253,
+		QuotedTTL:  62,
+		Annotation: "!F",
+		MTU:        1400,
+		QuotedECN:  network.NotECT,
+		MPLS: []network.MPLSLabel{
+			{Label: 24015, TTL: 1},
+			{Label: 16, TC: 5, S: true, TTL: 254},
+		},
+
+		NATDetected: true,
+	})
+	third.summarize()
+
+	data, err := FormatJSON([]Hop{first, second, third})
+
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"hops": [
+		{
+			"hop": 1,
+			"addresses": ["10.0.0.1", "10.0.0.2"],
+			"responders": [
+				{"address": "10.0.0.1", "count": 1, "rtts_ms": [1.5]},
+				{"address": "10.0.0.2", "count": 1, "rtts_ms": [2.5]}
+			],
+			"hostname": "gw.example.net",
+			"asn": 64496,
+			"prefix": "10.0.0.0/8",
+			"country": "NL",
+			"city": "Amsterdam",
+			"lat": 52.37,
+			"lon": 4.89,
+			"rtts_ms": [1.5, null, 2.5],
+			"min_ms": 1.5,
+			"avg_ms": 2,
+			"max_ms": 2.5,
+			"stddev_ms": 0.5,
+			"loss_pct": 33.33333333333333,
+			"reply_ttl": null,
+			"return_hops": null,
+			"quoted_ttl": 1,
+			"annotations": null,
+			"mtu": null,
+			"mpls": null,
+			"ecn_sent": null,
+			"ecn_quoted": null,
+			"duplicates": 1,
+			"reordered": 2,
+			"nat_detected": false,
+			"loop": false
+		},
+		{
+			"hop": 2,
+			"addresses": null,
+			"responders": null,
+			"hostname": null,
+			"asn": null,
+			"prefix": null,
+			"country": null,
+			"city": null,
+			"lat": null,
+			"lon": null,
+			"rtts_ms": [null],
+			"min_ms": null,
+			"avg_ms": null,
+			"max_ms": null,
+			"stddev_ms": null,
+			"loss_pct": 100,
+			"reply_ttl": null,
+			"return_hops": null,
+			"quoted_ttl": null,
+			"annotations": null,
+			"mtu": null,
+			"mpls": null,
+			"ecn_sent": null,
+			"ecn_quoted": null,
+			"duplicates": 0,
+			"reordered": 0,
+			"nat_detected": false,
+			"loop": false
+		},
+		{
+			"hop": 3,
+			"addresses": ["10.0.1.1"],
+			"responders": [{"address": "10.0.1.1", "count": 1, "rtts_ms": [3]}],
+			"hostname": null,
+			"asn": null,
+			"prefix": null,
+			"country": null,
+			"city": null,
+			"lat": null,
+			"lon": null,
+			"rtts_ms": [3],
+			"min_ms": 3,
+			"avg_ms": 3,
+			"max_ms": 3,
+			"stddev_ms": 0,
+			"loss_pct": 0,
+			"reply_ttl": 253,
+			"return_hops": 2,
+			"quoted_ttl": 62,
+			"annotations": ["!F"],
+			"mtu": 1400,
+			"mpls": [
+				{"label": 24015, "tc": 0, "s": false, "ttl": 1},
+				{"label": 16, "tc": 5, "s": true, "ttl": 254}
+			],
+			"ecn_sent": "ECT(0)",
+			"ecn_quoted": "Not-ECT",
+			"duplicates": 0,
+			"reordered": 0,
+			"nat_detected": true,
+			"loop": false
+		}
+	]}`, string(data))
+}
+
+func TestFormatJSONEmpty(t *testing.T) {
+	data, err := FormatJSON(nil)
+
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"hops": []}`, string(data))
+}
+
+func TestFormatHopLoadBalanced(t *testing.T) {
+	hop := Hop{TTL: 3}
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: 1234 * time.Microsecond})
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 2), RTT: 2345 * time.Microsecond})
+	hop.add(Probe{RTT: NoRTT})
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: 3456 * time.Microsecond})
+	hop.summarize()
+
+	assert.Equal(t, " 3  192.0.2.1  1.234 ms  192.0.2.2  2.345 ms  *  192.0.2.1  3.456 ms",
+		FormatHop(hop))
+
+	hop = Hop{TTL: 3}
+	hop.add(Probe{RTT: NoRTT})
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 2), RTT: 2345 * time.Microsecond})
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 2), RTT: 3456 * time.Microsecond})
+	hop.summarize()
+	hop.Host = "gw.example.net"
+
+	assert.Equal(t, " 3  gw.example.net (192.0.2.2)  *  2.345 ms  3.456 ms", FormatHop(hop))
+}
+
+func TestFormatCSV(t *testing.T) {
+	first := Hop{TTL: 1}
+	first.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: 1500 * time.Microsecond})
+	first.add(Probe{RTT: NoRTT})
+	first.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: 2500 * time.Microsecond})
+	first.summarize()
+	first.Host = "gw, example"
+
+	second := Hop{TTL: 2}
+	second.add(Probe{RTT: NoRTT})
+	second.summarize()
+
+	var b strings.Builder
+	require.NoError(t, FormatCSV(&b, []Hop{first, second}))
+
+	assert.Equal(t, "ttl,address,hostname,rtt1_ms,rtt2_ms,rtt3_ms\n"+
+		"1,10.0.0.1,\"gw, example\",1.500,,2.500\n"+
+		"2,,,,,\n", b.String())
+}
+
+func TestFormatCSVMoreProbes(t *testing.T) {
+	hop := Hop{TTL: 1}
+	for i := 1; i <= 4; i++ {
+		hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Duration(i) * time.Millisecond})
+	}
+	hop.summarize()
+
+	var b strings.Builder
+	require.NoError(t, FormatCSV(&b, []Hop{hop}))
+
+	assert.Equal(t, "ttl,address,hostname,rtt1_ms,rtt2_ms,rtt3_ms,rtt4_ms\n"+
+		"1,10.0.0.1,,1.000,2.000,3.000,4.000\n", b.String())
+}
+
+func TestFormatCSVEmpty(t *testing.T) {
+	var b strings.Builder
+	require.NoError(t, FormatCSV(&b, nil))
+
+	assert.Equal(t, "ttl,address,hostname,rtt1_ms,rtt2_ms,rtt3_ms\n", b.String())
+}
+
+func TestFormatHop(t *testing.T) {
+	hop := Hop{TTL: 3}
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: 1234 * time.Microsecond})
+	hop.add(Probe{RTT: NoRTT})
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: 2345 * time.Microsecond,
+		Annotation: "!X"})
+	hop.summarize()
+
+	assert.Equal(t, " 3  192.0.2.1  1.234 ms  *  2.345 ms !X", FormatHop(hop))
+
+	hop.Host = "gw.example.net"
+	assert.Equal(t, " 3  gw.example.net (192.0.2.1)  1.234 ms  *  2.345 ms !X", FormatHop(hop))
+
+	hop.OriginLookedUp = true
+	assert.Equal(t, " 3  [AS???] gw.example.net (192.0.2.1)  1.234 ms  *  2.345 ms !X",
+		FormatHop(hop))
+
+	hop.ASN = 64496
+	assert.Equal(t, " 3  [AS64496] gw.example.net (192.0.2.1)  1.234 ms  *  2.345 ms !X",
+		FormatHop(hop))
+
+	hop.Host = ""
+	assert.Equal(t, " 3  [AS64496] 192.0.2.1  1.234 ms  *  2.345 ms !X", FormatHop(hop))
+}
+
+func TestFormatHopMPLS(t *testing.T) {
+	hop := Hop{TTL: 5}
+	hop.add(Probe{
+		Responder: net.IPv4(192, 0, 2, 1),
+		RTT:       time.Millisecond,
+		MPLS: []network.MPLSLabel{
+			{Label: 24015, TTL: 1},
+			{Label: 16, TC: 5, S: true, TTL: 254},
+		},
+	})
+	hop.summarize()
+
+	assert.Equal(t, " 5  192.0.2.1 <MPLS:L=24015, E=0, S=0, T=1/L=16, E=5, S=1, T=254>"+
+		"  1.000 ms", FormatHop(hop))
+}
+
+func TestFormatHopMTU(t *testing.T) {
+	hop := Hop{TTL: 4}
+	hop.add(Probe{
+		Responder:  net.IPv4(192, 0, 2, 1),
+		RTT:        time.Millisecond,
+		Annotation: "!F",
+		MTU:        1400,
+	})
+	hop.summarize()
+
+	assert.Equal(t, " 4  192.0.2.1  1.000 ms !F pmtu 1400", FormatHop(hop))
+}
+
+func TestFormatHopDuplicatesAndReordered(t *testing.T) {
+	hop := Hop{TTL: 5, Duplicates: 1}
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: time.Millisecond})
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: 2 * time.Millisecond})
+	hop.summarize()
+
+	assert.Equal(t, " 5  192.0.2.1  1.000 ms  2.000 ms dup 1", FormatHop(hop))
+
+	hop.Reordered = 2
+	assert.Equal(t, " 5  192.0.2.1  1.000 ms  2.000 ms dup 1 reord 2", FormatHop(hop))
+}
+
+// formatText returns the output of FormatText for hops.
+func formatText(t *testing.T, hops []Hop) string {
+	t.Helper()
+
+	var b strings.Builder
+	require.NoError(t, FormatText(&b, hops))
+	return b.String()
+}
+
+func TestFormatText(t *testing.T) {
+	lost := Hop{TTL: 1}
+	lost.add(Probe{RTT: NoRTT})
+	lost.add(Probe{RTT: NoRTT})
+
+	reached := Hop{TTL: 12}
+	reached.add(Probe{Responder: net.IPv4(198, 51, 100, 7), RTT: 10 * time.Millisecond})
+
+	assert.Equal(t, " 1  *  *\n12  198.51.100.7  10.000 ms\n",
+		formatText(t, []Hop{lost, reached}))
+}
+
+func TestFormatTextAnnotation(t *testing.T) {
+	hop := Hop{TTL: 2}
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: time.Millisecond, Annotation: "!H"})
+	hop.add(Probe{RTT: NoRTT})
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: 2 * time.Millisecond, Annotation: "!H"})
+	hop.summarize()
+	hop.Host = "gw.example.net"
+
+	assert.Equal(t, " 2  gw.example.net (192.0.2.1)  1.000 ms  *  2.000 ms !H\n",
+		formatText(t, []Hop{hop}))
+}
+
+func TestFormatTextAnnotations(t *testing.T) {
+	hop := Hop{TTL: 2}
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: time.Millisecond, Annotation: "!H"})
+	hop.add(Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: 2 * time.Millisecond, Annotation: "!X"})
+	hop.summarize()
+
+	assert.Equal(t, " 2  192.0.2.1  1.000 ms  2.000 ms !H !X\n", formatText(t, []Hop{hop}))
+}
+
+func TestFormatTextWriteError(t *testing.T) {
+	hop := Hop{TTL: 1}
+	hop.add(Probe{RTT: NoRTT})
+
+	assert.ErrorContains(t, FormatText(failingWriter{}, []Hop{hop}), "disk full")
+}
+
+func TestFormatTextFlagsFirstECNBleaching(t *testing.T) {
+	hop := func(ttl int, quoted network.ECN) Hop {
+		h := Hop{TTL: ttl, SentECN: network.ECT0}
+		h.add(Probe{Responder: net.IPv4(10, 0, 0, byte(ttl)), RTT: time.Millisecond,
+			QuotedECN: quoted})
+		return h
+	}
+
+	text := formatText(t, []Hop{
+		hop(1, network.ECT0),
+		hop(2, network.NotECT),
+		hop(3, network.NotECT),
+		hop(4, UnknownECN),
+	})
+
+	assert.Equal(t, " 1  10.0.0.1  1.000 ms\n"+
+		" 2  10.0.0.2  1.000 ms ecn ECT(0)->Not-ECT\n"+
+		" 3  10.0.0.3  1.000 ms\n"+
+		" 4  10.0.0.4  1.000 ms\n", text)
+}
+
+func TestFormatTextFlagsFirstNAT(t *testing.T) {
+	hop := func(ttl int, natted bool) Hop {
+		h := Hop{TTL: ttl}
+		h.add(Probe{Responder: net.IPv4(10, 0, 0, byte(ttl)), RTT: time.Millisecond,
+			NATDetected: natted})
+		return h
+	}
+
+	text := formatText(t, []Hop{hop(1, false), hop(2, true), hop(3, true)})
+
+	assert.Equal(t, " 1  10.0.0.1  1.000 ms\n"+
+		" 2  10.0.0.2  1.000 ms nat\n"+
+		" 3  10.0.0.3  1.000 ms\n", text)
+}
+
+func TestFormatTextFlagsLoop(t *testing.T) {
+	hop := func(ttl int, loop bool) Hop {
+		h := Hop{TTL: ttl, Loop: loop}
+		h.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond})
+		return h
+	}
+
+	text := formatText(t, []Hop{hop(1, false), hop(2, true), hop(3, true)})
+
+	assert.Equal(t, " 1  10.0.0.1  1.000 ms\n"+
+		" 2  10.0.0.1  1.000 ms loop\n"+
+		" 3  10.0.0.1  1.000 ms loop\n", text)
+}
+
+func testMultipath() *Multipath {
+	return &Multipath{Hops: []MultipathHop{
+		{TTL: 2, Probes: 6, Nodes: []MultipathNode{
+			{IP: net.IPv4(192, 0, 2, 1), RTT: 1234 * time.Microsecond, Next: []int{0, 1}},
+			{IP: net.IPv4(192, 0, 2, 2), RTT: 1345 * time.Microsecond, Next: []int{1}},
+		}},
+		{TTL: 3, Probes: 11, Lost: 1, Nodes: []MultipathNode{
+			{IP: net.IPv4(198, 51, 100, 1), RTT: 2 * time.Millisecond},
+			{IP: net.IPv4(198, 51, 100, 2), RTT: 3 * time.Millisecond},
+		}},
+		{TTL: 4, Probes: 6, Lost: 6},
+	}}
+}
+
+func TestFormatMultipath(t *testing.T) {
+	assert.Equal(t, " 2  192.0.2.1  1.234 ms -> 198.51.100.1, 198.51.100.2\n"+
+		"    192.0.2.2  1.345 ms -> 198.51.100.2\n"+
+		" 3  198.51.100.1  2.000 ms\n"+
+		"    198.51.100.2  3.000 ms\n"+
+		" 4  *\n", FormatMultipath(testMultipath()))
+}
+
+func TestFormatMultipathJSON(t *testing.T) {
+	data, err := FormatMultipathJSON(testMultipath())
+
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"hops": [
+		{
+			"hop": 2,
+			"nodes": [
+				{"address": "192.0.2.1", "rtt_ms": 1.234, "next": ["198.51.100.1", "198.51.100.2"]},
+				{"address": "192.0.2.2", "rtt_ms": 1.345, "next": ["198.51.100.2"]}
+			],
+			"probes": 6,
+			"lost": 0
+		},
+		{
+			"hop": 3,
+			"nodes": [
+				{"address": "198.51.100.1", "rtt_ms": 2, "next": []},
+				{"address": "198.51.100.2", "rtt_ms": 3, "next": []}
+			],
+			"probes": 11,
+			"lost": 1
+		},
+		{"hop": 4, "nodes": [], "probes": 6, "lost": 6}
+	]}`, string(data))
+}
+
+func TestFormatReport(t *testing.T) {
+	ms := func(f float64) time.Duration { return time.Duration(f * float64(time.Millisecond)) }
+	snap := MonitorSnapshot{Rounds: 10, Hops: []HopStats{
+		{TTL: 1, IP: net.IPv4(192, 0, 2, 1), Sent: 10, Received: 10,
+			Last: ms(1.2), Avg: ms(1.4), Best: ms(1.1), Worst: ms(2), StdDev: ms(0.3)},
+		{TTL: 2, Sent: 10, Loss: 100,
+			Last: NoRTT, Avg: NoRTT, Best: NoRTT, Worst: NoRTT, StdDev: NoRTT},
+		{TTL: 3, IP: net.IPv4(198, 51, 100, 7), Sent: 10, Received: 9, Loss: 10,
+			Last: ms(9.8), Avg: ms(10.3), Best: ms(9.5), Worst: ms(12.1), StdDev: ms(0.8)},
+	}}
+
+	assert.Equal(t, ""+
+		"    HOST          Loss%   Snt   Last    Avg   Best   Wrst  StDev\n"+
+		" 1. 192.0.2.1      0.0%    10    1.2    1.4    1.1    2.0    0.3\n"+
+		" 2. ???          100.0%    10\n"+
+		" 3. 198.51.100.7  10.0%    10    9.8   10.3    9.5   12.1    0.8\n",
+		FormatReport(snap))
+}
+
+func TestFormatReportNames(t *testing.T) {
+	snap := MonitorSnapshot{Hops: []HopStats{
+		{TTL: 1, IP: net.IPv4(192, 0, 2, 1), Name: "gw.example.net", Sent: 1, Received: 1,
+			Last: time.Millisecond, Avg: time.Millisecond, Best: time.Millisecond,
+			Worst: time.Millisecond},
+		{TTL: 2, IP: net.IPv4(192, 0, 2, 2), Name: "192.0.2.2", Sent: 1, Received: 1,
+			Last: time.Millisecond, Avg: time.Millisecond, Best: time.Millisecond,
+			Worst: time.Millisecond},
+	}}
+
+	lines := strings.Split(FormatReport(snap), "\n")
+	assert.True(t, strings.HasPrefix(lines[1], " 1. gw.example.net (192.0.2.1)  "), lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], " 2. 192.0.2.2                   "), lines[2])
+}
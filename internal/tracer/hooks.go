@@ -0,0 +1,40 @@
+package tracer
+
+import (
+	"net"
+	"time"
+)
+
+// probeHooks calls Options.OnProbeSent, Options.OnReplyReceived and Options.OnProbeTimeout,
+// any of which may be nil.
+type probeHooks struct {
+	sent     func(ttl, seq int)
+	received func(ttl int, from net.IP, rtt time.Duration)
+	timeout  func(ttl, seq int)
+}
+
+// hooks returns the hooks of the options.
+func (o Options) hooks() probeHooks {
+	return probeHooks{sent: o.OnProbeSent, received: o.OnReplyReceived, timeout: o.OnProbeTimeout}
+}
+
+// probeSent reports that the seq-th probe for ttl was sent.
+func (h probeHooks) probeSent(ttl, seq int) {
+	if h.sent != nil {
+		h.sent(ttl, seq)
+	}
+}
+
+// replyReceived reports the outcome of a probe for ttl, unless it received no reply.
+func (h probeHooks) replyReceived(ttl int, probe Probe) {
+	if h.received != nil && probe.Responded() {
+		h.received(ttl, probe.Responder, probe.RTT)
+	}
+}
+
+// probeTimedOut reports that the seq-th probe for ttl received no reply in time.
+func (h probeHooks) probeTimedOut(ttl, seq int) {
+	if h.timeout != nil {
+		h.timeout(ttl, seq)
+	}
+}
@@ -0,0 +1,144 @@
+package tracer
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeHooks(t *testing.T) {
+	var sent [][2]int
+	var received []Probe
+	var timeouts [][2]int
+	hooks := Options{
+		OnProbeSent: func(ttl, seq int) { sent = append(sent, [2]int{ttl, seq}) },
+		OnReplyReceived: func(ttl int, from net.IP, rtt time.Duration) {
+			received = append(received, Probe{Responder: from, RTT: rtt, ReplyTTL: ttl})
+		},
+		OnProbeTimeout: func(ttl, seq int) { timeouts = append(timeouts, [2]int{ttl, seq}) },
+	}.hooks()
+
+	hooks.probeSent(3, 1)
+	hooks.replyReceived(3, lostProbe())
+	hooks.replyReceived(3, Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: time.Millisecond})
+	hooks.probeTimedOut(3, 2)
+
+	assert.Equal(t, [][2]int{{3, 1}}, sent)
+	assert.Equal(t, [][2]int{{3, 2}}, timeouts)
+	assert.Equal(t,
+		[]Probe{{Responder: net.IPv4(192, 0, 2, 1), RTT: time.Millisecond, ReplyTTL: 3}},
+		received, "lost probes received no reply")
+
+	// Unset hooks are not called.
+	Options{}.hooks().probeSent(1, 0)
+	Options{}.hooks().replyReceived(1, Probe{Responder: net.IPv4(192, 0, 2, 1)})
+	Options{}.hooks().probeTimedOut(1, 0)
+}
+
+func TestTraceRunHooks(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		name := "sequential"
+		if parallel {
+			name = "parallel"
+		}
+		t.Run(name, func(t *testing.T) {
+			dest := net.IPv4(198, 51, 100, 7)
+			p := &fakeProber{dest: dest, sent: make(chan int, 10)}
+			// TTL 2 does not answer.
+			receiver := pathReceiver(t, p, 3, func(ttl int) bool { return ttl == 2 })
+
+			var mu sync.Mutex
+			var sent, received, timeouts [][2]int
+			opts := Options{
+				Timeout:      50 * time.Millisecond,
+				ProbesPerHop: 2,
+				Retries:      1,
+				Parallel:     parallel,
+				OnProbeSent: func(ttl, seq int) {
+					mu.Lock()
+					defer mu.Unlock()
+					sent = append(sent, [2]int{ttl, seq})
+				},
+				OnReplyReceived: func(ttl int, from net.IP, rtt time.Duration) {
+					mu.Lock()
+					defer mu.Unlock()
+					received = append(received, [2]int{ttl, int(from.To4()[3])})
+					assert.Positive(t, rtt)
+				},
+				OnProbeTimeout: func(ttl, seq int) {
+					mu.Lock()
+					defer mu.Unlock()
+					timeouts = append(timeouts, [2]int{ttl, seq})
+				},
+			}.withDefaults()
+			tr := &trace{opts: opts, receiver: receiver, prober: p}
+			defer tr.close()
+
+			require.NoError(t, tr.run(context.Background(), func(Hop) {}))
+
+			sortPairs(sent)
+			sortPairs(received)
+			sortPairs(timeouts)
+			// Parallel probes may be sent beyond the destination before it answers.
+			for len(sent) > 0 && sent[len(sent)-1][0] > 3 {
+				sent = sent[:len(sent)-1]
+			}
+			assert.Equal(t, [][2]int{{1, 0}, {1, 1}, {2, 0}, {2, 1}, {2, 2}, {2, 3},
+				{3, 0}, {3, 1}}, sent, "the silent TTL is retried")
+			assert.Equal(t, [][2]int{{1, 1}, {1, 1}, {3, 7}, {3, 7}}, received)
+			assert.Equal(t, [][2]int{{2, 0}, {2, 1}, {2, 2}, {2, 3}}, timeouts,
+				"every probe of the silent TTL times out")
+		})
+	}
+}
+
+func sortPairs(pairs [][2]int) {
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+}
+
+func TestRunParallelHooksOutsideLocks(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 10)}
+	receiver := pathReceiver(t, p, 2, func(int) bool { return false })
+
+	// The first probe sent waits for another one to be sent, which would never happen
+	// if the hook held the lock of the probes.
+	second := make(chan struct{})
+	var once, first sync.Once
+	opts := Options{
+		Timeout:             time.Second,
+		ProbesPerHop:        1,
+		Parallel:            true,
+		MaxConcurrentProbes: 2,
+		OnProbeSent: func(ttl, seq int) {
+			blocked := false
+			first.Do(func() { blocked = true })
+			if !blocked {
+				once.Do(func() { close(second) })
+				return
+			}
+			select {
+			case <-second:
+			case <-time.After(time.Second):
+				t.Error("the hook blocked the other probes")
+			}
+		},
+	}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+	assert.Len(t, hops, 2)
+}
@@ -0,0 +1,273 @@
+package tracer
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// NoRTT is the RTT reported for probes that received no reply.
+const NoRTT time.Duration = -1
+
+// UnknownECN is the QuotedECN of probes whose reply did not quote them.
+const UnknownECN network.ECN = -1
+
+// Probe is the outcome of a single probe packet.
+type Probe struct {
+	// Responder is the address of the responder, or nil if no reply arrived in time.
+	Responder net.IP
+	// SentAt is when the probe was sent.
+	SentAt time.Time
+	// RTT is the round-trip time of the probe, or NoRTT if it timed out.
+	RTT time.Duration
+	// ReplyTTL is the TTL the reply arrived with, or -1 if it is unknown.
+	ReplyTTL int
+	// ICMPType and ICMPCode are the type and code of the ICMP reply, or -1 if there is none.
+	ICMPType int
+	ICMPCode int
+	// QuotedTTL is the TTL of the probe as the responder received it, or -1 if unknown.
+	QuotedTTL int
+	// Annotation marks an unreachable or filtered reply the way traceroute does, e.g. "!H".
+	Annotation string
+	// MTU is the next-hop MTU reported by the responder, or zero.
+	MTU int
+	// QuotedECN is the ECN codepoint of the probe as the responder received it.
+	QuotedECN network.ECN
+	// MPLS holds the MPLS label stack reported by the responder, if any.
+	MPLS []network.MPLSLabel
+	// Interface identifies the responder's interface that received the probe, if reported.
+	Interface *network.InterfaceInfo
+	// NATDetected is set when the responder quoted a probe rewritten by a NAT.
+	NATDetected bool
+	// Retries is the number of times the probe was sent again after timing out.
+	Retries int
+	// Err is the error the probe failed with, or nil.
+	Err error
+
+	// tooBig is set when the responder could not forward the probe without fragmenting it.
+	tooBig bool
+}
+
+// Responded reports whether a reply was received for the probe.
+func (p Probe) Responded() bool {
+	return p.RTT != NoRTT
+}
+
+// Hop is the outcome of probing a single TTL.
+type Hop struct {
+	// TTL is the time to live the probes were sent with.
+	TTL int
+	// IP is the address of the first router that responded, or nil if none did.
+	IP net.IP
+	// Responders holds every distinct address that responded, in the order of first reply.
+	Responders []Responder
+	// Host is the host name of IP, or IP itself if it has none.
+	Host string
+	// ASN and Prefix are the origin AS and BGP prefix of IP, if known.
+	ASN    int
+	Prefix *net.IPNet
+	// OriginLookedUp reports whether the origin of IP was looked up.
+	OriginLookedUp bool
+	// Country, City, Lat and Lon locate IP approximately, if known.
+	Country string
+	City    string
+	Lat     float64
+	Lon     float64
+	// ReplyTTL is the TTL the first reply arrived with, or zero or negative if unknown.
+	ReplyTTL int
+	// QuotedTTL is the TTL the first answered probe arrived with, or negative if unknown.
+	QuotedTTL int
+	// Annotations holds the distinct annotations of the probes, in the order received.
+	Annotations []string
+	// MTU is the next-hop MTU reported at this hop, or the path MTU found there.
+	MTU int
+	// SentECN is the ECN codepoint the probes were sent with.
+	SentECN network.ECN
+	// QuotedECN is the ECN codepoint the first answered probe arrived with.
+	QuotedECN network.ECN
+	// MPLS holds the MPLS label stack reported by the first router that responded.
+	MPLS []network.MPLSLabel
+	// Interface identifies the interface of the first router that responded, if reported.
+	Interface *network.InterfaceInfo
+	// NATDetected reports whether a NAT rewrote the first answered probe.
+	NATDetected bool
+	// Loop reports whether the hop is part of a routing loop.
+	Loop bool
+	// Probes holds the outcome of every probe in the order they were sent.
+	Probes []Probe
+	// RTTs holds the round-trip time of every probe, NoRTT for those that timed out.
+	RTTs []time.Duration
+	// Min, Avg, Max and StdDev summarize the RTTs of the probes that received a reply.
+	Min    time.Duration
+	Avg    time.Duration
+	Max    time.Duration
+	StdDev time.Duration
+	// Loss is the percentage of probes that received no reply.
+	Loss float64
+	// Retries is the number of retries sent, and FirstLoss the loss of the first attempts.
+	Retries   int
+	FirstLoss float64
+	// Duplicates and Reordered count the duplicated and out-of-order replies of the hop.
+	Duplicates int
+	Reordered  int
+	// Err is set on the final hop delivered by Tracer.RunStream when the trace failed.
+	Err error
+}
+
+// Responder is a distinct address that answered probes of a hop.
+type Responder struct {
+	IP net.IP
+	// Count is the number of probes it answered.
+	Count int
+	// RTTs holds the round-trip times of the probes it answered.
+	RTTs []time.Duration
+}
+
+// ReturnHops estimates the number of hops the reply of the first responding router
+// travelled back, or returns -1 if the TTL it arrived with is unknown.
+//
+// See ReturnHops.
+func (h Hop) ReturnHops() int {
+	return ReturnHops(h.ReplyTTL)
+}
+
+// ReturnHops estimates the length of the return path of a reply that arrived with the
+// given TTL, assuming the sender used the smallest of the common initial TTLs 64, 128 and
+// 255 that is not below it. It returns -1 if ttl is not positive.
+func ReturnHops(ttl int) int {
+	if ttl <= 0 {
+		return -1
+	}
+
+	for _, initial := range []int{64, 128, 255} {
+		if ttl <= initial {
+			return initial - ttl
+		}
+	}
+	return -1
+}
+
+// ECNBleached reports whether the probe answered by the first router that responded
+// arrived there with an ECN codepoint other than the one it was sent with, so a middlebox
+// before that router rewrote it.
+func (h Hop) ECNBleached() bool {
+	return h.Responded() && h.QuotedECN != UnknownECN && h.QuotedECN != h.SentECN
+}
+
+// Responded reports whether at least one probe of the hop received a reply.
+func (h Hop) Responded() bool {
+	return h.IP != nil
+}
+
+func (h *Hop) add(p Probe) {
+	h.Probes = append(h.Probes, p)
+	h.RTTs = append(h.RTTs, p.RTT)
+	h.Retries += p.Retries
+	if p.Responder == nil {
+		return
+	}
+	if p.Annotation != "" && !containsString(h.Annotations, p.Annotation) {
+		h.Annotations = append(h.Annotations, p.Annotation)
+	}
+	if h.MTU == 0 {
+		h.MTU = p.MTU
+	}
+	if h.IP == nil {
+		h.IP = p.Responder
+		h.QuotedECN = p.QuotedECN
+		h.ReplyTTL = p.ReplyTTL
+		h.QuotedTTL = p.QuotedTTL
+		h.MPLS = p.MPLS
+		h.Interface = p.Interface
+		h.NATDetected = p.NATDetected
+	}
+	for i := range h.Responders {
+		if r := &h.Responders[i]; r.IP.Equal(p.Responder) {
+			r.Count++
+			r.RTTs = append(r.RTTs, p.RTT)
+			return
+		}
+	}
+	h.Responders = append(h.Responders,
+		Responder{IP: p.Responder, Count: 1, RTTs: []time.Duration{p.RTT}})
+}
+
+// Addrs returns every distinct address that responded, in the order of first reply.
+func (h Hop) Addrs() []net.IP {
+	if len(h.Responders) == 0 {
+		return nil
+	}
+	addrs := make([]net.IP, len(h.Responders))
+	for i, r := range h.Responders {
+		addrs[i] = r.IP
+	}
+	return addrs
+}
+
+// summarize computes the RTT statistics and loss of the probes added so far.
+func (h *Hop) summarize() {
+	h.Min, h.Avg, h.Max, h.StdDev = NoRTT, NoRTT, NoRTT, NoRTT
+	h.Loss, h.FirstLoss = 0, 0
+	if len(h.RTTs) == 0 {
+		return
+	}
+
+	var sum time.Duration
+	received := 0
+
+	for _, rtt := range h.RTTs {
+		if rtt == NoRTT {
+			continue
+		}
+		if received == 0 || rtt < h.Min {
+			h.Min = rtt
+		}
+		if received == 0 || rtt > h.Max {
+			h.Max = rtt
+		}
+		sum += rtt
+		received++
+	}
+
+	if received > 0 {
+		h.Avg = sum / time.Duration(received)
+		h.StdDev = stdDev(h.RTTs, h.Avg, received)
+	}
+	h.Loss = float64(len(h.RTTs)-received) / float64(len(h.RTTs)) * 100
+
+	h.FirstLoss = h.Loss
+	if len(h.Probes) == len(h.RTTs) {
+		firstAnswered := 0
+		for _, p := range h.Probes {
+			if p.Responded() && p.Retries == 0 {
+				firstAnswered++
+			}
+		}
+		h.FirstLoss = float64(len(h.Probes)-firstAnswered) / float64(len(h.Probes)) * 100
+	}
+}
+
+// stdDev returns the population standard deviation of the received rtts, whose mean is avg.
+func stdDev(rtts []time.Duration, avg time.Duration, received int) time.Duration {
+	var squares float64
+	for _, rtt := range rtts {
+		if rtt == NoRTT {
+			continue
+		}
+		d := float64(rtt - avg)
+		squares += d * d
+	}
+	return time.Duration(math.Sqrt(squares / float64(received)))
+}
+
+// containsString reports whether values holds value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
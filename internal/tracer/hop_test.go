@@ -0,0 +1,143 @@
+package tracer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func TestHopSummarize(t *testing.T) {
+	hop := Hop{TTL: 3}
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: 10 * time.Millisecond})
+	hop.add(Probe{RTT: NoRTT})
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 2), RTT: 20 * time.Millisecond})
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: 30 * time.Millisecond})
+	hop.summarize()
+
+	assert.True(t, hop.IP.Equal(net.IPv4(10, 0, 0, 1)))
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}, hop.Addrs())
+	assert.Equal(t, []Responder{
+		{IP: net.IPv4(10, 0, 0, 1), Count: 2,
+			RTTs: []time.Duration{10 * time.Millisecond, 30 * time.Millisecond}},
+		{IP: net.IPv4(10, 0, 0, 2), Count: 1, RTTs: []time.Duration{20 * time.Millisecond}},
+	}, hop.Responders)
+	assert.Equal(t, []time.Duration{
+		10 * time.Millisecond, NoRTT, 20 * time.Millisecond, 30 * time.Millisecond,
+	}, hop.RTTs)
+	assert.Equal(t, 10*time.Millisecond, hop.Min)
+	assert.Equal(t, 20*time.Millisecond, hop.Avg)
+	assert.Equal(t, 30*time.Millisecond, hop.Max)
+	assert.InDelta(t, 8164966*time.Nanosecond, hop.StdDev, 1)
+	assert.Equal(t, 25.0, hop.Loss)
+	assert.True(t, hop.Responded())
+
+	require.Len(t, hop.Probes, 4)
+	assert.True(t, hop.Probes[0].Responder.Equal(net.IPv4(10, 0, 0, 1)))
+	assert.False(t, hop.Probes[1].Responded())
+	assert.True(t, hop.Probes[2].Responder.Equal(net.IPv4(10, 0, 0, 2)))
+	assert.Equal(t, 30*time.Millisecond, hop.Probes[3].RTT)
+}
+
+func TestHopSummarizeAllLost(t *testing.T) {
+	hop := Hop{TTL: 7}
+	hop.add(Probe{RTT: NoRTT})
+	hop.add(Probe{RTT: NoRTT})
+	hop.summarize()
+
+	assert.Nil(t, hop.IP)
+	assert.Empty(t, hop.Addrs())
+	assert.Empty(t, hop.Responders)
+	assert.Equal(t, NoRTT, hop.Min)
+	assert.Equal(t, NoRTT, hop.Avg)
+	assert.Equal(t, NoRTT, hop.Max)
+	assert.Equal(t, NoRTT, hop.StdDev)
+	assert.Equal(t, 100.0, hop.Loss)
+	assert.False(t, hop.Responded())
+}
+
+func TestHopAddKeepsFirstResponderExtensions(t *testing.T) {
+	labels := []network.MPLSLabel{{Label: 24015, S: true, TTL: 1}}
+	iface := &network.InterfaceInfo{Index: 3, Name: "ge-0/0/3"}
+
+	hop := Hop{TTL: 4}
+	hop.add(Probe{RTT: NoRTT})
+	hop.add(Probe{
+		Responder: net.IPv4(10, 0, 0, 1),
+		RTT:       time.Millisecond,
+		MPLS:      labels,
+		Interface: iface,
+	})
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 2), RTT: time.Millisecond})
+
+	assert.Equal(t, labels, hop.MPLS)
+	assert.Same(t, iface, hop.Interface)
+}
+
+func TestHopAddCollectsAnnotations(t *testing.T) {
+	hop := Hop{TTL: 5}
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond})
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond, Annotation: "!X"})
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond, Annotation: "!H"})
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond, Annotation: "!X"})
+
+	assert.Equal(t, []string{"!X", "!H"}, hop.Annotations)
+}
+
+func TestHopAddKeepsFirstMTU(t *testing.T) {
+	hop := Hop{TTL: 5}
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond})
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond, MTU: 1400})
+	hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond, MTU: 1280})
+
+	assert.Equal(t, 1400, hop.MTU)
+}
+
+func TestHopECNBleached(t *testing.T) {
+	tests := []struct {
+		name   string
+		quoted network.ECN
+		want   bool
+	}{
+		{"preserved", network.ECT0, false},
+		{"cleared", network.NotECT, true},
+		{"remarked", network.ECT1, true},
+		{"unknown", UnknownECN, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop := Hop{TTL: 3, SentECN: network.ECT0}
+			hop.add(Probe{Responder: net.IPv4(10, 0, 0, 1), RTT: time.Millisecond,
+				QuotedECN: tt.quoted})
+
+			assert.Equal(t, tt.quoted, hop.QuotedECN)
+			assert.Equal(t, tt.want, hop.ECNBleached())
+		})
+	}
+
+	lost := Hop{TTL: 4, SentECN: network.ECT0}
+	lost.add(lostProbe())
+	assert.False(t, lost.ECNBleached())
+}
+
+func TestReturnHops(t *testing.T) {
+	assert.Equal(t, 0, ReturnHops(64))
+	assert.Equal(t, 6, ReturnHops(58))
+	assert.Equal(t, 8, ReturnHops(120))
+	assert.Equal(t, 13, ReturnHops(242))
+	assert.Equal(t, -1, ReturnHops(0))
+	assert.Equal(t, -1, ReturnHops(-1))
+
+	assert.Equal(t, 6, Hop{ReplyTTL: 58}.ReturnHops())
+	assert.Equal(t, -1, Hop{}.ReturnHops())
+}
+
+func TestProbeResponded(t *testing.T) {
+	assert.True(t, Probe{RTT: 0}.Responded())
+	assert.False(t, Probe{RTT: NoRTT}.Responded())
+}
@@ -0,0 +1,80 @@
+package tracer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter paces outgoing probes with a token bucket: it allows bursts of up to burst probes
+// and refills one token every interval.
+//
+// A Limiter is safe for concurrent use, so a single one can pace several concurrent traces
+// when passed to each of them in Options.Limiter.
+type Limiter struct {
+	interval time.Duration
+	burst    int
+
+	mu sync.Mutex
+	// next is the earliest time the following probe may be sent once the bucket is empty.
+	next time.Time
+}
+
+// NewLimiter creates a Limiter that allows one probe every interval on average, with bursts
+// of up to burst probes. A burst below 1 is treated as 1.
+func NewLimiter(interval time.Duration, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{interval: interval, burst: burst}
+}
+
+// Wait blocks until a probe may be sent or ctx is done, in which case it returns ctx.Err()
+// and gives the probe's slot back.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	at := l.reserve(time.Now())
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel(at)
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token and returns the time the probe it stands for may be sent.
+func (l *Limiter) reserve(now time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A bucket that has been idle long enough holds burst tokens and no more.
+	if earliest := now.Add(-time.Duration(l.burst-1) * l.interval); l.next.Before(earliest) {
+		l.next = earliest
+	}
+
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	return at
+}
+
+// cancel returns the token reserved for at, unless later reservations depend on it.
+func (l *Limiter) cancel(at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.next.Equal(at.Add(l.interval)) {
+		l.next = at
+	}
+}
@@ -0,0 +1,71 @@
+package tracer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	l := NewLimiter(100*time.Millisecond, 2)
+	now := time.Unix(1000, 0)
+
+	// An idle bucket allows a burst of two, then one probe per interval.
+	assert.Equal(t, now.Add(-100*time.Millisecond), l.reserve(now))
+	assert.Equal(t, now, l.reserve(now))
+	assert.Equal(t, now.Add(100*time.Millisecond), l.reserve(now))
+	assert.Equal(t, now.Add(200*time.Millisecond), l.reserve(now))
+
+	// After a long pause the bucket is full again, but holds no more than the burst.
+	later := now.Add(time.Minute)
+	assert.Equal(t, later.Add(-100*time.Millisecond), l.reserve(later))
+	assert.Equal(t, later, l.reserve(later))
+	assert.Equal(t, later.Add(100*time.Millisecond), l.reserve(later))
+}
+
+func TestNewLimiterMinimumBurst(t *testing.T) {
+	l := NewLimiter(time.Second, 0)
+	now := time.Unix(1000, 0)
+
+	assert.Equal(t, now, l.reserve(now))
+	assert.Equal(t, now.Add(time.Second), l.reserve(now))
+}
+
+func TestLimiterWaitPaces(t *testing.T) {
+	l := NewLimiter(20*time.Millisecond, 1)
+	start := time.Now()
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, l.Wait(context.Background()))
+	}
+
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	l := NewLimiter(time.Hour, 1)
+	assert.NoError(t, l.Wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := l.Wait(ctx)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The cancelled probe gave its slot back.
+	next := l.reserve(time.Now())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), next, time.Second)
+}
+
+func TestLimiterWaitAlreadyDone(t *testing.T) {
+	l := NewLimiter(time.Hour, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.ErrorIs(t, l.Wait(ctx), context.Canceled)
+}
@@ -0,0 +1,105 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxLoopPeriod is the longest cycle of responders recognized as a routing loop: a single
+// router answering every TTL, or two routers bouncing the probes between them.
+const maxLoopPeriod = 2
+
+// ErrRoutingLoop is matched by the error ending a trace that found a routing loop with
+// Options.AbortOnLoop set.
+var ErrRoutingLoop = errors.New("routing loop detected")
+
+// RoutingLoopError reports the routing loop that ended a trace; see Options.LoopThreshold.
+// It matches ErrRoutingLoop.
+type RoutingLoopError struct {
+	// IPs holds the responders of the loop, in the order they first answered in it.
+	IPs []net.IP
+	// FirstTTL and LastTTL are the lowest and highest TTLs the loop was seen at.
+	FirstTTL int
+	LastTTL  int
+}
+
+func (e *RoutingLoopError) Error() string {
+	ips := make([]string, len(e.IPs))
+	for i, ip := range e.IPs {
+		ips[i] = ip.String()
+	}
+	return fmt.Sprintf("routing loop detected between %s at TTLs %d-%d",
+		strings.Join(ips, ", "), e.FirstTTL, e.LastTTL)
+}
+
+func (e *RoutingLoopError) Is(target error) bool {
+	return target == ErrRoutingLoop
+}
+
+// loopDetector watches the responders of consecutive hops for a routing loop.
+type loopDetector struct {
+	threshold int
+	// hops holds the TTL and responder of the hops since the last one that did not
+	// respond, oldest first.
+	hops []Hop
+}
+
+// newLoopDetector returns a detector flagging a loop once every responder of a cycle
+// answered threshold TTLs, or nil if threshold is zero.
+func newLoopDetector(threshold int) *loopDetector {
+	if threshold == 0 {
+		return nil
+	}
+	return &loopDetector{threshold: threshold}
+}
+
+// observe records the next hop of the trace, in the order of their TTL, and returns the
+// loop it completes or continues, or nil if it is not part of one. Hops that did not
+// respond, or skipped TTLs, break a loop. A nil detector finds no loop.
+func (d *loopDetector) observe(hop Hop) *RoutingLoopError {
+	if d == nil {
+		return nil
+	}
+	if hop.IP == nil || len(d.hops) > 0 && d.hops[len(d.hops)-1].TTL != hop.TTL-1 {
+		d.hops = d.hops[:0]
+	}
+	if hop.IP == nil {
+		return nil
+	}
+	d.hops = append(d.hops, Hop{TTL: hop.TTL, IP: hop.IP})
+
+	for period := 1; period <= maxLoopPeriod; period++ {
+		if loop := d.cycle(period); loop != nil {
+			return loop
+		}
+	}
+	return nil
+}
+
+// cycle returns the loop formed by the latest hops if their responders repeat every
+// period TTLs, each of them at threshold TTLs at least, or nil.
+func (d *loopDetector) cycle(period int) *RoutingLoopError {
+	n := period * d.threshold
+	if len(d.hops) < n {
+		return nil
+	}
+
+	last := len(d.hops) - 1
+	first := last
+	for first >= period && d.hops[first-period].IP.Equal(d.hops[first].IP) {
+		first--
+	}
+	// The responders of first-period+1 to last repeat every period TTLs.
+	first -= period - 1
+	if last-first+1 < n {
+		return nil
+	}
+
+	loop := &RoutingLoopError{FirstTTL: d.hops[first].TTL, LastTTL: d.hops[last].TTL}
+	for _, hop := range d.hops[first : first+period] {
+		loop.IPs = append(loop.IPs, hop.IP)
+	}
+	return loop
+}
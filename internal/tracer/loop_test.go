@@ -0,0 +1,185 @@
+package tracer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+
+	"my-little-tracerouter/internal/network"
+)
+
+var (
+	loopA = net.IPv4(192, 0, 2, 1)
+	loopB = net.IPv4(192, 0, 2, 2)
+	loopC = net.IPv4(192, 0, 2, 3)
+)
+
+// observeAll feeds hops answered by ips, from TTL 1 on, to a detector and returns the TTLs
+// flagged as part of a loop along with the last loop found.
+func observeAll(threshold int, ips ...net.IP) ([]int, *RoutingLoopError) {
+	d := newLoopDetector(threshold)
+
+	var flagged []int
+	var last *RoutingLoopError
+	for i, ip := range ips {
+		if loop := d.observe(Hop{TTL: i + 1, IP: ip}); loop != nil {
+			flagged = append(flagged, i+1)
+			last = loop
+		}
+	}
+	return flagged, last
+}
+
+func TestLoopDetectorSameResponder(t *testing.T) {
+	flagged, loop := observeAll(3, loopC, loopA, loopA, loopA, loopA, loopB)
+
+	assert.Equal(t, []int{4, 5}, flagged)
+	require.NotNil(t, loop)
+	assert.Equal(t, []net.IP{loopA}, loop.IPs)
+	assert.Equal(t, 2, loop.FirstTTL)
+	assert.Equal(t, 5, loop.LastTTL)
+}
+
+func TestLoopDetectorAlternatingResponders(t *testing.T) {
+	flagged, loop := observeAll(2, loopC, loopA, loopB, loopA, loopB, loopA)
+
+	assert.Equal(t, []int{5, 6}, flagged)
+	require.NotNil(t, loop)
+	assert.Equal(t, []net.IP{loopA, loopB}, loop.IPs)
+	assert.Equal(t, 2, loop.FirstTTL)
+	assert.Equal(t, 6, loop.LastTTL)
+}
+
+func TestLoopDetectorBelowThreshold(t *testing.T) {
+	flagged, _ := observeAll(3, loopA, loopA, loopB, loopA, loopB, loopC)
+
+	assert.Empty(t, flagged)
+}
+
+func TestLoopDetectorSilentHopBreaksLoop(t *testing.T) {
+	flagged, _ := observeAll(3, loopA, loopA, nil, loopA)
+
+	assert.Empty(t, flagged)
+}
+
+func TestLoopDetectorSkippedTTLBreaksLoop(t *testing.T) {
+	d := newLoopDetector(2)
+
+	assert.Nil(t, d.observe(Hop{TTL: 1, IP: loopA}))
+	assert.Nil(t, d.observe(Hop{TTL: 3, IP: loopA}))
+	assert.NotNil(t, d.observe(Hop{TTL: 4, IP: loopA}))
+}
+
+func TestLoopDetectorDisabled(t *testing.T) {
+	d := newLoopDetector(0)
+
+	assert.Nil(t, d)
+	assert.Nil(t, d.observe(Hop{TTL: 1, IP: loopA}))
+}
+
+func TestRoutingLoopError(t *testing.T) {
+	var err error = &RoutingLoopError{IPs: []net.IP{loopA, loopB}, FirstTTL: 4, LastTTL: 9}
+
+	assert.EqualError(t, err, "routing loop detected between 192.0.2.1, 192.0.2.2 at TTLs 4-9")
+	assert.ErrorIs(t, err, ErrRoutingLoop)
+}
+
+// loopReceiver answers every probe sent by p from the responder router returns for its TTL.
+func loopReceiver(t *testing.T, p *fakeProber, router func(ttl int) net.IP) *MockReader {
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			select {
+			case ttl := <-p.sent:
+				return &network.Message{
+					Peer:       router(ttl),
+					Data:       quotingMessage(t, p.dest, ipv4.ICMPTypeTimeExceeded, 0, ttl),
+					TTL:        -1,
+					ReceivedAt: time.Now(),
+				}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+	receiver.On("Close").Return(nil)
+	return receiver
+}
+
+// bouncing returns loopC for the first TTL, then alternately loopA and loopB.
+func bouncing(ttl int) net.IP {
+	switch {
+	case ttl == 1:
+		return loopC
+	case ttl%2 == 0:
+		return loopA
+	default:
+		return loopB
+	}
+}
+
+func TestTraceRunLoop(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 1)}
+	receiver := loopReceiver(t, p, bouncing)
+
+	opts := Options{MaxHops: 8, ProbesPerHop: 1, LoopThreshold: 2}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+
+	require.Len(t, hops, 8)
+	for _, hop := range hops {
+		assert.Equal(t, hop.TTL >= 5, hop.Loop, hop.TTL)
+	}
+}
+
+func TestTraceRunAbortOnLoop(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		name := "sequential"
+		if parallel {
+			name = "parallel"
+		}
+		t.Run(name, func(t *testing.T) {
+			dest := net.IPv4(198, 51, 100, 7)
+			p := &fakeProber{dest: dest, sent: make(chan int, 30)}
+			receiver := loopReceiver(t, p, bouncing)
+
+			opts := Options{
+				MaxHops:       30,
+				ProbesPerHop:  1,
+				LoopThreshold: 2,
+				AbortOnLoop:   true,
+				Parallel:      parallel,
+			}.withDefaults()
+			tr := &trace{opts: opts, receiver: receiver, prober: p}
+			defer tr.close()
+
+			var hops []Hop
+			err := tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) })
+
+			var loop *RoutingLoopError
+			require.ErrorAs(t, err, &loop)
+			assert.ErrorIs(t, err, ErrRoutingLoop)
+			assert.Equal(t, []net.IP{loopA, loopB}, loop.IPs)
+			assert.Equal(t, 2, loop.FirstTTL)
+			assert.Equal(t, 5, loop.LastTTL)
+			require.Len(t, hops, 5, "no hop past the one the loop was found at")
+			assert.True(t, hops[4].Loop)
+		})
+	}
+}
+
+func TestTracerRunInvalidLoopThreshold(t *testing.T) {
+	tr := New(WithOptions(Options{LoopThreshold: 1}))
+	_, err := tr.Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+	assert.EqualError(t, err, "invalid loop threshold 1: must be at least 2")
+}
@@ -0,0 +1,231 @@
+package tracer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRTTBuckets are the upper bounds of the RTT histogram of a MetricsCollector
+// created without buckets of its own, from 1ms to 2.5s.
+var DefaultRTTBuckets = []time.Duration{
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// MetricsCollector counts the probes of traces and their replies per target and TTL, and
+// exposes them in the Prometheus text format, so that a daemon running traces can be
+// scraped like an exporter. It is updated through the probe hooks of the traces it
+// instruments; see Instrument. A MetricsCollector is safe for concurrent use.
+//
+// It exposes the counters traceroute_probes_sent_total, traceroute_replies_received_total
+// and traceroute_probe_timeouts_total, and the histogram traceroute_rtt_seconds, all
+// labeled with target and ttl.
+type MetricsCollector struct {
+	buckets []time.Duration
+
+	mu   sync.Mutex
+	hops map[hopKey]*hopMetrics
+}
+
+// hopKey identifies the metrics of a TTL of the traces to a target.
+type hopKey struct {
+	target string
+	ttl    int
+}
+
+// hopMetrics holds the metrics of a TTL of the traces to a target.
+type hopMetrics struct {
+	sent     uint64
+	received uint64
+	timeouts uint64
+	// buckets counts the RTTs up to every bound of the collector, not cumulatively.
+	buckets []uint64
+	rttSum  time.Duration
+}
+
+// NewMetricsCollector returns a collector whose RTT histogram has the given upper bounds,
+// or DefaultRTTBuckets if there is none.
+func NewMetricsCollector(buckets ...time.Duration) *MetricsCollector {
+	if len(buckets) == 0 {
+		buckets = DefaultRTTBuckets
+	}
+	buckets = append([]time.Duration(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+
+	return &MetricsCollector{buckets: buckets, hops: make(map[hopKey]*hopMetrics)}
+}
+
+// Instrument returns opts with probe hooks recording the probes of a trace under the given
+// target label, typically the host traced. Hooks already set in opts are still called.
+func (c *MetricsCollector) Instrument(target string, opts Options) Options {
+	hooks := opts.hooks()
+
+	opts.OnProbeSent = func(ttl, seq int) {
+		c.update(target, ttl, func(m *hopMetrics) { m.sent++ })
+		hooks.probeSent(ttl, seq)
+	}
+	opts.OnReplyReceived = func(ttl int, from net.IP, rtt time.Duration) {
+		c.update(target, ttl, func(m *hopMetrics) {
+			m.received++
+			m.rttSum += rtt
+			if i := sort.Search(len(c.buckets), func(i int) bool {
+				return rtt <= c.buckets[i]
+			}); i < len(c.buckets) {
+				m.buckets[i]++
+			}
+		})
+		hooks.replyReceived(ttl, Probe{Responder: from, RTT: rtt})
+	}
+	opts.OnProbeTimeout = func(ttl, seq int) {
+		c.update(target, ttl, func(m *hopMetrics) { m.timeouts++ })
+		hooks.probeTimedOut(ttl, seq)
+	}
+
+	return opts
+}
+
+// update applies f to the metrics of ttl for target.
+func (c *MetricsCollector) update(target string, ttl int, f func(m *hopMetrics)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := hopKey{target: target, ttl: ttl}
+	m, ok := c.hops[key]
+	if !ok {
+		m = &hopMetrics{buckets: make([]uint64, len(c.buckets))}
+		c.hops[key] = m
+	}
+	f(m)
+}
+
+// Reset forgets the metrics of target, e.g. once it is no longer traced.
+func (c *MetricsCollector) Reset(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.hops {
+		if key.target == target {
+			delete(c.hops, key)
+		}
+	}
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format, ordered by
+// target and TTL.
+func (c *MetricsCollector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	keys := make([]hopKey, 0, len(c.hops))
+	hops := make(map[hopKey]hopMetrics, len(c.hops))
+	for key, m := range c.hops {
+		keys = append(keys, key)
+		snap := *m
+		snap.buckets = append([]uint64(nil), m.buckets...)
+		hops[key] = snap
+	}
+	c.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].target != keys[j].target {
+			return keys[i].target < keys[j].target
+		}
+		return keys[i].ttl < keys[j].ttl
+	})
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	counters := []struct {
+		name, help string
+		value      func(m hopMetrics) uint64
+	}{
+		{"traceroute_probes_sent_total", "Probes sent.",
+			func(m hopMetrics) uint64 { return m.sent }},
+		{"traceroute_replies_received_total", "Probes that received a reply.",
+			func(m hopMetrics) uint64 { return m.received }},
+		{"traceroute_probe_timeouts_total", "Probes that received no reply in time.",
+			func(m hopMetrics) uint64 { return m.timeouts }},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help,
+			counter.name)
+		for _, key := range keys {
+			fmt.Fprintf(cw, "%s{%s} %d\n", counter.name, key.labels(), counter.value(hops[key]))
+		}
+	}
+
+	const rtt = "traceroute_rtt_seconds"
+	fmt.Fprintf(cw, "# HELP %s Round-trip time of the replies.\n# TYPE %s histogram\n", rtt, rtt)
+	for _, key := range keys {
+		m, labels := hops[key], key.labels()
+		var count uint64
+		for i, bound := range c.buckets {
+			count += m.buckets[i]
+			fmt.Fprintf(cw, "%s_bucket{%s,le=\"%s\"} %d\n", rtt, labels, seconds(bound), count)
+		}
+		fmt.Fprintf(cw, "%s_bucket{%s,le=\"+Inf\"} %d\n", rtt, labels, m.received)
+		fmt.Fprintf(cw, "%s_sum{%s} %s\n", rtt, labels, seconds(m.rttSum))
+		fmt.Fprintf(cw, "%s_count{%s} %d\n", rtt, labels, m.received)
+	}
+
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	if cw.err != nil {
+		return cw.n, fmt.Errorf("failed to write metrics: %w", cw.err)
+	}
+	return cw.n, nil
+}
+
+// ServeHTTP serves the metrics, so that the collector can be mounted as the metrics
+// endpoint of an exporter.
+func (c *MetricsCollector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+// labels formats the labels of the metrics of key.
+func (k hopKey) labels() string {
+	return fmt.Sprintf("target=\"%s\",ttl=\"%d\"", escapeLabel(k.target), k.ttl)
+}
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// seconds formats d in seconds, the unit of Prometheus.
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+// countingWriter counts the bytes written to w and keeps the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
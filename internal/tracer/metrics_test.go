@@ -0,0 +1,132 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsCollectorWriteTo(t *testing.T) {
+	c := NewMetricsCollector(100*time.Millisecond, 10*time.Millisecond)
+
+	var sent int
+	opts := c.Instrument("example.com", Options{OnProbeSent: func(int, int) { sent++ }})
+	other := c.Instrument(`a"b`, Options{})
+
+	opts.OnProbeSent(2, 0)
+	opts.OnProbeSent(2, 1)
+	opts.OnProbeSent(1, 0)
+	opts.OnReplyReceived(1, net.IPv4(192, 0, 2, 1), 5*time.Millisecond)
+	opts.OnReplyReceived(2, net.IPv4(192, 0, 2, 2), 50*time.Millisecond)
+	opts.OnProbeTimeout(2, 1)
+	other.OnReplyReceived(1, net.IPv4(192, 0, 2, 1), time.Second)
+
+	assert.Equal(t, 3, sent, "the hooks already set are still called")
+
+	var b strings.Builder
+	n, err := c.WriteTo(&b)
+	require.NoError(t, err)
+	assert.EqualValues(t, b.Len(), n)
+	assert.Equal(t, `# HELP traceroute_probes_sent_total Probes sent.
+# TYPE traceroute_probes_sent_total counter
+traceroute_probes_sent_total{target="a\"b",ttl="1"} 0
+traceroute_probes_sent_total{target="example.com",ttl="1"} 1
+traceroute_probes_sent_total{target="example.com",ttl="2"} 2
+# HELP traceroute_replies_received_total Probes that received a reply.
+# TYPE traceroute_replies_received_total counter
+traceroute_replies_received_total{target="a\"b",ttl="1"} 1
+traceroute_replies_received_total{target="example.com",ttl="1"} 1
+traceroute_replies_received_total{target="example.com",ttl="2"} 1
+# HELP traceroute_probe_timeouts_total Probes that received no reply in time.
+# TYPE traceroute_probe_timeouts_total counter
+traceroute_probe_timeouts_total{target="a\"b",ttl="1"} 0
+traceroute_probe_timeouts_total{target="example.com",ttl="1"} 0
+traceroute_probe_timeouts_total{target="example.com",ttl="2"} 1
+# HELP traceroute_rtt_seconds Round-trip time of the replies.
+# TYPE traceroute_rtt_seconds histogram
+traceroute_rtt_seconds_bucket{target="a\"b",ttl="1",le="0.01"} 0
+traceroute_rtt_seconds_bucket{target="a\"b",ttl="1",le="0.1"} 0
+traceroute_rtt_seconds_bucket{target="a\"b",ttl="1",le="+Inf"} 1
+traceroute_rtt_seconds_sum{target="a\"b",ttl="1"} 1
+traceroute_rtt_seconds_count{target="a\"b",ttl="1"} 1
+traceroute_rtt_seconds_bucket{target="example.com",ttl="1",le="0.01"} 1
+traceroute_rtt_seconds_bucket{target="example.com",ttl="1",le="0.1"} 1
+traceroute_rtt_seconds_bucket{target="example.com",ttl="1",le="+Inf"} 1
+traceroute_rtt_seconds_sum{target="example.com",ttl="1"} 0.005
+traceroute_rtt_seconds_count{target="example.com",ttl="1"} 1
+traceroute_rtt_seconds_bucket{target="example.com",ttl="2",le="0.01"} 0
+traceroute_rtt_seconds_bucket{target="example.com",ttl="2",le="0.1"} 1
+traceroute_rtt_seconds_bucket{target="example.com",ttl="2",le="+Inf"} 1
+traceroute_rtt_seconds_sum{target="example.com",ttl="2"} 0.05
+traceroute_rtt_seconds_count{target="example.com",ttl="2"} 1
+`, b.String())
+
+	c.Reset(`a"b`)
+	b.Reset()
+	_, err = c.WriteTo(&b)
+	require.NoError(t, err)
+	assert.NotContains(t, b.String(), `a\"b`)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestMetricsCollectorWriteToError(t *testing.T) {
+	c := NewMetricsCollector()
+	c.Instrument("example.com", Options{}).OnProbeSent(1, 0)
+
+	_, err := c.WriteTo(failingWriter{})
+	assert.ErrorContains(t, err, "disk full")
+}
+
+func TestMetricsCollectorServeHTTP(t *testing.T) {
+	c := NewMetricsCollector()
+	c.Instrument("example.com", Options{}).OnProbeTimeout(3, 0)
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(),
+		`traceroute_probe_timeouts_total{target="example.com",ttl="3"} 1`)
+	assert.Contains(t, rec.Body.String(),
+		`traceroute_rtt_seconds_bucket{target="example.com",ttl="3",le="2.5"} 0`)
+}
+
+func TestMetricsCollectorTrace(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 10)}
+	// TTL 2 does not answer.
+	receiver := pathReceiver(t, p, 3, func(ttl int) bool { return ttl == 2 })
+
+	c := NewMetricsCollector()
+	opts := c.Instrument("dest", Options{Timeout: 50 * time.Millisecond, ProbesPerHop: 2})
+	tr := &trace{opts: opts.withDefaults(), receiver: receiver, prober: p}
+	defer tr.close()
+
+	require.NoError(t, tr.run(context.Background(), func(Hop) {}))
+
+	var b strings.Builder
+	_, err := c.WriteTo(&b)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`traceroute_probes_sent_total{target="dest",ttl="2"} 2`,
+		`traceroute_replies_received_total{target="dest",ttl="2"} 0`,
+		`traceroute_probe_timeouts_total{target="dest",ttl="2"} 2`,
+		`traceroute_replies_received_total{target="dest",ttl="3"} 2`,
+		`traceroute_probe_timeouts_total{target="dest",ttl="3"} 0`,
+		`traceroute_rtt_seconds_count{target="dest",ttl="3"} 2`,
+	} {
+		assert.Contains(t, b.String(), line)
+	}
+}
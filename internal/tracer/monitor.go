@@ -0,0 +1,225 @@
+package tracer
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// HopStats accumulates the probes of a TTL over the rounds of a Monitor, like a row of mtr.
+type HopStats struct {
+	// TTL is the time to live the probes were sent with.
+	TTL int
+	// IP is the first router that responded at TTL in the latest round any did, and Name
+	// its host name as in Hop.Host. IP is nil while no probe received a reply.
+	IP   net.IP
+	Name string
+	// Addrs holds every address that responded at TTL, in the order of first reply. More
+	// than one shows a load-balanced path, or a route that changed between rounds.
+	Addrs []net.IP
+	// Sent is the number of probes sent and Received the number of replies.
+	Sent     int
+	Received int
+	// Loss is the percentage of probes that received no reply.
+	Loss float64
+	// Last is the RTT of the latest reply, and Avg, Best, Worst and StdDev summarize the
+	// RTTs of every reply; StdDev is their population standard deviation. They are NoRTT
+	// while no probe received a reply.
+	Last   time.Duration
+	Avg    time.Duration
+	Best   time.Duration
+	Worst  time.Duration
+	StdDev time.Duration
+
+	// mean and m2 are the running mean of the RTTs, in nanoseconds, and the sum of their
+	// squared differences from it, so that the statistics do not keep every RTT.
+	mean float64
+	m2   float64
+}
+
+// newHopStats returns the statistics of a TTL no probe was sent for yet.
+func newHopStats(ttl int) *HopStats {
+	return &HopStats{TTL: ttl, Last: NoRTT, Avg: NoRTT, Best: NoRTT, Worst: NoRTT,
+		StdDev: NoRTT}
+}
+
+// add accumulates the probes of hop, the outcome of a round at the TTL of s.
+func (s *HopStats) add(hop Hop) {
+	if hop.IP != nil {
+		s.IP, s.Name = hop.IP, hop.Host
+	}
+	for _, ip := range hop.Addrs() {
+		if !containsIP(s.Addrs, ip) {
+			s.Addrs = append(s.Addrs, ip)
+		}
+	}
+
+	for _, rtt := range hop.RTTs {
+		s.Sent++
+		if rtt == NoRTT {
+			continue
+		}
+		s.Received++
+		s.Last = rtt
+		if s.Best == NoRTT || rtt < s.Best {
+			s.Best = rtt
+		}
+		if rtt > s.Worst {
+			s.Worst = rtt
+		}
+
+		// Welford's online algorithm.
+		d := float64(rtt) - s.mean
+		s.mean += d / float64(s.Received)
+		s.m2 += d * (float64(rtt) - s.mean)
+	}
+
+	if s.Sent > 0 {
+		s.Loss = float64(s.Sent-s.Received) / float64(s.Sent) * 100
+	}
+	if s.Received > 0 {
+		s.Avg = time.Duration(math.Round(s.mean))
+		s.StdDev = time.Duration(math.Round(math.Sqrt(s.m2 / float64(s.Received))))
+	}
+}
+
+// containsIP reports whether ips holds ip.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MonitorSnapshot is the state of a Monitor at some point.
+type MonitorSnapshot struct {
+	// Rounds is the number of rounds completed.
+	Rounds int
+	// Hops holds the statistics of every TTL of the path, in order.
+	Hops []HopStats
+}
+
+// Monitor traces the route to a destination round after round, like mtr, and accumulates
+// the statistics of every hop. Create one with Tracer.NewMonitor.
+//
+// Rows are keyed by TTL, so a route that changes between rounds keeps the statistics of
+// every TTL, and adds the new routers to HopStats.Addrs. When a round ends at a lower TTL
+// than the previous one, because the path got shorter or the destination answered at last,
+// the rows past its end are dropped, and start over if later rounds reach them again.
+type Monitor struct {
+	tr *trace
+
+	mu     sync.Mutex
+	rounds int
+	// hops holds the statistics of TTLs opts.FirstTTL and on, in order.
+	hops []*HopStats
+}
+
+// NewMonitor opens the sockets of a Monitor of the route to dest. Every round is a trace
+// run with opts, started every opts.Interval. Close releases the sockets.
+func (t *Tracer) NewMonitor(dest net.IP, opts Options) (*Monitor, error) {
+	tr, err := t.start(dest, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Monitor{tr: tr}, nil
+}
+
+// Run traces rounds until opts.Rounds of them completed, or until ctx is done if it is not
+// positive, and returns ctx.Err() then. A round that takes longer than opts.Interval starts
+// the next one right away. Hops are accumulated as soon as they complete, so Snapshot shows
+// a round in progress; a round cut short keeps the probes that completed. An error ending
+// a round, such as a *RoutingLoopError with opts.AbortOnLoop, ends Run.
+func (m *Monitor) Run(ctx context.Context) error {
+	opts := m.tr.opts
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for round := 0; opts.Rounds <= 0 || round < opts.Rounds; round++ {
+		if round > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		last := opts.FirstTTL - 1
+		err := m.tr.run(ctx, func(hop Hop) {
+			m.add(hop)
+			last = hop.TTL
+		})
+		if err != nil {
+			return err
+		}
+		m.endRound(last)
+	}
+
+	return nil
+}
+
+// add accumulates a hop of the current round.
+func (m *Monitor) add(hop Hop) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := hop.TTL - m.tr.opts.FirstTTL
+	for len(m.hops) <= i {
+		m.hops = append(m.hops, newHopStats(m.tr.opts.FirstTTL+len(m.hops)))
+	}
+	m.hops[i].add(hop)
+}
+
+// endRound completes a round whose last hop had the given TTL, dropping the rows past it.
+func (m *Monitor) endRound(last int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n := last - m.tr.opts.FirstTTL + 1; n < len(m.hops) {
+		m.hops = m.hops[:n]
+	}
+	m.rounds++
+}
+
+// Snapshot returns the statistics accumulated so far. It may be called while Run is
+// running, e.g. by a frontend refreshing its display.
+func (m *Monitor) Snapshot() MonitorSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap := MonitorSnapshot{Rounds: m.rounds, Hops: make([]HopStats, len(m.hops))}
+	for i, s := range m.hops {
+		snap.Hops[i] = *s
+		snap.Hops[i].Addrs = append([]net.IP(nil), s.Addrs...)
+	}
+	return snap
+}
+
+// Close releases the sockets of the Monitor.
+func (m *Monitor) Close() {
+	m.tr.close()
+}
+
+// Report monitors the route to dest for opts.Rounds rounds, DefaultReportRounds if not
+// positive, and returns the final statistics, like mtr --report --count. If ctx is
+// cancelled or a round fails, the statistics accumulated so far are returned with the
+// error.
+func (t *Tracer) Report(ctx context.Context, dest net.IP, opts Options) (MonitorSnapshot, error) {
+	if opts.Rounds <= 0 {
+		opts.Rounds = DefaultReportRounds
+	}
+
+	m, err := t.NewMonitor(dest, opts)
+	if err != nil {
+		return MonitorSnapshot{}, err
+	}
+	defer m.Close()
+
+	err = m.Run(ctx)
+	return m.Snapshot(), err
+}
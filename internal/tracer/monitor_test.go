@@ -0,0 +1,155 @@
+package tracer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundHop returns the hop of a round at ttl whose probes were answered by ip after the
+// given RTTs, or lost where they are NoRTT.
+func roundHop(ttl int, ip net.IP, rtts ...time.Duration) Hop {
+	hop := Hop{TTL: ttl}
+	for _, rtt := range rtts {
+		if rtt == NoRTT {
+			hop.add(lostProbe())
+			continue
+		}
+		hop.add(Probe{Responder: ip, RTT: rtt})
+	}
+	hop.summarize()
+	return hop
+}
+
+func TestHopStatsAdd(t *testing.T) {
+	a, b := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	s := newHopStats(3)
+
+	s.add(roundHop(3, a, 10*time.Millisecond, NoRTT, 30*time.Millisecond))
+	s.add(roundHop(3, b, 20*time.Millisecond, NoRTT))
+
+	assert.Equal(t, 3, s.TTL)
+	assert.Equal(t, b, s.IP)
+	assert.Equal(t, []net.IP{a, b}, s.Addrs)
+	assert.Equal(t, 5, s.Sent)
+	assert.Equal(t, 3, s.Received)
+	assert.Equal(t, 40.0, s.Loss)
+	assert.Equal(t, 20*time.Millisecond, s.Last)
+	assert.Equal(t, 20*time.Millisecond, s.Avg)
+	assert.Equal(t, 10*time.Millisecond, s.Best)
+	assert.Equal(t, 30*time.Millisecond, s.Worst)
+	assert.Equal(t, 8164966*time.Nanosecond, s.StdDev)
+}
+
+func TestHopStatsAddNoReply(t *testing.T) {
+	s := newHopStats(1)
+
+	s.add(roundHop(1, nil, NoRTT, NoRTT))
+
+	assert.Nil(t, s.IP)
+	assert.Equal(t, 2, s.Sent)
+	assert.Equal(t, 100.0, s.Loss)
+	for _, rtt := range []time.Duration{s.Last, s.Avg, s.Best, s.Worst, s.StdDev} {
+		assert.Equal(t, NoRTT, rtt)
+	}
+}
+
+func TestMonitorPathChanges(t *testing.T) {
+	router := func(i byte) net.IP { return net.IPv4(192, 0, 2, i) }
+	m := &Monitor{tr: &trace{opts: Options{}.withDefaults()}}
+
+	for ttl := 1; ttl <= 4; ttl++ {
+		m.add(roundHop(ttl, router(byte(ttl)), time.Millisecond))
+	}
+	m.endRound(4)
+
+	// The route changes at TTL 2 and the destination answers at TTL 3.
+	m.add(roundHop(1, router(1), time.Millisecond))
+	m.add(roundHop(2, router(20), time.Millisecond))
+	m.add(roundHop(3, router(3), time.Millisecond))
+	m.endRound(3)
+
+	snap := m.Snapshot()
+	assert.Equal(t, 2, snap.Rounds)
+	require.Len(t, snap.Hops, 3, "rows past the end of the path are dropped")
+	assert.Equal(t, router(20), snap.Hops[1].IP)
+	assert.Equal(t, []net.IP{router(2), router(20)}, snap.Hops[1].Addrs)
+	assert.Equal(t, 2, snap.Hops[1].Sent)
+
+	// A row reached again starts over.
+	for ttl := 1; ttl <= 4; ttl++ {
+		m.add(roundHop(ttl, router(byte(ttl)), time.Millisecond))
+	}
+	m.endRound(4)
+
+	snap = m.Snapshot()
+	require.Len(t, snap.Hops, 4)
+	assert.Equal(t, 3, snap.Hops[2].Sent)
+	assert.Equal(t, 1, snap.Hops[3].Sent)
+}
+
+func TestMonitorSnapshotIsACopy(t *testing.T) {
+	m := &Monitor{tr: &trace{opts: Options{FirstTTL: 3}.withDefaults()}}
+	m.add(roundHop(3, net.IPv4(192, 0, 2, 1), time.Millisecond))
+
+	snap := m.Snapshot()
+	m.add(roundHop(3, net.IPv4(192, 0, 2, 2), time.Millisecond))
+
+	require.Len(t, snap.Hops, 1)
+	assert.Equal(t, 3, snap.Hops[0].TTL)
+	assert.Equal(t, 1, snap.Hops[0].Sent)
+	assert.Len(t, snap.Hops[0].Addrs, 1)
+	assert.Equal(t, 0, snap.Rounds, "the round is in progress")
+}
+
+func TestMonitorRun(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 10)}
+	receiver := pathReceiver(t, p, 3, func(int) bool { return false })
+
+	opts := Options{
+		Timeout:      time.Second,
+		ProbesPerHop: 2,
+		Interval:     20 * time.Millisecond,
+		Rounds:       3,
+	}.withDefaults()
+	m := &Monitor{tr: &trace{opts: opts, receiver: receiver, prober: p}}
+	defer m.Close()
+
+	start := time.Now()
+	require.NoError(t, m.Run(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 2*opts.Interval)
+
+	snap := m.Snapshot()
+	assert.Equal(t, 3, snap.Rounds)
+	require.Len(t, snap.Hops, 3)
+	for i, hop := range snap.Hops {
+		assert.Equal(t, i+1, hop.TTL)
+		assert.Equal(t, 6, hop.Sent)
+		assert.Equal(t, 6, hop.Received)
+		assert.Equal(t, 0.0, hop.Loss)
+	}
+	assert.True(t, snap.Hops[2].IP.Equal(dest))
+}
+
+func TestMonitorRunCancelled(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 10)}
+	receiver := pathReceiver(t, p, 2, func(int) bool { return false })
+
+	opts := Options{Timeout: time.Second, ProbesPerHop: 1, Interval: time.Hour}.withDefaults()
+	m := &Monitor{tr: &trace{opts: opts, receiver: receiver, prober: p}}
+	defer m.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, m.Run(ctx), context.DeadlineExceeded)
+	snap := m.Snapshot()
+	assert.Equal(t, 1, snap.Rounds)
+	assert.Len(t, snap.Hops, 2)
+}
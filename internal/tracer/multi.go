@@ -0,0 +1,156 @@
+package tracer
+
+import (
+	"context"
+	"sync"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// TargetResult is the outcome of the trace to one of the hosts of TraceAll.
+type TargetResult struct {
+	// Index is the position of Host among the hosts passed to TraceAll.
+	Index int
+	// Host is the name or literal address traced.
+	Host string
+	// Result and Err are what Trace returns for Host: Result is nil if Host did not
+	// resolve or its trace could not start, and holds the hops probed so far if the trace
+	// ended early with Err.
+	Result *Result
+	Err    error
+}
+
+// TraceAll traces the routes to every host like Trace, opts.MaxConcurrentTraces at a time,
+// and delivers the result of each trace on the returned channel as soon as it ends. The
+// channel is closed once every host has its result, and buffers all of them, so the
+// caller may stop reading it at any time.
+//
+// The traces share a Dispatcher per address family, opened when the first trace needs it
+// and closed at the end, or opts.Dispatcher for its family, so that they do not each open
+// an ICMP listener; see Dispatcher for the options this rules out. The failure of a trace,
+// including a host that does not resolve, only shows in its own result. Hosts whose trace
+// did not start yet when ctx is done fail with ctx.Err().
+//
+// Writing every result with Banner and FormatText as it arrives groups the output of
+// each host.
+func (t *Tracer) TraceAll(ctx context.Context, hosts []string, opts Options) <-chan TargetResult {
+	results := make(chan TargetResult, len(hosts))
+
+	limit := opts.MaxConcurrentTraces
+	if limit <= 0 {
+		limit = DefaultMaxConcurrentTraces
+	}
+	shared := newDispatchers(opts.Dispatcher)
+
+	go func() {
+		defer close(results)
+		defer shared.close()
+
+		slots := make(chan struct{}, limit)
+		var wg sync.WaitGroup
+		for i, host := range hosts {
+			result := TargetResult{Index: i, Host: host}
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				result.Err = ctx.Err()
+				results <- result
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				result.Result, result.Err = t.traceShared(ctx, result.Host, opts, shared)
+				results <- result
+			}()
+		}
+		wg.Wait()
+	}()
+
+	return results
+}
+
+// traceShared traces the route to host like Trace, through the dispatcher of its family.
+func (t *Tracer) traceShared(
+	ctx context.Context,
+	host string,
+	opts Options,
+	shared *dispatchers,
+) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	target, err := network.ResolveTargetWith(host, opts.Preference, opts.DNSResolver)
+	if err != nil {
+		return nil, err
+	}
+	family, err := familyOf(target.IP)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Dispatcher, err = shared.get(family); err != nil {
+		return nil, err
+	}
+
+	return t.traceTarget(ctx, target, opts)
+}
+
+// dispatchers opens a Dispatcher per address family on demand.
+type dispatchers struct {
+	mu sync.Mutex
+	// byFamily holds the dispatcher of every family opened or given, and errs the error
+	// opening it failed with, so that it is not retried.
+	byFamily map[network.Family]*Dispatcher
+	errs     map[network.Family]error
+	// opened holds the dispatchers to close.
+	opened []*Dispatcher
+}
+
+// newDispatchers returns dispatchers using shared, unless it is nil, for its family.
+func newDispatchers(shared *Dispatcher) *dispatchers {
+	ds := &dispatchers{
+		byFamily: make(map[network.Family]*Dispatcher),
+		errs:     make(map[network.Family]error),
+	}
+	if shared != nil {
+		ds.byFamily[shared.Family()] = shared
+	}
+	return ds
+}
+
+// get returns the dispatcher of the family, opening it if needed.
+func (ds *dispatchers) get(family network.Family) (*Dispatcher, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if d, ok := ds.byFamily[family]; ok {
+		return d, nil
+	}
+	if err, ok := ds.errs[family]; ok {
+		return nil, err
+	}
+
+	d, err := NewDispatcher(family)
+	if err != nil {
+		ds.errs[family] = err
+		return nil, err
+	}
+	ds.byFamily[family] = d
+	ds.opened = append(ds.opened, d)
+	return d, nil
+}
+
+// close closes the dispatchers opened.
+func (ds *dispatchers) close() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for _, d := range ds.opened {
+		d.Close()
+	}
+}
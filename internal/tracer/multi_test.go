@@ -0,0 +1,99 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// collectTargets reads every result of TraceAll, ordered by the index of their host.
+func collectTargets(results <-chan TargetResult) []TargetResult {
+	var all []TargetResult
+	for r := range results {
+		all = append(all, r)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Index < all[j].Index })
+	return all
+}
+
+func TestTraceAllLoopback(t *testing.T) {
+	conn, err := network.NewICMPConn(network.IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	conn.Close()
+
+	hosts := []string{"127.0.0.1", "::1", "127.0.0.2", "127.0.0.1"}
+	results := collectTargets(New().TraceAll(context.Background(), hosts, Options{
+		MaxHops:             3,
+		Timeout:             time.Second,
+		Method:              ICMP,
+		Preference:          network.ForceIPv4,
+		MaxConcurrentTraces: 2,
+	}))
+
+	require.Len(t, results, len(hosts))
+	for i, r := range results {
+		assert.Equal(t, i, r.Index)
+		assert.Equal(t, hosts[i], r.Host)
+		if r.Host == "::1" {
+			var noAddr *network.NoAddressError
+			assert.ErrorAs(t, r.Err, &noAddr, "a failing host does not abort the others")
+			assert.Nil(t, r.Result)
+			continue
+		}
+		if assert.NoError(t, r.Err, r.Host) {
+			assert.True(t, r.Result.Reached, r.Host)
+			assert.Equal(t, r.Host, r.Result.Target.Host)
+		}
+	}
+}
+
+func TestTraceAllSharedDispatcher(t *testing.T) {
+	d, err := NewDispatcher(network.IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer d.Close()
+
+	opts := Options{MaxHops: 3, Timeout: time.Second, Method: ICMP, Dispatcher: d}
+	results := collectTargets(New().TraceAll(context.Background(), []string{"127.0.0.1"}, opts))
+
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+	assert.True(t, results[0].Result.Reached)
+
+	// The dispatcher given is left open.
+	hops, err := New(WithOptions(opts)).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+	require.NoError(t, err)
+	assert.Len(t, hops, 1)
+}
+
+func TestTraceAllCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	hosts := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+	results := collectTargets(New().TraceAll(ctx, hosts, Options{MaxConcurrentTraces: 1}))
+
+	require.Len(t, results, len(hosts))
+	for _, r := range results {
+		assert.ErrorIs(t, r.Err, context.Canceled)
+		assert.Nil(t, r.Result)
+	}
+}
+
+func TestTraceAllNoHosts(t *testing.T) {
+	assert.Empty(t, collectTargets(New().TraceAll(context.Background(), nil, Options{})))
+}
@@ -0,0 +1,266 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// DefaultConfidence is the probability with which RunMultipath finds every next hop of a
+// load-balanced hop when Options.Confidence is not set.
+const DefaultConfidence = 0.95
+
+// maxFlowsPerHop bounds the probes sent to a single TTL by RunMultipath, in case a load
+// balancer spreads packets over more next hops than can be enumerated, or per packet.
+const maxFlowsPerHop = 128
+
+// Multipath is the graph of the load-balanced paths to a destination found by RunMultipath.
+type Multipath struct {
+	// Hops holds the nodes found at every probed TTL, in order.
+	Hops []MultipathHop
+}
+
+// MultipathHop holds the nodes that answered the probes of a single TTL.
+type MultipathHop struct {
+	// TTL is the time to live the probes were sent with.
+	TTL int
+	// Nodes are the distinct responders, in the order of the flows they were found with.
+	// A hop where every probe was lost has none.
+	Nodes []MultipathNode
+	// Probes is the number of probes sent with this TTL, one per flow.
+	Probes int
+	// Lost is the number of probes that received no reply.
+	Lost int
+}
+
+// MultipathNode is a router, or the destination, found at a TTL.
+type MultipathNode struct {
+	// IP is the address of the responder.
+	IP net.IP
+	// RTT is the lowest RTT of the probes it answered.
+	RTT time.Duration
+	// Next holds the indices, among the nodes of the following hop, of the nodes that
+	// answered the flows it answered one TTL earlier.
+	Next []int
+}
+
+// RunMultipath enumerates the load-balanced paths to dest like the Multipath Detection
+// Algorithm of Paris traceroute, and returns them as a graph rather than one hop per TTL.
+//
+// Every probe follows a flow of its own: the probes are sent Paris-style and the flows are
+// told apart by their destination port, from opts.Port + opts.FlowID upwards. Each TTL is
+// probed with more flows until, having found k next hops, enough flows were sent to rule
+// out a k+1-th one with probability opts.Confidence (Veitch et al., "Failure Control in
+// Multipath Route Tracing"). A flow found at a TTL is probed one TTL earlier as well, so
+// that every node is linked to its predecessors. The probes are sent one at a time and
+// opts.ProbesPerHop is ignored.
+//
+// The trace stops once every answered probe of a TTL reached the destination or reported
+// it as unreachable, or opts.MaxHops is reached. If ctx is cancelled or opts.TraceTimeout
+// expires, the hops probed so far are returned with the error. Only UDP probes are
+// supported, and not in parallel or along with PathMTU or VarySrcPort.
+func (t *Tracer) RunMultipath(ctx context.Context, dest net.IP, opts Options) (*Multipath, error) {
+	if opts.Method != UDP || opts.Parallel || opts.SimultaneousHops > 0 || opts.PathMTU ||
+		opts.Vary != VaryDstPort {
+		return nil, fmt.Errorf("multipath discovery requires sequential UDP probes")
+	}
+	if opts.Confidence == 0 {
+		opts.Confidence = DefaultConfidence
+	}
+	if opts.Confidence <= 0 || opts.Confidence >= 1 {
+		return nil, fmt.Errorf("invalid confidence %v: must be between 0 and 1", opts.Confidence)
+	}
+	opts.Paris = true
+
+	tr, err := t.start(dest, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.close()
+
+	if last := tr.opts.Port + tr.opts.FlowID + maxFlowsPerHop - 1; last > 0xffff {
+		return nil, fmt.Errorf("invalid port %d: multipath discovery needs ports up to %d",
+			tr.opts.Port, last)
+	}
+
+	var flows []flowProbes
+	err = tr.bounded(ctx, func(ctx context.Context) (err error) {
+		flows, err = tr.runMultipath(ctx)
+		return err
+	})
+	return buildMultipath(tr.opts.FirstTTL, flows), err
+}
+
+// flowProbe is the outcome of the probe of a single flow.
+type flowProbe struct {
+	Probe
+	// done is set when the probe reached the destination or reported it as unreachable.
+	done bool
+}
+
+// flowProbes holds the outcome of the probes of a TTL by flow.
+type flowProbes map[int]flowProbe
+
+// runMultipath probes every TTL with as many flows as needed and returns the outcomes,
+// starting at opts.FirstTTL.
+func (tr *trace) runMultipath(ctx context.Context) ([]flowProbes, error) {
+	var hops []flowProbes
+
+	for ttl := tr.opts.FirstTTL; ttl <= tr.opts.MaxHops; ttl++ {
+		hop := make(flowProbes)
+		hops = append(hops, hop)
+
+		responders := 0
+		for flow := 0; flow < maxFlowsPerHop; flow++ {
+			if flow >= stoppingPoint(responders, tr.opts.Confidence) {
+				break
+			}
+			if err := tr.probeFlow(ctx, hop, ttl, flow); err != nil {
+				return hops, err
+			}
+			responders = countResponders(hop)
+		}
+
+		// Link the flows found here to their predecessors.
+		if prev := len(hops) - 2; prev >= 0 {
+			for flow := range hop {
+				if _, ok := hops[prev][flow]; ok {
+					continue
+				}
+				if err := tr.probeFlow(ctx, hops[prev], ttl-1, flow); err != nil {
+					return hops, err
+				}
+			}
+		}
+
+		if reachedAll(hop) {
+			break
+		}
+	}
+
+	return hops, nil
+}
+
+// probeFlow sends the probe of the given flow for ttl and records its outcome in hop.
+func (tr *trace) probeFlow(ctx context.Context, hop flowProbes, ttl, flow int) error {
+	tr.prober.(*udpProber).flow = flow
+
+	probe, done, err := tr.probe(ctx, ttl, flow, tr.opts.Timeout, nil)
+	if err != nil {
+		return err
+	}
+	hop[flow] = flowProbe{Probe: probe, done: tr.opts.stops(ttl, probe, done)}
+	return nil
+}
+
+// reachedAll reports whether every answered probe of hop reached the destination or
+// reported it as unreachable, and at least one was answered.
+func reachedAll(hop flowProbes) bool {
+	answered := false
+	for _, probe := range hop {
+		if !probe.Responded() {
+			continue
+		}
+		if !probe.done {
+			return false
+		}
+		answered = true
+	}
+	return answered
+}
+
+// countResponders returns the number of distinct addresses that answered the probes of hop.
+func countResponders(hop flowProbes) int {
+	seen := make(map[string]bool)
+	for _, probe := range hop {
+		if probe.Responded() {
+			seen[probe.Responder.String()] = true
+		}
+	}
+	return len(seen)
+}
+
+// stoppingPoint returns the number of flows to probe a TTL with, having found k next hops,
+// to rule out a k+1-th one with the given confidence. The first stopping points at 95% are
+// 6, 11, 16 and 21. A TTL is probed as if one next hop had been found before any answered.
+func stoppingPoint(k int, confidence float64) int {
+	if k < 1 {
+		k = 1
+	}
+	failure := (1 - confidence) / float64(k+1)
+	return int(math.Ceil(math.Log(failure) / math.Log(float64(k)/float64(k+1))))
+}
+
+// buildMultipath turns the outcomes of the probes of every TTL, starting at firstTTL, into
+// a graph. Nodes are ordered by the lowest flow they answered, and linked to the nodes that
+// answered the same flows one TTL later.
+func buildMultipath(firstTTL int, flows []flowProbes) *Multipath {
+	mp := &Multipath{Hops: make([]MultipathHop, len(flows))}
+
+	// index maps the address of every node to its position among the nodes of its hop.
+	index := make([]map[string]int, len(flows))
+	for i, hop := range flows {
+		h := MultipathHop{TTL: firstTTL + i, Probes: len(hop)}
+		index[i] = make(map[string]int)
+
+		for _, flow := range sortedFlows(hop) {
+			probe := hop[flow]
+			if !probe.Responded() {
+				h.Lost++
+				continue
+			}
+
+			key := probe.Responder.String()
+			n, ok := index[i][key]
+			if !ok {
+				n = len(h.Nodes)
+				index[i][key] = n
+				h.Nodes = append(h.Nodes, MultipathNode{IP: probe.Responder, RTT: probe.RTT})
+			}
+			if probe.RTT < h.Nodes[n].RTT {
+				h.Nodes[n].RTT = probe.RTT
+			}
+		}
+		mp.Hops[i] = h
+	}
+
+	for i := 0; i+1 < len(flows); i++ {
+		for _, flow := range sortedFlows(flows[i]) {
+			from := flows[i][flow]
+			to, ok := flows[i+1][flow]
+			if !ok || !from.Responded() || !to.Responded() {
+				continue
+			}
+
+			node := &mp.Hops[i].Nodes[index[i][from.Responder.String()]]
+			next := index[i+1][to.Responder.String()]
+			if !containsInt(node.Next, next) {
+				node.Next = append(node.Next, next)
+			}
+		}
+	}
+
+	return mp
+}
+
+// sortedFlows returns the flows of hop in increasing order.
+func sortedFlows(hop flowProbes) []int {
+	flows := make([]int, 0, len(hop))
+	for flow := range hop {
+		flows = append(flows, flow)
+	}
+	sort.Ints(flows)
+	return flows
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoppingPoint(t *testing.T) {
+	var points []int
+	for k := 1; k <= 5; k++ {
+		points = append(points, stoppingPoint(k, 0.95))
+	}
+	assert.Equal(t, []int{6, 11, 16, 21, 27}, points)
+
+	assert.Equal(t, stoppingPoint(1, 0.95), stoppingPoint(0, 0.95))
+	assert.Greater(t, stoppingPoint(2, 0.99), stoppingPoint(2, 0.95))
+}
+
+func answered(ip net.IP, rtt time.Duration) flowProbe {
+	return flowProbe{Probe: Probe{Responder: ip, RTT: rtt}}
+}
+
+func TestBuildMultipath(t *testing.T) {
+	gw := net.IPv4(192, 0, 2, 1)
+	left, right := net.IPv4(198, 51, 100, 1), net.IPv4(198, 51, 100, 2)
+	dest := net.IPv4(203, 0, 113, 7)
+	lost := flowProbe{Probe: lostProbe()}
+
+	mp := buildMultipath(2, []flowProbes{
+		{0: answered(gw, 2*time.Millisecond), 1: answered(gw, time.Millisecond), 2: lost},
+		{0: answered(left, time.Millisecond), 1: answered(right, time.Millisecond), 2: lost},
+		{0: answered(dest, time.Millisecond), 1: answered(dest, time.Millisecond)},
+	})
+
+	require.Len(t, mp.Hops, 3)
+
+	first := mp.Hops[0]
+	assert.Equal(t, 2, first.TTL)
+	assert.Equal(t, 3, first.Probes)
+	assert.Equal(t, 1, first.Lost)
+	require.Len(t, first.Nodes, 1)
+	assert.True(t, first.Nodes[0].IP.Equal(gw))
+	assert.Equal(t, time.Millisecond, first.Nodes[0].RTT)
+	assert.Equal(t, []int{0, 1}, first.Nodes[0].Next)
+
+	second := mp.Hops[1]
+	require.Len(t, second.Nodes, 2)
+	assert.True(t, second.Nodes[0].IP.Equal(left))
+	assert.True(t, second.Nodes[1].IP.Equal(right))
+	assert.Equal(t, []int{0}, second.Nodes[0].Next)
+	assert.Equal(t, []int{0}, second.Nodes[1].Next)
+
+	assert.Empty(t, mp.Hops[2].Nodes[0].Next)
+}
+
+func TestReachedAll(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 7)
+	reached := flowProbe{Probe: Probe{Responder: dest, RTT: time.Millisecond}, done: true}
+
+	assert.True(t, reachedAll(flowProbes{0: reached, 1: {Probe: lostProbe()}}))
+	assert.False(t, reachedAll(flowProbes{0: reached, 1: answered(dest, time.Millisecond)}))
+	assert.False(t, reachedAll(flowProbes{0: {Probe: lostProbe()}}))
+}
+
+func TestTracerRunMultipathLoopback(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	mp, err := New().RunMultipath(context.Background(), dest, Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+	})
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, mp.Hops, 1)
+	assert.Equal(t, stoppingPoint(1, DefaultConfidence), mp.Hops[0].Probes)
+	assert.Equal(t, 0, mp.Hops[0].Lost)
+	require.Len(t, mp.Hops[0].Nodes, 1)
+	assert.True(t, mp.Hops[0].Nodes[0].IP.Equal(dest))
+}
+
+func TestTracerRunMultipathInvalid(t *testing.T) {
+	for _, opts := range []Options{
+		{Method: ICMP},
+		{Parallel: true},
+		{Vary: VarySrcPort},
+		{Confidence: 1},
+		{Port: 65500},
+	} {
+		mp, err := New().RunMultipath(context.Background(), net.IPv4(127, 0, 0, 1), opts)
+		if err != nil && errors.Is(err, os.ErrPermission) {
+			t.Skip("raw ICMP sockets require elevated privileges")
+		}
+
+		assert.Error(t, err, opts)
+		assert.Nil(t, mp)
+	}
+}
@@ -0,0 +1,433 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// runParallel probes every TTL at once with a pool of opts.MaxConcurrentProbes workers,
+// and demultiplexes the replies by the probe they quote.
+//
+// The probes are queued in the order of their TTL, only opts.SimultaneousHops TTLs ahead of
+// the lowest one that did not complete if set. Every worker sends the next one and waits
+// for its reply, sending it again while it times out if opts.Retries is set, so at most
+// opts.MaxConcurrentProbes probes are outstanding. Hops are passed to emit in order: a hop
+// is emitted once its probes and those of every lower TTL completed. Once the first TTL
+// that reached the destination is known, the probes with a higher TTL are not sent, those
+// outstanding stop waiting for their reply, and their hops are not emitted.
+func runParallel(
+	ctx context.Context,
+	p prober,
+	receiver messageReader,
+	opts Options,
+	limiter *Limiter,
+	emit func(Hop),
+) error {
+	if _, ok := p.(directReader); ok {
+		return fmt.Errorf("parallel probing is not supported with %v probes", opts.Method)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logs := make([]*replyLog, opts.MaxHops)
+	for i := range logs {
+		logs[i] = newReplyLog(opts.slotsPerHop())
+	}
+
+	d := &demux{conn: receiver, logs: logs}
+	go d.run(runCtx, cancel)
+
+	results := newResults(opts.FirstTTL, opts.MaxHops, opts.ProbesPerHop, opts.ECN, logs, emit)
+	queue := queueProbes(runCtx, opts.FirstTTL, opts.MaxHops, opts.ProbesPerHop,
+		opts.SimultaneousHops, results)
+
+	retry := opts.sendRetry()
+	hooks := opts.hooks()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var sendErr error
+
+	for i := 0; i < opts.MaxConcurrentProbes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for q := range queue {
+				if runCtx.Err() != nil || results.beyondDestination(q.ttl) {
+					continue
+				}
+
+				// Send the probe again while it times out, up to opts.Retries times.
+				for try := 0; ; try++ {
+					if limiter != nil && limiter.Wait(runCtx) != nil {
+						break
+					}
+
+					var pending *pendingProbe
+					slot := opts.slot(q.attempt, try)
+					err := retry.do(runCtx, func() (err error) {
+						pending, err = d.send(p, q.ttl, slot)
+						return err
+					})
+					if err != nil {
+						errOnce.Do(func() { sendErr = err })
+						cancel()
+						failed := lostProbe()
+						failed.Err = err
+						results.set(q.ttl, q.attempt, failed, false)
+						break
+					}
+					hooks.probeSent(q.ttl, slot)
+
+					probe, done := d.wait(runCtx, pending, opts.Timeout, results.skipped(q.ttl))
+					hooks.replyReceived(q.ttl, probe)
+					if !probe.Responded() && runCtx.Err() == nil &&
+						!results.beyondDestination(q.ttl) {
+						hooks.probeTimedOut(q.ttl, slot)
+					}
+					probe.Retries = try
+					if probe.Responded() || try == opts.Retries || runCtx.Err() != nil ||
+						results.beyondDestination(q.ttl) {
+						results.set(q.ttl, q.attempt, probe,
+							opts.stops(q.ttl, probe, done))
+						break
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	cancel()
+
+	switch {
+	case sendErr != nil:
+		return sendErr
+	case contextErr(ctx) != nil:
+		return contextErr(ctx)
+	default:
+		return d.readErr()
+	}
+}
+
+// queuedProbe identifies a probe waiting for a worker.
+type queuedProbe struct {
+	ttl     int
+	attempt int
+}
+
+// queueProbes returns a queue of the probes for TTLs firstTTL to maxHops, in order. Unless
+// window is zero, the probes of a TTL are only queued once every TTL window or more below
+// it completed. The queue is closed once every probe was taken, a TTL beyond the
+// destination is reached or ctx is done.
+func queueProbes(
+	ctx context.Context,
+	firstTTL, maxHops, probesPerHop, window int,
+	results *results,
+) <-chan queuedProbe {
+	queue := make(chan queuedProbe)
+
+	go func() {
+		defer close(queue)
+
+		for ttl := firstTTL; ttl <= maxHops; ttl++ {
+			if window > 0 && !results.waitWindow(ctx, ttl, window) {
+				return
+			}
+			for attempt := 0; attempt < probesPerHop; attempt++ {
+				if results.beyondDestination(ttl) {
+					return
+				}
+				select {
+				case queue <- queuedProbe{ttl: ttl, attempt: attempt}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return queue
+}
+
+// demux hands the replies read from the ICMP listener to the outstanding probes they quote.
+type demux struct {
+	conn messageReader
+	// logs records the replies to the probes of every TTL.
+	logs []*replyLog
+
+	mu      sync.Mutex
+	pending []*pendingProbe
+	err     error
+}
+
+// pendingProbe is a probe waiting for its reply.
+type pendingProbe struct {
+	sent    sentProbe
+	ttl     int
+	attempt int
+	reply   chan *reply
+}
+
+// send sends the attempt-th probe for ttl and registers it for its reply. The probe is
+// registered before any message read in the meantime is matched, so its reply cannot be
+// missed.
+func (d *demux) send(p prober, ttl, attempt int) (*pendingProbe, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sent, err := p.send(ttl, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &pendingProbe{sent: sent, ttl: ttl, attempt: attempt, reply: make(chan *reply, 1)}
+	d.pending = append(d.pending, pending)
+	d.logs[ttl-1].add(attempt, sent)
+	return pending, nil
+}
+
+// wait waits up to timeout after the probe was sent for its reply, or until ctx is done or
+// skip is closed.
+func (d *demux) wait(
+	ctx context.Context,
+	pending *pendingProbe,
+	timeout time.Duration,
+	skip <-chan struct{},
+) (Probe, bool) {
+	timer := time.NewTimer(time.Until(pending.sent.sentAt.Add(timeout)))
+	defer timer.Stop()
+
+	select {
+	case r := <-pending.reply:
+		return r.probe(pending.sent)
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-skip:
+	}
+
+	d.forget(pending)
+
+	// The reply may have been delivered while giving up on it.
+	select {
+	case r := <-pending.reply:
+		return r.probe(pending.sent)
+	default:
+		probe := lostProbe()
+		probe.SentAt = pending.sent.sentAt
+		return probe, false
+	}
+}
+
+// run reads the ICMP listener until ctx is done. A read error other than a timeout is
+// recorded and stops the trace through cancel.
+func (d *demux) run(ctx context.Context, cancel context.CancelFunc) {
+	for {
+		msg, parsed, err := readParsed(ctx, d.conn)
+		switch network.Classify(err) {
+		case network.Ignore:
+			continue
+		case network.Terminal:
+			if ctx.Err() != nil || errors.Is(err, network.ErrReadTimeout) {
+				return
+			}
+			d.mu.Lock()
+			d.err = err
+			d.mu.Unlock()
+			cancel()
+			return
+		}
+
+		d.dispatch(msg, parsed)
+	}
+}
+
+// dispatch delivers the message to the first outstanding probe it is a reply to. Replies
+// to probes no longer outstanding are only recorded in the logs.
+func (d *demux) dispatch(msg *network.Message, parsed *network.ParsedICMP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, pending := range d.pending {
+		if r := pending.sent.replyFrom(msg, parsed); r != nil {
+			pending.reply <- r
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			d.logs[pending.ttl-1].answer(pending.attempt)
+			return
+		}
+	}
+
+	for _, log := range d.logs {
+		if log.observe(msg, parsed) {
+			return
+		}
+	}
+}
+
+// forget stops matching replies against the probe.
+func (d *demux) forget(pending *pendingProbe) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, p := range d.pending {
+		if p == pending {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *demux) readErr() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// results collects the outcome of probes completing concurrently and emits the hops in
+// order as they complete.
+type results struct {
+	mu      sync.Mutex
+	probes  [][]Probe
+	sentECN network.ECN
+	logs    []*replyLog
+	emit    func(Hop)
+	// emitted is the number of TTLs emitted or skipped so far.
+	emitted int
+	// completed counts the completed probes of every TTL.
+	completed []int
+	// destTTL is the lowest TTL whose probes reached the destination or reported it as
+	// unreachable, or zero if none did yet.
+	destTTL int
+	// skip holds a channel for every TTL, closed once the TTL is known to be past the
+	// destination.
+	skip []chan struct{}
+	// progress is closed, and replaced, whenever a hop is emitted or destTTL is lowered.
+	progress chan struct{}
+}
+
+// newResults creates the results of the probes for TTLs firstTTL to maxHops.
+func newResults(
+	firstTTL, maxHops, probesPerHop int,
+	sentECN network.ECN,
+	logs []*replyLog,
+	emit func(Hop),
+) *results {
+	r := &results{
+		probes:    make([][]Probe, maxHops),
+		sentECN:   sentECN,
+		logs:      logs,
+		emit:      emit,
+		emitted:   firstTTL - 1,
+		completed: make([]int, maxHops),
+		skip:      make([]chan struct{}, maxHops),
+		progress:  make(chan struct{}),
+	}
+	for i := range r.probes {
+		r.probes[i] = make([]Probe, probesPerHop)
+		r.skip[i] = make(chan struct{})
+	}
+	return r
+}
+
+// set records the outcome of the attempt-th probe for ttl.
+func (r *results) set(ttl, attempt int, probe Probe, done bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.probes[ttl-1][attempt] = probe
+	r.completed[ttl-1]++
+	if done && (r.destTTL == 0 || ttl < r.destTTL) {
+		last := len(r.probes)
+		if r.destTTL != 0 {
+			last = r.destTTL
+		}
+		for i := ttl; i < last; i++ {
+			close(r.skip[i])
+		}
+		r.destTTL = ttl
+		r.advance()
+	}
+
+	r.emitCompleted()
+}
+
+// skipped returns a channel closed once ttl is known to be past the destination.
+func (r *results) skipped(ttl int) <-chan struct{} {
+	return r.skip[ttl-1]
+}
+
+// waitWindow waits until every TTL window or more below ttl completed, and reports
+// whether ttl is to be probed: it returns false if ctx is done first or ttl is known to be
+// past the destination.
+func (r *results) waitWindow(ctx context.Context, ttl, window int) bool {
+	for {
+		r.mu.Lock()
+		inWindow := ttl <= r.emitted+window
+		beyond := r.destTTL != 0 && ttl > r.destTTL
+		progress := r.progress
+		r.mu.Unlock()
+
+		switch {
+		case beyond:
+			return false
+		case inWindow:
+			return true
+		}
+
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// advance wakes up the goroutines waiting for progress.
+func (r *results) advance() {
+	close(r.progress)
+	r.progress = make(chan struct{})
+}
+
+// beyondDestination reports whether ttl is known to be past the destination.
+func (r *results) beyondDestination(ttl int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.destTTL != 0 && ttl > r.destTTL
+}
+
+// emitCompleted emits the hops of the TTLs up to the destination whose probes, and those
+// of every lower TTL, completed. Every TTL below an emitted one completed before it, so the
+// destination is never found below an emitted hop.
+func (r *results) emitCompleted() {
+	last := len(r.probes)
+	if r.destTTL != 0 {
+		last = r.destTTL
+	}
+
+	for r.emitted < last {
+		probes := r.probes[r.emitted]
+		if r.completed[r.emitted] < len(probes) {
+			return
+		}
+
+		hop := Hop{TTL: r.emitted + 1, SentECN: r.sentECN}
+		for _, probe := range probes {
+			hop.add(probe)
+		}
+		if log := r.logs[r.emitted]; log != nil {
+			hop.Duplicates, hop.Reordered = log.counts()
+		}
+		hop.summarize()
+
+		r.emit(hop)
+		r.emitted++
+		r.advance()
+	}
+}
@@ -0,0 +1,557 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func reachedProbe(ip net.IP) Probe {
+	return Probe{Responder: ip, RTT: time.Millisecond, ReplyTTL: 64}
+}
+
+func TestResultsEmitsCompletedHops(t *testing.T) {
+	var hops []Hop
+	logs := make([]*replyLog, 5)
+	r := newResults(1, 5, 2, network.NotECT, logs, func(hop Hop) { hops = append(hops, hop) })
+	router := net.IPv4(10, 0, 0, 1)
+	dest := net.IPv4(10, 0, 0, 9)
+
+	var wg sync.WaitGroup
+	for ttl := 1; ttl <= 4; ttl++ {
+		for attempt := 0; attempt < 2; attempt++ {
+			wg.Add(1)
+			go func(ttl, attempt int) {
+				defer wg.Done()
+				switch {
+				case ttl >= 3:
+					r.set(ttl, attempt, reachedProbe(dest), true)
+				case attempt == 0:
+					r.set(ttl, attempt, reachedProbe(router), false)
+				default:
+					r.set(ttl, attempt, lostProbe(), false)
+				}
+			}(ttl, attempt)
+		}
+	}
+	wg.Wait()
+
+	assert.False(t, r.beyondDestination(3))
+	assert.True(t, r.beyondDestination(4))
+
+	require.Len(t, hops, 3)
+	for i, hop := range hops {
+		assert.Equal(t, i+1, hop.TTL)
+		assert.Len(t, hop.RTTs, 2)
+	}
+	assert.True(t, hops[0].IP.Equal(router))
+	assert.Equal(t, []time.Duration{time.Millisecond, NoRTT}, hops[0].RTTs)
+	assert.Equal(t, 50.0, hops[0].Loss)
+	assert.True(t, hops[2].IP.Equal(dest))
+}
+
+func TestResultsEmitInOrder(t *testing.T) {
+	var ttls []int
+	logs := make([]*replyLog, 3)
+	r := newResults(1, 3, 2, network.NotECT, logs, func(hop Hop) { ttls = append(ttls, hop.TTL) })
+
+	r.set(1, 0, lostProbe(), false)
+	r.set(2, 0, lostProbe(), false)
+	r.set(3, 0, lostProbe(), false)
+	r.set(3, 1, lostProbe(), false)
+	assert.Empty(t, ttls)
+
+	r.set(1, 1, lostProbe(), false)
+	assert.Equal(t, []int{1}, ttls)
+
+	r.set(2, 1, lostProbe(), false)
+	assert.Equal(t, []int{1, 2, 3}, ttls)
+	assert.False(t, r.beyondDestination(3))
+}
+
+func TestResultsFirstTTL(t *testing.T) {
+	var ttls []int
+	logs := make([]*replyLog, 4)
+	r := newResults(3, 4, 1, network.NotECT, logs, func(hop Hop) { ttls = append(ttls, hop.TTL) })
+
+	r.set(3, 0, lostProbe(), false)
+	assert.Equal(t, []int{3}, ttls, "the TTLs below the first one are not waited for")
+
+	r.set(4, 0, lostProbe(), false)
+	assert.Equal(t, []int{3, 4}, ttls)
+}
+
+func timeExceeded(
+	t *testing.T,
+	dst net.IP,
+	dstPort int,
+) (*network.Message, *network.ParsedICMP) {
+	t.Helper()
+
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + 8,
+		TTL:      1,
+		Protocol: protocolUDP,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      dst,
+	}
+	quoted, err := header.Marshal()
+	require.NoError(t, err)
+	quoted = append(quoted, 0xc3, 0x50, byte(dstPort>>8), byte(dstPort), 0, 8, 0, 0)
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: quoted},
+	}
+	data, err := msg.Marshal(nil)
+	require.NoError(t, err)
+
+	parsed, err := network.ParseICMP(network.IPv4, data)
+	require.NoError(t, err)
+
+	return &network.Message{
+		Peer:       net.IPv4(10, 0, 0, 1),
+		Data:       data,
+		TTL:        254,
+		ReceivedAt: time.Now(),
+	}, parsed
+}
+
+func TestDemuxDispatch(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	log := newReplyLog(2)
+	pendingProbeTo := func(port, attempt int) *pendingProbe {
+		pending := &pendingProbe{
+			sent: sentProbe{
+				dst:    dst,
+				key:    network.ProbeKey{Protocol: protocolUDP, SrcPort: 50000, DstPort: port},
+				sentAt: time.Now(),
+			},
+			ttl:     1,
+			attempt: attempt,
+			reply:   make(chan *reply, 1),
+		}
+		log.add(attempt, pending.sent)
+		return pending
+	}
+	first, second := pendingProbeTo(33434, 0), pendingProbeTo(33435, 1)
+	d := &demux{pending: []*pendingProbe{first, second}, logs: []*replyLog{log}}
+
+	d.dispatch(timeExceeded(t, dst, 33435))
+	d.dispatch(timeExceeded(t, dst, 33999))
+
+	require.Len(t, second.reply, 1)
+	assert.Empty(t, first.reply)
+	assert.Equal(t, []*pendingProbe{first}, d.pending)
+
+	// A second reply to the answered probe is only counted.
+	d.dispatch(timeExceeded(t, dst, 33435))
+	assert.Len(t, second.reply, 1)
+	duplicates, reordered := log.counts()
+	assert.Equal(t, 1, duplicates)
+	assert.Equal(t, 0, reordered)
+
+	probe, done := d.wait(context.Background(), second, time.Second, nil)
+	assert.True(t, probe.Responder.Equal(net.IPv4(10, 0, 0, 1)))
+	assert.Equal(t, 254, probe.ReplyTTL)
+	assert.False(t, done)
+
+	// A probe whose reply never arrives is given up on and forgotten.
+	probe, done = d.wait(context.Background(), first, 10*time.Millisecond, nil)
+	assert.False(t, probe.Responded())
+	assert.False(t, done)
+	assert.Empty(t, d.pending)
+}
+
+func TestQueueProbes(t *testing.T) {
+	r := newResults(2, 4, 2, network.NotECT, make([]*replyLog, 4), func(Hop) {})
+
+	var queued []queuedProbe
+	for q := range queueProbes(context.Background(), 2, 4, 2, 0, r) {
+		queued = append(queued, q)
+		if q.ttl == 3 && q.attempt == 0 {
+			r.set(2, 0, lostProbe(), false)
+			r.set(2, 1, lostProbe(), false)
+			r.set(3, 0, reachedProbe(net.IPv4(10, 0, 0, 9)), true)
+		}
+	}
+
+	assert.Equal(t, []queuedProbe{{2, 0}, {2, 1}, {3, 0}, {3, 1}}, queued,
+		"no probe is queued beyond the destination")
+}
+
+func TestQueueProbesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newResults(1, 30, 3, network.NotECT, make([]*replyLog, 30), func(Hop) {})
+
+	queue := queueProbes(ctx, 1, 30, 3, 0, r)
+	assert.Equal(t, queuedProbe{1, 0}, <-queue)
+	cancel()
+
+	for range queue {
+	}
+}
+
+func TestQueueProbesWindow(t *testing.T) {
+	r := newResults(1, 6, 1, network.NotECT, make([]*replyLog, 6), func(Hop) {})
+	queue := queueProbes(context.Background(), 1, 6, 1, 2, r)
+
+	assert.Equal(t, queuedProbe{1, 0}, <-queue)
+	assert.Equal(t, queuedProbe{2, 0}, <-queue)
+	select {
+	case q := <-queue:
+		t.Fatalf("%v queued before TTL 1 completed", q)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	r.set(2, 0, lostProbe(), false)
+	r.set(1, 0, lostProbe(), false)
+	assert.Equal(t, queuedProbe{3, 0}, <-queue)
+	assert.Equal(t, queuedProbe{4, 0}, <-queue)
+
+	// The destination ends the queue even while it waits for the window.
+	r.set(3, 0, reachedProbe(net.IPv4(10, 0, 0, 9)), true)
+	for q := range queue {
+		t.Fatalf("%v queued beyond the destination", q)
+	}
+}
+
+func TestResultsSkipped(t *testing.T) {
+	r := newResults(1, 5, 1, network.NotECT, make([]*replyLog, 5), func(Hop) {})
+	closed := func(ttl int) bool {
+		select {
+		case <-r.skipped(ttl):
+			return true
+		default:
+			return false
+		}
+	}
+
+	r.set(4, 0, reachedProbe(net.IPv4(10, 0, 0, 9)), true)
+	assert.False(t, closed(4))
+	assert.True(t, closed(5))
+
+	r.set(2, 0, reachedProbe(net.IPv4(10, 0, 0, 9)), true)
+	assert.False(t, closed(2))
+	assert.True(t, closed(3))
+	assert.True(t, closed(4))
+
+	r.set(3, 0, reachedProbe(net.IPv4(10, 0, 0, 9)), true)
+}
+
+// pathReceiver answers the probes sent by p like the path to p.dest, which the probes
+// reach at destTTL, would: routers answer the other TTLs below it unless silent says
+// otherwise, and nothing answers beyond it.
+func pathReceiver(
+	t *testing.T,
+	p *fakeProber,
+	destTTL int,
+	silent func(ttl int) bool,
+) *MockReader {
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			for {
+				select {
+				case ttl := <-p.sent:
+					msg := &network.Message{TTL: -1, ReceivedAt: time.Now()}
+					switch {
+					case ttl == destTTL:
+						msg.Peer = p.dest
+						msg.Data = quotingMessage(t, p.dest, ipv4.ICMPTypeDestinationUnreachable,
+							3, ttl)
+					case ttl < destTTL && !silent(ttl):
+						msg.Peer = net.IPv4(10, 0, 0, byte(ttl))
+						msg.Data = quotingMessage(t, p.dest, ipv4.ICMPTypeTimeExceeded, 0, ttl)
+					default:
+						continue
+					}
+					return msg, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+		})
+	receiver.On("Close").Return(nil)
+	return receiver
+}
+
+func TestRunParallelStopsProbesBeyondDestination(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 30)}
+	receiver := pathReceiver(t, p, 3, func(int) bool { return false })
+
+	opts := Options{Timeout: 5 * time.Second, ProbesPerHop: 1, Parallel: true}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	start := time.Now()
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+
+	assert.Less(t, time.Since(start), time.Second, "outstanding probes beyond the "+
+		"destination do not time out")
+	require.Len(t, hops, 3)
+	assert.True(t, hops[2].IP.Equal(dest))
+}
+
+func TestTraceRunSimultaneousHops(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 12)}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	receiver.On("Close").Return(nil)
+
+	opts := Options{
+		MaxHops:          6,
+		Timeout:          200 * time.Millisecond,
+		ProbesPerHop:     2,
+		SimultaneousHops: 2,
+	}.withDefaults()
+	assert.True(t, opts.Parallel)
+	assert.Equal(t, 4, opts.MaxConcurrentProbes)
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) })
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, p.sent, 4, "only the probes of the first two TTLs are sent")
+
+	require.NoError(t, <-done)
+	assert.Len(t, hops, 6)
+}
+
+func TestTraceRunSimultaneousHopsTakesOneTimeout(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 90)}
+	// The router at TTL 10 does not answer, so the trace takes one timeout.
+	receiver := pathReceiver(t, p, 20, func(ttl int) bool { return ttl == 10 })
+
+	const timeout = 300 * time.Millisecond
+	opts := Options{Timeout: timeout, SimultaneousHops: 30}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	start := time.Now()
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+
+	assert.Less(t, time.Since(start), 2*timeout)
+	require.Len(t, hops, 20)
+	assert.Equal(t, 100.0, hops[9].Loss)
+	assert.True(t, hops[19].IP.Equal(dest))
+}
+
+func TestRunParallelBoundsConcurrentProbes(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 8)}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+
+	opts := Options{
+		MaxHops:             8,
+		Timeout:             200 * time.Millisecond,
+		ProbesPerHop:        1,
+		MaxConcurrentProbes: 2,
+	}.withDefaults()
+
+	var hops []Hop
+	done := make(chan error, 1)
+	go func() {
+		done <- runParallel(context.Background(), p, receiver, opts, nil,
+			func(hop Hop) { hops = append(hops, hop) })
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, p.sent, 2, "only as many probes as workers are outstanding")
+
+	require.NoError(t, <-done)
+	assert.Len(t, p.sent, 8)
+	require.Len(t, hops, 8)
+	assert.Equal(t, 100.0, hops[7].Loss)
+}
+
+// timedProber is a fakeProber that also records when it sends every probe.
+type timedProber struct {
+	*fakeProber
+	mu     sync.Mutex
+	sentAt []time.Time
+}
+
+func (p *timedProber) send(ttl, attempt int) (sentProbe, error) {
+	sent, err := p.fakeProber.send(ttl, attempt)
+	p.mu.Lock()
+	p.sentAt = append(p.sentAt, sent.sentAt)
+	p.mu.Unlock()
+	return sent, err
+}
+
+func TestRunParallelPacesProbesAcrossTTLs(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &timedProber{fakeProber: &fakeProber{dest: dest, sent: make(chan int, 12)}}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+
+	const interval = 20 * time.Millisecond
+	opts := Options{MaxHops: 6, Timeout: 200 * time.Millisecond, ProbesPerHop: 1}.withDefaults()
+
+	require.NoError(t, runParallel(context.Background(), p, receiver, opts,
+		NewLimiter(interval, 1), func(Hop) {}))
+
+	require.Len(t, p.sentAt, 6)
+	for i := 1; i < len(p.sentAt); i++ {
+		// Timers may fire a little early on some platforms.
+		assert.GreaterOrEqual(t, p.sentAt[i].Sub(p.sentAt[i-1]), interval-2*time.Millisecond)
+	}
+}
+
+func TestRunParallelPacingCancelled(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 30)}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	opts := Options{Timeout: time.Second, ProbesPerHop: 1}.withDefaults()
+
+	start := time.Now()
+	err := runParallel(ctx, p, receiver, opts, NewLimiter(time.Hour, 1), func(Hop) {})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, p.sent, 1, "the queued probes are not sent")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRunParallelRetries(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &slotProber{dest: dest, sent: make(chan int, 4)}
+
+	var mu sync.Mutex
+	var sent []int
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		answerAttempts(t, p, func(attempt int) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, attempt)
+			// Only the first retry of the first probe is answered.
+			return attempt == 2
+		}))
+
+	opts := Options{
+		MaxHops:      1,
+		Timeout:      50 * time.Millisecond,
+		ProbesPerHop: 2,
+		Retries:      1,
+	}.withDefaults()
+
+	var hops []Hop
+	require.NoError(t, runParallel(context.Background(), p, receiver, opts, nil,
+		func(hop Hop) { hops = append(hops, hop) }))
+
+	mu.Lock()
+	assert.ElementsMatch(t, []int{0, 1, 2, 3}, sent)
+	mu.Unlock()
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+	assert.Equal(t, 1, hops[0].Probes[0].Retries)
+	assert.Equal(t, 1, hops[0].Probes[1].Retries)
+	assert.Equal(t, 2, hops[0].Retries)
+	assert.Equal(t, 50.0, hops[0].Loss)
+	assert.Equal(t, 100.0, hops[0].FirstLoss)
+}
+
+func TestTracerRunParallelLoopback(t *testing.T) {
+	for _, method := range []ProbeMethod{UDP, ICMP} {
+		t.Run(method.String(), func(t *testing.T) {
+			dest := net.IPv4(127, 0, 0, 1)
+
+			hops, err := New(WithOptions(Options{
+				MaxHops:             8,
+				Timeout:             time.Second,
+				Method:              method,
+				Parallel:            true,
+				MaxConcurrentProbes: 4,
+			})).Run(context.Background(), dest)
+			if err != nil && errors.Is(err, os.ErrPermission) {
+				t.Skip("raw ICMP sockets require elevated privileges")
+			}
+
+			require.NoError(t, err)
+			require.Len(t, hops, 1)
+			assert.True(t, hops[0].IP.Equal(dest))
+			assert.Equal(t, 0.0, hops[0].Loss)
+		})
+	}
+}
+
+func TestTracerRunParallelTCPUnsupported(t *testing.T) {
+	_, err := New(WithOptions(Options{
+		MaxHops:  1,
+		Timeout:  100 * time.Millisecond,
+		Method:   TCP,
+		Parallel: true,
+	})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw sockets require elevated privileges")
+	}
+
+	assert.ErrorContains(t, err, "parallel probing is not supported")
+}
+
+func TestTracerRunParallelCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := New(WithOptions(Options{
+		Timeout:  5 * time.Second,
+		Parallel: true,
+	})).Run(ctx, net.IPv4(192, 0, 2, 254))
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
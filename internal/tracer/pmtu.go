@@ -0,0 +1,138 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+
+	"my-little-tracerouter/internal/network"
+)
+
+const (
+	// maxPathMTU is the length of the first probes of a path MTU discovery unless
+	// Options.PacketSize is set, the MTU of Ethernet.
+	maxPathMTU = 1500
+
+	// minPathMTU and minPathMTUv6 are the smallest MTUs of IPv4 (RFC 791) and IPv6
+	// (RFC 8200) links.
+	minPathMTU   = 68
+	minPathMTUv6 = 1280
+)
+
+// mtuSearch narrows down the MTU of a path from the probes that fit through it and the
+// ones that did not.
+type mtuSearch struct {
+	// size is the length of the next probe, headers included.
+	size int
+	// lo is the largest length known to fit and hi the largest one not known not to fit.
+	lo int
+	hi int
+	// min is the smallest MTU of a link of the family probed.
+	min int
+}
+
+// newMTUSearch creates an mtuSearch whose first probe is size bytes long, or maxPathMTU if
+// size is zero.
+func newMTUSearch(family network.Family, size int) *mtuSearch {
+	if size == 0 {
+		size = maxPathMTU
+	}
+	floor := minPathMTU
+	if family == network.IPv6 {
+		floor = minPathMTUv6
+	}
+	if floor > size {
+		floor = size
+	}
+	return &mtuSearch{size: size, lo: floor, hi: size, min: floor}
+}
+
+// fit records that a probe of the current size made it through and moves on to a larger
+// one unless the search converged.
+func (s *mtuSearch) fit() {
+	s.lo = s.size
+	s.size = s.lo + (s.hi-s.lo+1)/2
+}
+
+// tooBig records that a probe of the current size did not fit through a link whose MTU is
+// mtu, or unknown if mtu is not smaller than the probe. The next probe is as large as that
+// MTU, or halfway to the largest length known to fit if it is unknown. It returns false if
+// probes cannot get any smaller.
+func (s *mtuSearch) tooBig(mtu int) bool {
+	if s.size <= s.min {
+		return false
+	}
+
+	known := mtu >= s.min && mtu < s.size
+	if known {
+		s.hi = mtu
+	} else {
+		s.hi = s.size - 1
+	}
+	if s.lo > s.hi {
+		// The path changed, so what fit before is not known to fit anymore.
+		s.lo = s.min
+	}
+
+	if known {
+		s.size = s.hi
+	} else {
+		s.size = s.lo + (s.hi-s.lo+1)/2
+	}
+	return true
+}
+
+// converged reports whether the MTU of the path is known.
+func (s *mtuSearch) converged() bool {
+	return s.lo == s.hi
+}
+
+// pathMTU returns the largest packet length not known not to fit the path, or zero outside
+// of PathMTU mode.
+func (tr *trace) pathMTU() int {
+	if tr.mtu == nil {
+		return 0
+	}
+	return tr.mtu.hi
+}
+
+// probeMTU sends the attempt-th probe for ttl as large as the path MTU search asks for.
+//
+// A probe that does not fit, according to the local host or to a router, is resent smaller
+// right away, and one that fits is followed by a larger one until the search converges, so
+// the outcome is that of the last probe sent. A lost probe ends the attempt without telling
+// anything about the MTU.
+func (tr *trace) probeMTU(ctx context.Context, ttl, attempt int) (Probe, bool, error) {
+	p := tr.prober.(*udpProber)
+
+	for {
+		if err := tr.wait(ctx); err != nil {
+			return lostProbe(), false, err
+		}
+
+		p.size = tr.mtu.size
+		probe, done, err := probeTTL(ctx, p, tr.receiver, ttl, attempt, tr.opts.Timeout,
+			tr.opts.sendRetry(), tr.opts.hooks(), nil)
+
+		var tooBig *network.PacketTooBigError
+		switch {
+		case errors.As(err, &tooBig):
+			// The local host knows the path to be narrower, but not by how much.
+			if !tr.mtu.tooBig(0) {
+				return probe, false, err
+			}
+		case err != nil:
+			return probe, false, err
+		case probe.tooBig:
+			if !tr.mtu.tooBig(probe.MTU) {
+				return probe, done, nil
+			}
+		case !probe.Responded():
+			return probe, false, nil
+		default:
+			tr.mtu.fit()
+			if tr.mtu.converged() {
+				return probe, done, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package tracer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func TestMTUSearchFits(t *testing.T) {
+	s := newMTUSearch(network.IPv4, 0)
+	assert.Equal(t, maxPathMTU, s.size)
+
+	s.fit()
+
+	assert.True(t, s.converged())
+	assert.Equal(t, maxPathMTU, s.size)
+}
+
+func TestMTUSearchReported(t *testing.T) {
+	s := newMTUSearch(network.IPv4, 0)
+
+	assert.True(t, s.tooBig(1400))
+	assert.Equal(t, 1400, s.size)
+	assert.False(t, s.converged())
+
+	s.fit()
+	assert.True(t, s.converged())
+	assert.Equal(t, 1400, s.hi)
+}
+
+// TestMTUSearchBinary searches the MTU of a path that drops probes larger than 1400 bytes
+// without reporting it.
+func TestMTUSearchBinary(t *testing.T) {
+	s := newMTUSearch(network.IPv4, 0)
+
+	for probes := 0; !s.converged(); probes++ {
+		require.Less(t, probes, 16, "the search does not converge")
+
+		if s.size > 1400 {
+			require.True(t, s.tooBig(0))
+		} else {
+			s.fit()
+		}
+	}
+
+	assert.Equal(t, 1400, s.hi)
+	assert.Equal(t, 1400, s.size)
+}
+
+func TestMTUSearchIgnoresBogusMTU(t *testing.T) {
+	s := newMTUSearch(network.IPv4, 0)
+
+	// A reported MTU no smaller than the probe is as good as none.
+	assert.True(t, s.tooBig(maxPathMTU))
+	assert.Equal(t, maxPathMTU-1, s.hi)
+	assert.Less(t, s.size, maxPathMTU-1)
+}
+
+func TestMTUSearchPathChanged(t *testing.T) {
+	s := newMTUSearch(network.IPv4, 0)
+	s.fit()
+
+	assert.True(t, s.tooBig(1280))
+	assert.Equal(t, minPathMTU, s.lo)
+	assert.Equal(t, 1280, s.size)
+}
+
+func TestMTUSearchFloor(t *testing.T) {
+	s := newMTUSearch(network.IPv6, 0)
+
+	assert.True(t, s.tooBig(minPathMTUv6))
+	assert.Equal(t, minPathMTUv6, s.size)
+	assert.False(t, s.tooBig(0), "IPv6 links carry at least 1280 bytes")
+}
+
+func TestMTUSearchPacketSize(t *testing.T) {
+	s := newMTUSearch(network.IPv4, 9000)
+	assert.Equal(t, 9000, s.size)
+
+	s = newMTUSearch(network.IPv6, 100)
+	assert.Equal(t, 100, s.size)
+	assert.False(t, s.tooBig(0), "probes smaller than the minimum MTU fit every link")
+}
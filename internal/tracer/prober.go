@@ -0,0 +1,573 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// IANA protocol numbers of the probes as quoted in ICMP error messages.
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// udpHeaderLen is the length of a UDP header.
+const udpHeaderLen = 8
+
+// ProbeMethod selects the kind of packet sent as a probe.
+type ProbeMethod int
+
+const (
+	// UDP sends empty UDP datagrams to high ports, like classic Unix traceroute.
+	UDP ProbeMethod = iota
+	// ICMP sends ICMP Echo Requests, like Windows tracert.
+	ICMP
+	// TCP sends TCP SYN segments, which often pass firewalls that drop UDP.
+	TCP
+)
+
+// String returns the name of the probe method.
+func (m ProbeMethod) String() string {
+	switch m {
+	case UDP:
+		return "UDP"
+	case ICMP:
+		return "ICMP"
+	case TCP:
+		return "TCP"
+	default:
+		return fmt.Sprintf("ProbeMethod(%d)", int(m))
+	}
+}
+
+// PortVariation names the port that differs between the UDP probes of a trace, so that the
+// port quoted by a reply identifies its probe.
+type PortVariation int
+
+const (
+	// VaryDstPort sends every probe to a destination port of its own, like classic Unix
+	// traceroute. See Options.Port.
+	VaryDstPort PortVariation = iota
+	// VarySrcPort sends every probe to the same destination port from a source port of its
+	// own, so that a firewall letting a single port through, e.g. 53, passes all of them.
+	VarySrcPort
+)
+
+// Prober sends the probes of a trace to a destination it was set up with.
+// *network.UDPConn implements it; see network.UDPConn.SetDestination.
+type Prober interface {
+	// SendProbe sends the seq-th probe for ttl.
+	SendProbe(ttl, seq int) error
+}
+
+// Receiver reads the replies that probes elicit. *network.ICMPConn implements it.
+type Receiver interface {
+	// Receive reads a single reply, waiting at most timeout. See
+	// network.ICMPConn.Receive.
+	Receive(timeout time.Duration) (network.Reply, error)
+}
+
+// prober sends probes of a single ProbeMethod towards the destination, describing them so
+// that replies can be matched to them.
+type prober interface {
+	// send emits the attempt-th probe for ttl and describes it for reply matching.
+	send(ttl, attempt int) (sentProbe, error)
+	Close() error
+}
+
+// messageReader reads the ICMP messages that probes elicit. *network.ICMPConn implements
+// it; other implementations let the tracing logic run without raw sockets, e.g. in tests.
+type messageReader interface {
+	// Family returns the address family of the messages read.
+	Family() network.Family
+	// ReadMessage reads a single ICMP message, waiting until it arrives or ctx is done.
+	// See network.ICMPConn.ReadMessage.
+	ReadMessage(ctx context.Context) (*network.Message, error)
+	Close() error
+}
+
+// parsedReader is a messageReader that parses the messages it reads, so that they are not
+// parsed again.
+type parsedReader interface {
+	// readParsed is ReadMessage, also returning the parsed message, or nil if it does not
+	// parse.
+	readParsed(ctx context.Context) (*network.Message, *network.ParsedICMP, error)
+}
+
+// tapReader passes every message read through a messageReader to tap before returning it.
+type tapReader struct {
+	messageReader
+	tap func(peer net.IP, data []byte)
+}
+
+func (r *tapReader) ReadMessage(ctx context.Context) (*network.Message, error) {
+	msg, err := r.messageReader.ReadMessage(ctx)
+	if err == nil {
+		r.tap(msg.Peer, msg.Data)
+	}
+	return msg, err
+}
+
+// echoFilter discards the Echo Replies read through a messageReader whose identifier is not
+// that of the trace's Echo Requests, along with the errors quoting such requests.
+type echoFilter struct {
+	messageReader
+	id int
+}
+
+func (r *echoFilter) ReadMessage(ctx context.Context) (*network.Message, error) {
+	msg, _, err := r.readParsed(ctx)
+	return msg, err
+}
+
+func (r *echoFilter) readParsed(
+	ctx context.Context,
+) (*network.Message, *network.ParsedICMP, error) {
+	msg, err := r.messageReader.ReadMessage(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := network.ParseICMPWithOptions(r.Family(), msg.Data, network.ParseOptions{
+		VerifyChecksum: true,
+		FilterEchoID:   true,
+		EchoID:         r.id,
+	})
+	return msg, parsed, err
+}
+
+// directReader is implemented by probers whose destination answers outside of ICMP.
+type directReader interface {
+	// readDirect waits until ctx is done for the destination's answer to the probe.
+	readDirect(ctx context.Context, probe sentProbe) *reply
+}
+
+// newProber opens the socket used to send probes of the given method.
+func newProber(
+	method ProbeMethod,
+	family network.Family,
+	icmpConn *network.ICMPConn,
+	dest net.IP,
+	opts Options,
+) (prober, error) {
+	switch method {
+	case UDP:
+		conn, err := newUDPConn(family, opts)
+		if err != nil {
+			return nil, err
+		}
+		var raw *network.RawUDPConn
+		if opts.DetectNAT {
+			// The UDP socket reserves the source port of the probes sent through raw.
+			if raw, err = network.NewRawUDPConn(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return &udpProber{
+			conn:   conn,
+			raw:    raw,
+			family: family,
+			dest:   dest,
+			opts:   opts,
+			ports:  opts.ports(),
+			size:   opts.PacketSize,
+		}, nil
+	case ICMP:
+		if tos := opts.trafficClass(); tos != 0 {
+			// The listener is owned by the tracer, which closes it on error.
+			if err := icmpConn.SetTOS(tos); err != nil {
+				return nil, err
+			}
+		}
+		id := opts.EchoID
+		if id == 0 {
+			id = os.Getpid()
+			if opts.Dispatcher != nil {
+				// Traces sharing a listener are told apart by their identifier.
+				id += int(atomic.AddUint32(&echoIDs, 1))
+			}
+		}
+		id = icmpConn.EchoID(id & 0xffff)
+		return &echoProber{conn: icmpConn, dest: dest, id: id}, nil
+	case TCP:
+		localAddr := ":0"
+		if opts.SourceIP != nil {
+			localAddr = net.JoinHostPort(opts.SourceIP.String(), "0")
+		}
+		conn, err := network.NewTCPConn(family, localAddr)
+		if err != nil {
+			return nil, err
+		}
+		if err := bindInterface(conn, opts.Interface); err != nil {
+			return nil, err
+		}
+		if err := setTOS(conn, opts.trafficClass()); err != nil {
+			return nil, err
+		}
+		return &tcpProber{conn: conn, dest: dest, port: opts.Port}, nil
+	default:
+		return nil, fmt.Errorf("unsupported probe method: %v", method)
+	}
+}
+
+// newUDPConn opens a socket for UDP probes bound to opts.SourceIP and opts.SrcPort,
+// configured as opts asks for.
+func newUDPConn(family network.Family, opts Options) (*network.UDPConn, error) {
+	conn, err := network.NewUDPConnFrom(family, opts.SourceIP, opts.SrcPort)
+	if err != nil {
+		return nil, err
+	}
+	if err := bindInterface(conn, opts.Interface); err != nil {
+		return nil, err
+	}
+	if opts.DontFragment {
+		if err := conn.SetDontFragment(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := setTOS(conn, opts.trafficClass()); err != nil {
+		return nil, err
+	}
+	conn.SetPayloadFunc(opts.Payload)
+	return conn, nil
+}
+
+// deviceConn is a probe socket that can be bound to a network interface.
+type deviceConn interface {
+	BindToDevice(name string) error
+	Close() error
+}
+
+// bindInterface binds conn to the named interface unless name is empty. The connection is
+// closed if binding fails.
+func bindInterface(conn deviceConn, name string) error {
+	if name == "" {
+		return nil
+	}
+	if err := conn.BindToDevice(name); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// tosConn is a probe socket whose Type of Service byte can be set.
+type tosConn interface {
+	SetTOS(tos int) error
+	Close() error
+}
+
+// setTOS sets the Type of Service byte of conn unless tos is zero. The connection is closed
+// if setting it fails.
+func setTOS(conn tosConn, tos int) error {
+	if tos == 0 {
+		return nil
+	}
+	if err := conn.SetTOS(tos); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// portSequence allocates the destination ports of classic UDP probes like traceroute does:
+// the attempt-th probe for ttl goes to base + (ttl-1)*probesPerHop + attempt. Every probe
+// of a trace thus has its own port, and the port quoted by a reply identifies the probe.
+type portSequence struct {
+	base         int
+	probesPerHop int
+}
+
+// check returns an error if the probes of maxHops TTLs would need ports beyond 65535.
+// Ports do not wrap around, so that a quoted port always identifies a single probe.
+func (s portSequence) check(maxHops int) error {
+	if last := s.port(maxHops, s.probesPerHop-1); s.base < 1 || last > 0xffff {
+		return fmt.Errorf("invalid base port %d: probing %d hops needs ports up to %d",
+			s.base, maxHops, last)
+	}
+	return nil
+}
+
+// port returns the destination port of the attempt-th probe for ttl.
+func (s portSequence) port(ttl, attempt int) int {
+	return s.base + (ttl-1)*s.probesPerHop + attempt
+}
+
+// probe recovers the TTL and attempt of the probe sent to port, if port belongs to the
+// sequence.
+func (s portSequence) probe(port int) (ttl, attempt int, ok bool) {
+	index := port - s.base
+	if index < 0 {
+		return 0, 0, false
+	}
+	return index/s.probesPerHop + 1, index % s.probesPerHop, true
+}
+
+// udpProber sends empty UDP datagrams, advancing the destination port with every probe.
+//
+// With VarySrcPort the destination port stays fixed and every probe but the first is sent
+// from a socket of its own, which is kept open until the prober is closed so that its port
+// is not reused within the trace. In Paris mode both ports stay fixed and every probe is sent
+// with a distinct checksum instead.
+type udpProber struct {
+	conn *network.UDPConn
+	// raw sends the probes with an IPv4 Identification of their own in DetectNAT mode, and
+	// is nil otherwise.
+	raw    *network.RawUDPConn
+	family network.Family
+	dest   net.IP
+	opts   Options
+	ports  portSequence
+	// size is the length of the IP packets sent, headers included, or zero to send empty
+	// datagrams.
+	size int
+	// sources holds the sockets opened for the probes after the first one with VarySrcPort.
+	sources []*network.UDPConn
+	sent    bool
+	// flow offsets the destination port of Paris probes from opts.FlowID, so that
+	// multipath discovery can send every probe along a flow of its own.
+	flow int
+}
+
+func (p *udpProber) send(ttl, attempt int) (sentProbe, error) {
+	if p.opts.Paris {
+		if err := p.conn.SetTTL(ttl); err != nil {
+			return sentProbe{}, err
+		}
+		return p.sendParis((ttl-1)*p.opts.slotsPerHop() + attempt)
+	}
+
+	conn, err := p.source()
+	if err != nil {
+		return sentProbe{}, err
+	}
+	if p.raw != nil {
+		return p.sendRaw(conn, ttl, attempt)
+	}
+	if err := conn.SetTTL(ttl); err != nil {
+		return sentProbe{}, err
+	}
+
+	addr := &net.UDPAddr{IP: p.dest, Port: p.opts.Port}
+	sent := sentProbe{
+		dst: p.dest,
+		key: network.ProbeKey{
+			Protocol: protocolUDP,
+			SrcPort:  conn.LocalAddr().(*net.UDPAddr).Port,
+			DstPort:  addr.Port,
+		},
+		sentAt: time.Now(),
+	}
+	if p.opts.Vary == VaryDstPort {
+		addr.Port = p.ports.port(ttl, attempt)
+		sent.key.DstPort = addr.Port
+		sent.ports, sent.ttl, sent.attempt = &p.ports, ttl, attempt
+	}
+
+	size := 0
+	if p.size > 0 {
+		size = p.size - packetOverhead(p.dest)
+	}
+	return sent, conn.SendProbeTo(addr, ttl, attempt, size)
+}
+
+// sendRaw sends the attempt-th probe for ttl through the raw socket, from the port of conn
+// and with an IPv4 Identification of its own; see nextIPID.
+func (p *udpProber) sendRaw(conn *network.UDPConn, ttl, attempt int) (sentProbe, error) {
+	src := conn.LocalAddr().(*net.UDPAddr)
+	dst := &net.UDPAddr{IP: p.dest, Port: p.ports.port(ttl, attempt)}
+	id := nextIPID()
+
+	sent := sentProbe{
+		dst: p.dest,
+		key: network.ProbeKey{
+			Protocol: protocolUDP,
+			SrcPort:  src.Port,
+			DstPort:  dst.Port,
+		},
+		sentAt:  time.Now(),
+		ports:   &p.ports,
+		ttl:     ttl,
+		attempt: attempt,
+		ipID:    id,
+	}
+
+	return sent, p.raw.Send(network.RawUDPDatagram{
+		Src:          src,
+		Dst:          dst,
+		TTL:          ttl,
+		TOS:          p.opts.trafficClass(),
+		ID:           id,
+		DontFragment: p.opts.DontFragment,
+	})
+}
+
+// source returns the socket the next probe is sent from.
+func (p *udpProber) source() (*network.UDPConn, error) {
+	if p.opts.Vary != VarySrcPort || !p.sent {
+		p.sent = true
+		return p.conn, nil
+	}
+
+	conn, err := newUDPConn(p.family, p.opts)
+	if err != nil {
+		return nil, err
+	}
+	p.sources = append(p.sources, conn)
+	return conn, nil
+}
+
+func (p *udpProber) sendParis(index int) (sentProbe, error) {
+	addr := &net.UDPAddr{IP: p.dest, Port: p.opts.Port + p.opts.FlowID + p.flow}
+
+	offloaded, err := p.conn.OffloadedChecksum(addr)
+	if err != nil {
+		return sentProbe{}, err
+	}
+
+	// Checksums 0 and 0xffff cannot be sent, so number the probes from 1.
+	checksum := index%0xfffe + 1
+	sent := sentProbe{
+		dst: p.dest,
+		key: network.ProbeKey{
+			Protocol: protocolUDP,
+			SrcPort:  p.conn.LocalAddr().(*net.UDPAddr).Port,
+			DstPort:  addr.Port,
+			Checksum: checksum,
+		},
+		sentAt:            time.Now(),
+		offloadedChecksum: offloaded,
+	}
+
+	return sent, p.conn.SendWithChecksum(addr, uint16(checksum))
+}
+
+// packetOverhead returns the length of the IP and UDP headers of a datagram sent to dest.
+func packetOverhead(dest net.IP) int {
+	if dest.To4() != nil {
+		return ipv4.HeaderLen + udpHeaderLen
+	}
+	return ipv6.HeaderLen + udpHeaderLen
+}
+
+func (p *udpProber) Close() error {
+	for _, conn := range p.sources {
+		conn.Close()
+	}
+	if p.raw != nil {
+		p.raw.Close()
+	}
+	return p.conn.Close()
+}
+
+// ipIDs numbers the probes sent through a raw socket by every trace in the process, so
+// that their IPv4 Identification tells apart the probes of concurrent traces too.
+var ipIDs uint32
+
+// nextIPID returns the IPv4 Identification of the next probe sent through a raw socket,
+// from 1 to 0xffff: zero would let the kernel pick one.
+func nextIPID() int {
+	return int((atomic.AddUint32(&ipIDs, 1)-1)%0xffff) + 1
+}
+
+// echoSeq numbers the Echo Requests of every trace in the process. All of them share the
+// process ID as Echo identifier, so a shared counter keeps concurrent traces from matching
+// each other's replies.
+var echoSeq uint32
+
+// nextEchoSeq returns the sequence number of the next Echo Request, from 1 to 0xffff: zero
+// is what a quote without an Echo header decodes to, which matches any probe.
+func nextEchoSeq() int {
+	return int((atomic.AddUint32(&echoSeq, 1)-1)%0xffff) + 1
+}
+
+// echoIDs offsets the Echo identifier of the traces sharing a Dispatcher from the process
+// ID.
+var echoIDs uint32
+
+// echoProber sends ICMP Echo Requests over the ICMP listener, numbering them sequentially.
+type echoProber struct {
+	conn *network.ICMPConn
+	dest net.IP
+	id   int
+	seq  int
+}
+
+func (p *echoProber) send(ttl, attempt int) (sentProbe, error) {
+	p.seq = nextEchoSeq()
+
+	protocol := protocolICMP
+	if p.conn.Family() == network.IPv6 {
+		protocol = protocolICMPv6
+	}
+
+	sent := sentProbe{
+		dst: p.dest,
+		key: network.ProbeKey{
+			Protocol: protocol,
+			EchoID:   p.id,
+			EchoSeq:  p.seq,
+		},
+		sentAt: time.Now(),
+	}
+
+	return sent, p.conn.SendEcho(&net.IPAddr{IP: p.dest}, ttl, p.id, p.seq, nil)
+}
+
+// Close is a no-op because the ICMP listener is owned by the tracer.
+func (p *echoProber) Close() error {
+	return nil
+}
+
+// tcpProber sends TCP SYN segments to a fixed destination port.
+type tcpProber struct {
+	conn *network.TCPConn
+	dest net.IP
+	port int
+}
+
+func (p *tcpProber) send(ttl, attempt int) (sentProbe, error) {
+	if err := p.conn.SetTTL(ttl); err != nil {
+		return sentProbe{}, err
+	}
+
+	sent := sentProbe{
+		dst: p.dest,
+		key: network.ProbeKey{
+			Protocol: protocolTCP,
+			SrcPort:  p.conn.SrcPort(),
+			DstPort:  p.port,
+		},
+		sentAt: time.Now(),
+	}
+
+	return sent, p.conn.SendSYN(&net.TCPAddr{IP: p.dest, Port: p.port})
+}
+
+// readDirect waits for the SYN-ACK or RST with which the destination answers a SYN.
+func (p *tcpProber) readDirect(ctx context.Context, probe sentProbe) *reply {
+	addr := &net.TCPAddr{IP: p.dest, Port: p.port}
+
+	if _, err := p.conn.ReadResponseWithContext(ctx, addr); err != nil {
+		return nil
+	}
+
+	return &reply{from: p.dest, receivedAt: time.Now(), reached: true, ttl: -1, icmpType: -1,
+		icmpCode: -1}
+}
+
+func (p *tcpProber) Close() error {
+	return p.conn.Close()
+}
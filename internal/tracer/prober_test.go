@@ -0,0 +1,381 @@
+package tracer
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func TestNextIPID(t *testing.T) {
+	saved := atomic.LoadUint32(&ipIDs)
+	defer atomic.StoreUint32(&ipIDs, saved)
+
+	atomic.StoreUint32(&ipIDs, 0xfffd)
+	assert.Equal(t, 0xfffe, nextIPID())
+	assert.Equal(t, 0xffff, nextIPID())
+	assert.Equal(t, 1, nextIPID(), "zero lets the kernel pick the ID")
+}
+
+func TestNextEchoSeq(t *testing.T) {
+	saved := atomic.LoadUint32(&echoSeq)
+	defer atomic.StoreUint32(&echoSeq, saved)
+
+	atomic.StoreUint32(&echoSeq, 0xfffd)
+	assert.Equal(t, 0xfffe, nextEchoSeq())
+	last := nextEchoSeq()
+	assert.Equal(t, 0xffff, last)
+	first := nextEchoSeq()
+	assert.Equal(t, 1, first, "zero would match any Echo probe")
+
+	probe := sentProbe{
+		dst: net.IPv4(192, 0, 2, 1),
+		key: network.ProbeKey{Protocol: protocolICMP, EchoID: 7, EchoSeq: last},
+	}
+	wrapped := network.ProbeKey{Protocol: protocolICMP, EchoID: 7, EchoSeq: first}
+	assert.False(t, probe.matches(probe.dst, &wrapped))
+}
+
+func TestPortSequence(t *testing.T) {
+	s := portSequence{base: DefaultPort, probesPerHop: 3}
+
+	assert.Equal(t, 33434, s.port(1, 0))
+	assert.Equal(t, 33436, s.port(1, 2))
+	assert.Equal(t, 33437, s.port(2, 0))
+	assert.Equal(t, 33434+29*3+2, s.port(30, 2))
+
+	for ttl := 1; ttl <= 30; ttl++ {
+		for attempt := 0; attempt < 3; attempt++ {
+			gotTTL, gotAttempt, ok := s.probe(s.port(ttl, attempt))
+			assert.True(t, ok)
+			assert.Equal(t, ttl, gotTTL)
+			assert.Equal(t, attempt, gotAttempt)
+		}
+	}
+
+	_, _, ok := s.probe(33433)
+	assert.False(t, ok)
+}
+
+func TestPortSequenceCheck(t *testing.T) {
+	assert.NoError(t, portSequence{base: DefaultPort, probesPerHop: 3}.check(30))
+	assert.NoError(t, portSequence{base: 65535 - 89, probesPerHop: 3}.check(30))
+
+	// Ports never wrap around to 0, which would make quoted ports ambiguous.
+	assert.Error(t, portSequence{base: 65535 - 88, probesPerHop: 3}.check(30))
+	assert.Error(t, portSequence{base: 0, probesPerHop: 3}.check(30))
+}
+
+func TestUDPProberBasePort(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+	var opts Options
+	WithBasePort(40000)(&opts)
+	opts = opts.withDefaults()
+
+	p, err := newProber(UDP, network.IPv4, nil, dest, opts)
+	require.NoError(t, err)
+	defer p.Close()
+
+	first, err := p.send(1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 40000, first.key.DstPort)
+
+	sent, err := p.send(2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 40000+opts.ProbesPerHop+1, sent.key.DstPort)
+}
+
+func TestUDPProberVarySrcPort(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+	opts := Options{Port: 53, Vary: VarySrcPort}.withDefaults()
+
+	p, err := newProber(UDP, network.IPv4, nil, dest, opts)
+	require.NoError(t, err)
+	defer p.Close()
+
+	srcPorts := make(map[int]bool)
+	for attempt := 0; attempt < 3; attempt++ {
+		sent, err := p.send(1, attempt)
+		require.NoError(t, err)
+
+		assert.Equal(t, 53, sent.key.DstPort)
+		assert.Nil(t, sent.ports)
+		srcPorts[sent.key.SrcPort] = true
+	}
+	assert.Len(t, srcPorts, 3, "every probe has a source port of its own")
+}
+
+func TestUDPProberSendSetTTLFailure(t *testing.T) {
+	p, err := newProber(UDP, network.IPv4, nil, net.IPv4(127, 0, 0, 1), Options{}.withDefaults())
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	// The probe is not sent with whatever TTL the socket had before.
+	_, err = p.send(1, 0)
+	assert.ErrorContains(t, err, "failed to set TTL")
+}
+
+func TestUDPProberParisKeepsFlow(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+	opts := Options{Paris: true, FlowID: 3}.withDefaults()
+
+	p, err := newProber(UDP, network.IPv4, nil, dest, opts)
+	require.NoError(t, err)
+	defer p.Close()
+
+	first, err := p.send(1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultPort+3, first.key.DstPort)
+
+	checksums := map[int]bool{first.key.Checksum: true}
+	for ttl := 1; ttl <= 3; ttl++ {
+		for attempt := 1; attempt < opts.ProbesPerHop; attempt++ {
+			sent, err := p.send(ttl, attempt)
+			require.NoError(t, err)
+
+			// Load balancers hash on the addresses and ports, which never change.
+			assert.True(t, sent.dst.Equal(first.dst))
+			assert.Equal(t, first.key.SrcPort, sent.key.SrcPort)
+			assert.Equal(t, first.key.DstPort, sent.key.DstPort)
+			checksums[sent.key.Checksum] = true
+		}
+	}
+	assert.Len(t, checksums, 7, "every probe has a checksum of its own")
+	assert.NotContains(t, checksums, 0)
+}
+
+var (
+	_ Prober        = (*network.UDPConn)(nil)
+	_ Receiver      = (*network.ICMPConn)(nil)
+	_ messageReader = (*network.ICMPConn)(nil)
+)
+
+type MockReader struct {
+	mock.Mock
+}
+
+func (m *MockReader) Family() network.Family {
+	return network.IPv4
+}
+
+func (m *MockReader) ReadMessage(ctx context.Context) (*network.Message, error) {
+	args := m.Called(ctx)
+	if read, ok := args.Get(0).(func(context.Context) (*network.Message, error)); ok {
+		return read(ctx)
+	}
+	msg, _ := args.Get(0).(*network.Message)
+	return msg, args.Error(1)
+}
+
+func (m *MockReader) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func TestTapReceiver(t *testing.T) {
+	peer := net.IPv4(192, 0, 2, 1)
+	garbage := &network.Message{Peer: peer, Data: []byte{11, 0}, TTL: -1}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(garbage, nil).Once()
+	receiver.On("ReadMessage", mock.Anything).Return(nil, network.ErrReadTimeout).Once()
+
+	var tapped [][]byte
+	r := &tapReader{messageReader: receiver, tap: func(ip net.IP, data []byte) {
+		assert.True(t, ip.Equal(peer))
+		tapped = append(tapped, data)
+	}}
+
+	msg, err := r.ReadMessage(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, garbage, msg)
+
+	_, err = r.ReadMessage(context.Background())
+	assert.ErrorIs(t, err, network.ErrReadTimeout)
+
+	assert.Equal(t, [][]byte{{11, 0}}, tapped, "messages are tapped even if they do not parse")
+}
+
+func TestEchoFilter(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	reply := func(id int) *network.Message {
+		msg := icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: id, Seq: 1}}
+		data, err := msg.Marshal(nil)
+		require.NoError(t, err)
+		return &network.Message{Peer: dest, Data: data, TTL: -1}
+	}
+
+	receiver := new(MockReader)
+	receiver.On("Family").Return(network.IPv4)
+	receiver.On("ReadMessage", mock.Anything).Return(reply(0x4321), nil).Once()
+	receiver.On("ReadMessage", mock.Anything).Return(reply(0x1234), nil).Once()
+
+	r := &echoFilter{messageReader: receiver, id: 0x1234}
+
+	_, _, err := r.readParsed(context.Background())
+	assert.ErrorIs(t, err, network.ErrForeignEcho)
+	assert.Equal(t, network.Ignore, network.Classify(err))
+
+	_, parsed, err := r.readParsed(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0x1234, parsed.Echo.ID)
+}
+
+// fakeProber records the TTLs of the classic UDP probes it pretends to send.
+type fakeProber struct {
+	dest net.IP
+	sent chan int
+}
+
+func (p *fakeProber) send(ttl, attempt int) (sentProbe, error) {
+	p.sent <- ttl
+	return sentProbe{
+		dst: p.dest,
+		key: network.ProbeKey{
+			Protocol: protocolUDP,
+			SrcPort:  50000,
+			DstPort:  DefaultPort + ttl - 1,
+		},
+		sentAt: time.Now(),
+	}, nil
+}
+
+func (p *fakeProber) Close() error {
+	return nil
+}
+
+// slotProber sends the probes of a single TTL, each attempt to a port of its own, and
+// reports the attempts sent on sent.
+type slotProber struct {
+	dest net.IP
+	sent chan int
+}
+
+func (p *slotProber) send(_, attempt int) (sentProbe, error) {
+	p.sent <- attempt
+	return sentProbe{
+		dst: p.dest,
+		key: network.ProbeKey{
+			Protocol: protocolUDP,
+			SrcPort:  50000,
+			DstPort:  DefaultPort + attempt,
+		},
+		sentAt: time.Now(),
+	}, nil
+}
+
+func (p *slotProber) Close() error {
+	return nil
+}
+
+// answerAttempts returns a ReadMessage implementation answering the attempts sent by p
+// for which answer returns true with the Port Unreachable of dest, and ignoring the others.
+func answerAttempts(
+	t *testing.T,
+	p *slotProber,
+	answer func(attempt int) bool,
+) func(context.Context) (*network.Message, error) {
+	return func(ctx context.Context) (*network.Message, error) {
+		for {
+			select {
+			case attempt := <-p.sent:
+				if !answer(attempt) {
+					continue
+				}
+				return &network.Message{
+					Peer: p.dest,
+					Data: quotingMessage(t, p.dest, ipv4.ICMPTypeDestinationUnreachable, 3,
+						attempt+1),
+					TTL:        -1,
+					ReceivedAt: time.Now(),
+				}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// quotingMessage returns an ICMP error of the given type and code quoting the probe sent
+// with ttl by fakeProber.
+func quotingMessage(t *testing.T, dest net.IP, typ icmp.Type, code, ttl int) []byte {
+	t.Helper()
+
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + udpHeaderLen,
+		TTL:      1,
+		Protocol: protocolUDP,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      dest,
+	}
+	quoted, err := header.Marshal()
+	require.NoError(t, err)
+	quoted = append(quoted, 0xc3, 0x50, 0, 0, 0, udpHeaderLen, 0, 0)
+	binary.BigEndian.PutUint16(quoted[ipv4.HeaderLen+2:], uint16(DefaultPort+ttl-1))
+
+	var body icmp.MessageBody = &icmp.TimeExceeded{Data: quoted}
+	if typ == ipv4.ICMPTypeDestinationUnreachable {
+		body = &icmp.DstUnreach{Data: quoted}
+	}
+	data, err := (&icmp.Message{Type: typ, Code: code, Body: body}).Marshal(nil)
+	require.NoError(t, err)
+	return data
+}
+
+func TestTraceRunMockedReceiver(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	router := net.IPv4(192, 0, 2, 1)
+	p := &fakeProber{dest: dest, sent: make(chan int, 1)}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			var ttl int
+			select {
+			case ttl = <-p.sent:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+
+			msg := &network.Message{TTL: -1, ReceivedAt: time.Now()}
+			switch ttl {
+			case 1:
+				msg.Peer = router
+				msg.Data = quotingMessage(t, dest, ipv4.ICMPTypeTimeExceeded, 0, ttl)
+			case 2:
+				// The second hop does not answer.
+				<-ctx.Done()
+				return nil, ctx.Err()
+			default:
+				msg.Peer = dest
+				msg.Data = quotingMessage(t, dest, ipv4.ICMPTypeDestinationUnreachable, 3, ttl)
+			}
+			return msg, nil
+		})
+	receiver.On("Close").Return(nil)
+
+	opts := Options{MaxHops: 5, Timeout: 50 * time.Millisecond, ProbesPerHop: 1}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+
+	require.Len(t, hops, 3)
+	assert.True(t, hops[0].IP.Equal(router))
+	assert.False(t, hops[1].Responded())
+	assert.True(t, hops[2].IP.Equal(dest))
+	assert.Empty(t, hops[2].Annotations)
+}
@@ -0,0 +1,86 @@
+package tracer
+
+import (
+	"sync"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// replyLog tracks the replies to the probes of a single hop, to count the replies that are
+// duplicated or arrive out of order.
+//
+// The key of every probe is unique within its trace, be it a UDP port or checksum or an
+// Echo sequence number, so the probe a reply quotes gives its position in the sequence of
+// probes of the hop. TCP probes share their key and are not tracked.
+//
+// It is safe for concurrent use.
+type replyLog struct {
+	mu       sync.Mutex
+	sent     []*sentProbe
+	answered []bool
+	// latest is the highest attempt answered so far, or -1 if none was.
+	latest     int
+	duplicates int
+	reordered  int
+}
+
+func newReplyLog(probesPerHop int) *replyLog {
+	return &replyLog{
+		sent:     make([]*sentProbe, probesPerHop),
+		answered: make([]bool, probesPerHop),
+		latest:   -1,
+	}
+}
+
+// add records that the attempt-th probe of the hop was sent.
+func (l *replyLog) add(attempt int, sent sentProbe) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sent[attempt] = &sent
+}
+
+// answer records a reply to the attempt-th probe of the hop.
+func (l *replyLog) answer(attempt int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.answerLocked(attempt)
+}
+
+func (l *replyLog) answerLocked(attempt int) {
+	switch {
+	case l.answered[attempt]:
+		l.duplicates++
+	case attempt < l.latest:
+		l.answered[attempt] = true
+		l.reordered++
+	default:
+		l.answered[attempt] = true
+		l.latest = attempt
+	}
+}
+
+// observe records msg as a reply to the probe of the hop it quotes, if any, and reports
+// whether there is one. It is given the messages that did not answer the probe they were
+// read for: duplicates and replies arriving after their probe timed out.
+func (l *replyLog) observe(msg *network.Message, parsed *network.ParsedICMP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for attempt, sent := range l.sent {
+		if sent != nil && sent.replyFrom(msg, parsed) != nil {
+			l.answerLocked(attempt)
+			return true
+		}
+	}
+	return false
+}
+
+// counts returns the number of duplicated and reordered replies seen so far.
+func (l *replyLog) counts() (duplicates, reordered int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.duplicates, l.reordered
+}
@@ -0,0 +1,43 @@
+package tracer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func TestReplyLogAnswer(t *testing.T) {
+	log := newReplyLog(3)
+
+	log.answer(1)
+	log.answer(0)
+	log.answer(1)
+	log.answer(2)
+
+	duplicates, reordered := log.counts()
+	assert.Equal(t, 1, duplicates)
+	assert.Equal(t, 1, reordered)
+}
+
+func TestReplyLogObserve(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	log := newReplyLog(2)
+	for attempt := 0; attempt < 2; attempt++ {
+		key := network.ProbeKey{Protocol: protocolUDP, SrcPort: 50000, DstPort: 33434 + attempt}
+		log.add(attempt, sentProbe{dst: dst, key: key, sentAt: time.Now()})
+	}
+
+	// The first probe timed out and its reply shows up while waiting for the second one.
+	log.answer(1)
+	assert.True(t, log.observe(timeExceeded(t, dst, 33434)))
+	assert.True(t, log.observe(timeExceeded(t, dst, 33435)))
+	assert.False(t, log.observe(timeExceeded(t, dst, 33999)))
+
+	duplicates, reordered := log.counts()
+	assert.Equal(t, 1, duplicates)
+	assert.Equal(t, 1, reordered)
+}
@@ -0,0 +1,406 @@
+package tracer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// Result is the outcome of a trace to a host.
+type Result struct {
+	// Target is the host traced.
+	Target *network.Target
+	// Resolved is the address the host resolved to.
+	Resolved net.IP
+	// Hops holds one Hop per probed TTL, in order.
+	Hops []Hop
+	// Reached reports whether the destination answered a probe of the last hop.
+	Reached bool
+	// Unresponsive reports whether the trace gave up after Options.MaxUnresponsiveHops.
+	Unresponsive bool
+	// Duration is the time the trace took.
+	Duration time.Duration
+}
+
+// Trace resolves host, a name or a literal address, according to opts.Preference, with
+// opts.DNSResolver if set, and traces the route to it like Run.
+//
+// If the trace ends early with an error, including ctx.Err() if ctx is cancelled, the hops
+// completed so far are returned in the Result along with the error. The Result is nil only
+// when host does not resolve or the sockets cannot be opened.
+func (t *Tracer) Trace(ctx context.Context, host string, opts Options) (*Result, error) {
+	target, err := network.ResolveTargetWith(host, opts.Preference, opts.DNSResolver)
+	if err != nil {
+		return nil, err
+	}
+	return t.traceTarget(ctx, target, opts)
+}
+
+// TraceHost traces the route to host like Trace, with the options the Tracer was created
+// with; see New.
+func (t *Tracer) TraceHost(ctx context.Context, host string) (*Result, error) {
+	return t.Trace(ctx, host, t.opts)
+}
+
+// traceTarget traces the route to a resolved target like Trace.
+func (t *Tracer) traceTarget(
+	ctx context.Context,
+	target *network.Target,
+	opts Options,
+) (*Result, error) {
+	start := time.Now()
+	tr, err := t.start(target.IP, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.close()
+
+	result := &Result{Target: target, Resolved: target.IP}
+	err = tr.run(ctx, func(hop Hop) { result.Hops = append(result.Hops, hop) })
+	result.Duration = time.Since(start)
+	result.Reached = reached(result.Hops, target)
+	result.Unresponsive = tr.unresponsive
+	return result, err
+}
+
+// reached reports whether the destination answered a probe of the last hop.
+func reached(hops []Hop, target *network.Target) bool {
+	if len(hops) == 0 {
+		return false
+	}
+	for _, r := range hops[len(hops)-1].Responders {
+		if r.IP.Equal(target.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonResult is the JSON schema of a Result, see Result.MarshalJSON.
+type jsonResult struct {
+	Host         string          `json:"host,omitempty"`
+	Address      string          `json:"address,omitempty"`
+	Candidates   []string        `json:"candidates,omitempty"`
+	Reached      bool            `json:"reached"`
+	Unresponsive bool            `json:"unresponsive,omitempty"`
+	Duration     float64         `json:"duration_ms"`
+	Hops         []jsonResultHop `json:"hops"`
+}
+
+// jsonResultHop is the JSON schema of a Hop of a Result. It only holds what the probes of
+// the hop do not tell; the rest is derived from them again when decoding.
+type jsonResultHop struct {
+	Hop        int         `json:"hop"`
+	Probes     []jsonProbe `json:"probes"`
+	Hostname   string      `json:"hostname,omitempty"`
+	ASN        int         `json:"asn,omitempty"`
+	ASNLookup  bool        `json:"asn_lookup,omitempty"`
+	Prefix     string      `json:"prefix,omitempty"`
+	Country    string      `json:"country,omitempty"`
+	City       string      `json:"city,omitempty"`
+	Lat        float64     `json:"lat,omitempty"`
+	Lon        float64     `json:"lon,omitempty"`
+	ECNSent    string      `json:"ecn_sent,omitempty"`
+	MTU        int         `json:"mtu,omitempty"`
+	Duplicates int         `json:"duplicates,omitempty"`
+	Reordered  int         `json:"reordered,omitempty"`
+	Loop       bool        `json:"loop,omitempty"`
+}
+
+// jsonProbe is the JSON schema of a Probe. Unknown values, -1 in a Probe, are omitted.
+type jsonProbe struct {
+	Address     string          `json:"address,omitempty"`
+	SentAt      *time.Time      `json:"sent_at,omitempty"`
+	RTT         *float64        `json:"rtt_ms"`
+	ReplyTTL    *int            `json:"reply_ttl,omitempty"`
+	ICMPType    *int            `json:"icmp_type,omitempty"`
+	ICMPCode    *int            `json:"icmp_code,omitempty"`
+	QuotedTTL   *int            `json:"quoted_ttl,omitempty"`
+	Annotation  string          `json:"annotation,omitempty"`
+	MTU         int             `json:"mtu,omitempty"`
+	ECNQuoted   *string         `json:"ecn_quoted,omitempty"`
+	MPLS        []jsonMPLSLabel `json:"mpls,omitempty"`
+	Interface   *jsonInterface  `json:"interface,omitempty"`
+	NATDetected bool            `json:"nat_detected,omitempty"`
+	Retries     int             `json:"retries,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// jsonInterface is the JSON schema of a network.InterfaceInfo.
+type jsonInterface struct {
+	Role    int    `json:"role"`
+	Index   int    `json:"index,omitempty"`
+	Name    string `json:"name,omitempty"`
+	MTU     int    `json:"mtu,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// MarshalJSON encodes the result with every probe of every hop, so that UnmarshalJSON
+// restores it, e.g. to compare it with a later trace. Durations are given in milliseconds,
+// and values that are unknown or unset are omitted, except the RTT of a lost probe, which
+// is null. Hop.Err is not encoded.
+//
+// Unlike FormatJSON, the statistics of the hops are left out, since they follow from
+// their probes.
+func (r *Result) MarshalJSON() ([]byte, error) {
+	out := jsonResult{
+		Reached:      r.Reached,
+		Unresponsive: r.Unresponsive,
+		Duration:     float64(r.Duration) / float64(time.Millisecond),
+		Hops:         make([]jsonResultHop, 0, len(r.Hops)),
+	}
+	out.Address = ipString(r.Resolved)
+	if r.Target != nil {
+		out.Host = r.Target.Host
+		for _, ip := range r.Target.Candidates {
+			out.Candidates = append(out.Candidates, ip.String())
+		}
+	}
+
+	for _, hop := range r.Hops {
+		h := jsonResultHop{
+			Hop:        hop.TTL,
+			Probes:     make([]jsonProbe, 0, len(hop.Probes)),
+			Hostname:   hop.Host,
+			ASN:        hop.ASN,
+			ASNLookup:  hop.OriginLookedUp,
+			Country:    hop.Country,
+			City:       hop.City,
+			Lat:        hop.Lat,
+			Lon:        hop.Lon,
+			MTU:        hop.MTU,
+			Duplicates: hop.Duplicates,
+			Reordered:  hop.Reordered,
+			Loop:       hop.Loop,
+		}
+		if hop.Prefix != nil {
+			h.Prefix = hop.Prefix.String()
+		}
+		if hop.SentECN != network.NotECT {
+			h.ECNSent = hop.SentECN.String()
+		}
+		for _, p := range hop.Probes {
+			h.Probes = append(h.Probes, encodeProbe(p))
+		}
+		out.Hops = append(out.Hops, h)
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode result as JSON: %w", err)
+	}
+	return data, nil
+}
+
+// encodeProbe returns the JSON schema of p.
+func encodeProbe(p Probe) jsonProbe {
+	out := jsonProbe{
+		Address:     ipString(p.Responder),
+		RTT:         milliseconds(p.RTT),
+		ReplyTTL:    known(p.ReplyTTL),
+		ICMPType:    known(p.ICMPType),
+		ICMPCode:    known(p.ICMPCode),
+		QuotedTTL:   known(p.QuotedTTL),
+		Annotation:  p.Annotation,
+		MTU:         p.MTU,
+		NATDetected: p.NATDetected,
+		Retries:     p.Retries,
+	}
+	if p.Err != nil {
+		out.Error = p.Err.Error()
+	}
+	if !p.SentAt.IsZero() {
+		sentAt := p.SentAt
+		out.SentAt = &sentAt
+	}
+	if p.QuotedECN != UnknownECN {
+		ecn := p.QuotedECN.String()
+		out.ECNQuoted = &ecn
+	}
+	for _, l := range p.MPLS {
+		out.MPLS = append(out.MPLS, jsonMPLSLabel{Label: l.Label, TC: l.TC, S: l.S, TTL: l.TTL})
+	}
+	if i := p.Interface; i != nil {
+		out.Interface = &jsonInterface{Role: int(i.Role), Index: i.Index, Name: i.Name,
+			MTU: i.MTU, Address: ipString(i.IP)}
+	}
+	return out
+}
+
+// UnmarshalJSON decodes a result encoded by MarshalJSON, deriving the summary of every hop
+// from its probes again.
+func (r *Result) UnmarshalJSON(data []byte) error {
+	var in jsonResult
+	if err := json.Unmarshal(data, &in); err != nil {
+		return fmt.Errorf("failed to decode result from JSON: %w", err)
+	}
+
+	out := Result{
+		Reached:      in.Reached,
+		Unresponsive: in.Unresponsive,
+		Duration:     fromMilliseconds(in.Duration),
+	}
+	var err error
+	if out.Resolved, err = parseIP(in.Address); err != nil {
+		return err
+	}
+	if in.Host != "" || in.Address != "" {
+		out.Target = &network.Target{Host: in.Host, IP: out.Resolved}
+		for _, s := range in.Candidates {
+			ip, err := parseIP(s)
+			if err != nil {
+				return err
+			}
+			out.Target.Candidates = append(out.Target.Candidates, ip)
+		}
+	}
+
+	for _, h := range in.Hops {
+		hop, err := decodeHop(h)
+		if err != nil {
+			return err
+		}
+		out.Hops = append(out.Hops, hop)
+	}
+
+	*r = out
+	return nil
+}
+
+// decodeHop rebuilds a hop from its JSON schema.
+func decodeHop(in jsonResultHop) (Hop, error) {
+	hop := Hop{TTL: in.Hop}
+	if in.ECNSent != "" {
+		ecn, err := parseECN(in.ECNSent)
+		if err != nil {
+			return Hop{}, err
+		}
+		hop.SentECN = ecn
+	}
+
+	for _, p := range in.Probes {
+		probe, err := decodeProbe(p)
+		if err != nil {
+			return Hop{}, err
+		}
+		hop.add(probe)
+	}
+	hop.summarize()
+
+	hop.Host, hop.ASN, hop.OriginLookedUp = in.Hostname, in.ASN, in.ASNLookup
+	hop.Country, hop.City, hop.Lat, hop.Lon = in.Country, in.City, in.Lat, in.Lon
+	hop.MTU, hop.Loop = in.MTU, in.Loop
+	hop.Duplicates, hop.Reordered = in.Duplicates, in.Reordered
+	if in.Prefix != "" {
+		_, prefix, err := net.ParseCIDR(in.Prefix)
+		if err != nil {
+			return Hop{}, fmt.Errorf("invalid prefix %q: %w", in.Prefix, err)
+		}
+		hop.Prefix = prefix
+	}
+	return hop, nil
+}
+
+// decodeProbe rebuilds a probe from its JSON schema.
+func decodeProbe(in jsonProbe) (Probe, error) {
+	probe := Probe{
+		RTT:         NoRTT,
+		ReplyTTL:    unknown(in.ReplyTTL),
+		ICMPType:    unknown(in.ICMPType),
+		ICMPCode:    unknown(in.ICMPCode),
+		QuotedTTL:   unknown(in.QuotedTTL),
+		Annotation:  in.Annotation,
+		MTU:         in.MTU,
+		QuotedECN:   UnknownECN,
+		NATDetected: in.NATDetected,
+		Retries:     in.Retries,
+	}
+	if in.Error != "" {
+		probe.Err = errors.New(in.Error)
+	}
+
+	var err error
+	if probe.Responder, err = parseIP(in.Address); err != nil {
+		return Probe{}, err
+	}
+	if in.SentAt != nil {
+		probe.SentAt = *in.SentAt
+	}
+	if in.RTT != nil {
+		probe.RTT = fromMilliseconds(*in.RTT)
+	}
+	if in.ECNQuoted != nil {
+		if probe.QuotedECN, err = parseECN(*in.ECNQuoted); err != nil {
+			return Probe{}, err
+		}
+	}
+	for _, l := range in.MPLS {
+		probe.MPLS = append(probe.MPLS, network.MPLSLabel{Label: l.Label, TC: l.TC, S: l.S,
+			TTL: l.TTL})
+	}
+	if i := in.Interface; i != nil {
+		probe.Interface = &network.InterfaceInfo{Role: network.InterfaceRole(i.Role),
+			Index: i.Index, Name: i.Name, MTU: i.MTU}
+		if probe.Interface.IP, err = parseIP(i.Address); err != nil {
+			return Probe{}, err
+		}
+	}
+	return probe, nil
+}
+
+// known returns v, or nil if it is negative, meaning unknown.
+func known(v int) *int {
+	if v < 0 {
+		return nil
+	}
+	return &v
+}
+
+// unknown returns *v, or -1 if v is nil.
+func unknown(v *int) int {
+	if v == nil {
+		return -1
+	}
+	return *v
+}
+
+// fromMilliseconds converts fractional milliseconds back to a duration.
+func fromMilliseconds(ms float64) time.Duration {
+	return time.Duration(math.Round(ms * float64(time.Millisecond)))
+}
+
+// ipString formats ip, or returns an empty string if it is nil.
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// parseIP parses an address formatted by ipString.
+func parseIP(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	return ip, nil
+}
+
+// parseECN parses the name of an ECN codepoint, as returned by network.ECN.String.
+func parseECN(s string) (network.ECN, error) {
+	for _, ecn := range []network.ECN{network.NotECT, network.ECT1, network.ECT0, network.CE} {
+		if ecn.String() == s {
+			return ecn, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid ECN codepoint %q", s)
+}
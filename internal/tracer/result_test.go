@@ -0,0 +1,259 @@
+package tracer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func TestTracerTraceLoopback(t *testing.T) {
+	result, err := New().Trace(context.Background(), "127.0.0.1", Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+	})
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", result.Target.Host)
+	assert.True(t, result.Target.IP.Equal(net.IPv4(127, 0, 0, 1)))
+	assert.True(t, result.Resolved.Equal(net.IPv4(127, 0, 0, 1)))
+	require.Len(t, result.Hops, 1)
+	assert.True(t, result.Hops[0].IP.Equal(result.Target.IP))
+	assert.True(t, result.Reached)
+	assert.Positive(t, result.Duration)
+
+	probe := result.Hops[0].Probes[0]
+	assert.False(t, probe.SentAt.IsZero())
+	assert.Equal(t, 3, probe.ICMPType, "Destination Unreachable")
+	assert.Equal(t, 3, probe.ICMPCode, "port unreachable")
+}
+
+func TestTracerTraceUnresolvable(t *testing.T) {
+	result, err := New().Trace(context.Background(), "127.0.0.1", Options{
+		Preference: network.ForceIPv6,
+	})
+
+	var noAddr *network.NoAddressError
+	assert.ErrorAs(t, err, &noAddr)
+	assert.Nil(t, result)
+}
+
+func TestTracerTraceCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	result, err := New().Trace(ctx, "192.0.2.254", Options{
+		Timeout:      50 * time.Millisecond,
+		ProbesPerHop: 1,
+	})
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotNil(t, result)
+	assert.NotEmpty(t, result.Hops)
+	assert.False(t, result.Reached)
+}
+
+func TestReached(t *testing.T) {
+	target := &network.Target{Host: "example.com", IP: net.IPv4(198, 51, 100, 7)}
+	router := net.IPv4(192, 0, 2, 1)
+
+	assert.False(t, reached(nil, target))
+	assert.False(t, reached([]Hop{{Responders: []Responder{{IP: router}}}}, target))
+	assert.True(t, reached([]Hop{
+		{Responders: []Responder{{IP: router}}},
+		{Responders: []Responder{{IP: router}, {IP: target.IP}}},
+	}, target))
+	assert.False(t, reached([]Hop{{Responders: []Responder{{IP: target.IP}}}, {}}, target))
+}
+
+// sampleResult returns a result with every field of its hops and probes set somewhere,
+// built the way a trace builds it.
+func sampleResult() *Result {
+	sentAt := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+
+	first := Hop{TTL: 1, SentECN: network.ECT0}
+	first.add(Probe{
+		Responder: net.IPv4(192, 0, 2, 1),
+		SentAt:    sentAt,
+		RTT:       1500 * time.Microsecond,
+		ReplyTTL:  254,
+		ICMPType:  11,
+		ICMPCode:  0,
+		QuotedTTL: 1,
+		QuotedECN: network.NotECT,
+		MPLS:      []network.MPLSLabel{{Label: 24015, TC: 5, S: true, TTL: 1}},
+		Interface: &network.InterfaceInfo{Role: network.IncomingInterface, Index: 3,
+			Name: "ge-0/0/1", MTU: 1500, IP: net.IPv4(192, 0, 2, 1)},
+		NATDetected: true,
+		Retries:     1,
+	})
+	lost := lostProbe()
+	lost.SentAt = sentAt.Add(time.Second)
+	first.add(lost)
+	first.add(Probe{
+		Responder: net.ParseIP("2001:db8::1"),
+		RTT:       2*time.Millisecond + 7,
+		ReplyTTL:  -1,
+		ICMPType:  -1,
+		ICMPCode:  -1,
+		QuotedTTL: -1,
+		QuotedECN: UnknownECN,
+	})
+	first.summarize()
+	first.Host, first.ASN, first.OriginLookedUp = "gw.example.net", 64496, true
+	_, first.Prefix, _ = net.ParseCIDR("192.0.2.0/24")
+	first.Country, first.City, first.Lat, first.Lon = "NL", "Amsterdam", 52.37, 4.89
+	first.Duplicates, first.Reordered = 1, 2
+
+	second := Hop{TTL: 2}
+	second.add(lostProbe())
+	failed := lostProbe()
+	failed.Err = errors.New("sendto: network is unreachable")
+	second.add(failed)
+	second.summarize()
+
+	third := Hop{TTL: 3}
+	third.add(Probe{Responder: net.IPv4(198, 51, 100, 7), RTT: 3 * time.Millisecond, ReplyTTL: 0,
+		ICMPType: 3, ICMPCode: 3, QuotedTTL: 0, Annotation: "!F", MTU: 1400})
+	third.summarize()
+	third.MTU, third.Loop = 1280, true
+
+	return &Result{
+		Target: &network.Target{Host: "example.com", IP: net.IPv4(198, 51, 100, 7),
+			Candidates: []net.IP{net.IPv4(198, 51, 100, 7), net.ParseIP("2001:db8::7")}},
+		Resolved:     net.IPv4(198, 51, 100, 7),
+		Hops:         []Hop{first, second, third},
+		Reached:      true,
+		Unresponsive: true,
+		Duration:     1234567 * time.Microsecond,
+	}
+}
+
+func TestTracerTraceHostLoopback(t *testing.T) {
+	tr := New(WithMaxTTL(3), WithProbesPerHop(2), WithTimeout(time.Second),
+		WithProtocol(ICMP))
+
+	result, err := tr.TraceHost(context.Background(), "127.0.0.1")
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, result.Hops, 1)
+	assert.True(t, result.Reached)
+	assert.Len(t, result.Hops[0].Probes, 2)
+	assert.Equal(t, 0, result.Hops[0].Probes[0].ICMPType, "Echo Reply")
+}
+
+func TestTracerTraceDNSResolver(t *testing.T) {
+	dns := &stubDNSResolver{
+		addrs: map[string][]string{"intranet.example.com": {"127.0.0.1"}},
+		names: map[string][]string{"127.0.0.1": {"intranet.example.com."}},
+	}
+
+	result, err := New().Trace(context.Background(), "intranet.example.com", Options{
+		MaxHops:      3,
+		Timeout:      time.Second,
+		ProbesPerHop: 1,
+		ResolveNames: true,
+		DNSResolver:  dns,
+	})
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	assert.True(t, result.Target.IP.Equal(net.IPv4(127, 0, 0, 1)))
+	require.Len(t, result.Hops, 1)
+	assert.Equal(t, "intranet.example.com", result.Hops[0].Host)
+
+	_, err = New().Trace(context.Background(), "missing.example.com", Options{DNSResolver: dns})
+	assert.ErrorContains(t, err, "no such host")
+}
+
+func TestResultJSONRoundTrip(t *testing.T) {
+	result := sampleResult()
+
+	data, err := json.Marshal(result)
+	require.NoError(t, err)
+
+	var decoded Result
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, result, &decoded)
+
+	// Encoding is stable.
+	again, err := json.Marshal(&decoded)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(data), string(again))
+}
+
+func TestResultJSONZeroValue(t *testing.T) {
+	data, err := json.Marshal(&Result{})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"reached": false, "duration_ms": 0, "hops": []}`, string(data))
+
+	var decoded Result
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, Result{}, decoded)
+}
+
+func TestResultJSONOmitsUnknown(t *testing.T) {
+	data, err := json.Marshal(sampleResult())
+	require.NoError(t, err)
+
+	var doc struct {
+		Hops []struct {
+			Probes []map[string]any `json:"probes"`
+		} `json:"hops"`
+	}
+	require.NoError(t, json.Unmarshal(data, &doc))
+	require.Len(t, doc.Hops, 3)
+
+	assert.Equal(t, map[string]any{"rtt_ms": nil}, doc.Hops[1].Probes[0],
+		"a lost probe only has a null RTT")
+	assert.Equal(t, map[string]any{"rtt_ms": nil, "error": "sendto: network is unreachable"},
+		doc.Hops[1].Probes[1])
+	assert.Equal(t, map[string]any{"address": "2001:db8::1", "rtt_ms": 2.000007},
+		doc.Hops[0].Probes[2], "unknown TTLs, ICMP type and ECN are omitted")
+	assert.Equal(t, map[string]any{
+		"address":    "198.51.100.7",
+		"rtt_ms":     3.0,
+		"reply_ttl":  0.0,
+		"icmp_type":  3.0,
+		"icmp_code":  3.0,
+		"quoted_ttl": 0.0,
+		"annotation": "!F",
+		"mtu":        1400.0,
+		"ecn_quoted": "Not-ECT",
+	}, doc.Hops[2].Probes[0], "known zero values are kept")
+}
+
+func TestResultUnmarshalJSONInvalid(t *testing.T) {
+	for _, data := range []string{
+		`[]`,
+		`{"address": "nowhere"}`,
+		`{"host": "example.com", "candidates": ["nowhere"]}`,
+		`{"hops": [{"hop": 1, "probes": [{"address": "nowhere"}]}]}`,
+		`{"hops": [{"hop": 1, "probes": [{"interface": {"address": "nowhere"}}]}]}`,
+		`{"hops": [{"hop": 1, "probes": [{"ecn_quoted": "ECT(2)"}]}]}`,
+		`{"hops": [{"hop": 1, "probes": [], "ecn_sent": "ECT(2)"}]}`,
+		`{"hops": [{"hop": 1, "probes": [], "prefix": "192.0.2.0"}]}`,
+	} {
+		var result Result
+		assert.Error(t, json.Unmarshal([]byte(data), &result), data)
+	}
+}
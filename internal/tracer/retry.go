@@ -0,0 +1,40 @@
+package tracer
+
+import (
+	"context"
+	"time"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// sendRetry retries probes that fail to send for a transient reason. The zero value sends
+// every probe once.
+type sendRetry struct {
+	// retries is the number of times a probe is sent again.
+	retries int
+	// backoff is the wait before the first retry, doubled before every other one.
+	backoff time.Duration
+}
+
+// do calls send until it succeeds, fails with an error that is not transient or the
+// retries are exhausted, and returns its last error. If ctx is done while waiting for the
+// next retry, ctx.Err() is returned.
+func (r sendRetry) do(ctx context.Context, send func() error) error {
+	backoff := r.backoff
+
+	for retry := 0; ; retry++ {
+		err := send()
+		if err == nil || retry >= r.retries || !network.IsTransient(err) {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
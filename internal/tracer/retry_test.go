@@ -0,0 +1,127 @@
+//go:build unix
+
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// failingSends returns a send function failing with the given errors, then succeeding, and
+// the number of calls made to it.
+func failingSends(errs ...error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func TestSendRetryTransient(t *testing.T) {
+	send, calls := failingSends(syscall.ENOBUFS, syscall.EAGAIN)
+	r := sendRetry{retries: 2, backoff: time.Millisecond}
+
+	start := time.Now()
+	require.NoError(t, r.do(context.Background(), send))
+
+	assert.Equal(t, 3, *calls)
+	assert.GreaterOrEqual(t, time.Since(start), 3*time.Millisecond, "the backoff doubles")
+}
+
+func TestSendRetryExhausted(t *testing.T) {
+	send, calls := failingSends(syscall.ENOBUFS, syscall.ENOBUFS, syscall.ENOBUFS)
+	r := sendRetry{retries: 2, backoff: time.Millisecond}
+
+	assert.ErrorIs(t, r.do(context.Background(), send), syscall.ENOBUFS)
+	assert.Equal(t, 3, *calls)
+}
+
+func TestSendRetryPermanent(t *testing.T) {
+	send, calls := failingSends(syscall.ENETUNREACH)
+	r := sendRetry{retries: 2, backoff: time.Millisecond}
+
+	assert.ErrorIs(t, r.do(context.Background(), send), syscall.ENETUNREACH)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestSendRetryZeroValue(t *testing.T) {
+	send, calls := failingSends(syscall.ENOBUFS)
+
+	assert.ErrorIs(t, sendRetry{}.do(context.Background(), send), syscall.ENOBUFS)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestSendRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	send, calls := failingSends(syscall.ENOBUFS, syscall.ENOBUFS)
+	r := sendRetry{retries: 2, backoff: time.Hour}
+
+	assert.ErrorIs(t, r.do(ctx, send), context.DeadlineExceeded)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestOptionsSendRetry(t *testing.T) {
+	assert.Equal(t, sendRetry{retries: DefaultSendRetries, backoff: DefaultSendRetryBackoff},
+		Options{}.withDefaults().sendRetry())
+	assert.Equal(t, sendRetry{}, Options{SendRetries: -1}.withDefaults().sendRetry())
+	assert.Equal(t, sendRetry{retries: 5, backoff: time.Second},
+		Options{SendRetries: 5, SendRetryBackoff: time.Second}.withDefaults().sendRetry())
+}
+
+// transientProber fails to send its first probes with a transient error.
+type transientProber struct {
+	*fakeProber
+	failures int
+}
+
+func (p *transientProber) send(ttl, attempt int) (sentProbe, error) {
+	if p.failures > 0 {
+		p.failures--
+		return sentProbe{}, fmt.Errorf("failed to send UDP packet: %w", syscall.ENOBUFS)
+	}
+	return p.fakeProber.send(ttl, attempt)
+}
+
+func TestProbeTTLRetriesTransientSendError(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &transientProber{
+		fakeProber: &fakeProber{dest: dest, sent: make(chan int, 1)},
+		failures:   1,
+	}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			ttl := <-p.sent
+			return &network.Message{
+				Peer:       dest,
+				Data:       quotingMessage(t, dest, ipv4.ICMPTypeDestinationUnreachable, 3, ttl),
+				TTL:        -1,
+				ReceivedAt: time.Now(),
+			}, nil
+		})
+
+	retry := sendRetry{retries: 1, backoff: time.Millisecond}
+	probe, done, err := probeTTL(context.Background(), p, receiver, 1, 0, time.Second, retry,
+		probeHooks{}, nil)
+
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.True(t, probe.Responder.Equal(dest), "the hop is not lost")
+	assert.Equal(t, 0, p.failures)
+}
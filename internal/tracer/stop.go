@@ -0,0 +1,27 @@
+package tracer
+
+// Reply is a reply to a probe, as passed to Options.StopWhen.
+type Reply struct {
+	// TTL is the TTL the probe was sent with.
+	TTL int
+	// Probe is the outcome of the probe, which received a reply.
+	Probe
+	// Reached reports whether the reply came from the destination itself, or reported it
+	// as unreachable.
+	Reached bool
+}
+
+// DestinationReached reports whether r came from the destination or reported it as
+// unreachable. It is the stop condition of a trace whose Options.StopWhen is nil.
+func DestinationReached(r Reply) bool {
+	return r.Reached
+}
+
+// stops reports whether the trace is done after the probe for ttl, which reached the
+// destination if reached is set, as opts.StopWhen decides.
+func (o Options) stops(ttl int, probe Probe, reached bool) bool {
+	if o.StopWhen == nil {
+		return reached
+	}
+	return probe.Responded() && o.StopWhen(Reply{TTL: ttl, Probe: probe, Reached: reached})
+}
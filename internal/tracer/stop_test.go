@@ -0,0 +1,75 @@
+package tracer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptionsStops(t *testing.T) {
+	router := Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: time.Millisecond}
+
+	assert.True(t, Options{}.stops(3, router, true))
+	assert.False(t, Options{}.stops(3, router, false))
+
+	var got Reply
+	opts := Options{StopWhen: func(r Reply) bool {
+		got = r
+		return r.TTL == 3
+	}}
+	assert.True(t, opts.stops(3, router, false))
+	assert.Equal(t, Reply{TTL: 3, Probe: router}, got)
+	assert.False(t, opts.stops(4, router, true))
+	assert.False(t, opts.stops(3, lostProbe(), false), "lost probes are no replies")
+}
+
+func TestDestinationReached(t *testing.T) {
+	assert.True(t, DestinationReached(Reply{Reached: true}))
+	assert.False(t, DestinationReached(Reply{}))
+}
+
+func TestTraceRunStopWhen(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+
+	for _, parallel := range []bool{false, true} {
+		name := "sequential"
+		if parallel {
+			name = "parallel"
+		}
+		t.Run(name, func(t *testing.T) {
+			dest := net.IPv4(198, 51, 100, 7)
+			p := &fakeProber{dest: dest, sent: make(chan int, 30)}
+			receiver := loopReceiver(t, p, func(ttl int) net.IP {
+				if ttl < 4 {
+					return net.IPv4(192, 0, 2, byte(ttl))
+				}
+				return net.IPv4(10, 0, 0, byte(ttl))
+			})
+
+			opts := Options{
+				MaxHops:      30,
+				Timeout:      time.Second,
+				ProbesPerHop: 2,
+				Parallel:     parallel,
+				StopWhen: func(r Reply) bool {
+					return subnet.Contains(r.Responder)
+				},
+			}.withDefaults()
+			tr := &trace{opts: opts, receiver: receiver, prober: p}
+			defer tr.close()
+
+			var hops []Hop
+			require.NoError(t, tr.run(context.Background(),
+				func(hop Hop) { hops = append(hops, hop) }))
+
+			require.Len(t, hops, 4)
+			assert.True(t, hops[3].IP.Equal(net.IPv4(10, 0, 0, 4)))
+			assert.Len(t, hops[3].RTTs, 2)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package tracer
+
+import (
+	"context"
+	"net"
+
+	"my-little-tracerouter/internal/network"
+)
+
+// RunStream traces the route to dest like Run, but delivers every Hop on the returned
+// channel as soon as its probes complete. The channel is closed when the trace ends.
+//
+// Errors opening the sockets are returned right away. An error that ends the trace early,
+// including ctx.Err() if ctx is cancelled, is delivered as a final Hop whose Err is set and
+// whose other fields are empty. The channel buffers every hop the trace can produce, so the
+// caller may stop reading it at any time.
+func (t *Tracer) RunStream(ctx context.Context, dest net.IP, opts Options) (<-chan Hop, error) {
+	tr, err := t.start(dest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hops := make(chan Hop, tr.opts.MaxHops+1)
+
+	go func() {
+		defer close(hops)
+		defer tr.close()
+
+		if err := tr.run(ctx, func(hop Hop) { hops <- hop }); err != nil {
+			hops <- Hop{Err: err}
+		}
+	}()
+
+	return hops, nil
+}
+
+// hopEmitter passes hops to a callback in order once their names, origins and locations are
+// resolved. Lookups run in the background, so a slow PTR or origin record holds back the
+// hops that follow it without delaying the trace.
+type hopEmitter struct {
+	// names, origins and locations resolve the hops; any is nil if not wanted.
+	names     *network.ReverseResolver
+	origins   network.ASNResolver
+	locations network.GeoResolver
+	queue     chan pendingHop
+	done      chan struct{}
+}
+
+// pendingHop is a hop waiting for the lookups of its name, origin and location, if any.
+type pendingHop struct {
+	hop      Hop
+	name     chan string
+	origin   chan *network.Origin
+	location chan *network.GeoInfo
+}
+
+// newHopEmitter creates a hopEmitter for up to capacity hops that calls emit from its own
+// goroutine.
+func newHopEmitter(
+	names *network.ReverseResolver,
+	origins network.ASNResolver,
+	locations network.GeoResolver,
+	capacity int,
+	emit func(Hop),
+) *hopEmitter {
+	e := &hopEmitter{
+		names:     names,
+		origins:   origins,
+		locations: locations,
+		queue:     make(chan pendingHop, capacity),
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		defer close(e.done)
+		for p := range e.queue {
+			if p.name != nil {
+				p.hop.Host = <-p.name
+			}
+			if p.origin != nil {
+				p.hop.OriginLookedUp = true
+				if origin := <-p.origin; origin != nil {
+					p.hop.ASN, p.hop.Prefix = origin.ASN, origin.Prefix
+				}
+			}
+			if p.location != nil {
+				if geo := <-p.location; geo != nil {
+					p.hop.Country, p.hop.City = geo.Country, geo.City
+					p.hop.Lat, p.hop.Lon = geo.Lat, geo.Lon
+				}
+			}
+			emit(p.hop)
+		}
+	}()
+
+	return e
+}
+
+// add queues hop for emission and starts looking up its name, origin and location
+// concurrently. It must not be called more than capacity times.
+func (e *hopEmitter) add(hop Hop) {
+	p := pendingHop{hop: hop}
+
+	if e.names != nil && hop.IP != nil {
+		p.name = make(chan string, 1)
+		go func(ip net.IP) {
+			p.name <- e.names.ResolveHop(ip)
+		}(hop.IP)
+	}
+	if e.origins != nil && hop.IP != nil {
+		p.origin = make(chan *network.Origin, 1)
+		go func(ip net.IP) {
+			p.origin <- e.origins.ResolveOrigin(ip)
+		}(hop.IP)
+	}
+	if e.locations != nil && hop.IP != nil {
+		p.location = make(chan *network.GeoInfo, 1)
+		go func(ip net.IP) {
+			// A hop that cannot be located is emitted without a location.
+			geo, err := e.locations.Locate(ip)
+			if err != nil {
+				p.location <- nil
+				return
+			}
+			p.location <- &geo
+		}(hop.IP)
+	}
+
+	e.queue <- p
+}
+
+// close waits until every queued hop has been emitted.
+func (e *hopEmitter) close() {
+	close(e.queue)
+	<-e.done
+}
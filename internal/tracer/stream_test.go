@@ -0,0 +1,159 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func collect(hops <-chan Hop) []Hop {
+	var all []Hop
+	for hop := range hops {
+		all = append(all, hop)
+	}
+	return all
+}
+
+func TestTracerRunStreamLoopback(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		dest := net.IPv4(127, 0, 0, 1)
+
+		hops, err := New().RunStream(context.Background(), dest, Options{
+			MaxHops:  3,
+			Timeout:  time.Second,
+			Parallel: parallel,
+		})
+		if err != nil && errors.Is(err, os.ErrPermission) {
+			t.Skip("raw ICMP sockets require elevated privileges")
+		}
+		require.NoError(t, err)
+
+		all := collect(hops)
+
+		require.Len(t, all, 1, "parallel %v", parallel)
+		assert.NoError(t, all[0].Err)
+		assert.True(t, all[0].IP.Equal(dest))
+	}
+}
+
+func TestTracerRunStreamInvalidDestination(t *testing.T) {
+	hops, err := New().RunStream(context.Background(), net.IP{1, 2}, Options{})
+
+	assert.Error(t, err)
+	assert.Nil(t, hops)
+}
+
+func TestTracerRunStreamCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	hops, err := New().RunStream(ctx, net.IPv4(192, 0, 2, 254), Options{Timeout: time.Second})
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+
+	all := collect(hops)
+
+	require.NotEmpty(t, all)
+	assert.ErrorIs(t, all[len(all)-1].Err, context.DeadlineExceeded)
+}
+
+func TestHopEmitterKeepsOrder(t *testing.T) {
+	var ttls []int
+	e := newHopEmitter(nil, nil, nil, 3, func(hop Hop) { ttls = append(ttls, hop.TTL) })
+
+	e.add(Hop{TTL: 1})
+	e.add(Hop{TTL: 2, IP: net.IPv4(127, 0, 0, 1)})
+	e.add(Hop{TTL: 3})
+	e.close()
+
+	assert.Equal(t, []int{1, 2, 3}, ttls)
+}
+
+// fakeASNResolver knows the origin of a single address and answers after a delay.
+type fakeASNResolver struct {
+	ip     net.IP
+	origin network.Origin
+}
+
+func (r fakeASNResolver) ResolveOrigin(ip net.IP) *network.Origin {
+	time.Sleep(10 * time.Millisecond)
+	if !ip.Equal(r.ip) {
+		return nil
+	}
+	return &r.origin
+}
+
+func TestHopEmitterResolvesOrigins(t *testing.T) {
+	_, prefix, err := net.ParseCIDR("198.51.100.0/24")
+	require.NoError(t, err)
+	resolver := fakeASNResolver{
+		ip:     net.IPv4(198, 51, 100, 1),
+		origin: network.Origin{ASN: 64496, Prefix: prefix},
+	}
+
+	var hops []Hop
+	e := newHopEmitter(nil, resolver, nil, 3, func(hop Hop) { hops = append(hops, hop) })
+
+	e.add(Hop{TTL: 1, IP: net.IPv4(198, 51, 100, 1)})
+	e.add(Hop{TTL: 2})
+	e.add(Hop{TTL: 3, IP: net.IPv4(203, 0, 113, 1)})
+	e.close()
+
+	require.Len(t, hops, 3)
+	assert.Equal(t, 64496, hops[0].ASN)
+	assert.Equal(t, prefix, hops[0].Prefix)
+	assert.Zero(t, hops[1].ASN)
+	assert.Zero(t, hops[2].ASN)
+	assert.Nil(t, hops[2].Prefix)
+	assert.True(t, hops[0].OriginLookedUp)
+	assert.False(t, hops[1].OriginLookedUp, "hops that did not respond are not looked up")
+	assert.True(t, hops[2].OriginLookedUp)
+	assert.Empty(t, hops[0].Host, "names are only resolved when asked for")
+}
+
+// fakeGeoResolver locates a single address and fails for the others.
+type fakeGeoResolver struct {
+	ip  net.IP
+	geo network.GeoInfo
+}
+
+func (r fakeGeoResolver) Locate(ip net.IP) (network.GeoInfo, error) {
+	if !ip.Equal(r.ip) {
+		return network.GeoInfo{}, errors.New("address not found")
+	}
+	return r.geo, nil
+}
+
+func TestHopEmitterLocatesHops(t *testing.T) {
+	resolver := fakeGeoResolver{
+		ip:  net.IPv4(198, 51, 100, 1),
+		geo: network.GeoInfo{Country: "NL", City: "Amsterdam", Lat: 52.37, Lon: 4.89},
+	}
+
+	var hops []Hop
+	e := newHopEmitter(nil, nil, resolver, 3, func(hop Hop) { hops = append(hops, hop) })
+
+	e.add(Hop{TTL: 1, IP: net.IPv4(198, 51, 100, 1)})
+	e.add(Hop{TTL: 2})
+	e.add(Hop{TTL: 3, IP: net.IPv4(203, 0, 113, 1)})
+	e.close()
+
+	require.Len(t, hops, 3)
+	assert.Equal(t, "NL", hops[0].Country)
+	assert.Equal(t, "Amsterdam", hops[0].City)
+	assert.Equal(t, 52.37, hops[0].Lat)
+	assert.Equal(t, 4.89, hops[0].Lon)
+	assert.Empty(t, hops[1].Country)
+	assert.Empty(t, hops[2].Country, "hops that cannot be located have no location")
+	assert.Zero(t, hops[2].Lat)
+}
@@ -0,0 +1,76 @@
+package tracer
+
+import "time"
+
+// probeTimeouts picks how long the probes of a sequential trace wait for their reply; see
+// Options.AdaptiveTimeout.
+type probeTimeouts struct {
+	// max is the fixed timeout, and the longest one picked.
+	max time.Duration
+	// hereFactor and nearFactor scale the RTTs of the current and the closest lower hop
+	// that answered, and are zero unless the timeout adapts.
+	hereFactor float64
+	nearFactor float64
+
+	// ttl is the TTL of the current hop.
+	ttl int
+	// here is the fastest RTT of the probes of the current hop answered so far, and near
+	// that of the closest lower hop that answered. Either is NoRTT if there is none.
+	here time.Duration
+	near time.Duration
+}
+
+// newProbeTimeouts returns the timeouts of the probes of a trace run with opts.
+func newProbeTimeouts(opts Options) *probeTimeouts {
+	t := &probeTimeouts{max: opts.Timeout, here: NoRTT, near: NoRTT}
+	if opts.AdaptiveTimeout {
+		t.hereFactor, t.nearFactor = opts.HereFactor, opts.NearFactor
+	}
+	return t
+}
+
+// timeout returns how long the next probe for ttl waits for its reply: the longest of the
+// scaled RTTs known, bounded by the fixed timeout, or the latter if no RTT is known yet.
+// TTLs must not decrease from one call to the next.
+func (t *probeTimeouts) timeout(ttl int) time.Duration {
+	t.advance(ttl)
+
+	var timeout time.Duration
+	if t.hereFactor > 0 && t.here != NoRTT {
+		timeout = scaleRTT(t.here, t.hereFactor)
+	}
+	if t.nearFactor > 0 && t.near != NoRTT {
+		if near := scaleRTT(t.near, t.nearFactor); near > timeout {
+			timeout = near
+		}
+	}
+
+	if timeout <= 0 || timeout > t.max {
+		return t.max
+	}
+	return timeout
+}
+
+// observe records the outcome of a probe for ttl.
+func (t *probeTimeouts) observe(ttl int, probe Probe) {
+	t.advance(ttl)
+
+	if probe.Responded() && (t.here == NoRTT || probe.RTT < t.here) {
+		t.here = probe.RTT
+	}
+}
+
+// advance moves on to the hop of ttl, keeping the RTT of the current one if it answered.
+func (t *probeTimeouts) advance(ttl int) {
+	if ttl == t.ttl {
+		return
+	}
+	if t.here != NoRTT {
+		t.near = t.here
+	}
+	t.ttl, t.here = ttl, NoRTT
+}
+
+func scaleRTT(rtt time.Duration, factor float64) time.Duration {
+	return time.Duration(float64(rtt) * factor)
+}
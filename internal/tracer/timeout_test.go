@@ -0,0 +1,178 @@
+package tracer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func adaptiveTimeouts() *probeTimeouts {
+	return newProbeTimeouts(Options{Timeout: time.Second, AdaptiveTimeout: true}.withDefaults())
+}
+
+func answeredIn(rtt time.Duration) Probe {
+	return Probe{Responder: net.IPv4(192, 0, 2, 1), RTT: rtt}
+}
+
+func TestProbeTimeoutsFixedWithoutSamples(t *testing.T) {
+	timeouts := adaptiveTimeouts()
+
+	assert.Equal(t, time.Second, timeouts.timeout(1))
+	timeouts.observe(1, lostProbe())
+	assert.Equal(t, time.Second, timeouts.timeout(1))
+	assert.Equal(t, time.Second, timeouts.timeout(2))
+}
+
+func TestProbeTimeoutsHere(t *testing.T) {
+	timeouts := adaptiveTimeouts()
+
+	timeouts.timeout(1)
+	timeouts.observe(1, answeredIn(20*time.Millisecond))
+	timeouts.observe(1, answeredIn(10*time.Millisecond))
+	timeouts.observe(1, answeredIn(30*time.Millisecond))
+
+	assert.Equal(t, 30*time.Millisecond, timeouts.timeout(1), "3 times the fastest reply")
+}
+
+func TestProbeTimeoutsNear(t *testing.T) {
+	timeouts := adaptiveTimeouts()
+
+	timeouts.observe(1, answeredIn(2*time.Millisecond))
+	timeouts.observe(2, lostProbe())
+	timeouts.observe(3, lostProbe())
+
+	assert.Equal(t, 20*time.Millisecond, timeouts.timeout(3),
+		"10 times the closest lower hop that answered")
+
+	timeouts.observe(3, answeredIn(15*time.Millisecond))
+	assert.Equal(t, 45*time.Millisecond, timeouts.timeout(3), "the longest of both")
+}
+
+func TestProbeTimeoutsBounded(t *testing.T) {
+	timeouts := adaptiveTimeouts()
+
+	timeouts.observe(1, answeredIn(500*time.Millisecond))
+
+	assert.Equal(t, time.Second, timeouts.timeout(2))
+}
+
+func TestProbeTimeoutsDisabled(t *testing.T) {
+	timeouts := newProbeTimeouts(Options{Timeout: time.Second}.withDefaults())
+
+	timeouts.observe(1, answeredIn(time.Millisecond))
+
+	assert.Equal(t, time.Second, timeouts.timeout(1))
+	assert.Equal(t, time.Second, timeouts.timeout(2))
+}
+
+func TestOptionsTimeoutFactorDefaults(t *testing.T) {
+	opts := Options{}.withDefaults()
+	assert.Equal(t, float64(DefaultHereFactor), opts.HereFactor)
+	assert.Equal(t, float64(DefaultNearFactor), opts.NearFactor)
+
+	opts = Options{HereFactor: 2, NearFactor: 5}.withDefaults()
+	assert.Equal(t, 2.0, opts.HereFactor)
+	assert.Equal(t, 5.0, opts.NearFactor)
+}
+
+// fakeClock is the time of a simulated trace: it only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// clockProber is a fakeProber that sends its probes at the time of a fake clock.
+type clockProber struct {
+	*fakeProber
+	clock *fakeClock
+}
+
+func (p *clockProber) send(ttl, attempt int) (sentProbe, error) {
+	sent, err := p.fakeProber.send(ttl, attempt)
+	sent.sentAt = p.clock.Now()
+	return sent, err
+}
+
+// blackHoleReceiver answers the probes sent by p after 1ms per TTL, on the clock of p,
+// except those with a TTL of silentFrom or more, whose wait for a reply runs the clock up
+// to its deadline.
+func blackHoleReceiver(t *testing.T, p *clockProber, silentFrom int) *MockReader {
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			ttl := <-p.sent
+			if ttl >= silentFrom {
+				deadline, _ := ctx.Deadline()
+				p.clock.advance(deadline.Sub(p.clock.Now()))
+				return nil, context.DeadlineExceeded
+			}
+			return &network.Message{
+				Peer:       net.IPv4(10, 0, 0, byte(ttl)),
+				Data:       quotingMessage(t, p.dest, ipv4.ICMPTypeTimeExceeded, 0, ttl),
+				TTL:        -1,
+				ReceivedAt: p.clock.advance(time.Duration(ttl) * time.Millisecond),
+			}, nil
+		})
+	receiver.On("Close").Return(nil)
+	return receiver
+}
+
+// simulateBlackHoles traces through 30 hops, the last 11 of which do not answer, and
+// returns how long the trace took on its fake clock.
+func simulateBlackHoles(t *testing.T, adaptive bool) time.Duration {
+	dest := net.IPv4(198, 51, 100, 7)
+	start := time.Now()
+	p := &clockProber{
+		fakeProber: &fakeProber{dest: dest, sent: make(chan int, 1)},
+		clock:      &fakeClock{now: start},
+	}
+
+	opts := Options{
+		MaxHops:             30,
+		AdaptiveTimeout:     adaptive,
+		MaxUnresponsiveHops: -1,
+	}.withDefaults()
+	tr := &trace{opts: opts, receiver: blackHoleReceiver(t, p, 20), prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+
+	require.Len(t, hops, 30)
+	assert.Equal(t, 0.0, hops[18].Loss)
+	assert.Equal(t, 100.0, hops[19].Loss)
+	return p.clock.Now().Sub(start)
+}
+
+func TestTraceRunAdaptiveTimeoutBlackHoles(t *testing.T) {
+	fixed := simulateBlackHoles(t, false)
+	adaptive := simulateBlackHoles(t, true)
+
+	// Every probe of the silent hops waits 3s, or 10 times the 19ms of hop 19.
+	assert.Equal(t, 11*DefaultProbesPerHop*DefaultTimeout+3*190*time.Millisecond, fixed)
+	assert.Equal(t, 11*DefaultProbesPerHop*190*time.Millisecond+3*190*time.Millisecond,
+		adaptive)
+	assert.Less(t, adaptive, fixed/10)
+}
@@ -0,0 +1,1197 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"my-little-tracerouter/internal/network"
+)
+
+const (
+	// DefaultMaxHops is the maximum TTL probed when Options.MaxHops is not set.
+	DefaultMaxHops = 30
+
+	// DefaultTimeout is how long to wait for a reply when Options.Timeout is not set.
+	DefaultTimeout = 3 * time.Second
+
+	// DefaultPort is the base destination port of UDP probes, as in classic traceroute.
+	// Options.BasePort overrides it.
+	DefaultPort = 33434
+
+	// DefaultTCPPort is the destination port of TCP probes when Options.Port is not set.
+	DefaultTCPPort = 80
+
+	// DefaultProbesPerHop is the number of probes sent per TTL when
+	// Options.ProbesPerHop is not set.
+	DefaultProbesPerHop = 3
+
+	// DefaultMaxInFlight is the number of probes outstanding at once in parallel mode when
+	// Options.MaxInFlight is not set.
+	//
+	// Deprecated: Use DefaultMaxConcurrentProbes.
+	DefaultMaxInFlight = 16
+
+	// DefaultSendRetries is the number of times a probe that failed to send for a transient
+	// reason is sent again when Options.SendRetries is not set.
+	DefaultSendRetries = 2
+
+	// DefaultSendRetryBackoff is the wait before the first retry of a probe when
+	// Options.SendRetryBackoff is not set.
+	DefaultSendRetryBackoff = 10 * time.Millisecond
+
+	// DefaultHereFactor and DefaultNearFactor scale the RTTs that adaptive timeouts are
+	// derived from when Options.HereFactor and Options.NearFactor are not set, like the
+	// defaults of traceroute -w.
+	DefaultHereFactor = 3
+	DefaultNearFactor = 10
+
+	// DefaultMaxConcurrentProbes is the number of workers probing at once in parallel mode
+	// when neither Options.MaxConcurrentProbes nor Options.MaxInFlight is set.
+	DefaultMaxConcurrentProbes = 8
+
+	// DefaultMaxUnresponsiveHops is the number of hops in a row without any reply a trace
+	// gives up after when Options.MaxUnresponsiveHops is not set.
+	DefaultMaxUnresponsiveHops = 10
+
+	// DefaultInterval is the time between the starts of the rounds of a Monitor when
+	// Options.Interval is not set, like mtr.
+	DefaultInterval = time.Second
+
+	// DefaultReportRounds is the number of rounds Tracer.Report runs when Options.Rounds is
+	// not set, like mtr --report.
+	DefaultReportRounds = 10
+
+	// DefaultMaxConcurrentTraces is the number of traces TraceAll runs at once when
+	// Options.MaxConcurrentTraces is not set.
+	DefaultMaxConcurrentTraces = 8
+)
+
+// ErrTraceTimeout is returned along with the hops probed so far when a trace does not
+// complete within Options.TraceTimeout.
+var ErrTraceTimeout = errors.New("trace timed out")
+
+// Options configures a single traceroute run.
+type Options struct {
+	// MaxHops is the highest TTL to probe.
+	MaxHops int
+	// FirstTTL is the lowest TTL to probe, 1 if not set.
+	FirstTTL int
+	// Timeout is how long to wait for a reply to each probe.
+	Timeout time.Duration
+	// AdaptiveTimeout shortens the wait for replies from the RTTs already measured, like
+	// traceroute -w with its HERE and NEAR factors.
+	AdaptiveTimeout bool
+	// HereFactor and NearFactor are the factors of AdaptiveTimeout.
+	HereFactor float64
+	NearFactor float64
+	// TraceTimeout, if positive, bounds the whole trace, which then ends with ErrTraceTimeout.
+	TraceTimeout time.Duration
+	// Method selects the kind of probe packets to send.
+	Method ProbeMethod
+	// EchoID is the identifier of ICMP Echo probes, derived from the process ID if not set.
+	EchoID int
+	// Port is the destination port of the probes.
+	Port int
+	// BasePort is the destination port of the first UDP probe, Port if not set.
+	BasePort int
+	// Vary selects the port that tells UDP probes apart.
+	Vary PortVariation
+	// SourceIP, if set, is the local address the probes leave from.
+	SourceIP net.IP
+	// SrcPort is the source port of UDP probes, an ephemeral one if not set.
+	SrcPort int
+	// ProbesPerHop is the number of probes sent for each TTL.
+	ProbesPerHop int
+	// Retries is the number of times a probe that timed out is sent again.
+	Retries int
+	// Paris keeps the ports of UDP probes constant across all TTLs, like Paris traceroute.
+	Paris bool
+	// FlowID selects the flow followed by Paris probes by offsetting their destination port.
+	FlowID int
+	// Confidence is the probability with which RunMultipath finds every next hop.
+	Confidence float64
+	// Interval is the time between the starts of the rounds of a Monitor.
+	Interval time.Duration
+	// Rounds is the number of rounds a Monitor or Tracer.Report runs.
+	Rounds int
+	// Interface, if set, forces the probes out through the named network interface.
+	Interface string
+	// InterfaceOnly, with Interface, binds the listener to the interface too.
+	InterfaceOnly bool
+	// DontFragment sets the Don't Fragment bit on UDP probes.
+	DontFragment bool
+	// TOS is the Type of Service byte (IPv6 traffic class) of the probes.
+	TOS int
+	// ECN is the ECN codepoint the probes are sent with.
+	ECN network.ECN
+	// FilterICMP attaches a socket filter to the ICMP listener on Linux.
+	FilterICMP bool
+	// ReadSize is the size of the buffer ICMP messages are read into.
+	ReadSize int
+	// Unprivileged reads the replies from an unprivileged datagram ICMP socket.
+	Unprivileged bool
+	// StopWhen, if set, decides which replies end the trace instead of DestinationReached.
+	StopWhen func(Reply) bool
+	// OnProbeSent, OnReplyReceived and OnProbeTimeout, if set, are called whenever a probe
+	// is sent, answered or times out.
+	OnProbeSent     func(ttl, seq int)
+	OnReplyReceived func(ttl int, from net.IP, rtt time.Duration)
+	OnProbeTimeout  func(ttl, seq int)
+	// LoopThreshold, if positive, is the number of TTLs after which a routing loop is found.
+	LoopThreshold int
+	// AbortOnLoop ends the trace with a *RoutingLoopError as soon as a loop is found.
+	AbortOnLoop bool
+	// MaxUnresponsiveHops ends the trace once that many hops in a row received no reply.
+	MaxUnresponsiveHops int
+	// MinProbeInterval is the minimum time between two probes of the trace.
+	MinProbeInterval time.Duration
+	// Limiter, if set, paces the probes instead of MinProbeInterval.
+	Limiter *Limiter
+	// Parallel sends the probes of all TTLs at once instead of one after the other.
+	Parallel bool
+	// SimultaneousHops, if positive, probes that many TTLs at a time, like traceroute -N.
+	SimultaneousHops int
+	// SendRetries is the number of times a probe that failed to send is sent again.
+	SendRetries int
+	// SendRetryBackoff is the wait before the first send retry, doubled before every other.
+	SendRetryBackoff time.Duration
+	// MaxConcurrentProbes is the number of workers sending probes in parallel mode.
+	MaxConcurrentProbes int
+	// MaxInFlight bounds the number of probes outstanding at once in parallel mode.
+	//
+	// Deprecated: MaxInFlight is used as MaxConcurrentProbes if the latter is not set.
+	MaxInFlight int
+	// PacketSize is the length of the UDP probes, IP and UDP headers included.
+	PacketSize int
+	// Payload, if set, generates the payload of every UDP probe padded to PacketSize.
+	Payload network.PayloadFunc
+	// PathMTU discovers the MTU of the path like tracepath.
+	PathMTU bool
+	// DetectNAT sends UDP probes with an IPv4 Identification of their own to reveal NATs.
+	DetectNAT bool
+	// OnRawPacket, if set, is called with every ICMP message the trace reads.
+	OnRawPacket func(peer net.IP, data []byte)
+	// Dispatcher, if set, reads the replies of the trace from its shared ICMP listener.
+	Dispatcher *Dispatcher
+	// MaxConcurrentTraces is the number of traces TraceAll runs at once.
+	MaxConcurrentTraces int
+	// Preference selects the address family Trace picks for a host name.
+	Preference network.Preference
+	// ResolveNames looks up the host name of every responding hop.
+	ResolveNames bool
+	// NameResolver, if set, looks up the names of the hops instead of that of the Tracer.
+	NameResolver *network.ReverseResolver
+	// DNSResolver, if set, resolves host names instead of the system resolver.
+	DNSResolver network.DNSResolver
+	// ASNResolver, if set, looks up the origin AS and BGP prefix of every responding hop.
+	ASNResolver network.ASNResolver
+	// GeoResolver, if set, locates every responding hop.
+	GeoResolver network.GeoResolver
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxHops <= 0 {
+		o.MaxHops = DefaultMaxHops
+	}
+	if o.FirstTTL <= 0 {
+		o.FirstTTL = 1
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.HereFactor <= 0 {
+		o.HereFactor = DefaultHereFactor
+	}
+	if o.NearFactor <= 0 {
+		o.NearFactor = DefaultNearFactor
+	}
+	if o.Port <= 0 {
+		o.Port = DefaultPort
+		if o.Method == TCP {
+			o.Port = DefaultTCPPort
+		}
+	}
+	if o.BasePort <= 0 {
+		o.BasePort = o.Port
+	}
+	if o.ProbesPerHop <= 0 {
+		o.ProbesPerHop = DefaultProbesPerHop
+	}
+	if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.MaxUnresponsiveHops == 0 {
+		o.MaxUnresponsiveHops = DefaultMaxUnresponsiveHops
+	}
+	if o.SimultaneousHops > 0 {
+		o.Parallel = true
+	}
+	if o.MaxConcurrentProbes <= 0 {
+		o.MaxConcurrentProbes = DefaultMaxConcurrentProbes
+		if o.MaxInFlight > 0 {
+			o.MaxConcurrentProbes = o.MaxInFlight
+		}
+		if o.SimultaneousHops > 0 {
+			o.MaxConcurrentProbes = o.SimultaneousHops * o.ProbesPerHop
+		}
+	}
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = DefaultMaxInFlight
+	}
+	if o.SendRetries == 0 {
+		o.SendRetries = DefaultSendRetries
+	}
+	if o.SendRetryBackoff <= 0 {
+		o.SendRetryBackoff = DefaultSendRetryBackoff
+	}
+	if o.PathMTU {
+		o.DontFragment = true
+	}
+	return o
+}
+
+// sendRetry returns how probes that fail to send are retried.
+func (o Options) sendRetry() sendRetry {
+	if o.SendRetries < 0 {
+		return sendRetry{}
+	}
+	return sendRetry{retries: o.SendRetries, backoff: o.SendRetryBackoff}
+}
+
+// ports returns the destination ports of classic UDP probes.
+func (o Options) ports() portSequence {
+	return portSequence{base: o.BasePort, probesPerHop: o.slotsPerHop()}
+}
+
+// slotsPerHop returns the number of probes that may be sent for each TTL, retries
+// included.
+func (o Options) slotsPerHop() int {
+	return o.ProbesPerHop * (o.Retries + 1)
+}
+
+// slot returns the index among the probes sent for a TTL of the try-th retry of the
+// attempt-th probe, the first try being the probe itself. It is passed to the prober as
+// the attempt of the retry, so that every retry is sent with a key of its own.
+func (o Options) slot(attempt, try int) int {
+	return try*o.ProbesPerHop + attempt
+}
+
+// trafficClass returns the TOS byte (IPv6 traffic class) of the probes.
+func (o Options) trafficClass() int {
+	return o.TOS&^0x3 | int(o.ECN)&0x3
+}
+
+// Banner returns the line traceroute prints before the hops,
+// e.g. "traceroute to example.com (192.0.2.1), 30 hops max". The source address follows
+// the target if opts.SourceIP is set, e.g. "(192.0.2.1) from 198.51.100.2".
+func Banner(target *network.Target, opts Options) string {
+	opts = opts.withDefaults()
+	if opts.SourceIP != nil {
+		return fmt.Sprintf("traceroute to %v from %v, %d hops max", target, opts.SourceIP,
+			opts.MaxHops)
+	}
+	return fmt.Sprintf("traceroute to %v, %d hops max", target, opts.MaxHops)
+}
+
+// nameResolver returns the resolver looking up the names of the hops: NameResolver if set,
+// a resolver querying DNSResolver if that is set, and fallback otherwise.
+func (o Options) nameResolver(fallback *network.ReverseResolver) *network.ReverseResolver {
+	switch {
+	case o.NameResolver != nil:
+		return o.NameResolver
+	case o.DNSResolver != nil:
+		return network.NewReverseResolverWith(o.DNSResolver, network.DefaultReverseTimeout, 0)
+	}
+	return fallback
+}
+
+// Tracer discovers the route to a destination by sending probes with increasing TTL
+// and listening for the ICMP replies they elicit.
+//
+// Most methods take the Options of the run, so that one Tracer, and its cache of host
+// names, serves traces configured differently. TraceHost runs with the options the Tracer
+// was created with instead.
+type Tracer struct {
+	resolver *network.ReverseResolver
+	// opts are the options of TraceHost.
+	opts Options
+}
+
+// Option sets an option of the traces run by TraceHost; see New.
+type Option func(o *Options)
+
+// WithOptions sets every option at once, e.g. to start from Options shared with other
+// runs. Options given after it override its fields.
+func WithOptions(opts Options) Option {
+	return func(o *Options) { *o = opts }
+}
+
+// WithMaxTTL sets Options.MaxHops, the highest TTL to probe.
+func WithMaxTTL(n int) Option {
+	return func(o *Options) { o.MaxHops = n }
+}
+
+// WithBasePort sets Options.BasePort, the destination port of the first UDP probe.
+func WithBasePort(port int) Option {
+	return func(o *Options) { o.BasePort = port }
+}
+
+// WithProbesPerHop sets Options.ProbesPerHop.
+func WithProbesPerHop(n int) Option {
+	return func(o *Options) { o.ProbesPerHop = n }
+}
+
+// WithTimeout sets Options.Timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) { o.Timeout = d }
+}
+
+// WithProtocol sets Options.Method, the protocol of the probes.
+func WithProtocol(method ProbeMethod) Option {
+	return func(o *Options) { o.Method = method }
+}
+
+// New creates a new Tracer whose TraceHost runs with the given options, in order, applied
+// to the zero Options.
+func New(opts ...Option) *Tracer {
+	t := &Tracer{resolver: network.NewReverseResolver(network.DefaultReverseTimeout)}
+	for _, opt := range opts {
+		opt(&t.opts)
+	}
+	return t
+}
+
+// Run traces the route to dest with the options given to New and returns one Hop per
+// probed TTL.
+//
+// The trace stops once the destination replies or a router reports it as unreachable, or
+// a reply meets Options.StopWhen instead if set, once Options.MaxHops is reached, after
+// Options.MaxUnresponsiveHops hops in a row that did not respond, or with
+// Options.AbortOnLoop, when a routing loop is found.
+// If ctx is cancelled mid-trace, the hops completed so far are returned with ctx.Err().
+// Opening the ICMP listener usually requires elevated privileges.
+func (t *Tracer) Run(ctx context.Context, dest net.IP) ([]Hop, error) {
+	return t.run(ctx, dest, t.opts)
+}
+
+// RunWithOptions is Run with opts instead of the options given to New.
+//
+// Deprecated: Pass the options to New, e.g. with WithOptions, and use Run.
+func (t *Tracer) RunWithOptions(ctx context.Context, dest net.IP, opts Options) ([]Hop, error) {
+	return t.run(ctx, dest, opts)
+}
+
+func (t *Tracer) run(ctx context.Context, dest net.IP, opts Options) ([]Hop, error) {
+	tr, err := t.start(dest, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.close()
+
+	var hops []Hop
+	err = tr.run(ctx, func(hop Hop) { hops = append(hops, hop) })
+	return hops, err
+}
+
+// trace is a traceroute run whose sockets are open.
+type trace struct {
+	opts     Options
+	receiver messageReader
+	prober   prober
+	limiter  *Limiter
+	resolver *network.ReverseResolver
+	// mtu searches the path MTU in PathMTU mode and is nil otherwise.
+	mtu *mtuSearch
+	// unresponsive is set once the trace gave up after opts.MaxUnresponsiveHops hops in a
+	// row did not respond.
+	unresponsive bool
+}
+
+// replyTypes are the ICMP types of the messages a trace parses, those passed by the filter
+// of Options.FilterICMP.
+var replyTypes = []ipv4.ICMPType{
+	ipv4.ICMPTypeTimeExceeded,
+	ipv4.ICMPTypeDestinationUnreachable,
+	ipv4.ICMPTypeParameterProblem,
+	ipv4.ICMPTypeEchoReply,
+}
+
+// start opens the sockets of a trace to dest.
+func (t *Tracer) start(dest net.IP, opts Options) (*trace, error) {
+	opts = opts.withDefaults()
+
+	family, err := familyOf(dest)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FirstTTL > opts.MaxHops {
+		return nil, fmt.Errorf("invalid first TTL %d: must not exceed the maximum of %d hops",
+			opts.FirstTTL, opts.MaxHops)
+	}
+	if opts.PathMTU && (opts.Method != UDP || opts.Paris || opts.Parallel) {
+		return nil, fmt.Errorf("path MTU discovery requires sequential UDP probes")
+	}
+	if err := checkPacketSize(opts, dest); err != nil {
+		return nil, err
+	}
+	if opts.DetectNAT && (family != network.IPv4 || opts.Method != UDP || opts.Paris ||
+		opts.Vary != VaryDstPort || opts.PacketSize != 0 || opts.PathMTU ||
+		opts.Interface != "") {
+		return nil, fmt.Errorf("NAT detection requires classic UDP probes over IPv4")
+	}
+	if err := checkPorts(opts); err != nil {
+		return nil, err
+	}
+	if opts.EchoID < 0 || opts.EchoID > 0xffff {
+		return nil, fmt.Errorf("invalid ICMP identifier %d", opts.EchoID)
+	}
+	if opts.LoopThreshold < 0 || opts.LoopThreshold == 1 {
+		return nil, fmt.Errorf("invalid loop threshold %d: must be at least 2",
+			opts.LoopThreshold)
+	}
+
+	var icmpConn *network.ICMPConn
+	if opts.Dispatcher != nil {
+		if err := opts.Dispatcher.check(family, opts); err != nil {
+			return nil, err
+		}
+		icmpConn = opts.Dispatcher.listener
+	} else if icmpConn, err = openListener(family, opts); err != nil {
+		return nil, err
+	}
+
+	p, err := newProber(opts.Method, family, icmpConn, dest, opts)
+	if err != nil {
+		if opts.Dispatcher == nil {
+			icmpConn.Close()
+		}
+		return nil, err
+	}
+
+	var receiver messageReader = icmpConn
+	if opts.Dispatcher != nil {
+		route, err := opts.Dispatcher.register(routeKeyOf(p, dest))
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		receiver = route
+	}
+
+	limiter := opts.Limiter
+	if limiter == nil && opts.MinProbeInterval > 0 {
+		limiter = NewLimiter(opts.MinProbeInterval, 1)
+	}
+
+	tr := &trace{
+		opts:     opts,
+		receiver: receiver,
+		prober:   p,
+		limiter:  limiter,
+		resolver: opts.nameResolver(t.resolver),
+	}
+	if opts.PathMTU {
+		tr.mtu = newMTUSearch(family, opts.PacketSize)
+	}
+	if opts.OnRawPacket != nil {
+		tr.receiver = &tapReader{messageReader: receiver, tap: opts.OnRawPacket}
+	}
+	// A Dispatcher already routes Echo Replies by their identifier.
+	if echo, ok := p.(*echoProber); ok && opts.Dispatcher == nil {
+		tr.receiver = &echoFilter{messageReader: tr.receiver, id: echo.id}
+	}
+	return tr, nil
+}
+
+// openListener opens the ICMP listener of a trace to an address of the given family,
+// configured as opts asks for.
+func openListener(family network.Family, opts Options) (*network.ICMPConn, error) {
+	if opts.Unprivileged && opts.Method != ICMP {
+		return nil, errNeedsRawSocket(opts.Method)
+	}
+
+	open := network.NewICMPConnBound
+	if opts.Unprivileged {
+		open = network.NewUnprivilegedICMPConnBound
+	}
+	icmpConn, err := open(family, opts.SourceIP)
+	if err != nil {
+		return nil, err
+	}
+	if icmpConn.Mode() == network.DatagramICMP && opts.Method != ICMP {
+		// Only the errors caused by Echo Requests reach an unprivileged listener.
+		icmpConn.Close()
+		return nil, errNeedsRawSocket(opts.Method)
+	}
+	if opts.Interface != "" && (opts.InterfaceOnly || opts.Method == ICMP) {
+		if err := icmpConn.BindToDevice(opts.Interface); err != nil {
+			icmpConn.Close()
+			return nil, err
+		}
+	}
+
+	if opts.ReadSize != 0 {
+		if err := icmpConn.SetReadSize(opts.ReadSize); err != nil {
+			icmpConn.Close()
+			return nil, err
+		}
+	}
+
+	// Reply TTLs are informational, so platforms that cannot report them still trace.
+	_ = icmpConn.EnableReceiveTTL()
+	// Without kernel timestamps RTTs are measured when replies are read instead.
+	_ = icmpConn.EnableTimestamps()
+	if opts.FilterICMP {
+		if err := attachFilter(icmpConn); err != nil {
+			icmpConn.Close()
+			return nil, err
+		}
+	}
+
+	return icmpConn, nil
+}
+
+// attachFilter attaches a filter passing only the messages of replyTypes to conn. Where
+// filters are not supported, unrelated messages are discarded when parsed instead, so only
+// other failures are returned.
+func attachFilter(conn *network.ICMPConn) error {
+	err := conn.SetFilter(replyTypes...)
+	if err != nil && !errors.Is(err, network.ErrFilterUnsupported) {
+		return err
+	}
+	return nil
+}
+
+// errNeedsRawSocket is returned when probes of the given method cannot be traced with an
+// unprivileged datagram listener.
+func errNeedsRawSocket(method ProbeMethod) error {
+	return fmt.Errorf("failed to create ICMP connection: %v probes need a raw socket: %w",
+		method, os.ErrPermission)
+}
+
+// bounded calls run with ctx, bounded by opts.TraceTimeout if set, and reports the expiry
+// of the latter as ErrTraceTimeout.
+func (tr *trace) bounded(ctx context.Context, run func(ctx context.Context) error) error {
+	if tr.opts.TraceTimeout <= 0 {
+		return run(ctx)
+	}
+
+	traceCtx, cancel := context.WithTimeout(ctx, tr.opts.TraceTimeout)
+	defer cancel()
+
+	err := run(traceCtx)
+	if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %v: %w", ErrTraceTimeout, tr.opts.TraceTimeout, err)
+	}
+	return err
+}
+
+// run probes every TTL and passes the hops to emit in order, as soon as they complete and
+// their names are resolved. Name lookups run concurrently with the trace, so emit is
+// called from another goroutine, but never concurrently and never after run returns.
+//
+// If ctx is done or opts.TraceTimeout expires in the middle of a hop, the hop is passed to
+// emit with the probes that completed, unless there is none.
+func (tr *trace) run(ctx context.Context, emit func(Hop)) error {
+	return tr.bounded(ctx, func(ctx context.Context) error {
+		return tr.probeHops(ctx, emit)
+	})
+}
+
+// probeHops is run, without opts.TraceTimeout.
+func (tr *trace) probeHops(ctx context.Context, emit func(Hop)) error {
+	opts := tr.opts
+	tr.unresponsive = false
+
+	var names *network.ReverseResolver
+	if opts.ResolveNames {
+		names = tr.resolver
+	}
+	out := newHopEmitter(names, opts.ASNResolver, opts.GeoResolver, opts.MaxHops, emit)
+	defer out.close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// add marks the hops of a routing loop, and stops the trace at the first one with
+	// opts.AbortOnLoop, or at the last of opts.MaxUnresponsiveHops hops in a row that did
+	// not respond. Parallel probes may complete further hops meanwhile; they are dropped.
+	loops := newLoopDetector(opts.LoopThreshold)
+	var loop *RoutingLoopError
+	silent := 0
+	add := func(hop Hop) {
+		if loop != nil || tr.unresponsive {
+			return
+		}
+		if l := loops.observe(hop); l != nil {
+			hop.Loop = true
+			if opts.AbortOnLoop {
+				loop = l
+				cancel()
+			}
+		}
+		out.add(hop)
+
+		if hop.Responded() {
+			silent = 0
+		} else {
+			silent++
+		}
+		if opts.MaxUnresponsiveHops > 0 && silent >= opts.MaxUnresponsiveHops {
+			tr.unresponsive = true
+			cancel()
+		}
+	}
+
+	if opts.Parallel {
+		err := runParallel(ctx, tr.prober, tr.receiver, opts, tr.limiter, add)
+		switch {
+		case loop != nil:
+			return loop
+		case tr.unresponsive:
+			return nil
+		}
+		return err
+	}
+
+	timeouts := newProbeTimeouts(opts)
+	for ttl := opts.FirstTTL; ttl <= opts.MaxHops; ttl++ {
+		hop := Hop{TTL: ttl, SentECN: opts.ECN}
+		pathMTU := tr.pathMTU()
+		log := tr.newReplyLog()
+		done := false
+
+		for attempt := 0; attempt < opts.ProbesPerHop; attempt++ {
+			timeout := timeouts.timeout(ttl)
+			probe, probeDone, err := tr.probeRetrying(ctx, ttl, attempt, timeout, log)
+			if err != nil {
+				if contextErr(ctx) == nil {
+					probe.Err = err
+					hop.add(probe)
+				}
+				if len(hop.RTTs) > 0 {
+					hop.summarize()
+					add(hop)
+				}
+				return err
+			}
+
+			timeouts.observe(ttl, probe)
+			hop.add(probe)
+			done = done || opts.stops(ttl, probe, probeDone)
+		}
+
+		if mtu := tr.pathMTU(); mtu < pathMTU {
+			hop.MTU = mtu
+		}
+		if log != nil {
+			hop.Duplicates, hop.Reordered = log.counts()
+		}
+		hop.summarize()
+		add(hop)
+		if loop != nil {
+			return loop
+		}
+		if done || tr.unresponsive {
+			break
+		}
+	}
+
+	return nil
+}
+
+// probe sends the attempt-th probe for ttl as soon as the limiter allows and waits up to
+// timeout for its reply, or opts.Timeout in PathMTU mode, recording the replies of the hop
+// in log unless it is nil. It also reports whether the trace is done; see probeTTL.
+func (tr *trace) probe(
+	ctx context.Context,
+	ttl, attempt int,
+	timeout time.Duration,
+	log *replyLog,
+) (Probe, bool, error) {
+	if tr.mtu != nil {
+		return tr.probeMTU(ctx, ttl, attempt)
+	}
+	if err := tr.wait(ctx); err != nil {
+		return lostProbe(), false, err
+	}
+	return probeTTL(ctx, tr.prober, tr.receiver, ttl, attempt, timeout, tr.opts.sendRetry(),
+		tr.opts.hooks(), log)
+}
+
+// probeRetrying is probe, sending the probe again up to opts.Retries times while it times
+// out. The probe reports the number of retries sent.
+func (tr *trace) probeRetrying(
+	ctx context.Context,
+	ttl, attempt int,
+	timeout time.Duration,
+	log *replyLog,
+) (Probe, bool, error) {
+	if tr.mtu != nil {
+		return tr.probe(ctx, ttl, attempt, timeout, log)
+	}
+
+	for try := 0; ; try++ {
+		probe, done, err := tr.probe(ctx, ttl, tr.opts.slot(attempt, try), timeout, log)
+		if err != nil || probe.Responded() || try == tr.opts.Retries {
+			probe.Retries = try
+			return probe, done, err
+		}
+	}
+}
+
+// newReplyLog returns a replyLog for the probes of a hop, or nil if they cannot be told
+// apart: TCP probes share their key, and the probes of a path MTU search that of their
+// attempt.
+func (tr *trace) newReplyLog() *replyLog {
+	if _, ok := tr.prober.(directReader); ok || tr.mtu != nil {
+		return nil
+	}
+	return newReplyLog(tr.opts.slotsPerHop())
+}
+
+// wait blocks until the limiter, if any, allows sending a probe.
+func (tr *trace) wait(ctx context.Context) error {
+	if tr.limiter == nil {
+		return nil
+	}
+	return tr.limiter.Wait(ctx)
+}
+
+func (tr *trace) close() {
+	tr.prober.Close()
+	tr.receiver.Close()
+}
+
+// probeTTL sends a single probe with the given TTL and waits up to timeout for its reply.
+// A probe that fails to send for a transient reason is retried as set by retry. The hooks
+// are called once the probe is sent and once it is answered.
+//
+// The send time is taken immediately before the probe is written and the receive time as
+// soon as the matching reply is read, so the RTT excludes TTL setup and parsing.
+// It also reports whether the trace is done, because the reply came from the destination
+// itself or reported it as unreachable. Unless log is nil, the probe and its reply are
+// recorded there, along with any reply to the earlier probes of the hop read meanwhile.
+func probeTTL(
+	ctx context.Context,
+	p prober,
+	receiver messageReader,
+	ttl int,
+	attempt int,
+	timeout time.Duration,
+	retry sendRetry,
+	hooks probeHooks,
+	log *replyLog,
+) (Probe, bool, error) {
+	probe := lostProbe()
+
+	if err := contextErr(ctx); err != nil {
+		return probe, false, err
+	}
+
+	var sent sentProbe
+	err := retry.do(ctx, func() (err error) {
+		sent, err = p.send(ttl, attempt)
+		return err
+	})
+	if err != nil {
+		return probe, false, err
+	}
+	hooks.probeSent(ttl, attempt)
+	probe.SentAt = sent.sentAt
+
+	readCtx, cancel := context.WithDeadline(ctx, sent.sentAt.Add(timeout))
+	defer cancel()
+
+	var direct chan *reply
+	if d, ok := p.(directReader); ok {
+		direct = make(chan *reply, 1)
+		go func() {
+			defer close(direct)
+			if r := d.readDirect(readCtx, sent); r != nil {
+				direct <- r
+				cancel()
+			}
+		}()
+	}
+
+	if log != nil {
+		log.add(attempt, sent)
+	}
+
+	reply, err := readReply(readCtx, receiver, sent, log)
+	cancel()
+	if direct != nil {
+		if r, ok := <-direct; ok && reply == nil {
+			reply = r
+		}
+	}
+
+	if ctxErr := contextErr(ctx); ctxErr != nil {
+		return probe, false, ctxErr
+	}
+	if err != nil || reply == nil {
+		if err == nil {
+			hooks.probeTimedOut(ttl, attempt)
+		}
+		return probe, false, err
+	}
+
+	if log != nil {
+		log.answer(attempt)
+	}
+	probe, done := reply.probe(sent)
+	hooks.replyReceived(ttl, probe)
+	return probe, done, nil
+}
+
+// sentProbe describes an outstanding probe that incoming replies are matched against.
+//
+// Its key is unique among the probes outstanding in the process: UDP and TCP probes are
+// sent from a source port owned by their trace and Echo Requests are numbered by a
+// process-wide counter, so concurrent traces never claim each other's replies.
+type sentProbe struct {
+	dst    net.IP
+	key    network.ProbeKey
+	sentAt time.Time
+	// offloadedChecksum is the checksum quoted instead of key.Checksum when the probe left
+	// through an interface that offloads checksums, such as loopback.
+	offloadedChecksum int
+	// ports is the sequence that allocated the destination port of a classic UDP probe,
+	// which identifies its TTL and attempt, and nil for other probes.
+	ports   *portSequence
+	ttl     int
+	attempt int
+	// ipID is the IPv4 Identification the probe was sent with, or zero if the kernel chose
+	// it. It is unique among the probes outstanding in the process, like key.
+	ipID int
+}
+
+// matches reports whether an ICMP error quoting a datagram to quotedDst with the given key
+// was elicited by this probe. Routers that do not quote the transport header are matched
+// on the destination address alone.
+func (p sentProbe) matches(quotedDst net.IP, key *network.ProbeKey) bool {
+	if !quotedDst.Equal(p.dst) {
+		return false
+	}
+	if key == nil {
+		return true
+	}
+	if key.Protocol != p.key.Protocol {
+		return false
+	}
+
+	switch key.Protocol {
+	case protocolICMP, protocolICMPv6:
+		if key.EchoID == 0 && key.EchoSeq == 0 {
+			return true
+		}
+		return key.EchoID == p.key.EchoID && key.EchoSeq == p.key.EchoSeq
+	default:
+		if key.SrcPort == 0 && key.DstPort == 0 {
+			return true
+		}
+		// The Identification tags the probe even when a NAT rewrote its ports.
+		if p.ipID != 0 && key.ID == p.ipID {
+			return true
+		}
+		if key.SrcPort != p.key.SrcPort {
+			return false
+		}
+		if p.ports != nil {
+			ttl, attempt, ok := p.ports.probe(key.DstPort)
+			return ok && ttl == p.ttl && attempt == p.attempt
+		}
+		if key.DstPort != p.key.DstPort {
+			return false
+		}
+		// Paris probes share their ports and differ in the checksum only.
+		if p.key.Checksum == 0 || key.Checksum == 0 {
+			return true
+		}
+		return key.Checksum == p.key.Checksum || key.Checksum == p.offloadedChecksum
+	}
+}
+
+// rewritten reports whether key quotes the probe with other ports than it was sent with.
+func (p sentProbe) rewritten(key *network.ProbeKey) bool {
+	if key == nil || key.SrcPort == 0 && key.DstPort == 0 {
+		return false
+	}
+	return key.SrcPort != p.key.SrcPort || key.DstPort != p.key.DstPort
+}
+
+// matchesEcho reports whether an Echo Reply from peer answers this probe.
+func (p sentProbe) matchesEcho(peer net.IP, parsed *network.ParsedICMP) bool {
+	if !peer.Equal(p.dst) {
+		return false
+	}
+	if p.key.Protocol != protocolICMP && p.key.Protocol != protocolICMPv6 {
+		return false
+	}
+	return parsed.MatchesEcho(p.key.EchoID, p.key.EchoSeq)
+}
+
+// reply is an ICMP message matched to an outstanding probe.
+type reply struct {
+	from       net.IP
+	receivedAt time.Time
+	reached    bool
+	// ttl is the TTL the reply arrived with, or -1 if it is unknown.
+	ttl int
+	// icmpType and icmpCode are those of the ICMP message, or -1 for a reply outside of
+	// ICMP.
+	icmpType int
+	icmpCode int
+	// unreachable is set when a router answered with Destination Unreachable, so probes
+	// with a higher TTL would not get any further.
+	unreachable bool
+	annotation  string
+	// tooBig is set when a router could not forward the probe without fragmenting it, and
+	// mtu is the next-hop MTU it reported, if any.
+	tooBig bool
+	mtu    int
+	// quotedTOS, quotedTTL and quotedID are the TOS byte, TTL and IPv4 Identification of the
+	// quoted probe, or -1 if the reply did not quote it.
+	quotedTOS int
+	quotedTTL int
+	quotedID  int
+	// rewritten is set when the reply quoted the probe with other ports than it was sent
+	// with, which only a probe matched on its IPv4 Identification can be.
+	rewritten bool
+	mpls      []network.MPLSLabel
+	iface     *network.InterfaceInfo
+}
+
+// lostProbe returns the outcome of a probe that received no reply.
+func lostProbe() Probe {
+	return Probe{RTT: NoRTT, ReplyTTL: -1, ICMPType: -1, ICMPCode: -1, QuotedTTL: -1,
+		QuotedECN: UnknownECN}
+}
+
+// probe returns the outcome of the sent probe this is the reply to. It also reports whether
+// the trace is done, because the reply came from the destination itself or reported it as
+// unreachable.
+func (r *reply) probe(sent sentProbe) (Probe, bool) {
+	probe := Probe{
+		Responder:  r.from,
+		SentAt:     sent.sentAt,
+		RTT:        r.receivedAt.Sub(sent.sentAt),
+		ReplyTTL:   r.ttl,
+		ICMPType:   r.icmpType,
+		ICMPCode:   r.icmpCode,
+		QuotedTTL:  r.quotedTTL,
+		Annotation: r.annotation,
+		MTU:        r.mtu,
+		QuotedECN:  UnknownECN,
+		MPLS:       r.mpls,
+		Interface:  r.iface,
+		tooBig:     r.tooBig,
+	}
+	if r.quotedTOS >= 0 {
+		probe.QuotedECN = network.ECNOf(r.quotedTOS)
+	}
+	if sent.ipID != 0 && r.quotedID >= 0 {
+		probe.NATDetected = r.quotedID != sent.ipID || r.rewritten
+	}
+	return probe, r.reached || r.unreachable
+}
+
+// readReply waits until ctx is done for an ICMP message elicited by the probe.
+//
+// The listener sees every ICMP message delivered to the host, so messages that do not
+// quote the probe, such as unrelated pings or unreachables, are discarded once log, unless
+// it is nil, has seen them. It returns nil if nothing relevant arrived in time.
+func readReply(
+	ctx context.Context,
+	conn messageReader,
+	probe sentProbe,
+	log *replyLog,
+) (*reply, error) {
+	for {
+		msg, parsed, err := readParsed(ctx, conn)
+		switch network.Classify(err) {
+		case network.Ignore:
+			continue
+		case network.Terminal:
+			if ctx.Err() != nil || errors.Is(err, network.ErrReadTimeout) ||
+				errors.Is(err, context.DeadlineExceeded) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		if r := probe.replyFrom(msg, parsed); r != nil {
+			return r, nil
+		}
+		if log != nil {
+			log.observe(msg, parsed)
+		}
+	}
+}
+
+// readParsed reads a single message from conn and parses it. The error of a message that
+// does not parse is classified as network.Ignore; see network.Classify.
+func readParsed(
+	ctx context.Context,
+	conn messageReader,
+) (*network.Message, *network.ParsedICMP, error) {
+	if r, ok := conn.(parsedReader); ok {
+		return r.readParsed(ctx)
+	}
+
+	msg, err := conn.ReadMessage(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := parseReply(conn.Family(), msg)
+	return msg, parsed, err
+}
+
+// parseReply parses a message read from the ICMP listener. Corrupted messages fail with
+// network.ErrBadChecksum, to be dropped like any other unparsable message.
+func parseReply(family network.Family, msg *network.Message) (*network.ParsedICMP, error) {
+	return network.ParseICMPWithOptions(family, msg.Data,
+		network.ParseOptions{VerifyChecksum: true})
+}
+
+// replyFrom returns the reply to the probe carried by msg, or nil if msg was not elicited
+// by the probe.
+func (p sentProbe) replyFrom(msg *network.Message, parsed *network.ParsedICMP) *reply {
+	peer := msg.Peer
+
+	switch parsed.Type {
+	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+		if p.matchesEcho(peer, parsed) {
+			return &reply{
+				from:       peer,
+				receivedAt: msg.ReceivedAt,
+				reached:    true,
+				ttl:        msg.TTL,
+				icmpType:   icmpType(parsed.Type),
+				icmpCode:   parsed.Code,
+				quotedTOS:  -1,
+				quotedTTL:  -1,
+				quotedID:   -1,
+			}
+		}
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded,
+		ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable,
+		ipv4.ICMPTypeParameterProblem, ipv6.ICMPTypeParameterProblem,
+		ipv6.ICMPTypePacketTooBig:
+		// The destination answers a UDP probe with Port Unreachable, so a quoting reply
+		// from the destination itself means the trace is complete.
+		if p.matches(parsed.QuotedDst(), parsed.Key) {
+			return &reply{
+				from:        peer,
+				receivedAt:  msg.ReceivedAt,
+				reached:     peer.Equal(p.dst),
+				ttl:         msg.TTL,
+				icmpType:    icmpType(parsed.Type),
+				icmpCode:    parsed.Code,
+				unreachable: parsed.Unreachable() != network.NotUnreachable,
+				annotation:  parsed.Annotation(),
+				tooBig:      parsed.Unreachable() == network.UnreachableFragmentation,
+				mtu:         parsed.MTU,
+				quotedTOS:   parsed.QuotedTOS(),
+				quotedTTL:   parsed.QuotedTTL(),
+				quotedID:    parsed.QuotedID(),
+				rewritten:   p.rewritten(parsed.Key),
+				mpls:        parsed.MPLS,
+				iface:       parsed.Interface,
+			}
+		}
+	}
+
+	return nil
+}
+
+// icmpType returns the number of an ICMP or ICMPv6 message type.
+func icmpType(t icmp.Type) int {
+	switch t := t.(type) {
+	case ipv4.ICMPType:
+		return int(t)
+	case ipv6.ICMPType:
+		return int(t)
+	default:
+		return -1
+	}
+}
+
+// checkPorts validates the destination ports of UDP probes.
+func checkPorts(opts Options) error {
+	if opts.Method != UDP {
+		return nil
+	}
+	switch {
+	case opts.Vary == VarySrcPort && opts.Paris:
+		return fmt.Errorf("varying the source port is not supported with Paris probes")
+	case opts.Vary == VarySrcPort && opts.SrcPort != 0:
+		return fmt.Errorf("a fixed source port is not supported when varying the source port")
+	case opts.Vary == VarySrcPort:
+		if opts.Port > 0xffff {
+			return fmt.Errorf("invalid port %d", opts.Port)
+		}
+		return nil
+	case opts.Paris:
+		return nil
+	default:
+		return opts.ports().check(opts.MaxHops)
+	}
+}
+
+// checkPacketSize validates opts.PacketSize for probes to dest.
+func checkPacketSize(opts Options, dest net.IP) error {
+	if opts.PacketSize == 0 {
+		return nil
+	}
+	if opts.Method != UDP || opts.Paris {
+		return fmt.Errorf("packet size is only supported with UDP probes")
+	}
+
+	overhead := packetOverhead(dest)
+	if opts.PacketSize < overhead {
+		return fmt.Errorf("invalid packet size %d: must be at least %d", opts.PacketSize,
+			overhead)
+	}
+	family, _ := familyOf(dest)
+	if size := opts.PacketSize - overhead; size > network.MaxPayloadSize(family) {
+		return &network.PayloadSizeError{Size: size, Max: network.MaxPayloadSize(family)}
+	}
+	return nil
+}
+
+func familyOf(ip net.IP) (network.Family, error) {
+	switch {
+	case ip.To4() != nil:
+		return network.IPv4, nil
+	case ip.To16() != nil:
+		return network.IPv6, nil
+	default:
+		return 0, fmt.Errorf("invalid destination address: %v", ip)
+	}
+}
+
+// contextErr is ctx.Err(), except that a deadline is reported as soon as it has passed.
+// Socket deadlines can expire a moment before the timer of ctx fires, and a read that timed
+// out must not be mistaken for a lost probe then.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
@@ -0,0 +1,1357 @@
+package tracer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"my-little-tracerouter/internal/network"
+)
+
+func TestOptionsWithDefaults(t *testing.T) {
+	opts := Options{}.withDefaults()
+
+	assert.Equal(t, DefaultMaxHops, opts.MaxHops)
+	assert.Equal(t, 1, opts.FirstTTL)
+	assert.Equal(t, DefaultTimeout, opts.Timeout)
+	assert.Equal(t, DefaultPort, opts.Port)
+	assert.Equal(t, DefaultPort, opts.BasePort)
+	assert.Equal(t, DefaultProbesPerHop, opts.ProbesPerHop)
+	assert.Equal(t, DefaultMaxInFlight, opts.MaxInFlight)
+	assert.Equal(t, DefaultMaxConcurrentProbes, opts.MaxConcurrentProbes)
+	assert.Equal(t, DefaultMaxUnresponsiveHops, opts.MaxUnresponsiveHops)
+	assert.Equal(t, DefaultInterval, opts.Interval)
+	assert.Equal(t, -1, Options{MaxUnresponsiveHops: -1}.withDefaults().MaxUnresponsiveHops)
+	assert.Equal(t, 4, Options{MaxInFlight: 4}.withDefaults().MaxConcurrentProbes)
+	assert.Equal(t, 2,
+		Options{MaxInFlight: 4, MaxConcurrentProbes: 2}.withDefaults().MaxConcurrentProbes)
+	assert.Equal(t, DefaultTCPPort, Options{Method: TCP}.withDefaults().Port)
+	assert.True(t, Options{PathMTU: true}.withDefaults().DontFragment)
+
+	opts = Options{MaxHops: 5, Timeout: time.Second, Port: 40000, ProbesPerHop: 1}.withDefaults()
+
+	assert.Equal(t, 5, opts.MaxHops)
+	assert.Equal(t, time.Second, opts.Timeout)
+	assert.Equal(t, 40000, opts.Port)
+	assert.Equal(t, 40000, opts.BasePort, "the probes start at Port")
+	assert.Equal(t, 1, opts.ProbesPerHop)
+	assert.Equal(t, 50000, Options{Port: 40000, BasePort: 50000}.withDefaults().BasePort)
+}
+
+func TestNewOptions(t *testing.T) {
+	assert.Equal(t, Options{}, New().opts)
+
+	tr := New(
+		WithOptions(Options{MaxHops: 10, FirstTTL: 2}),
+		WithMaxTTL(5),
+		WithProbesPerHop(2),
+		WithTimeout(time.Second),
+		WithProtocol(ICMP),
+	)
+
+	assert.Equal(t, Options{
+		MaxHops:      5,
+		FirstTTL:     2,
+		ProbesPerHop: 2,
+		Timeout:      time.Second,
+		Method:       ICMP,
+	}, tr.opts)
+}
+
+func TestBanner(t *testing.T) {
+	target := &network.Target{Host: "example.com", IP: net.IPv4(192, 0, 2, 1)}
+
+	assert.Equal(t, "traceroute to example.com (192.0.2.1), 30 hops max",
+		Banner(target, Options{}))
+	assert.Equal(t, "traceroute to example.com (192.0.2.1), 5 hops max",
+		Banner(target, Options{MaxHops: 5}))
+	assert.Equal(t, "traceroute to example.com (192.0.2.1) from 198.51.100.2, 30 hops max",
+		Banner(target, Options{SourceIP: net.IPv4(198, 51, 100, 2)}))
+}
+
+func TestTracerRunInvalidDestination(t *testing.T) {
+	hops, err := New().Run(context.Background(), net.IP{1, 2, 3})
+
+	assert.Error(t, err)
+	assert.Nil(t, hops)
+}
+
+func TestTracerRunLoopback(t *testing.T) {
+	for _, method := range []ProbeMethod{UDP, ICMP, TCP} {
+		for _, dest := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+			method, dest := method, dest
+			t.Run(method.String()+"/"+dest.String(), func(t *testing.T) {
+				testTracerRunLoopback(t, method, dest)
+			})
+		}
+	}
+}
+
+func testTracerRunLoopback(t *testing.T, method ProbeMethod, dest net.IP) {
+	hops, err := New(WithOptions(Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+		Method:  method,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.Equal(t, 1, hops[0].TTL)
+	assert.True(t, hops[0].IP.Equal(dest))
+	assert.Len(t, hops[0].RTTs, DefaultProbesPerHop)
+	assert.Greater(t, hops[0].Min, time.Duration(0))
+	assert.Equal(t, 0.0, hops[0].Loss)
+	assert.True(t, hops[0].Responded())
+	assert.Empty(t, hops[0].Host)
+	if method != TCP {
+		// The destination's reply travels back over loopback without losing TTL.
+		assert.Equal(t, 0, hops[0].ReturnHops())
+	}
+}
+
+func TestTracerRunFilterICMPLoopback(t *testing.T) {
+	for _, method := range []ProbeMethod{UDP, ICMP} {
+		for _, dest := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+			method, dest := method, dest
+			t.Run(method.String()+"/"+dest.String(), func(t *testing.T) {
+				hops, err := New(WithOptions(Options{
+					MaxHops:    3,
+					Timeout:    time.Second,
+					Method:     method,
+					FilterICMP: true,
+				})).Run(context.Background(), dest)
+				if err != nil && errors.Is(err, os.ErrPermission) {
+					t.Skip("raw ICMP sockets require elevated privileges")
+				}
+
+				require.NoError(t, err)
+				require.Len(t, hops, 1)
+				assert.True(t, hops[0].IP.Equal(dest))
+				assert.Equal(t, 0.0, hops[0].Loss)
+			})
+		}
+	}
+}
+
+func TestAttachFilter(t *testing.T) {
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udp.Close()
+
+	// The socket of a connection the network package does not know cannot be reached, a
+	// failure other than a platform without filters.
+	conn, err := network.NewICMPConnFrom(network.IPv4, struct{ net.PacketConn }{udp})
+	require.NoError(t, err)
+
+	err = attachFilter(conn)
+	assert.ErrorContains(t, err, "failed to attach ICMP filter")
+	assert.NotErrorIs(t, err, network.ErrFilterUnsupported)
+}
+
+func TestTracerRunReadSize(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	hops, err := New(WithOptions(Options{
+		MaxHops:  3,
+		Timeout:  time.Second,
+		ReadSize: 9000,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+
+	_, err = New(WithOptions(Options{ReadSize: 1})).Run(context.Background(), dest)
+	assert.ErrorContains(t, err, "invalid read size")
+}
+
+func TestTracerRunOnRawPacketLoopback(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+	var mu sync.Mutex
+	var packets [][]byte
+
+	hops, err := New(WithOptions(Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+		Method:  ICMP,
+		OnRawPacket: func(peer net.IP, data []byte) {
+			if !peer.Equal(dest) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			packets = append(packets, data)
+		},
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var replies int
+	for _, data := range packets {
+		if parsed, err := network.ParseICMP(network.IPv4, data); err == nil &&
+			parsed.Type == ipv4.ICMPTypeEchoReply {
+			replies++
+		}
+	}
+	assert.GreaterOrEqual(t, replies, DefaultProbesPerHop)
+}
+
+func TestTracerRunEchoIDLoopback(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+	tr, err := New().start(dest, Options{Method: ICMP, EchoID: 0x4242})
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer tr.close()
+
+	if icmpConn, ok := tr.receiver.(*echoFilter).messageReader.(*network.ICMPConn); ok &&
+		icmpConn.Mode() == network.RawICMP {
+		assert.Equal(t, 0x4242, tr.prober.(*echoProber).id)
+	}
+
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+}
+
+func TestTracerRunInvalidEchoID(t *testing.T) {
+	_, err := New(WithOptions(Options{
+		Method: ICMP,
+		EchoID: 0x10000,
+	})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+	assert.EqualError(t, err, "invalid ICMP identifier 65536")
+}
+
+func TestTracerRunUnprivilegedLoopback(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	hops, err := New(WithOptions(Options{
+		MaxHops:      3,
+		Timeout:      time.Second,
+		Method:       ICMP,
+		Unprivileged: true,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("datagram ICMP sockets are not allowed by net.ipv4.ping_group_range")
+	}
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+}
+
+func TestTracerRunUnprivilegedNeedsICMP(t *testing.T) {
+	for _, method := range []ProbeMethod{UDP, TCP} {
+		hops, err := New(WithOptions(Options{
+			Method:       method,
+			Unprivileged: true,
+		})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+		assert.ErrorIs(t, err, os.ErrPermission)
+		assert.ErrorContains(t, err, "raw socket")
+		assert.Nil(t, hops)
+	}
+}
+
+func TestTracerRunFirstTTL(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		dest := net.IPv4(127, 0, 0, 1)
+
+		hops, err := New(WithOptions(Options{
+			MaxHops:  8,
+			FirstTTL: 4,
+			Timeout:  time.Second,
+			Parallel: parallel,
+		})).Run(context.Background(), dest)
+		if err != nil && errors.Is(err, os.ErrPermission) {
+			t.Skip("raw ICMP sockets require elevated privileges")
+		}
+
+		require.NoError(t, err, parallel)
+		require.Len(t, hops, 1, parallel)
+		assert.Equal(t, 4, hops[0].TTL, "hops are numbered by their TTL")
+		assert.True(t, hops[0].IP.Equal(dest))
+	}
+}
+
+func TestTracerRunFirstTTLBeyondMaxHops(t *testing.T) {
+	tr := New(WithOptions(Options{MaxHops: 3, FirstTTL: 4}))
+	hops, err := tr.Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+	assert.ErrorContains(t, err, "invalid first TTL 4")
+	assert.Nil(t, hops)
+}
+
+func TestTracerRunUsesNewOptions(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+	tr := New(WithOptions(Options{FirstTTL: 4}), WithMaxTTL(3))
+
+	// FirstTTL 4 is only invalid if the maximum TTL given to New applies.
+	_, err := tr.Run(context.Background(), dest)
+	assert.ErrorContains(t, err, "invalid first TTL 4")
+
+	_, err = New().RunWithOptions(context.Background(), dest, Options{MaxHops: 3, FirstTTL: 4})
+	assert.ErrorContains(t, err, "invalid first TTL 4")
+}
+
+func TestTracerRunParis(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	hops, err := New(WithOptions(Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+		Paris:   true,
+		FlowID:  7,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+	assert.Equal(t, 0.0, hops[0].Loss)
+}
+
+func TestTracerRunDontFragment(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	hops, err := New(WithOptions(Options{
+		MaxHops:      3,
+		Timeout:      time.Second,
+		DontFragment: true,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+	// Empty probes fit any link, so no MTU is reported.
+	assert.Zero(t, hops[0].MTU)
+}
+
+func TestTracerRunPacketSize(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	hops, err := New(WithOptions(Options{
+		MaxHops:    3,
+		Timeout:    time.Second,
+		PacketSize: 60,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+}
+
+func TestTracerRunPayload(t *testing.T) {
+	type probe struct{ ttl, attempt, size int }
+	var mu sync.Mutex
+	var probes []probe
+
+	hops, err := New(WithOptions(Options{
+		MaxHops:      3,
+		Timeout:      time.Second,
+		ProbesPerHop: 2,
+		PacketSize:   40,
+		Payload: func(ttl, attempt, size int) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			probes = append(probes, probe{ttl, attempt, size})
+			return make([]byte, size)
+		},
+	})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.Equal(t, []probe{{1, 0, 12}, {1, 1, 12}}, probes)
+}
+
+func TestTracerRunPacketSizeInvalid(t *testing.T) {
+	for _, opts := range []Options{
+		{PacketSize: 60, Method: TCP},
+		{PacketSize: 60, Paris: true},
+		{PacketSize: 27},
+		{PacketSize: 1501},
+	} {
+		hops, err := New(WithOptions(opts)).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+		assert.Error(t, err)
+		assert.Nil(t, hops)
+	}
+
+	tr := New(WithOptions(Options{PacketSize: 1501}))
+	_, err := tr.Run(context.Background(), net.IPv6loopback)
+
+	var sizeErr *network.PayloadSizeError
+	require.ErrorAs(t, err, &sizeErr)
+	assert.Equal(t, 1453, sizeErr.Size)
+}
+
+func TestTracerRunPathMTU(t *testing.T) {
+	for _, dest := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		hops, err := New(WithOptions(Options{
+			MaxHops: 3,
+			Timeout: time.Second,
+			PathMTU: true,
+		})).Run(context.Background(), dest)
+		if err != nil && errors.Is(err, os.ErrPermission) {
+			t.Skip("raw ICMP sockets require elevated privileges")
+		}
+
+		require.NoError(t, err)
+		require.Len(t, hops, 1)
+		assert.True(t, hops[0].IP.Equal(dest))
+		// Loopback carries far larger packets than the first probes.
+		assert.Zero(t, hops[0].MTU)
+	}
+}
+
+func TestTracerRunPathMTUUnsupported(t *testing.T) {
+	for _, opts := range []Options{
+		{PathMTU: true, Method: TCP},
+		{PathMTU: true, Method: ICMP},
+		{PathMTU: true, Paris: true},
+		{PathMTU: true, Parallel: true},
+	} {
+		hops, err := New(WithOptions(opts)).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+		assert.Error(t, err)
+		assert.Nil(t, hops)
+	}
+}
+
+func TestTracerRunTOS(t *testing.T) {
+	for _, method := range []ProbeMethod{UDP, ICMP} {
+		t.Run(method.String(), func(t *testing.T) {
+			dest := net.IPv4(127, 0, 0, 1)
+
+			hops, err := New(WithOptions(Options{
+				MaxHops: 3,
+				Timeout: time.Second,
+				Method:  method,
+				TOS:     0xb8,
+			})).Run(context.Background(), dest)
+			if err != nil && errors.Is(err, os.ErrPermission) {
+				t.Skip("raw ICMP sockets require elevated privileges")
+			}
+
+			require.NoError(t, err)
+			require.Len(t, hops, 1)
+			assert.True(t, hops[0].IP.Equal(dest))
+		})
+	}
+}
+
+func TestTracerRunECN(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	hops, err := New(WithOptions(Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+		TOS:     0xb8,
+		ECN:     network.ECT0,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	// The Port Unreachable of the destination quotes the probe with its marking intact.
+	assert.Equal(t, 1, hops[0].QuotedTTL)
+	assert.Equal(t, network.ECT0, hops[0].SentECN)
+	assert.Equal(t, network.ECT0, hops[0].QuotedECN)
+	assert.False(t, hops[0].ECNBleached())
+}
+
+func TestOptionsSlots(t *testing.T) {
+	opts := Options{ProbesPerHop: 3, Retries: 2}.withDefaults()
+	assert.Equal(t, 9, opts.slotsPerHop())
+	assert.Equal(t, 3, Options{}.withDefaults().slotsPerHop())
+	assert.Equal(t, 0, Options{Retries: -1}.withDefaults().Retries)
+
+	ports := opts.ports()
+	seen := make(map[int]bool)
+	for ttl := 1; ttl <= 4; ttl++ {
+		for attempt := 0; attempt < 3; attempt++ {
+			for try := 0; try <= 2; try++ {
+				slot := opts.slot(attempt, try)
+				port := ports.port(ttl, slot)
+				assert.False(t, seen[port], "port %d is used twice", port)
+				seen[port] = true
+
+				gotTTL, gotSlot, ok := ports.probe(port)
+				assert.True(t, ok)
+				assert.Equal(t, ttl, gotTTL)
+				assert.Equal(t, slot, gotSlot)
+			}
+		}
+	}
+
+	// Retries take ports of their own, so fewer hops fit below 65535.
+	assert.NoError(t, checkPorts(Options{Port: 65535 - 89}.withDefaults()))
+	assert.Error(t, checkPorts(Options{Port: 65535 - 89, Retries: 1}.withDefaults()))
+}
+
+func TestTraceRunRetries(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	router := net.IPv4(192, 0, 2, 1)
+	p := &slotProber{dest: dest, sent: make(chan int, 3)}
+
+	// The original probe times out, and its reply arrives right before that of the retry,
+	// which is held back in next.
+	next := make(chan *network.Message, 1)
+	read := answerAttempts(t, p, func(attempt int) bool { return attempt > 0 })
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			select {
+			case msg := <-next:
+				return msg, nil
+			default:
+			}
+
+			msg, err := read(ctx)
+			if err == nil {
+				next <- msg
+				msg = &network.Message{
+					Peer:       router,
+					Data:       quotingMessage(t, dest, ipv4.ICMPTypeTimeExceeded, 0, 1),
+					TTL:        -1,
+					ReceivedAt: time.Now(),
+				}
+			}
+			return msg, err
+		})
+	receiver.On("Close").Return(nil)
+
+	opts := Options{
+		MaxHops:      3,
+		Timeout:      50 * time.Millisecond,
+		ProbesPerHop: 1,
+		Retries:      2,
+	}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest), "the late reply to the original is not the retry's")
+	require.Len(t, hops[0].Probes, 1)
+	assert.Equal(t, 1, hops[0].Probes[0].Retries)
+	assert.Less(t, hops[0].RTTs[0], opts.Timeout)
+	assert.Equal(t, 1, hops[0].Retries)
+	assert.Equal(t, 0.0, hops[0].Loss)
+	assert.Equal(t, 100.0, hops[0].FirstLoss)
+}
+
+func TestTraceRunRetriesExhausted(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &slotProber{dest: dest, sent: make(chan int, 6)}
+
+	var sent []int
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		answerAttempts(t, p, func(attempt int) bool {
+			sent = append(sent, attempt)
+			return false
+		}))
+	receiver.On("Close").Return(nil)
+
+	opts := Options{
+		MaxHops:      1,
+		Timeout:      20 * time.Millisecond,
+		ProbesPerHop: 2,
+		Retries:      2,
+	}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+
+	assert.Equal(t, []int{0, 2, 4, 1, 3, 5}, sent)
+	require.Len(t, hops, 1)
+	assert.Len(t, hops[0].RTTs, 2, "retries are not probes of their own")
+	assert.Equal(t, 2, hops[0].Probes[0].Retries)
+	assert.Equal(t, 4, hops[0].Retries)
+	assert.Equal(t, 100.0, hops[0].Loss)
+	assert.Equal(t, 100.0, hops[0].FirstLoss)
+}
+
+// failingProber is a fakeProber whose probes fail to send from TTL failAt on.
+type failingProber struct {
+	fakeProber
+	failAt int
+	err    error
+}
+
+func (p *failingProber) send(ttl, attempt int) (sentProbe, error) {
+	if ttl >= p.failAt {
+		return sentProbe{}, p.err
+	}
+	return p.fakeProber.send(ttl, attempt)
+}
+
+func TestTraceRunSendError(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	router := net.IPv4(192, 0, 2, 1)
+	sendErr := errors.New("network is unreachable")
+	p := &failingProber{fakeProber: fakeProber{dest: dest, sent: make(chan int, 1)},
+		failAt: 2, err: sendErr}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			select {
+			case ttl := <-p.sent:
+				return &network.Message{
+					Peer:       router,
+					Data:       quotingMessage(t, dest, ipv4.ICMPTypeTimeExceeded, 0, ttl),
+					TTL:        -1,
+					ReceivedAt: time.Now(),
+				}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+	receiver.On("Close").Return(nil)
+
+	opts := Options{MaxHops: 3, Timeout: 50 * time.Millisecond, ProbesPerHop: 1}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	err := tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) })
+
+	assert.ErrorIs(t, err, sendErr)
+	require.Len(t, hops, 2)
+	assert.NoError(t, hops[0].Probes[0].Err)
+	require.Len(t, hops[1].Probes, 1)
+	assert.ErrorIs(t, hops[1].Probes[0].Err, sendErr)
+	assert.False(t, hops[1].Responded())
+}
+
+func TestTraceRunTraceTimeout(t *testing.T) {
+	for _, ownTimeout := range []bool{true, false} {
+		name := "context"
+		if ownTimeout {
+			name = "TraceTimeout"
+		}
+		t.Run(name, func(t *testing.T) {
+			testTraceRunTraceTimeout(t, ownTimeout)
+		})
+	}
+}
+
+func testTraceRunTraceTimeout(t *testing.T, ownTimeout bool) {
+	dest := net.IPv4(198, 51, 100, 7)
+	router := net.IPv4(192, 0, 2, 1)
+	p := &fakeProber{dest: dest, sent: make(chan int, 1)}
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).Return(
+		func(ctx context.Context) (*network.Message, error) {
+			select {
+			case ttl := <-p.sent:
+				if ttl == 1 {
+					return &network.Message{
+						Peer:       router,
+						Data:       quotingMessage(t, dest, ipv4.ICMPTypeTimeExceeded, 0, ttl),
+						TTL:        -1,
+						ReceivedAt: time.Now(),
+					}, nil
+				}
+				// No other hop answers.
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+	receiver.On("Close").Return(nil)
+
+	// The second hop is cut short after two of its probes timed out.
+	const traceTimeout = 250 * time.Millisecond
+	opts := Options{MaxHops: 5, Timeout: 100 * time.Millisecond}
+	ctx := context.Background()
+	if ownTimeout {
+		opts.TraceTimeout = traceTimeout
+	} else {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, traceTimeout)
+		defer cancel()
+	}
+	tr := &trace{opts: opts.withDefaults(), receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	err := tr.run(ctx, func(hop Hop) { hops = append(hops, hop) })
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	if ownTimeout {
+		assert.ErrorIs(t, err, ErrTraceTimeout)
+	} else {
+		assert.NotErrorIs(t, err, ErrTraceTimeout)
+	}
+	require.Len(t, hops, 2)
+	assert.True(t, hops[0].IP.Equal(router))
+	assert.Len(t, hops[0].RTTs, DefaultProbesPerHop)
+	assert.Len(t, hops[1].RTTs, 2)
+	assert.Equal(t, 100.0, hops[1].Loss)
+}
+
+func TestOptionsTrafficClass(t *testing.T) {
+	assert.Equal(t, 0, Options{}.trafficClass())
+	assert.Equal(t, 0xb8, Options{TOS: 0xb8}.trafficClass())
+	assert.Equal(t, 0xba, Options{TOS: 0xb8, ECN: network.ECT0}.trafficClass())
+	assert.Equal(t, 0xb9, Options{TOS: 0xbb, ECN: network.ECT1}.trafficClass())
+}
+
+func TestTracerRunUnknownInterface(t *testing.T) {
+	_, err := New(WithOptions(Options{
+		MaxHops:   1,
+		Timeout:   100 * time.Millisecond,
+		Interface: "nosuchif0",
+	})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	assert.ErrorContains(t, err, "nosuchif0")
+}
+
+func TestTracerRunInterfaceLoopback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the loopback interface is only named lo on Linux")
+	}
+	dest := net.IPv4(127, 0, 0, 1)
+
+	for _, method := range []ProbeMethod{UDP, ICMP, TCP} {
+		t.Run(method.String(), func(t *testing.T) {
+			hops, err := New(WithOptions(Options{
+				MaxHops:       3,
+				Timeout:       time.Second,
+				Method:        method,
+				Interface:     "lo",
+				InterfaceOnly: true,
+			})).Run(context.Background(), dest)
+			if err != nil && errors.Is(err, os.ErrPermission) {
+				t.Skip("binding to an interface requires elevated privileges")
+			}
+
+			require.NoError(t, err)
+			require.Len(t, hops, 1)
+			assert.True(t, hops[0].IP.Equal(dest))
+		})
+	}
+}
+
+func TestTracerRunResolveNames(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	hops, err := New(WithOptions(Options{
+		MaxHops:      3,
+		Timeout:      time.Second,
+		ProbesPerHop: 1,
+		ResolveNames: true,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	// Without a PTR record the name falls back to the address itself.
+	assert.NotEmpty(t, hops[0].Host)
+}
+
+func TestOptionsNameResolver(t *testing.T) {
+	fallback := network.NewReverseResolver(0)
+	custom := network.NewLimitedReverseResolver(time.Second, 1)
+
+	assert.Same(t, fallback, Options{}.nameResolver(fallback))
+	assert.Same(t, custom, Options{NameResolver: custom}.nameResolver(fallback))
+
+	dns := &stubDNSResolver{names: map[string][]string{"192.0.2.1": {"gw.corp.example."}}}
+	assert.Same(t, custom, Options{NameResolver: custom, DNSResolver: dns}.nameResolver(fallback))
+	names := Options{DNSResolver: dns}.nameResolver(fallback)
+	assert.Equal(t, "gw.corp.example", names.ResolveHop(net.IPv4(192, 0, 2, 1)))
+}
+
+// stubDNSResolver answers lookups from its records.
+type stubDNSResolver struct {
+	addrs map[string][]string
+	names map[string][]string
+}
+
+func (r *stubDNSResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	result := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return result, nil
+}
+
+func (r *stubDNSResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func TestTracerRunTimeout(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation, so nothing answers probes sent there.
+	hops, err := New(WithOptions(Options{
+		MaxHops:      1,
+		Timeout:      100 * time.Millisecond,
+		ProbesPerHop: 2,
+	})).Run(context.Background(), net.IPv4(192, 0, 2, 254))
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.Nil(t, hops[0].IP)
+	assert.Equal(t, []time.Duration{NoRTT, NoRTT}, hops[0].RTTs)
+	assert.Equal(t, 100.0, hops[0].Loss)
+	assert.False(t, hops[0].Responded())
+}
+
+func TestSentProbeMatches(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	key := network.ProbeKey{Protocol: protocolUDP, SrcPort: 50000, DstPort: 33434}
+	probe := sentProbe{dst: dst, key: key}
+
+	assert.True(t, probe.matches(dst, &key))
+	assert.True(t, probe.matches(dst, &network.ProbeKey{Protocol: protocolUDP}))
+	assert.True(t, probe.matches(dst, nil))
+	assert.False(t, probe.matches(dst,
+		&network.ProbeKey{Protocol: protocolUDP, SrcPort: 50001, DstPort: 33434}))
+	assert.False(t, probe.matches(dst,
+		&network.ProbeKey{Protocol: protocolTCP, SrcPort: 50000, DstPort: 33434}))
+	assert.False(t, probe.matches(net.IPv4(198, 51, 100, 8), &key))
+}
+
+func TestSentProbeMatchesPortSequence(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	ports := portSequence{base: DefaultPort, probesPerHop: 3}
+	probe := sentProbe{
+		dst:     dst,
+		key:     network.ProbeKey{Protocol: protocolUDP, SrcPort: 50000, DstPort: ports.port(2, 1)},
+		ports:   &ports,
+		ttl:     2,
+		attempt: 1,
+	}
+
+	quoted := func(port int) *network.ProbeKey {
+		return &network.ProbeKey{Protocol: protocolUDP, SrcPort: 50000, DstPort: port}
+	}
+	assert.True(t, probe.matches(dst, quoted(33438)))
+	assert.False(t, probe.matches(dst, quoted(33437)), "the first probe for TTL 2")
+	assert.False(t, probe.matches(dst, quoted(33433)), "not a port of the sequence")
+}
+
+func TestTracerRunPortsOutOfRange(t *testing.T) {
+	tr := New(WithOptions(Options{Port: 65500}))
+	hops, err := tr.Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+	assert.Error(t, err)
+	assert.Nil(t, hops)
+}
+
+func TestTracerRunVarySrcPort(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	// Advancing the destination port from 65535 would run out of ports.
+	hops, err := New(WithOptions(Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+		Port:    65535,
+		Vary:    VarySrcPort,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+	assert.Equal(t, 0.0, hops[0].Loss)
+}
+
+func TestTracerRunVarySrcPortParis(t *testing.T) {
+	_, err := New(WithOptions(Options{
+		Vary:  VarySrcPort,
+		Paris: true,
+	})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+	assert.ErrorContains(t, err, "not supported with Paris probes")
+}
+
+func TestTracerRunSrcPort(t *testing.T) {
+	taken, err := network.NewUDPConnFrom(network.IPv4, nil, 0)
+	require.NoError(t, err)
+	defer taken.Close()
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+
+	_, err = New(WithOptions(Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+		SrcPort: port,
+	})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	var inUse *network.PortInUseError
+	require.ErrorAs(t, err, &inUse)
+	assert.Equal(t, port, inUse.Port)
+
+	// The port is free again once released.
+	require.NoError(t, taken.Close())
+	hops, err := New(WithOptions(Options{
+		MaxHops: 3,
+		Timeout: time.Second,
+		SrcPort: port,
+	})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.Equal(t, 0.0, hops[0].Loss)
+}
+
+func TestReplyNATDetected(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	ports := portSequence{base: DefaultPort, probesPerHop: 1}
+	sent := sentProbe{
+		dst:     dst,
+		key:     network.ProbeKey{Protocol: protocolUDP, SrcPort: 50000, DstPort: DefaultPort},
+		sentAt:  time.Now(),
+		ports:   &ports,
+		ttl:     1,
+		attempt: 0,
+		ipID:    1,
+	}
+
+	tests := []struct {
+		name     string
+		quotedID uint16
+		want     bool
+	}{
+		{"ID preserved", 1, false},
+		{"ID rewritten", 0x9b3e, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _ := timeExceeded(t, dst, DefaultPort)
+			// The quoted IPv4 header follows the 8-byte ICMP header; ID is its third word.
+			binary.BigEndian.PutUint16(msg.Data[12:14], tt.quotedID)
+			parsed, err := network.ParseICMP(network.IPv4, msg.Data)
+			require.NoError(t, err)
+
+			r := sent.replyFrom(msg, parsed)
+			require.NotNil(t, r)
+			probe, _ := r.probe(sent)
+
+			assert.Equal(t, tt.want, probe.NATDetected)
+		})
+	}
+
+	// Without a chosen ID there is nothing to compare the quoted one with.
+	sent.ipID = 0
+	msg, parsed := timeExceeded(t, dst, DefaultPort)
+	probe, _ := sent.replyFrom(msg, parsed).probe(sent)
+	assert.False(t, probe.NATDetected)
+}
+
+func TestReplyMatchesIPID(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	ports := portSequence{base: DefaultPort, probesPerHop: 1}
+	sent := sentProbe{
+		dst:     dst,
+		key:     network.ProbeKey{Protocol: protocolUDP, SrcPort: 40000, DstPort: DefaultPort},
+		sentAt:  time.Now(),
+		ports:   &ports,
+		ttl:     1,
+		attempt: 0,
+		ipID:    0x1234,
+	}
+
+	// A NAT rewrote the source port of the probe, 50000 in the quote, and kept its ID.
+	quote := func(id uint16) (*network.Message, *network.ParsedICMP) {
+		msg, _ := timeExceeded(t, dst, DefaultPort)
+		binary.BigEndian.PutUint16(msg.Data[12:14], id)
+		parsed, err := network.ParseICMP(network.IPv4, msg.Data)
+		require.NoError(t, err)
+		return msg, parsed
+	}
+
+	msg, parsed := quote(0x1234)
+	r := sent.replyFrom(msg, parsed)
+	require.NotNil(t, r, "the ID identifies the probe")
+	probe, _ := r.probe(sent)
+	assert.True(t, probe.NATDetected, "the ports were rewritten")
+
+	msg, parsed = quote(0x1235)
+	assert.Nil(t, sent.replyFrom(msg, parsed), "neither the ID nor the ports match")
+
+	sent.ipID = 0
+	msg, parsed = quote(0)
+	assert.Nil(t, sent.replyFrom(msg, parsed), "probes without an ID are matched on ports")
+}
+
+func TestTracerRunDetectNAT(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	hops, err := New(WithOptions(Options{
+		MaxHops:   3,
+		Timeout:   time.Second,
+		DetectNAT: true,
+	})).Run(context.Background(), dest)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw sockets require elevated privileges")
+	}
+
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.True(t, hops[0].IP.Equal(dest))
+	assert.Equal(t, 0.0, hops[0].Loss)
+	assert.False(t, hops[0].NATDetected)
+}
+
+func TestTracerRunDetectNATUnsupported(t *testing.T) {
+	for _, tt := range []struct {
+		dest net.IP
+		opts Options
+	}{
+		{net.IPv6loopback, Options{}},
+		{net.IPv4(127, 0, 0, 1), Options{Method: ICMP}},
+		{net.IPv4(127, 0, 0, 1), Options{Paris: true}},
+		{net.IPv4(127, 0, 0, 1), Options{PacketSize: 100}},
+	} {
+		tt.opts.DetectNAT = true
+		_, err := New(WithOptions(tt.opts)).Run(context.Background(), tt.dest)
+
+		assert.ErrorContains(t, err, "NAT detection requires", tt.opts)
+	}
+}
+
+func TestTracerRunSourceIP(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	for _, method := range []ProbeMethod{UDP, ICMP, TCP} {
+		t.Run(method.String(), func(t *testing.T) {
+			hops, err := New(WithOptions(Options{
+				MaxHops:  3,
+				Timeout:  time.Second,
+				Method:   method,
+				SourceIP: net.IPv4(127, 0, 0, 1),
+			})).Run(context.Background(), dest)
+			if err != nil && errors.Is(err, os.ErrPermission) {
+				t.Skip("raw sockets require elevated privileges")
+			}
+
+			require.NoError(t, err)
+			require.Len(t, hops, 1)
+			assert.True(t, hops[0].IP.Equal(dest))
+		})
+	}
+}
+
+func TestTracerRunSourceIPNotLocal(t *testing.T) {
+	_, err := New(WithOptions(Options{
+		SourceIP: net.IPv4(192, 0, 2, 254),
+	})).Run(context.Background(), net.IPv4(127, 0, 0, 1))
+
+	var sourceErr *network.SourceAddrError
+	require.ErrorAs(t, err, &sourceErr)
+	assert.Contains(t, sourceErr.Valid, net.IPv4(127, 0, 0, 1))
+}
+
+func TestSentProbeMatchesParis(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	key := network.ProbeKey{Protocol: protocolUDP, SrcPort: 50000, DstPort: 33434, Checksum: 2}
+	probe := sentProbe{dst: dst, key: key, offloadedChecksum: 0xfe1d}
+
+	quoted := func(checksum int) *network.ProbeKey {
+		return &network.ProbeKey{
+			Protocol: protocolUDP,
+			SrcPort:  50000,
+			DstPort:  33434,
+			Checksum: checksum,
+		}
+	}
+
+	assert.True(t, probe.matches(dst, quoted(2)))
+	assert.True(t, probe.matches(dst, quoted(0xfe1d)))
+	assert.False(t, probe.matches(dst, quoted(3)), "another probe of the same flow")
+}
+
+func TestSentProbeMatchesEcho(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	key := network.ProbeKey{Protocol: protocolICMP, EchoID: 42, EchoSeq: 7}
+	probe := sentProbe{dst: dst, key: key}
+
+	assert.True(t, probe.matches(dst, &key))
+	assert.False(t, probe.matches(dst,
+		&network.ProbeKey{Protocol: protocolICMP, EchoID: 42, EchoSeq: 8}))
+	assert.False(t, probe.matches(dst,
+		&network.ProbeKey{Protocol: protocolICMP, EchoID: 43, EchoSeq: 7}))
+}
+
+func TestSentProbeMatchesEchoReply(t *testing.T) {
+	dst := net.IPv4(198, 51, 100, 7)
+	probe := sentProbe{
+		dst: dst,
+		key: network.ProbeKey{Protocol: protocolICMP, EchoID: 42, EchoSeq: 7},
+	}
+
+	echoReply := func(id, seq int) *network.ParsedICMP {
+		return &network.ParsedICMP{
+			Type: ipv4.ICMPTypeEchoReply,
+			Echo: &icmp.Echo{ID: id, Seq: seq},
+		}
+	}
+
+	assert.True(t, probe.matchesEcho(dst, echoReply(42, 7)))
+	assert.False(t, probe.matchesEcho(dst, echoReply(42, 8)))
+	assert.False(t, probe.matchesEcho(dst, echoReply(1, 7)))
+	assert.False(t, probe.matchesEcho(net.IPv4(198, 51, 100, 8), echoReply(42, 7)))
+	assert.False(t, probe.matchesEcho(dst, &network.ParsedICMP{Type: ipv4.ICMPTypeEchoReply}))
+}
+
+func TestReadReplyIgnoresForeignProbe(t *testing.T) {
+	dest := net.IPv4(127, 0, 0, 1)
+
+	icmpConn, err := network.NewICMPConn(network.IPv4)
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+	require.NoError(t, err)
+	defer icmpConn.Close()
+
+	udpConn, err := network.NewUDPConn(network.IPv4, ":0")
+	require.NoError(t, err)
+	defer udpConn.Close()
+
+	// The Port Unreachable elicited by this datagram quotes a source port the probe below
+	// was not sent from, as if another process were tracing the same destination.
+	require.NoError(t, udpConn.SendEmptyPacket(&net.UDPAddr{IP: dest, Port: DefaultPort}))
+
+	probe := sentProbe{
+		dst: dest,
+		key: network.ProbeKey{
+			Protocol: protocolUDP,
+			SrcPort:  udpConn.LocalAddr().(*net.UDPAddr).Port + 1,
+			DstPort:  DefaultPort,
+		},
+		sentAt: time.Now(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	reply, err := readReply(ctx, icmpConn, probe, nil)
+
+	require.NoError(t, err)
+	assert.Nil(t, reply)
+}
+
+func TestReadReplySkipsUnexpectedTypes(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	router := net.IPv4(192, 0, 2, 1)
+
+	redirect, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeRedirect,
+		Body: &icmp.RawBody{Data: make([]byte, 4)},
+	}).Marshal(nil)
+	require.NoError(t, err)
+
+	receiver := new(MockReader)
+	receiver.On("ReadMessage", mock.Anything).
+		Return(&network.Message{Peer: router, Data: redirect, TTL: -1}, nil).Once()
+	receiver.On("ReadMessage", mock.Anything).
+		Return(&network.Message{Peer: router, Data: []byte{11, 0}, TTL: -1}, nil).Once()
+	receiver.On("ReadMessage", mock.Anything).Return(&network.Message{
+		Peer: router,
+		Data: quotingMessage(t, dest, ipv4.ICMPTypeTimeExceeded, 0, 1),
+		TTL:  -1,
+	}, nil).Once()
+
+	probe := sentProbe{
+		dst:    dest,
+		key:    network.ProbeKey{Protocol: protocolUDP, SrcPort: 50000, DstPort: DefaultPort},
+		sentAt: time.Now(),
+	}
+
+	reply, err := readReply(context.Background(), receiver, probe, nil)
+
+	require.NoError(t, err)
+	require.NotNil(t, reply)
+	assert.True(t, reply.from.Equal(router))
+	receiver.AssertExpectations(t)
+}
+
+func TestProbeMethodString(t *testing.T) {
+	assert.Equal(t, "UDP", UDP.String())
+	assert.Equal(t, "ICMP", ICMP.String())
+	assert.Equal(t, "TCP", TCP.String())
+	assert.Equal(t, "ProbeMethod(9)", ProbeMethod(9).String())
+}
+
+func TestTracerRunCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	hops, err := New(WithOptions(Options{Timeout: time.Second})).Run(ctx, net.IPv4(192, 0, 2, 254))
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	// Only the interrupted first hop may be returned, if one of its probes was answered.
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.LessOrEqual(t, len(hops), 1)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestTracerRunMinProbeIntervalCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	hops, err := New(WithOptions(Options{
+		Timeout:          time.Second,
+		MinProbeInterval: time.Hour,
+	})).Run(ctx, net.IPv4(127, 0, 0, 1))
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ICMP sockets require elevated privileges")
+	}
+
+	// The first probe goes out immediately; the second waits for the limiter until the
+	// trace is aborted, and the hop is returned with the first probe only.
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, hops, 1)
+	assert.Len(t, hops[0].RTTs, 1)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestTraceRunMaxUnresponsiveHops(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		name := "sequential"
+		if parallel {
+			name = "parallel"
+		}
+		t.Run(name, func(t *testing.T) {
+			dest := net.IPv4(198, 51, 100, 7)
+			p := &fakeProber{dest: dest, sent: make(chan int, 90)}
+			// TTLs 3 and 4 do not answer, TTL 5 answers its first probe only, and nothing
+			// answers beyond it.
+			answered := map[int]int{}
+			receiver := pathReceiver(t, p, 31, func(ttl int) bool {
+				answered[ttl]++
+				return ttl == 3 || ttl == 4 || ttl == 5 && answered[ttl] > 1 || ttl > 5
+			})
+
+			opts := Options{
+				Timeout:             20 * time.Millisecond,
+				Parallel:            parallel,
+				MaxUnresponsiveHops: 3,
+			}.withDefaults()
+			tr := &trace{opts: opts, receiver: receiver, prober: p}
+			defer tr.close()
+
+			var hops []Hop
+			require.NoError(t, tr.run(context.Background(),
+				func(hop Hop) { hops = append(hops, hop) }))
+
+			assert.True(t, tr.unresponsive)
+			require.Len(t, hops, 8, "the reply at TTL 5 starts the count over")
+			assert.True(t, hops[4].Responded())
+			assert.Equal(t, 8, hops[7].TTL)
+		})
+	}
+}
+
+func TestTraceRunMaxUnresponsiveHopsDisabled(t *testing.T) {
+	dest := net.IPv4(198, 51, 100, 7)
+	p := &fakeProber{dest: dest, sent: make(chan int, 30)}
+	receiver := pathReceiver(t, p, 31, func(ttl int) bool { return ttl > 1 })
+
+	opts := Options{
+		MaxHops:             12,
+		Timeout:             10 * time.Millisecond,
+		ProbesPerHop:        1,
+		MaxUnresponsiveHops: -1,
+	}.withDefaults()
+	tr := &trace{opts: opts, receiver: receiver, prober: p}
+	defer tr.close()
+
+	var hops []Hop
+	require.NoError(t, tr.run(context.Background(), func(hop Hop) { hops = append(hops, hop) }))
+
+	assert.False(t, tr.unresponsive)
+	assert.Len(t, hops, 12)
+}
+
+func TestContextErrPastDeadline(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Hour))
+	defer cancel()
+	assert.NoError(t, contextErr(ctx))
+
+	assert.ErrorIs(t, contextErr(pastDeadline{ctx}), context.DeadlineExceeded)
+}
+
+// pastDeadline is a context whose deadline has passed before its timer fired.
+type pastDeadline struct {
+	context.Context
+}
+
+func (pastDeadline) Deadline() (time.Time, bool) {
+	return time.Now().Add(-time.Millisecond), true
+}